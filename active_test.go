@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// link forwards the connections it accepts to a process, until cut.
+type link struct {
+	l      net.Listener
+	target string
+
+	mu    sync.Mutex
+	cut   bool
+	conns []net.Conn
+}
+
+// newLink returns a link to target, closed when the test ends.
+func newLink(t *testing.T, target string) *link {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &link{l: l, target: target}
+	t.Cleanup(func() {
+		l.Close()
+		k.setCut(true)
+	})
+	go k.serve()
+	return k
+}
+
+func (k *link) addr() string {
+	return k.l.Addr().String()
+}
+
+func (k *link) serve() {
+	for {
+		conn, err := k.l.Accept()
+		if err != nil {
+			return
+		}
+		k.mu.Lock()
+		if k.cut {
+			k.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		target, err := net.Dial("tcp", k.target)
+		if err != nil {
+			k.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		k.conns = append(k.conns, conn, target)
+		k.mu.Unlock()
+		go func() {
+			io.Copy(target, conn)
+			target.Close()
+		}()
+		go func() {
+			io.Copy(conn, target)
+			conn.Close()
+		}()
+	}
+}
+
+// setCut cuts the link, closing the connections going through it and
+// refusing new ones, or restores it.
+func (k *link) setCut(cut bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.cut = cut
+	if cut {
+		for _, conn := range k.conns {
+			conn.Close()
+		}
+		k.conns = nil
+	}
+}
+
+// activeValues returns what the keys of TestActivePartition hold on p.
+func activeValues(p *process) (map[string]any, error) {
+	values := make(map[string]any)
+	for _, key := range []string{"conflict", "counter", "a-only", "b-only", "deleted"} {
+		reply, err := call(p.addr(), "GET", key)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = reply.Bulk
+	}
+	reply, err := call(p.addr(), "LRANGE", "list", "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, v := range reply.Array {
+		list = append(list, v.Bulk)
+	}
+	slices.Sort(list)
+	values["list"] = list
+	return values, nil
+}
+
+func TestActivePartition(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs several processes for a while")
+	}
+	// Each master reaches the other through a link the test can cut.
+	portA, portB := freePort(t), freePort(t)
+	toA := newLink(t, net.JoinHostPort("127.0.0.1", portA))
+	toB := newLink(t, net.JoinHostPort("127.0.0.1", portB))
+	a := startProcess(t, portA, "-save", "", "-active-active", "yes", "-active-peer", toB.addr())
+	b := startProcess(t, portB, "-save", "", "-active-active", "yes", "-active-peer", toA.addr())
+
+	do := func(p *process, args ...string) {
+		t.Helper()
+		if reply := mustCall(t, p.addr(), args...); reply.Type == "error" {
+			t.Fatalf("%v on %s: %s", args, p.port, reply.Str)
+		}
+	}
+	do(a, "SET", "conflict", "before")
+	do(a, "INCR", "counter")
+	do(a, "LPUSH", "list", "before")
+	do(a, "SET", "deleted", "before")
+	waitFor(t, 10*time.Second, "the writes to reach the other master", func() bool {
+		reply, err := call(b.addr(), "GET", "deleted")
+		return err == nil && reply.Bulk == "before"
+	})
+
+	toA.setCut(true)
+	toB.setCut(true)
+	// Both sides keep taking writes, some of them conflicting.
+	do(a, "SET", "conflict", "a")
+	do(b, "SET", "conflict", "b")
+	do(a, "INCR", "counter")
+	do(b, "INCR", "counter")
+	do(b, "INCR", "counter")
+	do(a, "LPUSH", "list", "a")
+	do(b, "LPUSH", "list", "b")
+	do(a, "SET", "a-only", "a")
+	do(b, "SET", "b-only", "b")
+	do(b, "DEL", "deleted")
+	if reply := mustCall(t, a.addr(), "GET", "b-only"); reply.Type != "nil" {
+		t.Fatalf("a write crossed the partition: %+v", reply)
+	}
+
+	toA.setCut(false)
+	toB.setCut(false)
+	var values map[string]any
+	waitFor(t, 30*time.Second, "the masters to converge", func() bool {
+		va, err := activeValues(a)
+		if err != nil {
+			return false
+		}
+		vb, err := activeValues(b)
+		if err != nil || !reflect.DeepEqual(va, vb) {
+			return false
+		}
+		values = va
+		return va["b-only"] == "b" && va["a-only"] == "a"
+	})
+	want := map[string]any{
+		"counter": "4",
+		"a-only":  "a",
+		"b-only":  "b",
+		"deleted": "",
+		"list":    []string{"a", "b", "before"},
+	}
+	for key, value := range want {
+		if !reflect.DeepEqual(values[key], value) {
+			t.Errorf("%s is %v after the partition healed, want %v", key, values[key], value)
+		}
+	}
+	if c := values["conflict"]; c != "a" && c != "b" {
+		t.Errorf("conflict is %v, want one of the concurrent writes", c)
+	}
+}
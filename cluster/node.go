@@ -0,0 +1,199 @@
+package cluster
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Node describes a cluster node as a line of nodes.conf or CLUSTER NODES:
+//
+//	<id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> <slot-range> ...
+//
+// A node describing itself also lists the slots it is moving, as
+// [slot->-target] when migrating and [slot-<-source] when importing.
+type Node struct {
+	ID      string
+	IP      string
+	Port    int
+	BusPort int
+	// Flags such as "myself", "master", "slave", "pfail" and "fail".
+	Flags []string
+	// MasterID is the master of a replica, "" for masters.
+	MasterID string
+	// PingSent and PongRecv are unix times in milliseconds; PingSent is 0
+	// when no ping is pending.
+	PingSent    int64
+	PongRecv    int64
+	ConfigEpoch uint64
+	Connected   bool
+	Slots       []SlotRange
+	Migrations  []Migration
+}
+
+// Migration is a slot being moved from or to the node.
+type Migration struct {
+	Slot int
+	// NodeID is the target of a migrating slot, or the source of an
+	// importing one.
+	NodeID    string
+	Importing bool
+}
+
+func (m Migration) String() string {
+	if m.Importing {
+		return fmt.Sprintf("[%d-<-%s]", m.Slot, m.NodeID)
+	}
+	return fmt.Sprintf("[%d->-%s]", m.Slot, m.NodeID)
+}
+
+// SlotRange is a range of slots, both ends included.
+type SlotRange struct {
+	Start, End int
+}
+
+func (r SlotRange) String() string {
+	if r.Start == r.End {
+		return strconv.Itoa(r.Start)
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// Ranges returns the slots for which owned is true as ranges, in order.
+func Ranges(owned func(slot int) bool) []SlotRange {
+	var ranges []SlotRange
+	for slot := 0; slot < Slots; slot++ {
+		if !owned(slot) {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].End == slot-1 {
+			ranges[n-1].End = slot
+		} else {
+			ranges = append(ranges, SlotRange{slot, slot})
+		}
+	}
+	return ranges
+}
+
+// HasFlag reports whether n has flag.
+func (n *Node) HasFlag(flag string) bool {
+	return slices.Contains(n.Flags, flag)
+}
+
+// SetFlag adds or removes flag.
+func (n *Node) SetFlag(flag string, on bool) {
+	i := slices.Index(n.Flags, flag)
+	switch {
+	case on && i < 0:
+		n.Flags = append(n.Flags, flag)
+	case !on && i >= 0:
+		n.Flags = slices.Delete(n.Flags, i, i+1)
+	}
+}
+
+// String returns the description of n, without a line terminator.
+func (n *Node) String() string {
+	flags := strings.Join(n.Flags, ",")
+	if flags == "" {
+		flags = "noflags"
+	}
+	master := n.MasterID
+	if master == "" {
+		master = "-"
+	}
+	link := "disconnected"
+	if n.Connected {
+		link = "connected"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s:%d@%d %s %s %d %d %d %s",
+		n.ID, n.IP, n.Port, n.BusPort, flags, master, n.PingSent, n.PongRecv, n.ConfigEpoch, link)
+	for _, r := range n.Slots {
+		b.WriteString(" ")
+		b.WriteString(r.String())
+	}
+	for _, m := range n.Migrations {
+		b.WriteString(" ")
+		b.WriteString(m.String())
+	}
+	return b.String()
+}
+
+// ParseNode parses a node description.
+func ParseNode(line string) (*Node, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 8 {
+		return nil, fmt.Errorf("invalid node description %q", line)
+	}
+	n := &Node{ID: fields[0]}
+
+	addr, bus, ok := strings.Cut(fields[1], "@")
+	bus, _, _ = strings.Cut(bus, ",") // an optional hostname follows
+	colon := strings.LastIndexByte(addr, ':')
+	if !ok || colon < 0 {
+		return nil, fmt.Errorf("invalid node address %q", fields[1])
+	}
+	var err1, err2 error
+	n.IP = addr[:colon]
+	n.Port, err1 = strconv.Atoi(addr[colon+1:])
+	n.BusPort, err2 = strconv.Atoi(bus)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("invalid node address %q", fields[1])
+	}
+
+	if fields[2] != "noflags" {
+		n.Flags = strings.Split(fields[2], ",")
+	}
+	if fields[3] != "-" {
+		n.MasterID = fields[3]
+	}
+	var err3 error
+	n.PingSent, err1 = strconv.ParseInt(fields[4], 10, 64)
+	n.PongRecv, err2 = strconv.ParseInt(fields[5], 10, 64)
+	n.ConfigEpoch, err3 = strconv.ParseUint(fields[6], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, fmt.Errorf("invalid node description %q", line)
+	}
+	n.Connected = fields[7] == "connected"
+
+	for _, field := range fields[8:] {
+		if strings.HasPrefix(field, "[") {
+			m, err := parseMigration(field)
+			if err != nil {
+				return nil, err
+			}
+			n.Migrations = append(n.Migrations, m)
+			continue
+		}
+		start, end, isRange := strings.Cut(field, "-")
+		if !isRange {
+			end = start
+		}
+		r := SlotRange{}
+		r.Start, err1 = strconv.Atoi(start)
+		r.End, err2 = strconv.Atoi(end)
+		if err1 != nil || err2 != nil || r.Start < 0 || r.End >= Slots || r.Start > r.End {
+			return nil, fmt.Errorf("invalid slot range %q", field)
+		}
+		n.Slots = append(n.Slots, r)
+	}
+	return n, nil
+}
+
+func parseMigration(field string) (Migration, error) {
+	inner, closed := strings.CutSuffix(field[1:], "]")
+	slot, id, ok := strings.Cut(inner, "->-")
+	m := Migration{}
+	if !ok {
+		slot, id, ok = strings.Cut(inner, "-<-")
+		m.Importing = true
+	}
+	m.NodeID = id
+	var err error
+	m.Slot, err = strconv.Atoi(slot)
+	if !closed || !ok || err != nil || m.Slot < 0 || m.Slot >= Slots || id == "" {
+		return Migration{}, fmt.Errorf("invalid slot migration %q", field)
+	}
+	return m, nil
+}
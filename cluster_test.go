@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freeClusterPort returns a port that is free along with its cluster bus
+// port.
+func freeClusterPort(t *testing.T) string {
+	t.Helper()
+	for {
+		port := freePort(t)
+		n, _ := strconv.Atoi(port)
+		if n+10000 > 65535 {
+			continue
+		}
+		l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(n+10000)))
+		if err != nil {
+			continue
+		}
+		l.Close()
+		return port
+	}
+}
+
+// clusterInfo returns the fields of CLUSTER INFO of p, nil if it can't be
+// reached.
+func clusterInfo(p *process) map[string]string {
+	reply, err := call(p.addr(), "CLUSTER", "INFO")
+	if err != nil || reply.Type != "bulk" {
+		return nil
+	}
+	status := make(map[string]string)
+	for _, line := range strings.Split(reply.Bulk, "\r\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			status[key] = value
+		}
+	}
+	return status
+}
+
+// addSlots assigns slots start to end to p.
+func addSlots(t *testing.T, p *process, start, end int) {
+	t.Helper()
+	args := []string{"CLUSTER", "ADDSLOTS"}
+	for slot := start; slot <= end; slot++ {
+		args = append(args, strconv.Itoa(slot))
+	}
+	if reply := mustCall(t, p.addr(), args...); reply.Str != "OK" {
+		t.Fatalf("CLUSTER ADDSLOTS on %s: %+v", p.port, reply)
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs several processes for a while")
+	}
+	var nodes []*process
+	for range 4 {
+		nodes = append(nodes, startProcess(t, freeClusterPort(t), "-save", "",
+			"-cluster-enabled", "yes", "-cluster-node-timeout", "1000"))
+	}
+	masters, replica := nodes[:3], nodes[3]
+	for _, p := range nodes[1:] {
+		if reply := mustCall(t, nodes[0].addr(), "CLUSTER", "MEET", "127.0.0.1", p.port); reply.Str != "OK" {
+			t.Fatalf("CLUSTER MEET %s: %+v", p.port, reply)
+		}
+	}
+	addSlots(t, masters[0], 0, 5460)
+	addSlots(t, masters[1], 5461, 10922)
+	addSlots(t, masters[2], 10923, 16383)
+	waitFor(t, 30*time.Second, "every node to know the others and the cluster to be ok", func() bool {
+		for _, p := range nodes {
+			if info := clusterInfo(p); info["cluster_known_nodes"] != "4" || info["cluster_state"] != "ok" {
+				return false
+			}
+		}
+		return true
+	})
+
+	id := mustCall(t, masters[0].addr(), "CLUSTER", "MYID").Bulk
+	if reply := mustCall(t, replica.addr(), "CLUSTER", "REPLICATE", id); reply.Str != "OK" {
+		t.Fatalf("CLUSTER REPLICATE: %+v", reply)
+	}
+	waitFor(t, 30*time.Second, "the replica to sync with its master", func() bool {
+		reply, err := call(replica.addr(), "ROLE")
+		return err == nil && len(reply.Array) == 5 && reply.Array[0].Bulk == "slave" && reply.Array[3].Bulk == "connected"
+	})
+
+	// "bar" hashes to slot 5061, served by the first master.
+	if reply := mustCall(t, masters[0].addr(), "SET", "bar", "before"); reply.Str != "OK" {
+		t.Fatalf("SET on the master: %+v", reply)
+	}
+	if reply := mustCall(t, masters[1].addr(), "GET", "bar"); reply.Str != "MOVED 5061 "+masters[0].addr() {
+		t.Fatalf("GET on another master before the failover: %+v", reply)
+	}
+	waitFor(t, 10*time.Second, "the write to reach the replica", func() bool {
+		reply, err := call(masters[0].addr(), "WAIT", "1", "100")
+		return err == nil && reply.Num == 1
+	})
+	epoch, _ := strconv.Atoi(clusterInfo(masters[0])["cluster_my_epoch"])
+
+	masters[0].kill()
+	waitFor(t, 30*time.Second, "the replica to take over the slots of its master", func() bool {
+		reply, err := call(masters[1].addr(), "GET", "bar")
+		return err == nil && reply.Str == "MOVED 5061 "+replica.addr()
+	})
+	if reply := mustCall(t, replica.addr(), "ROLE"); len(reply.Array) == 0 || reply.Array[0].Bulk != "master" {
+		t.Fatalf("ROLE of the promoted replica: %+v", reply)
+	}
+	if got, _ := strconv.Atoi(clusterInfo(replica)["cluster_my_epoch"]); got <= epoch {
+		t.Fatalf("the promoted replica has configEpoch %d, not above the %d of its master", got, epoch)
+	}
+	if reply := mustCall(t, replica.addr(), "GET", "bar"); reply.Bulk != "before" {
+		t.Fatalf("GET on the promoted replica: %+v", reply)
+	}
+	for _, p := range masters[1:] {
+		waitFor(t, 10*time.Second, "master "+p.port+" to see the cluster ok again", func() bool {
+			return clusterInfo(p)["cluster_state"] == "ok"
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// Command go-redis-check-aof lists the timestamp annotations of a multi-part
+// AOF and rolls it back to a point in time, for recovering from operator
+// mistakes without an external backup.
+//
+//	go-redis-check-aof appendonlydir/appendonly.aof.manifest
+//	go-redis-check-aof --truncate-to-timestamp 2026-10-18T09:30:00Z appendonlydir/appendonly.aof.manifest
+//	go-redis-check-aof --truncate-to-offset 1048576 appendonlydir/appendonly.aof.manifest
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/server"
+)
+
+func main() {
+	toTimestamp := flag.String("truncate-to-timestamp", "", "Roll back to this time (unix seconds or RFC 3339)")
+	toOffset := flag.Int64("truncate-to-offset", -1, "Roll back to this many bytes of incremental AOF")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <manifest>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	manifest := flag.Arg(0)
+
+	switch {
+	case *toTimestamp != "":
+		until, err := parseTime(*toTimestamp)
+		if err != nil {
+			fmt.Println("Invalid timestamp:", err)
+			os.Exit(2)
+		}
+		if err := server.TruncateAOFToTimestamp(manifest, until); err != nil {
+			fmt.Println("Failed to truncate the AOF:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Successfully truncated the AOF to timestamp", until.Unix())
+	case *toOffset >= 0:
+		if err := server.TruncateAOFToOffset(manifest, *toOffset); err != nil {
+			fmt.Println("Failed to truncate the AOF:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Successfully truncated the AOF to offset", *toOffset)
+	default:
+		stamps, err := server.AOFTimestamps(manifest)
+		if err != nil {
+			fmt.Println("Failed to read the AOF:", err)
+			os.Exit(1)
+		}
+		if len(stamps) == 0 {
+			fmt.Println("No timestamp annotations found (is aof-timestamp-enabled on?)")
+		}
+		for _, ts := range stamps {
+			fmt.Printf("%s offset=%d unix=%d %s\n", ts.File, ts.Offset, ts.Time.Unix(), ts.Time.UTC().Format(time.RFC3339))
+		}
+	}
+}
+
+func parseTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
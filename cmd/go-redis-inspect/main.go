@@ -0,0 +1,224 @@
+// Command go-redis-inspect reads RDB and AOF files without starting a server,
+// for incident forensics and capacity planning.
+//
+//	go-redis-inspect dump dump.rdb
+//	go-redis-inspect memory --separator : --top 20 appendonlydir/appendonly.aof.manifest
+//	go-redis-inspect diff before.rdb after.rdb
+//	go-redis-inspect rdb-to-aof dump.rdb > appendonly.aof
+//
+// A file is read as an RDB when it starts with the "REDIS" signature, as a
+// multi-part AOF when its name ends in ".manifest" and as a single AOF file
+// otherwise.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/saurabhdhingra/go-redis/rdb"
+	"github.com/saurabhdhingra/go-redis/server"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+const usageText = `Usage: %s <command> [options] <file>...
+
+Commands:
+  dump <file>              print every key as a JSON line
+  memory <file>            estimated memory use per type and prefix, and the largest keys
+  diff <old> <new>         print the keys added, removed or changed as JSON lines
+  rdb-to-aof <file>        print the AOF commands that recreate the dataset
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, usageText, os.Args[0])
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, usageText, os.Args[0])
+		fs.PrintDefaults()
+	}
+	separator := fs.String("separator", ":", "Separator ending the key prefix (memory)")
+	top := fs.Int("top", 10, "Number of prefixes and keys to list (memory)")
+	fs.Parse(os.Args[2:])
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	var err error
+	switch os.Args[1] {
+	case "dump":
+		err = dump(out, fs.Args())
+	case "memory":
+		err = memory(out, fs.Args(), *separator, *top)
+	case "diff":
+		err = diff(out, fs.Args())
+	case "rdb-to-aof":
+		err = rdbToAOF(out, fs.Args())
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		out.Flush()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// load reads the dataset held by an RDB file, an AOF manifest or an AOF file.
+func load(path string) (map[string]store.Data, error) {
+	if strings.HasSuffix(path, ".manifest") {
+		return server.ReadAOF(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if magic, _ := br.Peek(5); string(magic) != "REDIS" {
+		return server.ReadAOF(path)
+	}
+	data := make(map[string]store.Data)
+	err = rdb.Parse(br, func(key string, d store.Data) error {
+		data[key] = d
+		return nil
+	})
+	return data, err
+}
+
+func loadOne(args []string) (map[string]store.Data, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected one file, got %d", len(args))
+	}
+	return load(args[0])
+}
+
+// record is the JSON form of a key.
+type record struct {
+	Op        string `json:"op,omitempty"`
+	Key       string `json:"key"`
+	Type      string `json:"type"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // unix milliseconds
+	Value     any    `json:"value"`
+}
+
+type streamEntry struct {
+	ID     string            `json:"id"`
+	Fields map[string]string `json:"fields"`
+}
+
+func newRecord(key string, d store.Data) record {
+	r := record{Key: key, Type: typeName(d)}
+	if !d.Expiration.IsZero() {
+		r.ExpiresAt = d.Expiration.UnixMilli()
+	}
+	switch r.Type {
+	case "list":
+		r.Value = d.List
+	case "stream":
+		entries := make([]streamEntry, len(d.Stream))
+		for i, e := range d.Stream {
+			entries[i] = streamEntry{ID: e.ID, Fields: e.Fields}
+		}
+		r.Value = entries
+	default:
+		r.Value = d.Value
+	}
+	return r
+}
+
+func typeName(d store.Data) string {
+	if d.Type == "" {
+		return "string"
+	}
+	return d.Type
+}
+
+func dump(out *bufio.Writer, args []string) error {
+	data, err := loadOne(args)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	for _, key := range slices.Sorted(maps.Keys(data)) {
+		if err := enc.Encode(newRecord(key, data[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func diff(out *bufio.Writer, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected two files, got %d", len(args))
+	}
+	before, err := load(args[0])
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+	after, err := load(args[1])
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[1], err)
+	}
+
+	keys := slices.Sorted(maps.Keys(before))
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	enc := json.NewEncoder(out)
+	for _, key := range keys {
+		old, inOld := before[key]
+		cur, inNew := after[key]
+		var r record
+		switch {
+		case !inNew:
+			r = newRecord(key, old)
+			r.Op = "removed"
+		case !inOld:
+			r = newRecord(key, cur)
+			r.Op = "added"
+		case !equal(old, cur):
+			r = newRecord(key, cur)
+			r.Op = "changed"
+		default:
+			continue
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func equal(a, b store.Data) bool {
+	if typeName(a) != typeName(b) || !a.Expiration.Equal(b.Expiration) || a.Value != b.Value {
+		return false
+	}
+	if !slices.Equal(a.List, b.List) {
+		return false
+	}
+	return slices.EqualFunc(a.Stream, b.Stream, func(x, y store.StreamEntry) bool {
+		return x.ID == y.ID && maps.Equal(x.Fields, y.Fields)
+	})
+}
+
+func rdbToAOF(out *bufio.Writer, args []string) error {
+	data, err := loadOne(args)
+	if err != nil {
+		return err
+	}
+	return server.WriteAOF(out, data)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// Rough per-allocation overheads of a Redis keyspace, in bytes: the hash table
+// entry and key object, a list or stream element, and a stream field. They
+// make the estimates comparable with INFO memory rather than exact.
+const (
+	keyOverhead         = 56
+	listElementOverhead = 11
+	streamEntryOverhead = 32
+	streamFieldOverhead = 4
+	expireEntryOverhead = 32
+	noPrefix            = "(no prefix)"
+)
+
+// estimateSize approximates the memory used by key and its value.
+func estimateSize(key string, d store.Data) int {
+	size := keyOverhead + len(key)
+	if !d.Expiration.IsZero() {
+		size += expireEntryOverhead
+	}
+	switch typeName(d) {
+	case "list":
+		for _, item := range d.List {
+			size += listElementOverhead + len(item)
+		}
+	case "stream":
+		for _, e := range d.Stream {
+			size += streamEntryOverhead + len(e.ID)
+			for f, v := range e.Fields {
+				size += 2*streamFieldOverhead + len(f) + len(v)
+			}
+		}
+	default:
+		size += len(d.Value)
+	}
+	return size
+}
+
+// group accumulates the keys and estimated bytes of a type or a prefix.
+type group struct {
+	name  string
+	keys  int
+	bytes int
+}
+
+type keySize struct {
+	key, typ string
+	bytes    int
+}
+
+func memory(out *bufio.Writer, args []string, separator string, top int) error {
+	data, err := loadOne(args)
+	if err != nil {
+		return err
+	}
+
+	byType := map[string]*group{}
+	byPrefix := map[string]*group{}
+	sizes := make([]keySize, 0, len(data))
+	total := 0
+	add := func(groups map[string]*group, name string, bytes int) {
+		u, ok := groups[name]
+		if !ok {
+			u = &group{name: name}
+			groups[name] = u
+		}
+		u.keys++
+		u.bytes += bytes
+	}
+	for key, d := range data {
+		bytes := estimateSize(key, d)
+		total += bytes
+		add(byType, typeName(d), bytes)
+		prefix, _, found := strings.Cut(key, separator)
+		if !found || separator == "" {
+			prefix = noPrefix
+		} else {
+			prefix += separator
+		}
+		add(byPrefix, prefix, bytes)
+		sizes = append(sizes, keySize{key: key, typ: typeName(d), bytes: bytes})
+	}
+
+	fmt.Fprintf(out, "keys: %d\nestimated_bytes: %d\n", len(data), total)
+	fmt.Fprintln(out, "\n# By type")
+	printUsage(out, byType, len(byType))
+	fmt.Fprintln(out, "\n# By prefix")
+	printUsage(out, byPrefix, top)
+
+	fmt.Fprintln(out, "\n# Largest keys")
+	slices.SortFunc(sizes, func(a, b keySize) int {
+		return cmp.Or(cmp.Compare(b.bytes, a.bytes), strings.Compare(a.key, b.key))
+	})
+	for _, s := range sizes[:min(top, len(sizes))] {
+		fmt.Fprintf(out, "%12d  %-7s %q\n", s.bytes, s.typ, s.key)
+	}
+	return nil
+}
+
+// printUsage lists the n largest groups by estimated bytes.
+func printUsage(out *bufio.Writer, groups map[string]*group, n int) {
+	list := slices.Collect(maps.Values(groups))
+	slices.SortFunc(list, func(a, b *group) int {
+		return cmp.Or(cmp.Compare(b.bytes, a.bytes), strings.Compare(a.name, b.name))
+	})
+	for _, u := range list[:min(n, len(list))] {
+		fmt.Fprintf(out, "%12d  keys=%-8d %q\n", u.bytes, u.keys, u.name)
+	}
+}
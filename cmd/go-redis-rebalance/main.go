@@ -0,0 +1,302 @@
+// Command go-redis-rebalance moves hash slots between the masters of a
+// running cluster so that each serves the same number, without downtime:
+// every slot is moved with CLUSTER SETSLOT and MIGRATE while clients keep
+// being served, following ASK redirections for the keys already moved.
+//
+//	go-redis-rebalance 127.0.0.1:7000
+//	go-redis-rebalance --use-empty-masters --pipeline 100 127.0.0.1:7000
+//	go-redis-rebalance --simulate 127.0.0.1:7000
+//
+// Slots left open by an interrupted run, migrating on one master and
+// importing on another, are moved first.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/cluster"
+	"github.com/saurabhdhingra/go-redis/resp"
+)
+
+const usageText = `Usage: %s [options] <host:port>
+
+Moves slots between the masters of the cluster that host:port belongs to,
+until each master serves the same number of slots.
+
+Options:
+`
+
+func main() {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, usageText, os.Args[0])
+		fs.PrintDefaults()
+	}
+	pipeline := fs.Int("pipeline", 10, "Number of keys moved by each MIGRATE")
+	timeout := fs.Int("timeout", 60000, "MIGRATE timeout in milliseconds")
+	threshold := fs.Float64("threshold", 2, "Don't rebalance when no master is off its share of slots by more than this percentage")
+	useEmpty := fs.Bool("use-empty-masters", false, "Give slots to the masters that serve none, e.g. just added nodes")
+	simulate := fs.Bool("simulate", false, "Print the slots that would move without moving them")
+	fs.Parse(os.Args[1:])
+	if fs.NArg() != 1 || *pipeline <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	r := &rebalancer{
+		pipeline: *pipeline,
+		timeout:  time.Duration(*timeout) * time.Millisecond,
+		simulate: *simulate,
+	}
+	err := r.load(fs.Arg(0))
+	if err == nil {
+		err = r.fixOpenSlots()
+	}
+	if err == nil {
+		err = r.rebalance(*threshold, *useEmpty)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// master is a master of the cluster with a connection to it.
+type master struct {
+	*cluster.Node
+	conn   net.Conn
+	reader *resp.Resp
+	slots  []int // the slots it serves, in order
+}
+
+func (m *master) addr() string {
+	return net.JoinHostPort(m.IP, strconv.Itoa(m.Port))
+}
+
+// call sends a command to m and returns its reply, or the error it replied.
+func (m *master) call(timeout time.Duration, args ...string) (resp.Value, error) {
+	m.conn.SetDeadline(time.Now().Add(timeout))
+	if err := resp.Respond(m.conn, resp.Command(args...)); err != nil {
+		return resp.Value{}, fmt.Errorf("%s: %w", m.addr(), err)
+	}
+	reply, err := m.reader.Read()
+	if err != nil {
+		return resp.Value{}, fmt.Errorf("%s: %w", m.addr(), err)
+	}
+	if reply.Type == "error" {
+		return reply, fmt.Errorf("%s: %s %s: %s", m.addr(), args[0], args[1], reply.Str)
+	}
+	return reply, nil
+}
+
+type rebalancer struct {
+	masters  []*master
+	pipeline int
+	timeout  time.Duration
+	simulate bool
+}
+
+// load connects to the masters of the cluster that seed belongs to, as it
+// sees them. Masters that failed are left out: their slots can't move.
+func (r *rebalancer) load(seed string) error {
+	conn, err := net.DialTimeout("tcp", seed, r.timeout)
+	if err != nil {
+		return err
+	}
+	m := &master{Node: &cluster.Node{}, conn: conn, reader: resp.NewResp(conn)}
+	host, port, _ := net.SplitHostPort(seed)
+	m.IP = host
+	m.Port, _ = strconv.Atoi(port)
+	reply, err := m.call(r.timeout, "CLUSTER", "NODES")
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(reply.Bulk), "\n") {
+		n, err := cluster.ParseNode(line)
+		if err != nil {
+			return err
+		}
+		if !n.HasFlag("master") || n.HasFlag("fail") || n.HasFlag("handshake") {
+			continue
+		}
+		if n.IP == "" {
+			// A node that never met another doesn't know its address.
+			n.IP = m.IP
+		}
+		mc := &master{Node: n}
+		for _, sr := range n.Slots {
+			for slot := sr.Start; slot <= sr.End; slot++ {
+				mc.slots = append(mc.slots, slot)
+			}
+		}
+		r.masters = append(r.masters, mc)
+	}
+	for _, mc := range r.masters {
+		if mc.conn, err = net.DialTimeout("tcp", mc.addr(), r.timeout); err != nil {
+			return err
+		}
+		mc.reader = resp.NewResp(mc.conn)
+	}
+	return nil
+}
+
+func (r *rebalancer) byID(id string) *master {
+	for _, m := range r.masters {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// fixOpenSlots finishes the moves an earlier run left half done. Each
+// master lists the slots it is moving only in its own view of the cluster.
+func (r *rebalancer) fixOpenSlots() error {
+	for _, m := range r.masters {
+		reply, err := m.call(r.timeout, "CLUSTER", "NODES")
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(strings.TrimSpace(reply.Bulk), "\n") {
+			n, err := cluster.ParseNode(line)
+			if err != nil {
+				return err
+			}
+			if !n.HasFlag("myself") {
+				continue
+			}
+			for _, mig := range n.Migrations {
+				if mig.Importing {
+					continue // fixed from the side of the source
+				}
+				target := r.byID(mig.NodeID)
+				if target == nil {
+					return fmt.Errorf("slot %d is migrating from %s to unknown or failed node %s", mig.Slot, m.ID, mig.NodeID)
+				}
+				fmt.Printf("Finishing the move of slot %d from %s to %s\n", mig.Slot, m.addr(), target.addr())
+				if err := r.moveSlot(m, target, mig.Slot); err != nil {
+					return err
+				}
+				m.slots = slices.DeleteFunc(m.slots, func(slot int) bool { return slot == mig.Slot })
+				target.slots = append(target.slots, mig.Slot)
+			}
+		}
+	}
+	return nil
+}
+
+// rebalance moves slots from the masters serving more than their share to
+// those serving less.
+func (r *rebalancer) rebalance(threshold float64, useEmpty bool) error {
+	var masters []*master
+	for _, m := range r.masters {
+		if len(m.slots) > 0 || useEmpty {
+			masters = append(masters, m)
+		}
+	}
+	if len(masters) == 0 {
+		return errors.New("no master serves slots")
+	}
+	slices.SortFunc(masters, func(a, b *master) int { return strings.Compare(a.ID, b.ID) })
+
+	// Each master's share; the first ones take the remainder.
+	share := make(map[*master]int)
+	over := false
+	for i, m := range masters {
+		share[m] = cluster.Slots / len(masters)
+		if i < cluster.Slots%len(masters) {
+			share[m]++
+		}
+		if off := float64(len(m.slots)-share[m]) / float64(share[m]) * 100; off > threshold || -off > threshold {
+			over = true
+		}
+	}
+	if !over {
+		fmt.Printf("No rebalancing needed: every master is within %.2f%% of its share of slots.\n", threshold)
+		return nil
+	}
+
+	var donors, receivers []*master
+	for _, m := range masters {
+		switch {
+		case len(m.slots) > share[m]:
+			donors = append(donors, m)
+		case len(m.slots) < share[m]:
+			receivers = append(receivers, m)
+		}
+	}
+	for _, to := range receivers {
+		for len(to.slots) < share[to] {
+			from := donors[0]
+			slot := from.slots[len(from.slots)-1]
+			if r.simulate {
+				fmt.Printf("Would move slot %d from %s to %s\n", slot, from.addr(), to.addr())
+			} else if err := r.moveSlot(from, to, slot); err != nil {
+				return err
+			}
+			from.slots = from.slots[:len(from.slots)-1]
+			to.slots = append(to.slots, slot)
+			if len(from.slots) == share[from] {
+				donors = donors[1:]
+			}
+		}
+	}
+	return nil
+}
+
+// moveSlot moves slot and its keys from one master to another. The target
+// imports the slot before the source starts migrating it, so that a client
+// sent there with ASK is always served; once the keys moved, the target
+// takes the slot with a new config epoch and the others are told.
+func (r *rebalancer) moveSlot(from, to *master, slot int) error {
+	s := strconv.Itoa(slot)
+	if _, err := to.call(r.timeout, "CLUSTER", "SETSLOT", s, "IMPORTING", from.ID); err != nil {
+		return err
+	}
+	if _, err := from.call(r.timeout, "CLUSTER", "SETSLOT", s, "MIGRATING", to.ID); err != nil {
+		return err
+	}
+	moved := 0
+	for {
+		reply, err := from.call(r.timeout, "CLUSTER", "GETKEYSINSLOT", s, strconv.Itoa(r.pipeline))
+		if err != nil {
+			return err
+		}
+		if len(reply.Array) == 0 {
+			break
+		}
+		args := []string{"MIGRATE", to.IP, strconv.Itoa(to.Port), "", "0", strconv.FormatInt(r.timeout.Milliseconds(), 10), "KEYS"}
+		for _, key := range reply.Array {
+			args = append(args, key.Bulk)
+		}
+		// MIGRATE waits for the target, so it gets twice the time.
+		if _, err := from.call(2*r.timeout, args...); err != nil {
+			return err
+		}
+		moved += len(reply.Array)
+	}
+
+	if _, err := to.call(r.timeout, "CLUSTER", "SETSLOT", s, "NODE", to.ID); err != nil {
+		return err
+	}
+	if _, err := from.call(r.timeout, "CLUSTER", "SETSLOT", s, "NODE", to.ID); err != nil {
+		return err
+	}
+	// The other masters would learn it from the target anyway.
+	for _, m := range r.masters {
+		if m != from && m != to {
+			m.call(r.timeout, "CLUSTER", "SETSLOT", s, "NODE", to.ID)
+		}
+	}
+	fmt.Printf("Moved slot %d from %s to %s (%d keys)\n", slot, from.addr(), to.addr(), moved)
+	return nil
+}
@@ -5,10 +5,14 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	// "github.com/codecrafters-io/redis-starter-go/app/resp" // Our custom RESP package
-	"github.com/saurabhdhingra/go-redis/server" // Our server package
-	"github.com/saurabhdhingra/go-redis/store"  // Our key-value store package
+	"github.com/saurabhdhingra/go-redis/sentinel" // Sentinel mode
+	"github.com/saurabhdhingra/go-redis/server"   // Our server package
+	"github.com/saurabhdhingra/go-redis/store"    // Our key-value store package
 )
 
 func main() {
@@ -17,6 +21,49 @@ func main() {
 	// Parse flags
 	port := flag.String("port", "6379", "Port to listen on")
 	replicaof := flag.String("replicaof", "", "host:port of master (if this is a replica)")
+	dir := flag.String("dir", ".", "Directory where the RDB file is stored")
+	dbfilename := flag.String("dbfilename", "dump.rdb", "Name of the RDB file")
+	save := flag.String("save", "3600 1 300 100 60 10000", "Automatic save rules as \"<seconds> <changes>\" pairs, empty to disable")
+	stopWritesOnBgsaveError := flag.String("stop-writes-on-bgsave-error", "yes", "Refuse writes after a failed background save (yes/no)")
+	replBacklogSize := flag.String("repl-backlog-size", "1mb", "Size of the replication backlog, e.g. 1mb")
+	replBacklogTTL := flag.Int("repl-backlog-ttl", 3600, "Seconds without replicas after which a master frees its backlog, 0 for never")
+	replDisklessSync := flag.String("repl-diskless-sync", "no", "Stream full synchronizations to replicas without an RDB file (yes/no)")
+	replDisklessSyncDelay := flag.Int("repl-diskless-sync-delay", 5, "Seconds to wait for more replicas before a diskless transfer")
+	replDisklessLoad := flag.String("repl-diskless-load", server.DisklessLoadDisabled, "How replicas load the RDB from the master: disabled, on-empty-db or swapdb")
+	replicaPriority := flag.Int("replica-priority", 100, "Promotion priority of this replica, lower first, 0 for never")
+	replicaAnnounceIP := flag.String("replica-announce-ip", "", "IP address the master reports for this replica")
+	replicaAnnouncePort := flag.Int("replica-announce-port", 0, "Port the master reports for this replica, 0 for the listening port")
+	minReplicasToWrite := flag.Int("min-replicas-to-write", 0, "Refuse writes unless this many replicas are connected with a small lag, 0 to disable")
+	minReplicasMaxLag := flag.Int("min-replicas-max-lag", 10, "Seconds since the last acknowledgement for a replica to count toward min-replicas-to-write")
+	replicaReadOnly := flag.String("replica-read-only", "yes", "Reject writes from clients on replicas (yes/no)")
+	replicaServeStaleData := flag.String("replica-serve-stale-data", "yes", "Serve possibly stale data while the link to the master is down (yes/no)")
+	appendonly := flag.String("appendonly", "no", "Log every write to the append only file (yes/no)")
+	appenddirname := flag.String("appenddirname", "appendonlydir", "Directory inside dir holding the AOF files")
+	appendfilename := flag.String("appendfilename", "appendonly.aof", "Base name of the append only files")
+	appendfsync := flag.String("appendfsync", server.FsyncEverysec, "When to fsync the AOF: always, everysec or no")
+	aofLoadTruncated := flag.String("aof-load-truncated", "yes", "Load an AOF whose last command is incomplete (yes/no)")
+	aofUseRDBPreamble := flag.String("aof-use-rdb-preamble", "yes", "Write the AOF base file in RDB format (yes/no)")
+	aofTimestampEnabled := flag.String("aof-timestamp-enabled", "no", "Annotate the AOF with timestamps for point-in-time recovery (yes/no)")
+	aofTruncateToTimestamp := flag.Int64("aof-truncate-to-timestamp", 0, "Roll the AOF back to this unix time before loading it, keeping the files it replaces")
+	aofTruncateToOffset := flag.Int64("aof-truncate-to-offset", 0, "Roll the incremental AOF back to this many bytes before loading it, keeping the files it replaces")
+	clusterEnabled := flag.String("cluster-enabled", "no", "Run as a Redis Cluster node (yes/no)")
+	clusterConfigFile := flag.String("cluster-config-file", "nodes.conf", "File inside dir where a cluster node keeps its view of the cluster")
+	clusterNodeTimeout := flag.Int("cluster-node-timeout", 15000, "Milliseconds a cluster node may not answer before it is considered failing")
+	clusterRequireFullCoverage := flag.String("cluster-require-full-coverage", "yes", "Stop serving queries when some slot isn't served (yes/no)")
+	raftEnabled := flag.String("raft-enabled", "no", "Replicate writes through a Raft log for strong consistency (yes/no)")
+	raftAddr := flag.String("raft-addr", "", "host:port where the other raft nodes reach this one, 127.0.0.1:<port> by default")
+	raftElectionTimeout := flag.Int("raft-election-timeout", 1000, "Milliseconds without a raft leader after which a follower starts an election")
+	raftHeartbeatInterval := flag.Int("raft-heartbeat-interval", 100, "Milliseconds between the heartbeats of a raft leader")
+	raftSnapshotEntries := flag.Int("raft-snapshot-entries", 10000, "Number of raft log entries after which the log is compacted into a snapshot")
+	activeActive := flag.String("active-active", "no", "Take writes on several masters, merging them as CRDTs (yes/no)")
+	var activePeers stringList
+	flag.Var(&activePeers, "active-peer", "host:port of another active-active master (repeatable)")
+	notifyKeyspaceEvents := flag.String("notify-keyspace-events", "", "Classes of keyspace events published to Pub/Sub, e.g. \"KEA\", empty to disable")
+	sentinelMode := flag.Bool("sentinel", false, "Run as a Redis Sentinel instead of a server")
+	var sentinelMonitors stringList
+	flag.Var(&sentinelMonitors, "sentinel-monitor", "Master for a sentinel to monitor, as \"<name> <host> <port> <quorum>\" (repeatable)")
+	sentinelDownAfter := flag.Int("sentinel-down-after-milliseconds", int(sentinel.DefaultDownAfter.Milliseconds()), "Milliseconds without a valid reply after which a sentinel sees an instance down")
+	sentinelFailoverTimeout := flag.Int("sentinel-failover-timeout", int(sentinel.DefaultFailoverTimeout.Milliseconds()), "Milliseconds a sentinel gives a failover to complete")
 	flag.Parse()
 
 	role := "master"
@@ -26,8 +73,145 @@ func main() {
 		masterAddr = *replicaof
 	}
 
+	portNum, err := strconv.Atoi(*port)
+	if err != nil {
+		fmt.Println("Invalid port:", *port)
+		os.Exit(1)
+	}
+
+	if *sentinelMode {
+		var masters []sentinel.MasterConfig
+		for _, monitor := range sentinelMonitors {
+			m, err := sentinel.ParseMonitor(monitor)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			m.DownAfter = time.Duration(*sentinelDownAfter) * time.Millisecond
+			m.FailoverTimeout = time.Duration(*sentinelFailoverTimeout) * time.Millisecond
+			masters = append(masters, m)
+		}
+		runSentinel(*port, sentinel.New(portNum, masters))
+		return
+	}
+
+	saveParams, err := server.ParseSaveParams(*save)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	backlogSize, err := parseMemory(*replBacklogSize)
+	if err != nil || backlogSize <= 0 {
+		fmt.Println("Invalid repl-backlog-size:", *replBacklogSize)
+		os.Exit(1)
+	}
+
+	notifyFlags, err := server.ParseKeyspaceEvents(*notifyKeyspaceEvents)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	switch *replDisklessLoad {
+	case server.DisklessLoadDisabled, server.DisklessLoadOnEmptyDB, server.DisklessLoadSwapDB:
+	default:
+		fmt.Println("Invalid repl-diskless-load:", *replDisklessLoad)
+		os.Exit(1)
+	}
+
+	switch *appendfsync {
+	case server.FsyncAlways, server.FsyncEverysec, server.FsyncNo:
+	default:
+		fmt.Println("Invalid appendfsync:", *appendfsync)
+		os.Exit(1)
+	}
+
 	// Initialize the global key-value store
 	store := store.NewKeyValueStore()
+	info := &server.ServerInfo{
+		Role:       role,
+		MasterAddr: masterAddr,
+		Port:       portNum,
+
+		ReplBacklogSize: int(backlogSize),
+		ReplBacklogTTL:  time.Duration(*replBacklogTTL) * time.Second,
+
+		ReplDisklessSync:      *replDisklessSync == "yes",
+		ReplDisklessSyncDelay: time.Duration(*replDisklessSyncDelay) * time.Second,
+		ReplDisklessLoad:      *replDisklessLoad,
+
+		ReplicaPriority:     *replicaPriority,
+		ReplicaAnnounceIP:   *replicaAnnounceIP,
+		ReplicaAnnouncePort: *replicaAnnouncePort,
+
+		MinReplicasToWrite: *minReplicasToWrite,
+		MinReplicasMaxLag:  time.Duration(*minReplicasMaxLag) * time.Second,
+
+		ReplicaReadOnly:       *replicaReadOnly == "yes",
+		ReplicaServeStaleData: *replicaServeStaleData == "yes",
+		Dir:                   *dir,
+		DBFilename:            *dbfilename,
+
+		SaveParams:              saveParams,
+		StopWritesOnBgsaveError: *stopWritesOnBgsaveError == "yes",
+
+		AppendOnly:        *appendonly == "yes",
+		AppendDirName:     *appenddirname,
+		AppendFilename:    *appendfilename,
+		AppendFsync:       *appendfsync,
+		AOFLoadTruncated:  *aofLoadTruncated == "yes",
+		AOFUseRDBPreamble: *aofUseRDBPreamble == "yes",
+
+		AOFTimestampEnabled:    *aofTimestampEnabled == "yes",
+		AOFTruncateToTimestamp: *aofTruncateToTimestamp,
+		AOFTruncateToOffset:    *aofTruncateToOffset,
+
+		ClusterEnabled:             *clusterEnabled == "yes",
+		ClusterConfigFile:          *clusterConfigFile,
+		ClusterNodeTimeout:         time.Duration(*clusterNodeTimeout) * time.Millisecond,
+		ClusterRequireFullCoverage: *clusterRequireFullCoverage == "yes",
+
+		RaftEnabled:           *raftEnabled == "yes",
+		RaftAddr:              *raftAddr,
+		RaftElectionTimeout:   time.Duration(*raftElectionTimeout) * time.Millisecond,
+		RaftHeartbeatInterval: time.Duration(*raftHeartbeatInterval) * time.Millisecond,
+		RaftSnapshotEntries:   *raftSnapshotEntries,
+
+		ActiveActive: *activeActive == "yes",
+		ActivePeers:  activePeers,
+
+		NotifyKeyspaceEvents: notifyFlags,
+	}
+	if info.RaftAddr == "" {
+		info.RaftAddr = "127.0.0.1:" + *port
+	}
+
+	if info.RaftEnabled && (info.Role == "slave" || info.ClusterEnabled) {
+		fmt.Println("raft-enabled can't be used with replicaof or in cluster mode")
+		os.Exit(1)
+	}
+
+	if info.ActiveActive {
+		if info.Role == "slave" || info.ClusterEnabled || info.RaftEnabled || info.AppendOnly {
+			fmt.Println("active-active can't be used with replicaof, appendonly, raft-enabled or in cluster mode")
+			os.Exit(1)
+		}
+		info.ActiveInit()
+	}
+
+	info.KeyspaceEventsInit(store)
+
+	if info.ClusterEnabled {
+		if info.Role == "slave" {
+			fmt.Println("replicaof can't be used in cluster mode")
+			os.Exit(1)
+		}
+		if err := info.ClusterInit(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 
 	l, err := net.Listen("tcp", ":"+*port)
 	if err != nil {
@@ -35,6 +219,37 @@ func main() {
 		os.Exit(1)
 	}
 
+	if info.ClusterEnabled {
+		if err := info.StartClusterBus(store); err != nil {
+			fmt.Printf("Failed to bind to the cluster bus port: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if info.RaftEnabled {
+		// The raft snapshot and log hold the dataset
+		if err := info.RaftInit(store); err != nil {
+			fmt.Println("Failed loading the raft log:", err)
+			os.Exit(1)
+		}
+	} else {
+		// Load the dataset in the background; clients get LOADING errors meanwhile
+		info.SetLoading(true)
+		go func() {
+			if err := info.LoadDataFromDisk(store); err != nil {
+				fmt.Println("Failed loading data from disk:", err)
+				os.Exit(1)
+			}
+			if info.Role == "slave" {
+				info.StartReplication(store)
+			}
+			if info.ActiveActive {
+				info.StartActivePeers(store)
+			}
+		}()
+	}
+	go info.Cron(store)
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -42,7 +257,61 @@ func main() {
 			os.Exit(1)
 		}
 
-		// Pass role and master info to the handler
-		go server.HandleConnectionWithRole(conn, store, role, masterAddr)
+		// All connections share the same server state
+		go server.HandleConnectionWithInfo(conn, store, info)
+	}
+}
+
+// runSentinel serves sentinel clients on port.
+func runSentinel(port string, s *sentinel.Sentinel) {
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		fmt.Printf("Failed to bind to port %s\n", port)
+		os.Exit(1)
+	}
+	s.Start()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Println("Error accepting connection: ", err.Error())
+			os.Exit(1)
+		}
+		go s.HandleConnection(conn)
+	}
+}
+
+// stringList is a flag that may be given several times.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ", ") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// parseMemory parses a byte count with an optional unit, as in redis.conf:
+// "1024", "64kb", "1mb", "2gb" (and "k", "m", "g" for powers of 1000).
+func parseMemory(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	s = strings.ToLower(strings.TrimSpace(s))
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mul = strings.TrimSuffix(s, u.suffix), u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
 	}
+	return n * mul, nil
 }
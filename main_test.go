@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/resp"
+)
+
+// The tests of this package run servers as separate processes: the test
+// binary runs main when serverEnv is set, with the server flags as its
+// arguments.
+const serverEnv = "GO_REDIS_TEST_SERVER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(serverEnv) == "1" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// process is a server started by a test.
+type process struct {
+	t    *testing.T
+	port string
+	dir  string
+	args []string
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// addr returns the address clients reach the process at.
+func (p *process) addr() string {
+	return net.JoinHostPort("127.0.0.1", p.port)
+}
+
+// freePort returns a port nothing listens on.
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+// startProcess runs a server on port with args, in a directory of its own,
+// and waits until it accepts connections. It is killed when the test ends,
+// and its output logged if the test failed.
+func startProcess(t *testing.T, port string, args ...string) *process {
+	t.Helper()
+	p := &process{t: t, port: port, dir: t.TempDir(), args: args}
+	p.start()
+	t.Cleanup(func() {
+		p.kill()
+		if t.Failed() {
+			out, _ := os.ReadFile(filepath.Join(p.dir, "output.log"))
+			t.Logf("output of the process on port %s:\n%s", port, out)
+		}
+	})
+	return p
+}
+
+// start runs the process, again after kill, in the same directory.
+func (p *process) start() {
+	p.t.Helper()
+	out, err := os.OpenFile(filepath.Join(p.dir, "output.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	defer out.Close()
+	p.cmd = exec.Command(os.Args[0], append([]string{"-port", p.port, "-dir", p.dir}, p.args...)...)
+	p.cmd.Env = append(os.Environ(), serverEnv+"=1")
+	p.cmd.Dir = p.dir
+	p.cmd.Stdout, p.cmd.Stderr = out, out
+	if err := p.cmd.Start(); err != nil {
+		p.t.Fatal(err)
+	}
+	p.done = make(chan struct{})
+	go func(cmd *exec.Cmd, done chan struct{}) {
+		cmd.Wait()
+		close(done)
+	}(p.cmd, p.done)
+	waitFor(p.t, 10*time.Second, "the process on port "+p.port+" to listen", func() bool {
+		conn, err := net.Dial("tcp", p.addr())
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+}
+
+// kill stops the process at once, as a crash would.
+func (p *process) kill() {
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	p.cmd.Process.Kill()
+	<-p.done
+}
+
+// call sends a command to addr on a new connection and returns the reply.
+func call(addr string, args ...string) (resp.Value, error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return resp.Value{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := resp.Respond(conn, resp.Command(args...)); err != nil {
+		return resp.Value{}, err
+	}
+	return resp.NewResp(conn).Read()
+}
+
+// mustCall is call for a process that must be reachable.
+func mustCall(t *testing.T, addr string, args ...string) resp.Value {
+	t.Helper()
+	reply, err := call(addr, args...)
+	if err != nil {
+		t.Fatalf("%v to %s: %v", args, addr, err)
+	}
+	return reply
+}
+
+// waitFor polls cond until it holds, failing the test after timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// fields returns the alternating names and values of reply as a map.
+func fields(reply resp.Value) map[string]string {
+	m := make(map[string]string)
+	for i := 0; i+1 < len(reply.Array); i += 2 {
+		m[reply.Array[i].Bulk] = reply.Array[i+1].Bulk
+	}
+	return m
+}
@@ -0,0 +1,897 @@
+// Package raft implements the Raft consensus algorithm: a leader elected by
+// a majority of the members appends the entries proposed to it to a
+// replicated log, and every node applies them to its state machine in the
+// same order once a majority stored them. The log is compacted into
+// snapshots written by the state machine; members are added and removed one
+// at a time with configuration entries.
+//
+// Nodes are named by the address of their client port, where they send each
+// other RAFT commands, see rpc.go.
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of log entries.
+const (
+	// EntryCommand holds a command for the state machine.
+	EntryCommand = "command"
+	// EntryNoop is appended by a new leader, to commit the entries of the
+	// previous terms.
+	EntryNoop = "noop"
+	// EntryConfig holds the members, separated by spaces, from the moment
+	// it is appended.
+	EntryConfig = "config"
+)
+
+// Node states.
+const (
+	Follower  = "follower"
+	Candidate = "candidate"
+	Leader    = "leader"
+)
+
+// Auxiliary fields of a snapshot file recording what it holds.
+const (
+	auxIndex   = "raft-index"
+	auxTerm    = "raft-term"
+	auxMembers = "raft-members"
+)
+
+const (
+	tickPeriod      = 10 * time.Millisecond
+	proposeTimeout  = 10 * time.Second
+	maxAppendBatch  = 256
+	logFileName     = "raft.log"
+	snapshotName    = "raft-snapshot.rdb"
+	tmpSnapshotName = "temp-raft-snapshot.rdb"
+)
+
+// Errors returned to clients, in the form of Redis errors.
+var (
+	ErrNoCluster     = errors.New("NOCLUSTER No raft cluster, use RAFT INIT or RAFT JOIN")
+	ErrNoLeader      = errors.New("NOLEADER No raft leader")
+	ErrTimeout       = errors.New("TIMEOUT The entry was not committed in time")
+	ErrEntryLost     = errors.New("NOLEADER The leader changed before the entry was committed")
+	ErrConfigPending = errors.New("ERR A membership change is already in progress")
+	ErrUnknownNode   = errors.New("ERR Unknown raft node")
+)
+
+// NotLeaderError is returned by a follower that knows the leader.
+type NotLeaderError struct {
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	return "NOTLEADER " + e.Leader
+}
+
+// Entry is an entry of the log.
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  string
+	Data  string
+}
+
+// StateMachine is what the log is applied to.
+type StateMachine interface {
+	// Apply applies a committed command and returns the result for the
+	// client that proposed it.
+	Apply(data string) any
+	// Snapshot atomically writes the state, as of the last applied entry,
+	// to path, recording aux in it.
+	Snapshot(path string, aux map[string]string) error
+	// Restore replaces the state with the snapshot at path and returns the
+	// aux recorded in it.
+	Restore(path string) (map[string]string, error)
+}
+
+// Config configures a node.
+type Config struct {
+	// ID is the address where the other nodes reach this one.
+	ID string
+	// Dir holds the log and the snapshot.
+	Dir string
+	// A follower that doesn't hear from a leader for ElectionTimeout, plus
+	// up to as much at random, starts an election. Leaders send
+	// appends, empty or not, every HeartbeatInterval.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// SnapshotEntries is the number of applied entries after which the
+	// log is compacted into a snapshot.
+	SnapshotEntries int
+}
+
+// Node is a member, or future member, of a Raft cluster.
+type Node struct {
+	cfg Config
+	sm  StateMachine
+	log *logFile
+
+	// applyMu is held while the state machine changes: when applying
+	// entries and when installing a snapshot from the leader. It comes
+	// before mu.
+	applyMu sync.Mutex
+
+	mu   sync.Mutex
+	cond *sync.Cond // broadcast on every change, and every tick
+
+	state    string
+	term     uint64
+	votedFor string
+	leader   string
+
+	// entries follow the snapshot, which holds the state up to
+	// snapshotIndex with the configuration snapshotMembers.
+	entries         []Entry
+	snapshotIndex   uint64
+	snapshotTerm    uint64
+	snapshotMembers []string
+
+	// members is the configuration of the last config entry, or of the
+	// snapshot when the log has none; configIndex is that entry.
+	members     []string
+	configIndex uint64
+
+	commitIndex uint64
+	lastApplied uint64
+
+	electionDeadline time.Time
+	lastContact      time.Time // last append from the current leader
+
+	clients map[string]*client
+	peers   map[string]*peer // leader only
+	// readRound counts the rounds of appends that confirm the leadership
+	// for reads, see ReadIndex.
+	readRound uint64
+	waiters   map[uint64]*waiter
+}
+
+// peer is the leader's replication state for another member.
+type peer struct {
+	addr       string
+	nextIndex  uint64
+	matchIndex uint64
+	ackedRound uint64
+	trigger    chan struct{}
+	done       chan struct{}
+}
+
+// waiter is a client waiting for the entry it proposed.
+type waiter struct {
+	term   uint64
+	result chan any
+}
+
+// Open loads the snapshot and the log of a node from cfg.Dir, restoring sm,
+// and starts it. A node that was never part of a cluster waits for
+// Bootstrap, or to be added to one.
+func Open(cfg Config, sm StateMachine) (*Node, error) {
+	n := &Node{
+		cfg:     cfg,
+		sm:      sm,
+		state:   Follower,
+		clients: make(map[string]*client),
+		waiters: make(map[uint64]*waiter),
+	}
+	n.cond = sync.NewCond(&n.mu)
+
+	if _, err := os.Stat(n.snapshotPath()); err == nil {
+		aux, err := sm.Restore(n.snapshotPath())
+		if err != nil {
+			return nil, fmt.Errorf("loading the raft snapshot: %w", err)
+		}
+		if err := n.setSnapshot(aux); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	log, st, err := openLog(filepath.Join(cfg.Dir, logFileName))
+	if err != nil {
+		return nil, err
+	}
+	n.log = log
+	n.term, n.votedFor = st.term, st.votedFor
+	for _, e := range st.entries {
+		if e.Index > n.snapshotIndex {
+			n.entries = append(n.entries, e)
+		}
+	}
+	if len(n.entries) > 0 && n.entries[0].Index != n.snapshotIndex+1 {
+		return nil, fmt.Errorf("raft log starts at entry %d, after the snapshot at %d", n.entries[0].Index, n.snapshotIndex)
+	}
+	n.commitIndex, n.lastApplied = n.snapshotIndex, n.snapshotIndex
+	n.updateMembers()
+	n.resetElectionDeadline()
+	fmt.Printf("Raft node %s loaded: term %d, snapshot at %d, last entry %d\n", cfg.ID, n.term, n.snapshotIndex, n.lastIndex())
+
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+func (n *Node) snapshotPath() string {
+	return filepath.Join(n.cfg.Dir, snapshotName)
+}
+
+// setSnapshot records the position of a snapshot from its aux fields.
+func (n *Node) setSnapshot(aux map[string]string) error {
+	index, err1 := strconv.ParseUint(aux[auxIndex], 10, 64)
+	term, err2 := strconv.ParseUint(aux[auxTerm], 10, 64)
+	if err := errors.Join(err1, err2); err != nil {
+		return fmt.Errorf("raft snapshot without a valid position: %w", err)
+	}
+	n.snapshotIndex, n.snapshotTerm = index, term
+	n.snapshotMembers = strings.Fields(aux[auxMembers])
+	return nil
+}
+
+// The methods below that don't take mu must be called with it held.
+
+func (n *Node) lastIndex() uint64 {
+	if len(n.entries) > 0 {
+		return n.entries[len(n.entries)-1].Index
+	}
+	return n.snapshotIndex
+}
+
+func (n *Node) lastTerm() uint64 {
+	if len(n.entries) > 0 {
+		return n.entries[len(n.entries)-1].Term
+	}
+	return n.snapshotTerm
+}
+
+// termAt returns the term of the entry at index, if the node still knows it.
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	if index == n.snapshotIndex {
+		return n.snapshotTerm, true
+	}
+	if index < n.snapshotIndex || index > n.lastIndex() {
+		return 0, false
+	}
+	return n.entries[index-n.snapshotIndex-1].Term, true
+}
+
+func (n *Node) entry(index uint64) Entry {
+	return n.entries[index-n.snapshotIndex-1]
+}
+
+// membersAt returns the configuration in effect at index.
+func (n *Node) membersAt(index uint64) []string {
+	for i := len(n.entries) - 1; i >= 0; i-- {
+		if e := n.entries[i]; e.Index <= index && e.Type == EntryConfig {
+			return strings.Fields(e.Data)
+		}
+	}
+	return n.snapshotMembers
+}
+
+// updateMembers takes the configuration of the last config entry, and
+// starts or stops replicating to the members that changed.
+func (n *Node) updateMembers() {
+	n.members, n.configIndex = n.snapshotMembers, 0
+	for i := len(n.entries) - 1; i >= 0; i-- {
+		if e := n.entries[i]; e.Type == EntryConfig {
+			n.members, n.configIndex = strings.Fields(e.Data), e.Index
+			break
+		}
+	}
+	if n.state == Leader {
+		n.syncPeers()
+	}
+}
+
+func (n *Node) isMember(id string) bool {
+	return slices.Contains(n.members, id)
+}
+
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+func (n *Node) resetElectionDeadline() {
+	timeout := n.cfg.ElectionTimeout + rand.N(n.cfg.ElectionTimeout)
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// fatal stops the node when its state can't be saved: going on could break
+// the promises it made to the other nodes.
+func (n *Node) fatal(err error) {
+	fmt.Println("Fatal: can't write the raft log:", err)
+	os.Exit(1)
+}
+
+func (n *Node) saveState() {
+	if err := n.log.append(stateRecord(n.term, n.votedFor)); err != nil {
+		n.fatal(err)
+	}
+}
+
+// appendEntries durably adds entries to the log.
+func (n *Node) appendEntries(entries ...Entry) {
+	records := make([][]string, len(entries))
+	for i, e := range entries {
+		records[i] = entryRecord(e)
+	}
+	if err := n.log.append(records...); err != nil {
+		n.fatal(err)
+	}
+	n.entries = append(n.entries, entries...)
+	if slices.ContainsFunc(entries, func(e Entry) bool { return e.Type == EntryConfig }) {
+		n.updateMembers()
+	}
+}
+
+// truncateFrom removes the entries from index on, which a leader replaced.
+func (n *Node) truncateFrom(index uint64) {
+	if err := n.log.append(truncateRecord(index)); err != nil {
+		n.fatal(err)
+	}
+	n.entries = n.entries[:index-n.snapshotIndex-1]
+	n.updateMembers()
+}
+
+// becomeFollower steps down, in term when it is newer.
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term, n.votedFor = term, ""
+		n.saveState()
+	}
+	if n.state == Leader {
+		fmt.Printf("Raft: stepping down from leader in term %d\n", n.term)
+		for _, p := range n.peers {
+			close(p.done)
+		}
+		n.peers = nil
+		// The deadline dates from before it led: without a new one, a
+		// leader deposed by a newer term would at once start an election
+		// and depose the leader of that term in turn.
+		n.resetElectionDeadline()
+	}
+	n.state = Follower
+	if leader != n.leader && leader != "" {
+		fmt.Printf("Raft: following leader %s in term %d\n", leader, n.term)
+	}
+	n.leader = leader
+	n.cond.Broadcast()
+}
+
+// run drives the timers: elections on followers and candidates.
+func (n *Node) run() {
+	for range time.Tick(tickPeriod) {
+		n.mu.Lock()
+		if n.state != Leader && n.isMember(n.cfg.ID) && time.Now().After(n.electionDeadline) {
+			n.startElection()
+		}
+		n.cond.Broadcast()
+		n.mu.Unlock()
+	}
+}
+
+// startElection asks the other members for their vote in a new term.
+func (n *Node) startElection() {
+	n.state = Candidate
+	n.term++
+	n.votedFor = n.cfg.ID
+	n.leader = ""
+	n.saveState()
+	n.resetElectionDeadline()
+	fmt.Printf("Raft: starting an election for term %d\n", n.term)
+
+	term, lastIndex, lastTerm := n.term, n.lastIndex(), n.lastTerm()
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, addr := range n.members {
+		if addr == n.cfg.ID {
+			continue
+		}
+		c := n.client(addr)
+		go func() {
+			replyTerm, granted, err := c.requestVote(term, n.cfg.ID, lastIndex, lastTerm)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if replyTerm > n.term {
+				n.becomeFollower(replyTerm, "")
+				return
+			}
+			if n.state != Candidate || n.term != term || !granted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// becomeLeader takes over after winning an election.
+func (n *Node) becomeLeader() {
+	fmt.Printf("Raft: elected leader for term %d\n", n.term)
+	n.state = Leader
+	n.leader = n.cfg.ID
+	n.peers = make(map[string]*peer)
+	n.syncPeers()
+	n.appendEntries(Entry{Index: n.lastIndex() + 1, Term: n.term, Type: EntryNoop})
+	n.triggerPeers()
+	n.advanceCommit()
+	n.cond.Broadcast()
+}
+
+// syncPeers replicates to the current members, and only to them.
+func (n *Node) syncPeers() {
+	for addr, p := range n.peers {
+		if !n.isMember(addr) {
+			close(p.done)
+			delete(n.peers, addr)
+		}
+	}
+	for _, addr := range n.members {
+		if addr == n.cfg.ID || n.peers[addr] != nil {
+			continue
+		}
+		p := &peer{
+			addr:      addr,
+			nextIndex: n.lastIndex() + 1,
+			trigger:   make(chan struct{}, 1),
+			done:      make(chan struct{}),
+		}
+		n.peers[addr] = p
+		go n.replicateLoop(p, n.term)
+	}
+}
+
+func (n *Node) triggerPeers() {
+	for _, p := range n.peers {
+		p.retrigger()
+	}
+}
+
+// replicateLoop sends appends to p, on new entries and on every heartbeat,
+// while this node leads in term.
+func (n *Node) replicateLoop(p *peer, term uint64) {
+	heartbeat := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.trigger:
+		case <-heartbeat.C:
+		}
+		n.replicate(p, term)
+	}
+}
+
+// replicate sends p the entries it misses, or the snapshot when the log
+// no longer has them.
+func (n *Node) replicate(p *peer, term uint64) {
+	n.mu.Lock()
+	if n.state != Leader || n.term != term {
+		n.mu.Unlock()
+		return
+	}
+	round := n.readRound
+	c := n.client(p.addr)
+
+	if p.nextIndex <= n.snapshotIndex {
+		// The file is read under mu, so that no compaction replaces it.
+		data, err := os.ReadFile(n.snapshotPath())
+		snapIndex, snapTerm := n.snapshotIndex, n.snapshotTerm
+		n.mu.Unlock()
+		if err != nil {
+			fmt.Println("Raft: can't read the snapshot:", err)
+			return
+		}
+		replyTerm, index, err := c.installSnapshot(term, n.cfg.ID, snapIndex, snapTerm, data)
+		if err != nil {
+			return
+		}
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if replyTerm > n.term {
+			n.becomeFollower(replyTerm, "")
+			return
+		}
+		if n.state != Leader || n.term != term {
+			return
+		}
+		p.matchIndex = max(p.matchIndex, index)
+		p.nextIndex = p.matchIndex + 1
+		n.advanceCommit()
+		return
+	}
+
+	prevIndex := p.nextIndex - 1
+	prevTerm, _ := n.termAt(prevIndex)
+	var entries []Entry
+	for i := p.nextIndex; i <= n.lastIndex() && len(entries) < maxAppendBatch; i++ {
+		entries = append(entries, n.entry(i))
+	}
+	commit := n.commitIndex
+	n.mu.Unlock()
+
+	replyTerm, success, index, err := c.appendEntries(term, n.cfg.ID, prevIndex, prevTerm, commit, entries)
+	if err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if replyTerm > n.term {
+		n.becomeFollower(replyTerm, "")
+		return
+	}
+	if n.state != Leader || n.term != term {
+		return
+	}
+	if !success {
+		// index is the last entry the follower may share with us.
+		p.nextIndex = max(1, min(p.nextIndex-1, index+1))
+		p.retrigger()
+		return
+	}
+	p.matchIndex = max(p.matchIndex, index)
+	p.nextIndex = p.matchIndex + 1
+	p.ackedRound = max(p.ackedRound, round)
+	n.advanceCommit()
+	if p.nextIndex <= n.lastIndex() {
+		p.retrigger()
+	}
+	n.cond.Broadcast()
+}
+
+// retrigger makes the replicator of p send again without waiting for the
+// next heartbeat.
+func (p *peer) retrigger() {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// advanceCommit commits the entries of the current term stored by a
+// majority, with the entries before them. A leader that removed itself
+// steps down once that is committed.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.termAt(index); term != n.term {
+			break
+		}
+		count := 0
+		if n.isMember(n.cfg.ID) {
+			count++
+		}
+		for _, p := range n.peers {
+			if p.matchIndex >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.cond.Broadcast()
+			break
+		}
+	}
+	if n.state == Leader && !n.isMember(n.cfg.ID) && n.commitIndex >= n.configIndex {
+		fmt.Println("Raft: removed from the cluster")
+		n.becomeFollower(n.term, "")
+	}
+}
+
+// applyLoop applies the committed entries in order, and compacts the log
+// when it grew enough.
+func (n *Node) applyLoop() {
+	for {
+		n.applyMu.Lock()
+		n.mu.Lock()
+		for n.lastApplied >= n.commitIndex {
+			n.mu.Unlock()
+			n.applyMu.Unlock()
+			n.mu.Lock()
+			n.cond.Wait()
+			n.mu.Unlock()
+			n.applyMu.Lock()
+			n.mu.Lock()
+		}
+		entries := slices.Clone(n.entries[n.lastApplied-n.snapshotIndex : n.commitIndex-n.snapshotIndex])
+		n.mu.Unlock()
+
+		for _, e := range entries {
+			var result any
+			if e.Type == EntryCommand {
+				result = n.sm.Apply(e.Data)
+			}
+			n.mu.Lock()
+			n.lastApplied = e.Index
+			if w := n.waiters[e.Index]; w != nil {
+				delete(n.waiters, e.Index)
+				if w.term != e.Term {
+					result = ErrEntryLost
+				}
+				w.result <- result
+			}
+			n.cond.Broadcast()
+			n.mu.Unlock()
+		}
+		n.maybeSnapshot()
+		n.applyMu.Unlock()
+	}
+}
+
+// maybeSnapshot compacts the log into a snapshot of the state machine once
+// enough entries were applied. Must be called with applyMu held, so that
+// the state is the one of the last applied entry.
+func (n *Node) maybeSnapshot() {
+	n.mu.Lock()
+	if n.cfg.SnapshotEntries <= 0 || n.lastApplied-n.snapshotIndex < uint64(n.cfg.SnapshotEntries) {
+		n.mu.Unlock()
+		return
+	}
+	index := n.lastApplied
+	term, _ := n.termAt(index)
+	aux := map[string]string{
+		auxIndex:   strconv.FormatUint(index, 10),
+		auxTerm:    strconv.FormatUint(term, 10),
+		auxMembers: strings.Join(n.membersAt(index), " "),
+	}
+	n.mu.Unlock()
+
+	if err := n.sm.Snapshot(n.snapshotPath(), aux); err != nil {
+		fmt.Println("Raft: snapshot failed:", err)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.snapshotMembers = n.membersAt(index)
+	n.entries = slices.Clone(n.entries[index-n.snapshotIndex:])
+	n.snapshotIndex, n.snapshotTerm = index, term
+	if err := n.log.rewrite(n.term, n.votedFor, n.entries); err != nil {
+		n.fatal(err)
+	}
+	fmt.Printf("Raft: snapshot taken at entry %d\n", index)
+}
+
+// client returns the connection used to send RPCs to addr.
+func (n *Node) client(addr string) *client {
+	c := n.clients[addr]
+	if c == nil {
+		c = &client{addr: addr, timeout: n.cfg.ElectionTimeout}
+		n.clients[addr] = c
+	}
+	return c
+}
+
+// leaderErr returns why this node can't serve as the leader, or nil.
+func (n *Node) leaderErr() error {
+	switch {
+	case n.state == Leader:
+		return nil
+	case len(n.members) == 0:
+		return ErrNoCluster
+	case n.leader != "":
+		return &NotLeaderError{Leader: n.leader}
+	}
+	return ErrNoLeader
+}
+
+// Propose appends a command to the log, and returns the result of applying
+// it once committed.
+func (n *Node) Propose(data string) (any, error) {
+	return n.propose(EntryCommand, data)
+}
+
+func (n *Node) propose(typ, data string) (any, error) {
+	n.mu.Lock()
+	if err := n.leaderErr(); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Type: typ, Data: data}
+	w := &waiter{term: n.term, result: make(chan any, 1)}
+	n.waiters[e.Index] = w
+	n.appendEntries(e)
+	n.triggerPeers()
+	n.advanceCommit()
+	n.mu.Unlock()
+
+	select {
+	case result := <-w.result:
+		if err, ok := result.(error); ok {
+			return nil, err
+		}
+		return result, nil
+	case <-time.After(proposeTimeout):
+		n.mu.Lock()
+		delete(n.waiters, e.Index)
+		n.mu.Unlock()
+		return nil, ErrTimeout
+	}
+}
+
+// ReadIndex returns once the state machine reflects every entry committed
+// when it was called, after a majority confirmed that this node still
+// leads: a read served afterwards is linearizable.
+func (n *Node) ReadIndex() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	deadline := time.Now().Add(proposeTimeout)
+	wait := func(done func() bool) error {
+		for !done() {
+			if err := n.leaderErr(); err != nil {
+				return err
+			}
+			if time.Now().After(deadline) {
+				return ErrTimeout
+			}
+			n.cond.Wait()
+		}
+		return nil
+	}
+
+	if err := n.leaderErr(); err != nil {
+		return err
+	}
+	term := n.term
+	// Until the noop entry of its term commits, a new leader doesn't know
+	// everything that was committed.
+	if err := wait(func() bool { t, _ := n.termAt(n.commitIndex); return t == term }); err != nil {
+		return err
+	}
+	readIndex := n.commitIndex
+	n.readRound++
+	round := n.readRound
+	n.triggerPeers()
+	err := wait(func() bool {
+		if n.term != term {
+			return true
+		}
+		acks := 0
+		if n.isMember(n.cfg.ID) {
+			acks++
+		}
+		for _, p := range n.peers {
+			if p.ackedRound >= round {
+				acks++
+			}
+		}
+		return acks >= n.quorum()
+	})
+	if err != nil {
+		return err
+	}
+	if n.term != term {
+		return ErrNoLeader
+	}
+	return wait(func() bool { return n.lastApplied >= readIndex })
+}
+
+// Bootstrap starts a new cluster with this node as its only member.
+func (n *Node) Bootstrap() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.members) > 0 || n.lastIndex() > 0 {
+		return errors.New("ERR This node is already part of a raft cluster")
+	}
+	n.appendEntries(Entry{Index: 1, Term: n.term, Type: EntryConfig, Data: n.cfg.ID})
+	n.startElection()
+	return nil
+}
+
+// AddNode adds a member to the cluster. Adding a member again is a no-op.
+func (n *Node) AddNode(addr string) error {
+	return n.changeMembers(func(members []string) ([]string, error) {
+		if slices.Contains(members, addr) {
+			return nil, nil
+		}
+		return append(slices.Clone(members), addr), nil
+	})
+}
+
+// RemoveNode removes a member from the cluster.
+func (n *Node) RemoveNode(addr string) error {
+	return n.changeMembers(func(members []string) ([]string, error) {
+		if !slices.Contains(members, addr) {
+			return nil, ErrUnknownNode
+		}
+		return slices.DeleteFunc(slices.Clone(members), func(m string) bool { return m == addr }), nil
+	})
+}
+
+// changeMembers proposes the configuration change returns, nil meaning no
+// change. Only one change is in progress at a time: each configuration
+// overlaps with the previous in a majority.
+func (n *Node) changeMembers(change func(members []string) ([]string, error)) error {
+	n.mu.Lock()
+	if err := n.leaderErr(); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	if n.configIndex > n.commitIndex {
+		n.mu.Unlock()
+		return ErrConfigPending
+	}
+	members, err := change(n.members)
+	n.mu.Unlock()
+	if members == nil {
+		return err
+	}
+	_, err = n.propose(EntryConfig, strings.Join(members, " "))
+	return err
+}
+
+// Join asks the cluster that addr is part of to add this node.
+func (n *Node) Join(addr string) error {
+	n.mu.Lock()
+	if len(n.members) > 0 || n.lastIndex() > 0 {
+		n.mu.Unlock()
+		return errors.New("ERR This node is already part of a raft cluster")
+	}
+	n.mu.Unlock()
+	// Followers point to their leader.
+	for range 5 {
+		c := &client{addr: addr, timeout: proposeTimeout}
+		reply, err := c.call("RAFT", "ADDNODE", n.cfg.ID)
+		c.close()
+		if err != nil {
+			return fmt.Errorf("ERR Can't join the cluster through %s: %v", addr, err)
+		}
+		if reply.Type != "error" {
+			return nil
+		}
+		leader, ok := strings.CutPrefix(reply.Str, "NOTLEADER ")
+		if !ok {
+			return errors.New(reply.Str)
+		}
+		addr = leader
+	}
+	return errors.New("ERR Can't find the leader of the raft cluster")
+}
+
+// Status describes a node, for INFO.
+type Status struct {
+	ID            string
+	State         string
+	Term          uint64
+	Leader        string
+	Members       []string
+	CommitIndex   uint64
+	LastApplied   uint64
+	LastIndex     uint64
+	SnapshotIndex uint64
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.cfg.ID,
+		State:         n.state,
+		Term:          n.term,
+		Leader:        n.leader,
+		Members:       slices.Clone(n.members),
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		LastIndex:     n.lastIndex(),
+		SnapshotIndex: n.snapshotIndex,
+	}
+}
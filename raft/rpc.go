@@ -0,0 +1,349 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/resp"
+)
+
+// The RPCs between nodes are RAFT commands sent to the client port:
+//
+//	RAFT REQUESTVOTE <term> <candidate> <last-index> <last-term>
+//	  -> [term, granted]
+//	RAFT APPENDENTRIES <term> <leader> <prev-index> <prev-term> <commit> [<index> <term> <type> <data>]...
+//	  -> [term, success, last matching index or, on failure, where to retry after]
+//	RAFT INSTALLSNAPSHOT <term> <leader> <index> <snapshot-term> <rdb>
+//	  -> [term, index]
+//
+// A node replies with its term, which makes a stale leader or candidate
+// step down.
+
+// client sends RPCs to a node over one connection, one at a time.
+type client struct {
+	addr    string
+	timeout time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *resp.Resp
+}
+
+// call sends a command and returns its reply, which may be an error reply.
+func (c *client) call(args ...string) (resp.Value, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+		if err != nil {
+			return resp.Value{}, err
+		}
+		c.conn, c.reader = conn, resp.NewResp(conn)
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	err := resp.Respond(c.conn, resp.Command(args...))
+	var reply resp.Value
+	if err == nil {
+		reply, err = c.reader.Read()
+	}
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return resp.Value{}, err
+	}
+	return reply, nil
+}
+
+func (c *client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// rpc sends a RAFT command and returns the integers it replied.
+func (c *client) rpc(n int, args ...string) ([]uint64, error) {
+	reply, err := c.call(append([]string{"RAFT"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type == "error" {
+		return nil, errors.New(reply.Str)
+	}
+	if reply.Type != "array" || len(reply.Array) != n {
+		return nil, fmt.Errorf("invalid reply to RAFT %s from %s", args[0], c.addr)
+	}
+	values := make([]uint64, n)
+	for i, v := range reply.Array {
+		if v.Type != "integer" || v.Num < 0 {
+			return nil, fmt.Errorf("invalid reply to RAFT %s from %s", args[0], c.addr)
+		}
+		values[i] = uint64(v.Num)
+	}
+	return values, nil
+}
+
+func (c *client) requestVote(term uint64, candidate string, lastIndex, lastTerm uint64) (uint64, bool, error) {
+	r, err := c.rpc(2, "REQUESTVOTE", formatUint(term), candidate, formatUint(lastIndex), formatUint(lastTerm))
+	if err != nil {
+		return 0, false, err
+	}
+	return r[0], r[1] == 1, nil
+}
+
+func (c *client) appendEntries(term uint64, leader string, prevIndex, prevTerm, commit uint64, entries []Entry) (uint64, bool, uint64, error) {
+	args := []string{"APPENDENTRIES", formatUint(term), leader, formatUint(prevIndex), formatUint(prevTerm), formatUint(commit)}
+	for _, e := range entries {
+		args = append(args, formatUint(e.Index), formatUint(e.Term), e.Type, e.Data)
+	}
+	r, err := c.rpc(3, args...)
+	if err != nil {
+		return 0, false, 0, err
+	}
+	return r[0], r[1] == 1, r[2], nil
+}
+
+func (c *client) installSnapshot(term uint64, leader string, index, snapshotTerm uint64, data []byte) (uint64, uint64, error) {
+	r, err := c.rpc(2, "INSTALLSNAPSHOT", formatUint(term), leader, formatUint(index), formatUint(snapshotTerm), string(data))
+	if err != nil {
+		return 0, 0, err
+	}
+	return r[0], r[1], nil
+}
+
+func formatUint(i uint64) string {
+	return strconv.FormatUint(i, 10)
+}
+
+func integers(values ...uint64) resp.Value {
+	array := make([]resp.Value, len(values))
+	for i, v := range values {
+		array[i] = resp.Value{Type: "integer", Num: int(v)}
+	}
+	return resp.Value{Type: "array", Array: array}
+}
+
+func boolInt(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// HandleRPC serves the RPC in args, which follow RAFT.
+func (n *Node) HandleRPC(args []string) resp.Value {
+	var nums []uint64
+	parse := func(indexes ...int) bool {
+		nums = nums[:0]
+		for _, i := range indexes {
+			v, err := strconv.ParseUint(args[i], 10, 64)
+			if err != nil {
+				return false
+			}
+			nums = append(nums, v)
+		}
+		return true
+	}
+	invalid := resp.Value{Type: "error", Str: "ERR Invalid RAFT " + args[0] + " arguments"}
+
+	switch args[0] {
+	case "REQUESTVOTE":
+		if len(args) != 5 || !parse(1, 3, 4) {
+			return invalid
+		}
+		return n.requestVote(nums[0], args[2], nums[1], nums[2])
+	case "APPENDENTRIES":
+		if len(args) < 6 || (len(args)-6)%4 != 0 || !parse(1, 3, 4, 5) {
+			return invalid
+		}
+		term, prevIndex, prevTerm, commit := nums[0], nums[1], nums[2], nums[3]
+		var entries []Entry
+		for i := 6; i < len(args); i += 4 {
+			if !parse(i, i+1) {
+				return invalid
+			}
+			entries = append(entries, Entry{Index: nums[0], Term: nums[1], Type: args[i+2], Data: args[i+3]})
+		}
+		return n.appendEntriesRPC(term, args[2], prevIndex, prevTerm, commit, entries)
+	case "INSTALLSNAPSHOT":
+		if len(args) != 6 || !parse(1, 3, 4) {
+			return invalid
+		}
+		return n.installSnapshot(nums[0], args[2], nums[1], nums[2], args[5])
+	}
+	return resp.Value{Type: "error", Str: "ERR Unknown RAFT subcommand '" + args[0] + "'"}
+}
+
+// requestVote grants the vote of this node to a candidate whose log is at
+// least as recent as its own, once per term.
+func (n *Node) requestVote(term uint64, candidate string, lastIndex, lastTerm uint64) resp.Value {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// While a leader is heard from, elections are ignored: a member that
+	// was removed, or cut off for a while, would otherwise depose it.
+	if term > n.term && n.leader != "" && (n.state == Leader || time.Since(n.lastContact) < n.cfg.ElectionTimeout) {
+		return integers(n.term, 0)
+	}
+	if term < n.term {
+		return integers(n.term, 0)
+	}
+	if term > n.term {
+		n.becomeFollower(term, "")
+	}
+	upToDate := lastTerm > n.lastTerm() || (lastTerm == n.lastTerm() && lastIndex >= n.lastIndex())
+	if !upToDate || (n.votedFor != "" && n.votedFor != candidate) {
+		return integers(n.term, 0)
+	}
+	if n.votedFor == "" {
+		n.votedFor = candidate
+		n.saveState()
+	}
+	n.resetElectionDeadline()
+	return integers(n.term, 1)
+}
+
+// appendEntriesRPC stores the entries of the leader after the entry at
+// prevIndex, once it checked that its log holds that entry, replacing those
+// that conflict.
+func (n *Node) appendEntriesRPC(term uint64, leader string, prevIndex, prevTerm, commit uint64, entries []Entry) resp.Value {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if term < n.term {
+		return integers(n.term, 0, 0)
+	}
+	n.becomeFollower(term, leader)
+	n.lastContact = time.Now()
+	n.resetElectionDeadline()
+
+	// Entries already in the snapshot are committed, so they match.
+	for len(entries) > 0 && entries[0].Index <= n.snapshotIndex {
+		entries = entries[1:]
+	}
+	if prevIndex < n.snapshotIndex {
+		prevIndex, prevTerm = n.snapshotIndex, n.snapshotTerm
+		if len(entries) > 0 {
+			prevIndex = entries[0].Index - 1
+			prevTerm, _ = n.termAt(prevIndex)
+		}
+	}
+	if prevIndex > n.lastIndex() {
+		return integers(n.term, 0, n.lastIndex())
+	}
+	if t, _ := n.termAt(prevIndex); t != prevTerm {
+		// Skip the entries of the conflicting term at once.
+		hint := prevIndex - 1
+		for hint > n.commitIndex && hint > n.snapshotIndex {
+			if ht, _ := n.termAt(hint); ht != t {
+				break
+			}
+			hint--
+		}
+		return integers(n.term, 0, hint)
+	}
+
+	for i, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if t, _ := n.termAt(e.Index); t == e.Term {
+				continue
+			}
+			n.truncateFrom(e.Index)
+		}
+		n.appendEntries(entries[i:]...)
+		break
+	}
+	match := prevIndex + uint64(len(entries))
+	if c := min(commit, match); c > n.commitIndex {
+		n.commitIndex = c
+		n.cond.Broadcast()
+	}
+	return integers(n.term, 1, match)
+}
+
+// installSnapshot replaces the state of a follower that is too far behind
+// with the snapshot of the leader, and keeps the entries that follow it.
+func (n *Node) installSnapshot(term uint64, leader string, index, snapshotTerm uint64, data string) resp.Value {
+	n.mu.Lock()
+	if term < n.term {
+		defer n.mu.Unlock()
+		return integers(n.term, 0)
+	}
+	n.becomeFollower(term, leader)
+	n.lastContact = time.Now()
+	n.resetElectionDeadline()
+	n.mu.Unlock()
+
+	tmp := filepath.Join(n.cfg.Dir, tmpSnapshotName)
+	if err := writeFileSync(tmp, []byte(data)); err != nil {
+		return resp.Value{Type: "error", Str: "ERR Can't write the snapshot: " + err.Error()}
+	}
+	defer os.Remove(tmp)
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if index <= n.commitIndex {
+		return integers(n.term, n.commitIndex)
+	}
+	fmt.Printf("Raft: installing the snapshot of %s at entry %d\n", leader, index)
+	aux, err := n.sm.Restore(tmp)
+	if err == nil && aux[auxIndex] != formatUint(index) {
+		err = errors.New("the snapshot doesn't hold the announced entry")
+	}
+	if err != nil {
+		// The state machine may be half loaded: only a restart, from the
+		// previous snapshot and the log, recovers from this.
+		fmt.Println("Fatal: can't install the raft snapshot:", err)
+		os.Exit(1)
+	}
+	if err := os.Rename(tmp, n.snapshotPath()); err != nil {
+		n.fatal(err)
+	}
+	if err := syncDir(n.cfg.Dir); err != nil {
+		n.fatal(err)
+	}
+
+	if t, ok := n.termAt(index); ok && t == snapshotTerm {
+		n.entries = n.entries[index-n.snapshotIndex:]
+	} else {
+		n.entries = nil
+	}
+	n.setSnapshot(aux)
+	if err := n.log.rewrite(n.term, n.votedFor, n.entries); err != nil {
+		n.fatal(err)
+	}
+	n.updateMembers()
+	n.commitIndex, n.lastApplied = index, index
+	for i, w := range n.waiters {
+		if i <= index {
+			delete(n.waiters, i)
+			w.result <- ErrEntryLost
+		}
+	}
+	n.cond.Broadcast()
+	return integers(n.term, index)
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,188 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/saurabhdhingra/go-redis/resp"
+)
+
+// logFile is the append-only file holding the durable state of a node
+// besides its snapshot: one RESP array per record,
+//
+//	STATE <term> <voted-for>
+//	ENTRY <index> <term> <type> <data>
+//	TRUNCATE <index>
+//
+// where the last STATE wins and TRUNCATE removes the entries from index on.
+// Every append is fsynced before the node acts on it. Compaction rewrites
+// the file with the current state and the entries after the snapshot.
+type logFile struct {
+	path string
+	f    *os.File
+}
+
+// logState is what a log file holds.
+type logState struct {
+	term     uint64
+	votedFor string
+	entries  []Entry
+}
+
+// openLog reads the log file at path, creating it when missing. A record
+// cut short by a crash is removed, as it was never acknowledged.
+func openLog(path string) (*logFile, *logState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	st := &logState{}
+	good := 0
+	reader := resp.NewResp(bytes.NewReader(data))
+	for good < len(data) {
+		v, err := reader.Read()
+		if err != nil {
+			fmt.Printf("Raft log %s ends with an incomplete record, truncating it at %d bytes\n", path, good)
+			break
+		}
+		if err := st.apply(v); err != nil {
+			return nil, nil, fmt.Errorf("raft log %s: %w", path, err)
+		}
+		good += len(resp.Marshal(v))
+	}
+	if good < len(data) {
+		if err := os.Truncate(path, int64(good)); err != nil {
+			return nil, nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &logFile{path: path, f: f}, st, nil
+}
+
+func (st *logState) apply(v resp.Value) error {
+	if v.Type != "array" || len(v.Array) == 0 {
+		return errors.New("invalid record")
+	}
+	fields := make([]string, len(v.Array))
+	for i, f := range v.Array {
+		fields[i] = f.Bulk
+	}
+	switch {
+	case fields[0] == "STATE" && len(fields) == 3:
+		term, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		st.term, st.votedFor = term, fields[2]
+	case fields[0] == "ENTRY" && len(fields) == 5:
+		index, err1 := strconv.ParseUint(fields[1], 10, 64)
+		term, err2 := strconv.ParseUint(fields[2], 10, 64)
+		if err := errors.Join(err1, err2); err != nil {
+			return err
+		}
+		if n := len(st.entries); n > 0 && st.entries[n-1].Index+1 != index {
+			return fmt.Errorf("entry %d follows entry %d", index, st.entries[n-1].Index)
+		}
+		st.entries = append(st.entries, Entry{Index: index, Term: term, Type: fields[3], Data: fields[4]})
+	case fields[0] == "TRUNCATE" && len(fields) == 2:
+		index, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		for len(st.entries) > 0 && st.entries[len(st.entries)-1].Index >= index {
+			st.entries = st.entries[:len(st.entries)-1]
+		}
+	default:
+		return fmt.Errorf("invalid record %q", fields[0])
+	}
+	return nil
+}
+
+func stateRecord(term uint64, votedFor string) []string {
+	return []string{"STATE", strconv.FormatUint(term, 10), votedFor}
+}
+
+func entryRecord(e Entry) []string {
+	return []string{"ENTRY", strconv.FormatUint(e.Index, 10), strconv.FormatUint(e.Term, 10), e.Type, e.Data}
+}
+
+func truncateRecord(index uint64) []string {
+	return []string{"TRUNCATE", strconv.FormatUint(index, 10)}
+}
+
+func encodeRecords(w io.Writer, records [][]string) error {
+	for _, r := range records {
+		if err := resp.Respond(w, resp.Command(r...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append durably adds records to the log.
+func (l *logFile) append(records ...[]string) error {
+	var buf bytes.Buffer
+	encodeRecords(&buf, records)
+	if _, err := l.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// rewrite atomically replaces the log with the given state.
+func (l *logFile) rewrite(term uint64, votedFor string, entries []Entry) error {
+	records := [][]string{stateRecord(term, votedFor)}
+	for _, e := range entries {
+		records = append(records, entryRecord(e))
+	}
+	tmp := filepath.Join(filepath.Dir(l.path), "temp-"+filepath.Base(l.path))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := encodeRecords(f, records); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(l.path)); err != nil {
+		return err
+	}
+	nf, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.f.Close()
+	l.f = nf
+	return nil
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,179 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// raftStatus returns the fields of INFO raft of p, nil if it can't be
+// reached.
+func raftStatus(p *process) map[string]string {
+	reply, err := call(p.addr(), "INFO", "raft")
+	if err != nil || reply.Type != "bulk" {
+		return nil
+	}
+	status := make(map[string]string)
+	for _, line := range strings.Split(reply.Bulk, "\r\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			status[key] = value
+		}
+	}
+	return status
+}
+
+// waitLeader waits until one of nodes leads with every other node of nodes
+// following it, and returns it.
+func waitLeader(t *testing.T, nodes []*process) *process {
+	t.Helper()
+	var leader *process
+	waitFor(t, 30*time.Second, "a raft leader", func() bool {
+		leader = nil
+		for _, p := range nodes {
+			if raftStatus(p)["raft_state"] == "leader" {
+				leader = p
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, p := range nodes {
+			if raftStatus(p)["raft_leader"] != leader.addr() {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+// without returns nodes without p.
+func without(nodes []*process, p *process) []*process {
+	var others []*process
+	for _, n := range nodes {
+		if n != p {
+			others = append(others, n)
+		}
+	}
+	return others
+}
+
+// signal sends sig to p, to pause or resume it.
+func (p *process) signal(sig syscall.Signal) {
+	p.t.Helper()
+	if err := p.cmd.Process.Signal(sig); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func TestRaft(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs several processes for a while")
+	}
+	var nodes []*process
+	for range 3 {
+		nodes = append(nodes, startProcess(t, freePort(t), "-save", "",
+			"-raft-enabled", "yes", "-raft-snapshot-entries", "50"))
+	}
+	if reply := mustCall(t, nodes[0].addr(), "RAFT", "INIT"); reply.Str != "OK" {
+		t.Fatalf("RAFT INIT: %+v", reply)
+	}
+	waitLeader(t, nodes[:1])
+	for i, p := range nodes[1:] {
+		// A node joins through any member, which points it to the leader.
+		if reply := mustCall(t, p.addr(), "RAFT", "JOIN", nodes[i].addr()); reply.Str != "OK" {
+			t.Fatalf("RAFT JOIN on %s: %+v", p.port, reply)
+		}
+	}
+	leader := waitLeader(t, nodes)
+	waitFor(t, 10*time.Second, "every node to know the 3 members", func() bool {
+		for _, p := range nodes {
+			if strings.Count(raftStatus(p)["raft_members"], ",") != 2 {
+				return false
+			}
+		}
+		return true
+	})
+
+	if reply := mustCall(t, leader.addr(), "SET", "k", "v1"); reply.Str != "OK" {
+		t.Fatalf("SET on the leader: %+v", reply)
+	}
+	if reply := mustCall(t, leader.addr(), "GET", "k"); reply.Bulk != "v1" {
+		t.Fatalf("GET on the leader: %+v", reply)
+	}
+	follower := without(nodes, leader)[0]
+	if reply := mustCall(t, follower.addr(), "GET", "k"); reply.Type != "error" || reply.Str != "NOTLEADER "+leader.addr() {
+		t.Fatalf("GET on a follower: %+v", reply)
+	}
+
+	// Linearizable reads: a leader cut off while the others elect a new one
+	// and take a write must not serve its stale value once it is back.
+	old := leader
+	old.signal(syscall.SIGSTOP)
+	leader = waitLeader(t, without(nodes, old))
+	if reply := mustCall(t, leader.addr(), "SET", "k", "v2"); reply.Str != "OK" {
+		t.Fatalf("SET on the new leader: %+v", reply)
+	}
+	old.signal(syscall.SIGCONT)
+	if reply := mustCall(t, old.addr(), "GET", "k"); reply.Type != "error" && reply.Bulk != "v2" {
+		t.Fatalf("GET on the deposed leader: %+v", reply)
+	}
+	if reply := mustCall(t, leader.addr(), "GET", "k"); reply.Bulk != "v2" {
+		t.Fatalf("GET on the new leader: %+v", reply)
+	}
+	leader = waitLeader(t, nodes)
+
+	// A follower that misses more entries than the leader keeps in its log
+	// catches up from its snapshot.
+	follower = without(nodes, leader)[0]
+	follower.kill()
+	for i := range 200 {
+		if reply := mustCall(t, leader.addr(), "SET", "key:"+strconv.Itoa(i), strconv.Itoa(i)); reply.Str != "OK" {
+			t.Fatalf("SET with a follower down: %+v", reply)
+		}
+	}
+	if status := raftStatus(leader); status["raft_snapshot_index"] == "0" {
+		t.Fatalf("the leader took no snapshot: %v", status)
+	}
+	follower.start()
+	commit, _ := strconv.Atoi(raftStatus(leader)["raft_commit_index"])
+	waitFor(t, 30*time.Second, "the restarted follower to catch up", func() bool {
+		applied, err := strconv.Atoi(raftStatus(follower)["raft_last_applied"])
+		return err == nil && applied >= commit
+	})
+	out, _ := os.ReadFile(filepath.Join(follower.dir, "output.log"))
+	if !strings.Contains(string(out), "Raft: installing the snapshot of "+leader.addr()) {
+		t.Fatal("the restarted follower didn't install the snapshot of the leader")
+	}
+
+	// Leader loss: the two nodes left elect a leader that holds every
+	// acknowledged write, and take new ones.
+	old = leader
+	old.kill()
+	leader = waitLeader(t, without(nodes, old))
+	if reply := mustCall(t, leader.addr(), "GET", "k"); reply.Bulk != "v2" {
+		t.Fatalf("GET k after losing the leader: %+v", reply)
+	}
+	for i := range 200 {
+		key := "key:" + strconv.Itoa(i)
+		if reply := mustCall(t, leader.addr(), "GET", key); reply.Bulk != strconv.Itoa(i) {
+			t.Fatalf("GET %s after losing the leader: %+v", key, reply)
+		}
+	}
+	if reply := mustCall(t, leader.addr(), "SET", "k", "v3"); reply.Str != "OK" {
+		t.Fatalf("SET after losing the leader: %+v", reply)
+	}
+
+	// The old leader rejoins as a follower.
+	old.start()
+	leader = waitLeader(t, nodes)
+	if reply := mustCall(t, leader.addr(), "GET", "k"); reply.Bulk != "v3" {
+		t.Fatalf("GET once the old leader is back: %+v", reply)
+	}
+}
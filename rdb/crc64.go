@@ -0,0 +1,32 @@
+package rdb
+
+// Redis checksums RDB files and DUMP payloads with the Jones CRC64 polynomial
+// (reflected, no initial or final xor), which hash/crc64 cannot express since
+// it always inverts the register.
+const crc64JonesReflected = 0x95ac9329ac4bc9b5
+
+var crc64Table = makeCRC64Table()
+
+func makeCRC64Table() *[256]uint64 {
+	t := new([256]uint64)
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = (crc >> 1) ^ crc64JonesReflected
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return t
+}
+
+// CRC64 returns the result of adding the bytes in p to crc.
+func CRC64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64Table[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
@@ -0,0 +1,65 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+var (
+	// ErrDumpPayload is returned for payloads with a newer version or a bad checksum.
+	ErrDumpPayload = errors.New("DUMP payload version or checksum are wrong")
+	// ErrBadDataFormat is returned for payloads whose value cannot be decoded.
+	ErrBadDataFormat = errors.New("Bad data format")
+)
+
+// Dump serializes a single value the way DUMP does: the type byte and the RDB
+// encoding of the value, followed by a two byte RDB version and the CRC64 of
+// everything before the checksum, both little endian. The expiration is not
+// part of the payload.
+func Dump(d store.Data) ([]byte, error) {
+	var buf bytes.Buffer
+	e := &encoder{w: bufio.NewWriter(&buf)}
+	typ, err := valueType(d)
+	if err != nil {
+		return nil, err
+	}
+	e.writeByte(typ)
+	if err := e.writeValue(d); err != nil {
+		return nil, err
+	}
+	if err := e.w.Flush(); err != nil {
+		return nil, err
+	}
+	payload := binary.LittleEndian.AppendUint16(buf.Bytes(), Version)
+	return binary.LittleEndian.AppendUint64(payload, CRC64(0, payload)), nil
+}
+
+// Restore decodes a payload produced by Dump, by this server or by Redis.
+func Restore(payload []byte) (store.Data, error) {
+	if len(payload) < 10 {
+		return store.Data{}, ErrDumpPayload
+	}
+	footer := payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) > Version {
+		return store.Data{}, ErrDumpPayload
+	}
+	if binary.LittleEndian.Uint64(footer[2:]) != CRC64(0, payload[:len(payload)-8]) {
+		return store.Data{}, ErrDumpPayload
+	}
+
+	r := bytes.NewReader(payload[:len(payload)-10])
+	d := newDecoder(r)
+	typ, err := d.readByte()
+	if err != nil {
+		return store.Data{}, ErrBadDataFormat
+	}
+	data, err := d.readValue(typ)
+	if err != nil || d.r.Buffered() > 0 || r.Len() > 0 {
+		return store.Data{}, ErrBadDataFormat
+	}
+	return data, nil
+}
@@ -0,0 +1,201 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// Listpacks are the compact serialized lists Redis 7 uses inside RDB files
+// for quicklist nodes and stream entries.
+const (
+	listpackHeaderSize = 6
+	listpackEOF        = 0xFF
+)
+
+var errListpackCorrupt = errors.New("corrupt listpack")
+
+type listpackWriter struct {
+	buf   []byte
+	count int
+}
+
+func newListpackWriter() *listpackWriter {
+	return &listpackWriter{buf: make([]byte, listpackHeaderSize, 64)}
+}
+
+// appendString adds s, using an integer encoding when s is a canonical integer.
+func (lp *listpackWriter) appendString(s string) {
+	if n, ok := canonicalInt(s); ok {
+		lp.appendInt(n)
+		return
+	}
+	start := len(lp.buf)
+	l := len(s)
+	switch {
+	case l < 64:
+		lp.buf = append(lp.buf, 0x80|byte(l))
+	case l < 4096:
+		lp.buf = append(lp.buf, 0xE0|byte(l>>8), byte(l))
+	default:
+		lp.buf = append(lp.buf, 0xF0)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(l))
+	}
+	lp.buf = append(lp.buf, s...)
+	lp.appendBacklen(len(lp.buf) - start)
+}
+
+func (lp *listpackWriter) appendInt(n int64) {
+	start := len(lp.buf)
+	switch {
+	case n >= 0 && n <= 127:
+		lp.buf = append(lp.buf, byte(n))
+	case n >= -4096 && n <= 4095:
+		u := uint16(n) & 0x1FFF
+		lp.buf = append(lp.buf, 0xC0|byte(u>>8), byte(u))
+	case n >= -32768 && n <= 32767:
+		lp.buf = append(lp.buf, 0xF1)
+		lp.buf = binary.LittleEndian.AppendUint16(lp.buf, uint16(n))
+	case n >= -8388608 && n <= 8388607:
+		u := uint32(n)
+		lp.buf = append(lp.buf, 0xF2, byte(u), byte(u>>8), byte(u>>16))
+	case n >= -2147483648 && n <= 2147483647:
+		lp.buf = append(lp.buf, 0xF3)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(n))
+	default:
+		lp.buf = append(lp.buf, 0xF4)
+		lp.buf = binary.LittleEndian.AppendUint64(lp.buf, uint64(n))
+	}
+	lp.appendBacklen(len(lp.buf) - start)
+}
+
+// appendBacklen writes the entry length used for backward traversal: most
+// significant 7-bit group first, every byte but the first flagged with 0x80.
+func (lp *listpackWriter) appendBacklen(l int) {
+	n := backlenSize(l)
+	for i := 0; i < n; i++ {
+		b := byte(l>>(7*(n-1-i))) & 127
+		if i > 0 {
+			b |= 128
+		}
+		lp.buf = append(lp.buf, b)
+	}
+	lp.count++
+}
+
+func (lp *listpackWriter) bytes() []byte {
+	lp.buf = append(lp.buf, listpackEOF)
+	binary.LittleEndian.PutUint32(lp.buf[0:4], uint32(len(lp.buf)))
+	count := lp.count
+	if count > 65535 {
+		count = 65535
+	}
+	binary.LittleEndian.PutUint16(lp.buf[4:6], uint16(count))
+	return lp.buf
+}
+
+// parseListpack returns every entry of lp as a string.
+func parseListpack(lp []byte) ([]string, error) {
+	if len(lp) < listpackHeaderSize+1 || int(binary.LittleEndian.Uint32(lp[0:4])) != len(lp) {
+		return nil, errListpackCorrupt
+	}
+	entries := []string{}
+	p := listpackHeaderSize
+	for {
+		if p >= len(lp) {
+			return nil, errListpackCorrupt
+		}
+		b := lp[p]
+		if b == listpackEOF {
+			break
+		}
+		var entry string
+		var size int
+		switch {
+		case b&0x80 == 0:
+			entry, size = strconv.Itoa(int(b)), 1
+		case b&0xC0 == 0x80:
+			l := int(b & 0x3F)
+			size = 1 + l
+			if p+size > len(lp) {
+				return nil, errListpackCorrupt
+			}
+			entry = string(lp[p+1 : p+size])
+		case b&0xE0 == 0xC0:
+			if p+2 > len(lp) {
+				return nil, errListpackCorrupt
+			}
+			v := int64(b&0x1F)<<8 | int64(lp[p+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			entry, size = strconv.FormatInt(v, 10), 2
+		case b&0xF0 == 0xE0:
+			if p+2 > len(lp) {
+				return nil, errListpackCorrupt
+			}
+			l := int(b&0x0F)<<8 | int(lp[p+1])
+			size = 2 + l
+			if p+size > len(lp) {
+				return nil, errListpackCorrupt
+			}
+			entry = string(lp[p+2 : p+size])
+		case b == 0xF0:
+			if p+5 > len(lp) {
+				return nil, errListpackCorrupt
+			}
+			l := int(binary.LittleEndian.Uint32(lp[p+1 : p+5]))
+			size = 5 + l
+			if l < 0 || p+size > len(lp) {
+				return nil, errListpackCorrupt
+			}
+			entry = string(lp[p+5 : p+size])
+		case b >= 0xF1 && b <= 0xF4:
+			width := []int{2, 3, 4, 8}[b-0xF1]
+			size = 1 + width
+			if p+size > len(lp) {
+				return nil, errListpackCorrupt
+			}
+			var u uint64
+			for i := width - 1; i >= 0; i-- {
+				u = u<<8 | uint64(lp[p+1+i])
+			}
+			// Sign-extend from the encoded width.
+			shift := 64 - 8*width
+			entry = strconv.FormatInt(int64(u<<shift)>>shift, 10)
+		default:
+			return nil, errListpackCorrupt
+		}
+		p += size + backlenSize(size)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func backlenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// canonicalInt reports whether s is the decimal form of an int64 that would
+// round-trip exactly, the rule Redis uses before storing strings as integers.
+func canonicalInt(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != s {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,149 @@
+package rdb
+
+import "errors"
+
+// LZF as used by Redis for compressed strings (liblzf, "very fast" mode).
+const (
+	lzfHashLog = 14
+	lzfMaxLit  = 1 << 5
+	lzfMaxOff  = 1 << 13
+	lzfMaxRef  = (1 << 8) + (1 << 3)
+)
+
+var errLZFCorrupt = errors.New("corrupt LZF data")
+
+// lzfCompress compresses in and returns nil if the result would not be
+// shorter than maxLen bytes.
+func lzfCompress(in []byte, maxLen int) []byte {
+	if len(in) < 4 || maxLen <= 0 {
+		return nil
+	}
+	var htab [1 << lzfHashLog]int
+	out := make([]byte, 0, maxLen)
+	hash := func(p int) int {
+		v := uint32(in[p])<<16 | uint32(in[p+1])<<8 | uint32(in[p+2])
+		return int(((v >> (24 - lzfHashLog)) - v*5) & ((1 << lzfHashLog) - 1))
+	}
+
+	lit := 0
+	litPos := 0
+	out = append(out, 0) // placeholder for the first literal run length
+	ip := 0
+	for ip < len(in)-2 {
+		h := hash(ip)
+		ref := htab[h] - 1
+		htab[h] = ip + 1
+		off := ip - ref - 1
+		if ref >= 0 && off < lzfMaxOff && in[ref] == in[ip] && in[ref+1] == in[ip+1] && in[ref+2] == in[ip+2] {
+			maxRef := len(in) - ip
+			if maxRef > lzfMaxRef {
+				maxRef = lzfMaxRef
+			}
+			l := 3
+			for l < maxRef && in[ref+l] == in[ip+l] {
+				l++
+			}
+			// Close the pending literal run (or drop its empty placeholder).
+			if lit > 0 {
+				out[litPos] = byte(lit - 1)
+			} else {
+				out = out[:len(out)-1]
+			}
+			l -= 2
+			if l < 7 {
+				out = append(out, byte(off>>8)+byte(l<<5))
+			} else {
+				out = append(out, byte(off>>8)+(7<<5), byte(l-7))
+			}
+			out = append(out, byte(off))
+			if len(out) >= maxLen {
+				return nil
+			}
+			litPos = len(out)
+			out = append(out, 0)
+			lit = 0
+			end := ip + l + 2
+			for ip++; ip < end; ip++ {
+				if ip < len(in)-2 {
+					htab[hash(ip)] = ip + 1
+				}
+			}
+			continue
+		}
+		out = append(out, in[ip])
+		ip++
+		lit++
+		if lit == lzfMaxLit {
+			out[litPos] = byte(lit - 1)
+			litPos = len(out)
+			out = append(out, 0)
+			lit = 0
+		}
+		if len(out) >= maxLen {
+			return nil
+		}
+	}
+	for ip < len(in) {
+		out = append(out, in[ip])
+		ip++
+		lit++
+		if lit == lzfMaxLit {
+			out[litPos] = byte(lit - 1)
+			litPos = len(out)
+			out = append(out, 0)
+			lit = 0
+		}
+	}
+	if lit > 0 {
+		out[litPos] = byte(lit - 1)
+	} else {
+		out = out[:len(out)-1]
+	}
+	if len(out) >= maxLen {
+		return nil
+	}
+	return out
+}
+
+// lzfDecompress expands in, which must decode to exactly outLen bytes.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < lzfMaxLit {
+			n := ctrl + 1
+			if ip+n > len(in) || len(out)+n > outLen {
+				return nil, errLZFCorrupt
+			}
+			out = append(out, in[ip:ip+n]...)
+			ip += n
+			continue
+		}
+		l := ctrl >> 5
+		if l == 7 {
+			if ip >= len(in) {
+				return nil, errLZFCorrupt
+			}
+			l += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, errLZFCorrupt
+		}
+		ref := len(out) - ((ctrl & 0x1f) << 8) - int(in[ip]) - 1
+		ip++
+		l += 2
+		if ref < 0 || len(out)+l > outLen {
+			return nil, errLZFCorrupt
+		}
+		// The reference may overlap the bytes being written, so copy one at a time.
+		for i := 0; i < l; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != outLen {
+		return nil, errLZFCorrupt
+	}
+	return out, nil
+}
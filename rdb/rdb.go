@@ -0,0 +1,868 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// Version is the RDB format version written by Save.
+const Version = 11
+
+// Opcodes and value types, numbered as in Redis' rdb.h.
+const (
+	opSlotInfo     = 0xF4
+	opFunction2    = 0xF5
+	opModuleAux    = 0xF7
+	opIdle         = 0xF8
+	opFreq         = 0xF9
+	opAux          = 0xFA
+	opResizeDB     = 0xFB
+	opExpireTimeMs = 0xFC
+	opExpireTime   = 0xFD
+	opSelectDB     = 0xFE
+	opEOF          = 0xFF
+
+	typeString           = 0
+	typeList             = 1
+	typeStreamListpacks  = 15
+	typeListQuicklist2   = 18
+	typeStreamListpacks2 = 19
+	typeStreamListpacks3 = 21
+
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+
+	// Entries per listpack when writing lists and streams, close to Redis' defaults.
+	listpackListEntries   = 128
+	listpackStreamEntries = 100
+)
+
+var ErrCorrupt = errors.New("rdb: corrupt file")
+
+// Save writes data to w as a complete RDB file, including the CRC64 trailer.
+// aux holds extra auxiliary fields to record in the header.
+func Save(w io.Writer, data map[string]store.Data, aux map[string]string) error {
+	e := &encoder{w: bufio.NewWriter(w)}
+	e.write([]byte(fmt.Sprintf("REDIS%04d", Version)))
+	e.writeAux("redis-ver", "7.2.0")
+	e.writeAux("redis-bits", "64")
+	e.writeAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	for _, key := range slices.Sorted(maps.Keys(aux)) {
+		e.writeAux(key, aux[key])
+	}
+
+	expires := 0
+	for _, d := range data {
+		if !d.Expiration.IsZero() {
+			expires++
+		}
+	}
+	e.writeByte(opSelectDB)
+	e.writeLength(0)
+	e.writeByte(opResizeDB)
+	e.writeLength(uint64(len(data)))
+	e.writeLength(uint64(expires))
+
+	for key, d := range data {
+		if err := e.writeEntry(key, d); err != nil {
+			return err
+		}
+	}
+
+	e.writeByte(opEOF)
+	var sum [8]byte
+	binary.LittleEndian.PutUint64(sum[:], e.crc)
+	e.w.Write(sum[:])
+	return e.w.Flush()
+}
+
+// SaveFile atomically replaces path with an RDB file holding data.
+func SaveFile(path string, data map[string]store.Data, aux map[string]string) error {
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d-%s", os.Getpid(), filepath.Base(path)))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := Save(f, data, aux); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Parse reads an RDB file from r and calls fn for every key in database 0,
+// including keys whose expiration has already passed.
+func Parse(r io.Reader, fn func(key string, d store.Data) error) error {
+	return parse(r, fn, nil)
+}
+
+// parse is Parse, also calling aux for the auxiliary fields when not nil.
+func parse(r io.Reader, fn func(key string, d store.Data) error, aux func(key, value string)) error {
+	d := newDecoder(r)
+	header, err := d.read(9)
+	if err != nil {
+		return err
+	}
+	if string(header[:5]) != "REDIS" {
+		return fmt.Errorf("rdb: wrong signature %q", header[:5])
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > 12 {
+		return fmt.Errorf("rdb: unsupported version %q", header[5:])
+	}
+
+	db := uint64(0)
+	expiration := time.Time{}
+	for {
+		op, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opEOF:
+			return d.verifyChecksum(version)
+		case opSelectDB:
+			if db, err = d.readLength(); err != nil {
+				return err
+			}
+			continue
+		case opResizeDB:
+			if _, err := d.readLength(); err != nil {
+				return err
+			}
+			if _, err := d.readLength(); err != nil {
+				return err
+			}
+			continue
+		case opSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := d.readLength(); err != nil {
+					return err
+				}
+			}
+			continue
+		case opAux:
+			key, err := d.readString()
+			if err != nil {
+				return err
+			}
+			value, err := d.readString()
+			if err != nil {
+				return err
+			}
+			if aux != nil {
+				aux(key, value)
+			}
+			continue
+		case opExpireTimeMs:
+			b, err := d.read(8)
+			if err != nil {
+				return err
+			}
+			expiration = time.UnixMilli(int64(binary.LittleEndian.Uint64(b)))
+			continue
+		case opExpireTime:
+			b, err := d.read(4)
+			if err != nil {
+				return err
+			}
+			expiration = time.Unix(int64(binary.LittleEndian.Uint32(b)), 0)
+			continue
+		case opIdle:
+			if _, err := d.readLength(); err != nil {
+				return err
+			}
+			continue
+		case opFreq:
+			if _, err := d.readByte(); err != nil {
+				return err
+			}
+			continue
+		case opModuleAux, opFunction2:
+			return fmt.Errorf("rdb: modules and functions are not supported")
+		}
+
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		data, err := d.readValue(op)
+		if err != nil {
+			return fmt.Errorf("rdb: key %q: %w", key, err)
+		}
+		data.Expiration = expiration
+		expiration = time.Time{}
+		if db != 0 {
+			continue
+		}
+		if err := fn(key, data); err != nil {
+			return err
+		}
+	}
+}
+
+// Load reads an RDB file from r, dropping keys that have already expired.
+func Load(r io.Reader) (map[string]store.Data, error) {
+	data, _, err := LoadAux(r)
+	return data, err
+}
+
+// LoadAux is Load that also returns the auxiliary fields of the file.
+func LoadAux(r io.Reader) (map[string]store.Data, map[string]string, error) {
+	data := make(map[string]store.Data)
+	aux := make(map[string]string)
+	now := time.Now()
+	err := parse(r, func(key string, d store.Data) error {
+		if d.Expiration.IsZero() || d.Expiration.After(now) {
+			data[key] = d
+		}
+		return nil
+	}, func(key, value string) { aux[key] = value })
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, aux, nil
+}
+
+// LoadFile loads the RDB file at path.
+func LoadFile(path string) (map[string]store.Data, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+type encoder struct {
+	w   *bufio.Writer
+	crc uint64
+}
+
+// write buffers p; bufio.Writer keeps the first error and reports it on Flush.
+func (e *encoder) write(p []byte) {
+	e.crc = CRC64(e.crc, p)
+	e.w.Write(p)
+}
+
+func (e *encoder) writeByte(b byte) {
+	e.write([]byte{b})
+}
+
+func (e *encoder) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		e.writeByte(byte(n))
+	case n < 1<<14:
+		e.write([]byte{0x40 | byte(n>>8), byte(n)})
+	case n <= 0xFFFFFFFF:
+		b := []byte{0x80, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		e.write(b)
+	default:
+		b := []byte{0x81, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(b[1:], n)
+		e.write(b)
+	}
+}
+
+func (e *encoder) writeString(s string) {
+	if n, ok := canonicalInt(s); ok {
+		switch {
+		case n >= -1<<7 && n < 1<<7:
+			e.write([]byte{0xC0 | encInt8, byte(n)})
+			return
+		case n >= -1<<15 && n < 1<<15:
+			e.write([]byte{0xC0 | encInt16, byte(n), byte(n >> 8)})
+			return
+		case n >= -1<<31 && n < 1<<31:
+			e.write([]byte{0xC0 | encInt32, byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24)})
+			return
+		}
+	}
+	if len(s) > 20 {
+		if c := lzfCompress([]byte(s), len(s)-4); c != nil {
+			e.writeByte(0xC0 | encLZF)
+			e.writeLength(uint64(len(c)))
+			e.writeLength(uint64(len(s)))
+			e.write(c)
+			return
+		}
+	}
+	e.writeLength(uint64(len(s)))
+	e.write([]byte(s))
+}
+
+func (e *encoder) writeAux(key, value string) {
+	e.writeByte(opAux)
+	e.writeString(key)
+	e.writeString(value)
+}
+
+func (e *encoder) writeEntry(key string, d store.Data) error {
+	if !d.Expiration.IsZero() {
+		var b [9]byte
+		b[0] = opExpireTimeMs
+		binary.LittleEndian.PutUint64(b[1:], uint64(d.Expiration.UnixMilli()))
+		e.write(b[:])
+	}
+	typ, err := valueType(d)
+	if err != nil {
+		return fmt.Errorf("rdb: key %q: %w", key, err)
+	}
+	e.writeByte(typ)
+	e.writeString(key)
+	return e.writeValue(d)
+}
+
+func valueType(d store.Data) (byte, error) {
+	switch d.Type {
+	case "", "string":
+		return typeString, nil
+	case "list":
+		return typeListQuicklist2, nil
+	case "stream":
+		return typeStreamListpacks, nil
+	}
+	return 0, fmt.Errorf("cannot serialize type %q", d.Type)
+}
+
+// writeValue writes the payload of d, without its type byte.
+func (e *encoder) writeValue(d store.Data) error {
+	switch d.Type {
+	case "", "string":
+		e.writeString(d.Value)
+	case "list":
+		nodes := (len(d.List) + listpackListEntries - 1) / listpackListEntries
+		e.writeLength(uint64(nodes))
+		for i := 0; i < len(d.List); i += listpackListEntries {
+			lp := newListpackWriter()
+			for _, item := range d.List[i:min(i+listpackListEntries, len(d.List))] {
+				lp.appendString(item)
+			}
+			e.writeLength(quicklistNodePacked)
+			e.writeString(string(lp.bytes()))
+		}
+	case "stream":
+		return e.writeStream(d.Stream)
+	default:
+		return fmt.Errorf("cannot serialize type %q", d.Type)
+	}
+	return nil
+}
+
+// writeStream encodes entries as a radix tree of listpacks keyed by the ID
+// of each node's first entry (the master ID), followed by stream metadata.
+func (e *encoder) writeStream(entries []store.StreamEntry) error {
+	ids := make([][2]uint64, len(entries))
+	for i, entry := range entries {
+		ms, seq, err := parseStreamID(entry.ID)
+		if err != nil {
+			return err
+		}
+		ids[i] = [2]uint64{ms, seq}
+	}
+
+	nodes := (len(entries) + listpackStreamEntries - 1) / listpackStreamEntries
+	e.writeLength(uint64(nodes))
+	for start := 0; start < len(entries); start += listpackStreamEntries {
+		end := min(start+listpackStreamEntries, len(entries))
+		master := ids[start]
+		masterFields := sortedFields(entries[start].Fields)
+
+		lp := newListpackWriter()
+		lp.appendInt(int64(end - start))
+		lp.appendInt(0)
+		lp.appendInt(int64(len(masterFields)))
+		for _, f := range masterFields {
+			lp.appendString(f)
+		}
+		lp.appendInt(0)
+
+		for i := start; i < end; i++ {
+			fields := sortedFields(entries[i].Fields)
+			same := slices.Equal(fields, masterFields)
+			flags := int64(0)
+			if same {
+				flags = 2
+			}
+			lp.appendInt(flags)
+			lp.appendInt(int64(ids[i][0] - master[0]))
+			lp.appendInt(int64(ids[i][1] - master[1]))
+			if same {
+				for _, f := range fields {
+					lp.appendString(entries[i].Fields[f])
+				}
+				lp.appendInt(int64(len(fields) + 3))
+			} else {
+				lp.appendInt(int64(len(fields)))
+				for _, f := range fields {
+					lp.appendString(f)
+					lp.appendString(entries[i].Fields[f])
+				}
+				lp.appendInt(int64(2*len(fields) + 4))
+			}
+		}
+
+		var key [16]byte
+		binary.BigEndian.PutUint64(key[:8], master[0])
+		binary.BigEndian.PutUint64(key[8:], master[1])
+		e.writeString(string(key[:]))
+		e.writeString(string(lp.bytes()))
+	}
+
+	var last [2]uint64
+	if len(ids) > 0 {
+		last = ids[len(ids)-1]
+	}
+	e.writeLength(uint64(len(entries)))
+	e.writeLength(last[0])
+	e.writeLength(last[1])
+	e.writeLength(0) // consumer groups
+	return nil
+}
+
+// maxPrealloc is the most read allocates up front for input of unknown
+// size; longer strings grow as their bytes arrive.
+const maxPrealloc = 1 << 16
+
+type decoder struct {
+	r   *bufio.Reader
+	crc uint64
+	// remaining is the number of bytes left in the input, or -1 when its
+	// size isn't known, as for a stream from a master.
+	remaining int64
+}
+
+func newDecoder(r io.Reader) *decoder {
+	d := &decoder{remaining: -1}
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		d.remaining = int64(r.Len())
+	case *os.File:
+		fi, err := r.Stat()
+		if err == nil && fi.Mode().IsRegular() {
+			if off, err := r.Seek(0, io.SeekCurrent); err == nil {
+				d.remaining = fi.Size() - off
+			}
+		}
+	}
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	d.r = br
+	return d
+}
+
+// fits reports whether n bytes, or n items of at least a byte each, can
+// still be in the input.
+func (d *decoder) fits(n uint64) bool {
+	if d.remaining < 0 {
+		return n < 1<<62
+	}
+	return n <= uint64(d.remaining)
+}
+
+// read returns the next n bytes of the input. A length that can't fit in
+// the input is rejected before anything is allocated for it.
+func (d *decoder) read(n uint64) ([]byte, error) {
+	if !d.fits(n) {
+		return nil, ErrCorrupt
+	}
+	var b []byte
+	var err error
+	if n <= maxPrealloc {
+		b = make([]byte, n)
+		_, err = io.ReadFull(d.r, b)
+	} else {
+		var buf bytes.Buffer
+		_, err = io.CopyN(&buf, d.r, int64(n))
+		b = buf.Bytes()
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if d.remaining >= 0 {
+		d.remaining -= int64(n)
+	}
+	d.crc = CRC64(d.crc, b)
+	return b, nil
+}
+
+func (d *decoder) readByte() (byte, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readLengthOrEncoding returns either a plain length or, when encoded is
+// true, the special string encoding stored in the low six bits.
+func (d *decoder) readLengthOrEncoding() (n uint64, encoded bool, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false, nil
+	case 1:
+		next, err := d.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3F)<<8 | uint64(next), false, nil
+	case 2:
+		switch b {
+		case 0x80:
+			p, err := d.read(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(p)), false, nil
+		case 0x81:
+			p, err := d.read(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(p), false, nil
+		}
+		return 0, false, ErrCorrupt
+	}
+	return uint64(b & 0x3F), true, nil
+}
+
+func (d *decoder) readLength() (uint64, error) {
+	n, encoded, err := d.readLengthOrEncoding()
+	if err != nil {
+		return 0, err
+	}
+	if encoded {
+		return 0, ErrCorrupt
+	}
+	return n, nil
+}
+
+func (d *decoder) readString() (string, error) {
+	n, encoded, err := d.readLengthOrEncoding()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		b, err := d.read(n)
+		return string(b), err
+	}
+	switch n {
+	case encInt8:
+		b, err := d.read(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(b[0]))), nil
+	case encInt16:
+		b, err := d.read(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b)))), nil
+	case encInt32:
+		b, err := d.read(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b)))), nil
+	case encLZF:
+		clen, err := d.readLength()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := d.readLength()
+		if err != nil {
+			return "", err
+		}
+		c, err := d.read(clen)
+		if err != nil {
+			return "", err
+		}
+		// No LZF sequence expands to more than lzfMaxRef bytes per byte.
+		if ulen > clen*lzfMaxRef {
+			return "", ErrCorrupt
+		}
+		u, err := lzfDecompress(c, int(ulen))
+		if err != nil {
+			return "", err
+		}
+		return string(u), nil
+	}
+	return "", ErrCorrupt
+}
+
+// readValue decodes the payload of a value of type typ.
+func (d *decoder) readValue(typ byte) (store.Data, error) {
+	switch typ {
+	case typeString:
+		s, err := d.readString()
+		return store.Data{Type: "string", Value: s}, err
+	case typeList:
+		n, err := d.readLength()
+		if err != nil {
+			return store.Data{}, err
+		}
+		if !d.fits(n) {
+			return store.Data{}, ErrCorrupt
+		}
+		list := make([]string, 0, min(n, maxPrealloc))
+		for i := uint64(0); i < n; i++ {
+			s, err := d.readString()
+			if err != nil {
+				return store.Data{}, err
+			}
+			list = append(list, s)
+		}
+		return store.Data{Type: "list", List: list}, nil
+	case typeListQuicklist2:
+		nodes, err := d.readLength()
+		if err != nil {
+			return store.Data{}, err
+		}
+		list := []string{}
+		for i := uint64(0); i < nodes; i++ {
+			container, err := d.readLength()
+			if err != nil {
+				return store.Data{}, err
+			}
+			s, err := d.readString()
+			if err != nil {
+				return store.Data{}, err
+			}
+			if container == quicklistNodePlain {
+				list = append(list, s)
+				continue
+			}
+			items, err := parseListpack([]byte(s))
+			if err != nil {
+				return store.Data{}, err
+			}
+			list = append(list, items...)
+		}
+		return store.Data{Type: "list", List: list}, nil
+	case typeStreamListpacks, typeStreamListpacks2, typeStreamListpacks3:
+		return d.readStream(typ)
+	}
+	return store.Data{}, fmt.Errorf("unsupported value type %d", typ)
+}
+
+func (d *decoder) readStream(typ byte) (store.Data, error) {
+	nodes, err := d.readLength()
+	if err != nil {
+		return store.Data{}, err
+	}
+	stream := []store.StreamEntry{}
+	for i := uint64(0); i < nodes; i++ {
+		key, err := d.readString()
+		if err != nil {
+			return store.Data{}, err
+		}
+		if len(key) != 16 {
+			return store.Data{}, ErrCorrupt
+		}
+		lp, err := d.readString()
+		if err != nil {
+			return store.Data{}, err
+		}
+		items, err := parseListpack([]byte(lp))
+		if err != nil {
+			return store.Data{}, err
+		}
+		entries, err := streamNodeEntries([]byte(key), items)
+		if err != nil {
+			return store.Data{}, err
+		}
+		stream = append(stream, entries...)
+	}
+
+	// length, last ID, and for newer encodings first ID, max deleted ID and
+	// entries added; none of which the store keeps separately.
+	meta := 3
+	if typ != typeStreamListpacks {
+		meta += 5
+	}
+	for i := 0; i < meta; i++ {
+		if _, err := d.readLength(); err != nil {
+			return store.Data{}, err
+		}
+	}
+	groups, err := d.readLength()
+	if err != nil {
+		return store.Data{}, err
+	}
+	if groups != 0 {
+		return store.Data{}, fmt.Errorf("stream consumer groups are not supported")
+	}
+	return store.Data{Type: "stream", Stream: stream}, nil
+}
+
+// streamNodeEntries expands one stream listpack node into its live entries.
+func streamNodeEntries(key []byte, items []string) ([]store.StreamEntry, error) {
+	masterMs := binary.BigEndian.Uint64(key[:8])
+	masterSeq := binary.BigEndian.Uint64(key[8:])
+	p := 0
+	next := func() (string, error) {
+		if p >= len(items) {
+			return "", ErrCorrupt
+		}
+		p++
+		return items[p-1], nil
+	}
+	nextInt := func() (int64, error) {
+		s, err := next()
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, ErrCorrupt
+		}
+		return n, nil
+	}
+
+	// Master entry: count, deleted, field count, fields, terminator.
+	if _, err := nextInt(); err != nil {
+		return nil, err
+	}
+	if _, err := nextInt(); err != nil {
+		return nil, err
+	}
+	numFields, err := nextInt()
+	if err != nil {
+		return nil, err
+	}
+	if numFields < 0 || numFields > int64(len(items)) {
+		return nil, ErrCorrupt
+	}
+	masterFields := make([]string, numFields)
+	for i := range masterFields {
+		if masterFields[i], err = next(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := nextInt(); err != nil {
+		return nil, err
+	}
+
+	entries := []store.StreamEntry{}
+	for p < len(items) {
+		flags, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		fields := map[string]string{}
+		if flags&2 != 0 {
+			for _, f := range masterFields {
+				if fields[f], err = next(); err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			n, err := nextInt()
+			if err != nil {
+				return nil, err
+			}
+			for i := int64(0); i < n; i++ {
+				f, err := next()
+				if err != nil {
+					return nil, err
+				}
+				if fields[f], err = next(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if _, err := nextInt(); err != nil { // lp-count
+			return nil, err
+		}
+		if flags&1 != 0 {
+			continue
+		}
+		id := fmt.Sprintf("%d-%d", masterMs+uint64(msDiff), masterSeq+uint64(seqDiff))
+		entries = append(entries, store.StreamEntry{ID: id, Fields: fields})
+	}
+	return entries, nil
+}
+
+func (d *decoder) verifyChecksum(version int) error {
+	if version < 5 {
+		return nil
+	}
+	expected := d.crc
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return err
+	}
+	sum := binary.LittleEndian.Uint64(b)
+	if sum != 0 && sum != expected {
+		return fmt.Errorf("rdb: checksum mismatch")
+	}
+	return nil
+}
+
+func parseStreamID(id string) (uint64, uint64, error) {
+	ms, seq, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid stream ID %q", id)
+	}
+	m, err := strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid stream ID %q", id)
+	}
+	s, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid stream ID %q", id)
+	}
+	return m, s, nil
+}
+
+func sortedFields(fields map[string]string) []string {
+	return slices.Sorted(maps.Keys(fields))
+}
@@ -0,0 +1,230 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// testData returns values covering every encoding the encoder writes.
+func testData() map[string]store.Data {
+	var long []string
+	for i := range 300 {
+		// Several quicklist nodes mixing every listpack entry encoding.
+		switch i % 5 {
+		case 0:
+			long = append(long, strconv.Itoa(i))
+		case 1:
+			long = append(long, strconv.Itoa(-i*1000))
+		case 2:
+			long = append(long, strconv.Itoa(i<<40))
+		case 3:
+			long = append(long, strings.Repeat("x", 100+i))
+		default:
+			long = append(long, strings.Repeat("y", 5000))
+		}
+	}
+	var stream []store.StreamEntry
+	for i := range 250 {
+		fields := map[string]string{"temp": strconv.Itoa(20 + i%7), "unit": "C"}
+		if i%3 == 0 {
+			fields = map[string]string{"event": "reset"}
+		}
+		stream = append(stream, store.StreamEntry{ID: fmt.Sprintf("%d-%d", 1700000000000+i/4, i%4), Fields: fields})
+	}
+	return map[string]store.Data{
+		"int8":      {Type: "string", Value: "-12"},
+		"int16":     {Type: "string", Value: "1000"},
+		"int32":     {Type: "string", Value: "-2000000000"},
+		"int64":     {Type: "string", Value: "9000000000"},
+		"leading0":  {Type: "string", Value: "007"},
+		"empty":     {Type: "string", Value: ""},
+		"short":     {Type: "string", Value: "hello"},
+		"lzf":       {Type: "string", Value: strings.Repeat("abcabcabd", 50)},
+		"expiring":  {Type: "string", Value: "v", Expiration: time.UnixMilli(4102444800000)},
+		"list":      {Type: "list", List: []string{"a", "1", "b"}},
+		"long-list": {Type: "list", List: long},
+		"stream":    {Type: "stream", Stream: stream},
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Save(&buf, testData(), map[string]string{"repl-id": "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	data, aux, err := LoadAux(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aux["repl-id"] != "abc" || aux["redis-bits"] != "64" {
+		t.Errorf("aux fields: %v", aux)
+	}
+	want := testData()
+	if len(data) != len(want) {
+		t.Errorf("loaded %d keys, want %d", len(data), len(want))
+	}
+	for key, w := range want {
+		if d := data[key]; !reflect.DeepEqual(d, w) {
+			t.Errorf("key %q: loaded %+v, want %+v", key, d, w)
+		}
+	}
+}
+
+func TestLoadExpired(t *testing.T) {
+	var buf bytes.Buffer
+	expired := map[string]store.Data{"old": {Type: "string", Value: "v", Expiration: time.UnixMilli(1000)}}
+	if err := Save(&buf, expired, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := Load(bytes.NewReader(buf.Bytes()))
+	if err != nil || len(data) != 0 {
+		t.Fatalf("Load: %v, %v", data, err)
+	}
+	keys := 0
+	err = Parse(bytes.NewReader(buf.Bytes()), func(string, store.Data) error { keys++; return nil })
+	if err != nil || keys != 1 {
+		t.Fatalf("Parse saw %d keys: %v", keys, err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	// The check value of Redis' crc64 test.
+	if sum := CRC64(0, []byte("123456789")); sum != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("CRC64 = %#x", sum)
+	}
+
+	var buf bytes.Buffer
+	if err := Save(&buf, testData(), nil); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+	if sum := binary.LittleEndian.Uint64(file[len(file)-8:]); sum != CRC64(0, file[:len(file)-8]) {
+		t.Fatalf("trailer %#x isn't the CRC64 of the file", sum)
+	}
+	// The value of "short" is stored as is; changing it breaks the checksum.
+	i := bytes.Index(file, []byte("hello"))
+	corrupt := bytes.Clone(file)
+	corrupt[i] = 'j'
+	if _, err := Load(bytes.NewReader(corrupt)); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("Load of a corrupt file: %v", err)
+	}
+	// A zero checksum means the file wasn't checksummed.
+	unchecked := bytes.Clone(file)
+	clear(unchecked[len(unchecked)-8:])
+	if _, err := Load(bytes.NewReader(unchecked)); err != nil {
+		t.Fatalf("Load without a checksum: %v", err)
+	}
+}
+
+func TestLZF(t *testing.T) {
+	for _, in := range []string{
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		strings.Repeat("0123456789", 1000),
+		strings.Repeat("a", 100) + strings.Repeat("b", 300) + "c",
+	} {
+		c := lzfCompress([]byte(in), len(in)-4)
+		if c == nil {
+			t.Fatalf("%q didn't compress", in[:20])
+		}
+		out, err := lzfDecompress(c, len(in))
+		if err != nil || string(out) != in {
+			t.Fatalf("round trip of %q: %v", in[:20], err)
+		}
+		if _, err := lzfDecompress(c, len(in)+1); err == nil {
+			t.Fatalf("decompression of %q to a wrong length succeeded", in[:20])
+		}
+	}
+	if c := lzfCompress([]byte("abcdefgh"), 4); c != nil {
+		t.Fatalf("incompressible input compressed to %q", c)
+	}
+}
+
+func TestListpack(t *testing.T) {
+	items := []string{"0", "127", "128", "-4096", "4095", "32767", "-32768", "8388607",
+		"-2147483648", "9223372036854775807", "-9223372036854775808", "01", "",
+		strings.Repeat("s", 63), strings.Repeat("m", 64), strings.Repeat("m", 4095), strings.Repeat("l", 4096)}
+	lp := newListpackWriter()
+	for _, item := range items {
+		lp.appendString(item)
+	}
+	got, err := parseListpack(lp.bytes())
+	if err != nil || !reflect.DeepEqual(got, items) {
+		t.Fatalf("parseListpack: %v, %v", got, err)
+	}
+	b := lp.bytes()
+	if _, err := parseListpack(b[:len(b)-1]); err == nil {
+		t.Fatal("parseListpack of a truncated listpack succeeded")
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	for key, d := range testData() {
+		payload, err := Dump(d)
+		if err != nil {
+			t.Fatalf("Dump %q: %v", key, err)
+		}
+		got, err := Restore(payload)
+		if err != nil {
+			t.Fatalf("Restore %q: %v", key, err)
+		}
+		// The expiration isn't part of the payload.
+		d.Expiration = time.Time{}
+		if !reflect.DeepEqual(got, d) {
+			t.Errorf("key %q: restored %+v, want %+v", key, got, d)
+		}
+	}
+
+	payload, _ := Dump(store.Data{Type: "string", Value: "hello"})
+	corrupt := bytes.Clone(payload)
+	corrupt[2] = 'j'
+	if _, err := Restore(corrupt); err != ErrDumpPayload {
+		t.Fatalf("Restore with a bad checksum: %v", err)
+	}
+	newer := bytes.Clone(payload)
+	binary.LittleEndian.PutUint16(newer[len(newer)-10:], Version+1)
+	if _, err := Restore(newer); err != ErrDumpPayload {
+		t.Fatalf("Restore of a newer version: %v", err)
+	}
+}
+
+// withChecksum appends the version and checksum footer of a DUMP payload.
+func withChecksum(body []byte) []byte {
+	payload := binary.LittleEndian.AppendUint16(bytes.Clone(body), Version)
+	return binary.LittleEndian.AppendUint64(payload, CRC64(0, payload))
+}
+
+func TestCorruptLengths(t *testing.T) {
+	for name, body := range map[string][]byte{
+		// A 4 GiB string, in a few bytes.
+		"string": {typeString, 0x80, 0xFF, 0xFF, 0xFF, 0xFF, 'a'},
+		// 2^63 list items.
+		"list": {typeList, 0x81, 0x80, 0, 0, 0, 0, 0, 0, 0},
+		// A 3 byte LZF string said to expand to a gigabyte.
+		"lzf": {typeString, 0xC0 | encLZF, 3, 0x80, 0x40, 0, 0, 0, 2, 'a', 'b', 'c'},
+	} {
+		if _, err := Restore(withChecksum(body)); err != ErrBadDataFormat {
+			t.Errorf("Restore of a corrupt %s: %v", name, err)
+		}
+	}
+
+	// Without a known input size, a length past the end of the input is
+	// only found at the end, but without allocating it first.
+	var file bytes.Buffer
+	file.WriteString("REDIS0011")
+	file.Write([]byte{typeString, 1, 'k', 0x81, 0, 0, 0, 1, 0, 0, 0, 0})
+	file.WriteString("not that long")
+	err := Parse(io.MultiReader(&file), func(string, store.Data) error { return nil })
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Parse of a stream with a corrupt length: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package resp
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"strconv"
@@ -30,8 +31,6 @@ func (r *Resp) Read() (Value, error) {
 		return Value{}, err
 	}
 
-	fmt.Printf("Received first byte: %q (%d)\n", _type, _type)
-
 	switch _type {
 	case '+': // Simple Strings
 		s, err := r.readLine()
@@ -52,6 +51,9 @@ func (r *Resp) Read() (Value, error) {
 		if err != nil {
 			return Value{}, err
 		}
+		if length < 0 {
+			return Value{Type: "nil"}, nil
+		}
 
 		bulk := make([]byte, length)
 		_, err = io.ReadFull(r.reader, bulk)
@@ -72,6 +74,9 @@ func (r *Resp) Read() (Value, error) {
 		if err != nil {
 			return Value{}, err
 		}
+		if length < 0 {
+			return Value{Type: "nil"}, nil
+		}
 
 		array := make([]Value, length)
 		for i := 0; i < length; i++ {
@@ -120,3 +125,19 @@ func Respond(writer io.Writer, val Value) error {
 		return fmt.Errorf("unknown RESP type to respond: %s", val.Type)
 	}
 }
+
+// Marshal returns the wire encoding of val.
+func Marshal(val Value) []byte {
+	var buf bytes.Buffer
+	Respond(&buf, val)
+	return buf.Bytes()
+}
+
+// Command builds the array value used to send a command.
+func Command(args ...string) Value {
+	array := make([]Value, len(args))
+	for i, arg := range args {
+		array[i] = Value{Type: "bulk", Bulk: arg}
+	}
+	return Value{Type: "array", Array: array}
+}
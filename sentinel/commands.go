@@ -0,0 +1,332 @@
+package sentinel
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/glob"
+	"github.com/saurabhdhingra/go-redis/resp"
+)
+
+// HandleConnection serves the commands of a client, or of another sentinel,
+// on conn.
+func (s *Sentinel) HandleConnection(conn net.Conn) {
+	defer conn.Close()
+	reader := resp.NewResp(conn)
+	for {
+		value, err := reader.Read()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println("Error reading RESP:", err)
+			}
+			return
+		}
+		if value.Type != "array" || len(value.Array) == 0 {
+			resp.Respond(conn, resp.Value{Type: "error", Str: "ERR invalid command format"})
+			continue
+		}
+		if err := resp.Respond(conn, s.execute(value.Array)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Sentinel) execute(args []resp.Value) resp.Value {
+	command := strings.ToUpper(args[0].Bulk)
+	switch command {
+	case "PING":
+		return resp.Value{Type: "string", Str: "PONG"}
+	case "INFO":
+		return resp.Value{Type: "bulk", Bulk: s.info()}
+	case "ROLE":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var names []resp.Value
+		for _, name := range s.masterNames() {
+			names = append(names, resp.Value{Type: "bulk", Bulk: name})
+		}
+		return resp.Value{Type: "array", Array: []resp.Value{
+			{Type: "bulk", Bulk: "sentinel"}, {Type: "array", Array: names},
+		}}
+	case "SENTINEL":
+		if len(args) < 2 {
+			return errorValue("ERR wrong number of arguments for 'sentinel' command")
+		}
+		return s.sentinelCommand(strings.ToUpper(args[1].Bulk), args[2:])
+	default:
+		return errorValue(fmt.Sprintf("ERR unknown command '%s'", args[0].Bulk))
+	}
+}
+
+// sentinelCommand implements the SENTINEL subcommands.
+func (s *Sentinel) sentinelCommand(sub string, args []resp.Value) resp.Value {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+
+	lookup := func() (*master, resp.Value) {
+		if len(args) != 1 {
+			return nil, errorValue(fmt.Sprintf("ERR wrong number of arguments for 'sentinel|%s' command", strings.ToLower(sub)))
+		}
+		m := s.masters[args[0].Bulk]
+		if m == nil {
+			return nil, errorValue("ERR No such master with that name")
+		}
+		return m, resp.Value{}
+	}
+
+	switch sub {
+	case "MYID":
+		return resp.Value{Type: "bulk", Bulk: s.myid}
+
+	case "MASTERS":
+		var masters []resp.Value
+		for _, name := range s.masterNames() {
+			masters = append(masters, s.masterFields(s.masters[name], now))
+		}
+		return resp.Value{Type: "array", Array: masters}
+
+	case "MASTER":
+		m, errReply := lookup()
+		if m == nil {
+			return errReply
+		}
+		return s.masterFields(m, now)
+
+	case "REPLICAS", "SLAVES":
+		m, errReply := lookup()
+		if m == nil {
+			return errReply
+		}
+		addrs := make([]string, 0, len(m.replicas))
+		for addr := range m.replicas {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		var replicas []resp.Value
+		for _, addr := range addrs {
+			r := m.replicas[addr]
+			fields := instanceFields(m, r, now)
+			masterHost, masterPort, _ := net.SplitHostPort(r.masterAddr)
+			linkStatus := "err"
+			if r.masterLinkUp {
+				linkStatus = "ok"
+			}
+			fields = append(fields,
+				"master-host", masterHost,
+				"master-port", masterPort,
+				"master-link-status", linkStatus,
+				"slave-priority", strconv.Itoa(r.priority),
+				"slave-repl-offset", strconv.FormatInt(r.replOffset, 10),
+			)
+			replicas = append(replicas, resp.Command(fields...))
+		}
+		return resp.Value{Type: "array", Array: replicas}
+
+	case "SENTINELS":
+		m, errReply := lookup()
+		if m == nil {
+			return errReply
+		}
+		ids := make([]string, 0, len(m.sentinels))
+		for id := range m.sentinels {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		var sentinels []resp.Value
+		for _, id := range ids {
+			p := m.sentinels[id]
+			fields := instanceFields(m, p.instance, now)
+			fields[7] = p.runid
+			fields = append(fields,
+				"last-hello-message", strconv.FormatInt(now.Sub(p.lastHello).Milliseconds(), 10),
+				"voted-leader", orStar(p.leader),
+				"voted-leader-epoch", strconv.FormatInt(p.leaderEpoch, 10),
+			)
+			sentinels = append(sentinels, resp.Command(fields...))
+		}
+		return resp.Value{Type: "array", Array: sentinels}
+
+	case "GET-MASTER-ADDR-BY-NAME":
+		if len(args) != 1 {
+			return errorValue("ERR wrong number of arguments for 'sentinel|get-master-addr-by-name' command")
+		}
+		m := s.masters[args[0].Bulk]
+		if m == nil {
+			return resp.Value{Type: "nil"}
+		}
+		host, port, _ := net.SplitHostPort(m.currentAddr())
+		return resp.Command(host, port)
+
+	case "RESET":
+		if len(args) != 1 {
+			return errorValue("ERR wrong number of arguments for 'sentinel|reset' command")
+		}
+		count := 0
+		for _, name := range s.masterNames() {
+			if glob.Match(args[0].Bulk, name) {
+				s.reset(s.masters[name])
+				count++
+			}
+		}
+		return resp.Value{Type: "integer", Num: count}
+
+	case "FAILOVER":
+		m, errReply := lookup()
+		if m == nil {
+			return errReply
+		}
+		if m.failoverState != failoverStateNone {
+			return errorValue("INPROG Failover already in progress")
+		}
+		if s.selectReplica(m, now) == nil {
+			return errorValue("NOGOODSLAVE No suitable replica to promote")
+		}
+		fmt.Printf("Executing user requested FAILOVER of '%s'\n", m.name)
+		s.startFailover(m, now, true)
+		return resp.Value{Type: "string", Str: "OK"}
+
+	case "IS-MASTER-DOWN-BY-ADDR":
+		// SENTINEL IS-MASTER-DOWN-BY-ADDR <ip> <port> <current-epoch> <runid>
+		if len(args) != 4 {
+			return errorValue("ERR wrong number of arguments for 'sentinel|is-master-down-by-addr' command")
+		}
+		epoch, err := strconv.ParseInt(args[2].Bulk, 10, 64)
+		if err != nil {
+			return errorValue("ERR value is not an integer or out of range")
+		}
+		addr := net.JoinHostPort(args[0].Bulk, args[1].Bulk)
+		down := 0
+		leader, leaderEpoch := "*", int64(0)
+		for _, m := range s.masters {
+			if m.addr != addr {
+				continue
+			}
+			if m.sdown() {
+				down = 1
+			}
+			// A runid other than "*" asks for our vote.
+			if runid := args[3].Bulk; runid != "*" {
+				leader, leaderEpoch = s.voteLeader(m, epoch, runid)
+			}
+			break
+		}
+		return resp.Value{Type: "array", Array: []resp.Value{
+			{Type: "integer", Num: down},
+			{Type: "bulk", Bulk: orStar(leader)},
+			{Type: "integer", Num: int(leaderEpoch)},
+		}}
+
+	default:
+		return errorValue(fmt.Sprintf("ERR unknown subcommand '%s'. Try SENTINEL HELP.", strings.ToLower(sub)))
+	}
+}
+
+// masterFields describes m as in SENTINEL MASTER. Must be called with s.mu
+// held.
+func (s *Sentinel) masterFields(m *master, now time.Time) resp.Value {
+	fields := instanceFields(m, m.instance, now)
+	fields = append(fields,
+		"config-epoch", strconv.FormatInt(m.configEpoch, 10),
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+		"quorum", strconv.Itoa(m.quorum),
+		"failover-timeout", strconv.FormatInt(m.failoverTimeout.Milliseconds(), 10),
+		"failover-state", m.failoverState,
+	)
+	return resp.Command(fields...)
+}
+
+// instanceFields returns the fields common to every kind of instance, as
+// alternating names and values.
+func instanceFields(m *master, inst *instance, now time.Time) []string {
+	host, port, _ := net.SplitHostPort(inst.addr)
+	flags := []string{m.kind(inst)}
+	if inst.sdown() {
+		flags = append(flags, "s_down")
+	}
+	if inst == m.instance && !m.odownSince.IsZero() {
+		flags = append(flags, "o_down")
+	}
+	if !inst.linkUp {
+		flags = append(flags, "disconnected")
+	}
+	if inst == m.instance && m.failoverState != failoverStateNone {
+		flags = append(flags, "failover_in_progress")
+	}
+	if inst == m.promoted {
+		flags = append(flags, "promoted")
+	}
+	if inst.reconfSent {
+		flags = append(flags, "reconf_sent")
+	}
+	fields := []string{
+		"name", inst.addr,
+		"ip", host,
+		"port", port,
+		"runid", "",
+		"flags", strings.Join(flags, ","),
+		"last-ping-reply", strconv.FormatInt(now.Sub(inst.lastAvail).Milliseconds(), 10),
+	}
+	if inst == m.instance {
+		fields[1] = m.name
+	}
+	if inst.sdown() {
+		fields = append(fields, "s-down-time", strconv.FormatInt(now.Sub(inst.sdownSince).Milliseconds(), 10))
+	}
+	if !inst.lastInfo.IsZero() {
+		fields = append(fields,
+			"info-refresh", strconv.FormatInt(now.Sub(inst.lastInfo).Milliseconds(), 10),
+			"role-reported", inst.role,
+		)
+	}
+	return fields
+}
+
+// info returns the INFO text of a sentinel.
+func (s *Sentinel) info() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Server\r\nredis_mode:sentinel\r\nrun_id:%s\r\ntcp_port:%d\r\n\r\n", s.myid, s.port)
+	fmt.Fprintf(&b, "# Sentinel\r\nsentinel_masters:%d\r\n", len(s.masters))
+	for i, name := range s.masterNames() {
+		m := s.masters[name]
+		status := "ok"
+		if !m.odownSince.IsZero() {
+			status = "odown"
+		} else if m.sdown() {
+			status = "sdown"
+		}
+		fmt.Fprintf(&b, "master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d\r\n",
+			i, name, status, m.currentAddr(), len(m.replicas), len(m.sentinels)+1)
+	}
+	return b.String()
+}
+
+// masterNames returns the names of the monitored masters in order. Must be
+// called with s.mu held.
+func (s *Sentinel) masterNames() []string {
+	names := make([]string, 0, len(s.masters))
+	for name := range s.masters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func errorValue(msg string) resp.Value {
+	return resp.Value{Type: "error", Str: msg}
+}
+
+func orStar(s string) string {
+	if s == "" {
+		return "*"
+	}
+	return s
+}
@@ -0,0 +1,386 @@
+package sentinel
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Failover states, named as in SENTINEL MASTERS.
+const (
+	failoverStateNone           = "none"
+	failoverStateWaitStart      = "wait_start"
+	failoverStateSelectReplica  = "select_slave"
+	failoverStateSendReplicaof  = "send_slaveof_noone"
+	failoverStateWaitPromotion  = "wait_promotion"
+	failoverStateReconfReplicas = "reconf_slaves"
+)
+
+// checkSubjectivelyDown flags inst as down when a PING went unanswered, or
+// the link stayed down, for down-after-milliseconds, or when a master
+// reported being a replica for too long. Must be called with s.mu held, as
+// are the functions below.
+func (s *Sentinel) checkSubjectivelyDown(m *master, inst *instance, now time.Time) {
+	// Measured from the pending PING, as in Redis: the time since the last
+	// reply also counts the wait for the next PING.
+	var elapsed time.Duration
+	switch {
+	case !inst.pingSent.IsZero():
+		elapsed = now.Sub(inst.pingSent)
+	case !inst.linkUp:
+		elapsed = now.Sub(inst.lastAvail)
+	}
+	down := elapsed > m.downAfter
+	if inst == m.instance && inst.role == "slave" && now.Sub(inst.roleReported) > m.downAfter+2*infoPeriod {
+		down = true
+	}
+	switch {
+	case down && !inst.sdown():
+		inst.sdownSince = now
+		s.event("+sdown", m, inst, "")
+	case !down && inst.sdown():
+		inst.sdownSince = time.Time{}
+		s.event("-sdown", m, inst, "")
+	}
+}
+
+// checkObjectivelyDown flags m as down when a quorum of sentinels, this
+// one included, see it down.
+func (s *Sentinel) checkObjectivelyDown(m *master, now time.Time) {
+	votes := 0
+	if m.sdown() {
+		votes = 1
+		for _, p := range m.sentinels {
+			if p.masterDown && now.Sub(p.lastDownReply) < 5*askPeriod {
+				votes++
+			}
+		}
+	}
+	odown := votes >= m.quorum
+	switch {
+	case odown && m.odownSince.IsZero():
+		m.odownSince = now
+		s.event("+odown", m, m.instance, fmt.Sprintf("#quorum %d/%d", votes, m.quorum))
+	case !odown && !m.odownSince.IsZero():
+		m.odownSince = time.Time{}
+		s.event("-odown", m, m.instance, "")
+	}
+}
+
+// askOtherSentinels asks the other sentinels whether they see m down and,
+// once this sentinel started a failover, for their vote.
+func (s *Sentinel) askOtherSentinels(m *master, now time.Time) {
+	if !m.sdown() || now.Sub(m.lastAsk) < askPeriod {
+		return
+	}
+	m.lastAsk = now
+	host, port, _ := net.SplitHostPort(m.addr)
+	runid := "*"
+	if m.failoverState != failoverStateNone {
+		runid = s.myid
+	}
+	epoch := strconv.FormatInt(s.currentEpoch, 10)
+	for _, p := range m.sentinels {
+		if p.askPending {
+			continue
+		}
+		p.askPending = true
+		go func() {
+			reply, err := s.call(p.instance, "SENTINEL", "is-master-down-by-addr", host, port, epoch, runid)
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			p.askPending = false
+			if err != nil || reply.Type != "array" || len(reply.Array) != 3 {
+				return
+			}
+			p.masterDown = reply.Array[0].Num == 1
+			p.lastDownReply = time.Now()
+			if leader := reply.Array[1].Bulk; leader != "*" {
+				p.leader = leader
+				p.leaderEpoch = int64(reply.Array[2].Num)
+			}
+		}()
+	}
+}
+
+// voteLeader gives this sentinel's vote for epoch to runid, unless it voted
+// in that epoch already, and returns the current vote.
+func (s *Sentinel) voteLeader(m *master, epoch int64, runid string) (string, int64) {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		fmt.Printf("+new-epoch %d\n", epoch)
+	}
+	if m.leaderEpoch < epoch && s.currentEpoch <= epoch {
+		m.leader = runid
+		m.leaderEpoch = s.currentEpoch
+		s.event("+vote-for-leader", m, m.instance, fmt.Sprintf("%s %d", runid, m.leaderEpoch))
+		// Give the sentinel we voted for time to complete the failover.
+		if runid != s.myid {
+			m.failoverStart = time.Now().Add(rand.N(maxDesync))
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// leader returns the sentinel elected for epoch, if any: the one that got
+// the votes of a majority of the sentinels and at least the quorum.
+func (s *Sentinel) leader(m *master, epoch int64) string {
+	votes := make(map[string]int)
+	for _, p := range m.sentinels {
+		if p.leader != "" && p.leaderEpoch == s.currentEpoch {
+			votes[p.leader]++
+		}
+	}
+	winner := mostVoted(votes)
+	// This sentinel votes for the winner so far, or for itself.
+	candidate := s.myid
+	if winner != "" {
+		candidate = winner
+	}
+	if vote, voteEpoch := s.voteLeader(m, epoch, candidate); voteEpoch == epoch {
+		votes[vote]++
+	}
+	winner = mostVoted(votes)
+	voters := len(m.sentinels) + 1
+	if winner == "" || votes[winner] < voters/2+1 || votes[winner] < m.quorum {
+		return ""
+	}
+	return winner
+}
+
+func mostVoted(votes map[string]int) string {
+	winner := ""
+	for id, n := range votes {
+		if winner == "" || n > votes[winner] || n == votes[winner] && id < winner {
+			winner = id
+		}
+	}
+	return winner
+}
+
+// startFailoverIfNeeded starts a failover of m when it is objectively down,
+// unless one was attempted within twice the failover timeout.
+func (s *Sentinel) startFailoverIfNeeded(m *master, now time.Time) bool {
+	if m.odownSince.IsZero() || m.failoverState != failoverStateNone || now.Sub(m.failoverStart) < 2*m.failoverTimeout {
+		return false
+	}
+	s.startFailover(m, now, false)
+	return true
+}
+
+func (s *Sentinel) startFailover(m *master, now time.Time, forced bool) {
+	s.currentEpoch++
+	fmt.Printf("+new-epoch %d\n", s.currentEpoch)
+	m.failoverEpoch = s.currentEpoch
+	m.failoverState = failoverStateWaitStart
+	m.failoverStart = now.Add(rand.N(maxDesync))
+	m.failoverStateChange = now
+	m.forced = forced
+	s.event("+try-failover", m, m.instance, "")
+}
+
+// failoverStep advances the failover of m, as Redis' sentinelFailoverStateMachine.
+func (s *Sentinel) failoverStep(m *master, now time.Time) {
+	switch m.failoverState {
+	case failoverStateWaitStart:
+		if !m.forced {
+			if s.leader(m, m.failoverEpoch) != s.myid {
+				if now.Sub(m.failoverStart) > min(10*time.Second, m.failoverTimeout) {
+					s.abortFailover(m, "-failover-abort-not-elected")
+				}
+				return
+			}
+			s.event("+elected-leader", m, m.instance, "")
+		}
+		m.failoverState = failoverStateSelectReplica
+		m.failoverStateChange = now
+		s.event("+failover-state-select-slave", m, m.instance, "")
+		fallthrough
+
+	case failoverStateSelectReplica:
+		r := s.selectReplica(m, now)
+		if r == nil {
+			s.abortFailover(m, "-failover-abort-no-good-slave")
+			return
+		}
+		s.event("+selected-slave", m, r, "")
+		m.promoted = r
+		m.failoverState = failoverStateSendReplicaof
+		m.failoverStateChange = now
+		s.event("+failover-state-send-slaveof-noone", m, r, "")
+		fallthrough
+
+	case failoverStateSendReplicaof:
+		r := m.promoted
+		if !r.linkUp {
+			if now.Sub(m.failoverStateChange) > m.failoverTimeout {
+				s.abortFailover(m, "-failover-abort-slave-timeout")
+			}
+			return
+		}
+		m.failoverState = failoverStateWaitPromotion
+		m.failoverStateChange = now
+		r.infoRefresh = true
+		s.event("+failover-state-wait-promotion", m, r, "")
+		go func() {
+			if _, err := s.call(r, "REPLICAOF", "NO", "ONE"); err != nil {
+				fmt.Printf("REPLICAOF NO ONE to %s failed: %v\n", r.addr, err)
+			}
+		}()
+
+	case failoverStateWaitPromotion:
+		// refreshInfo moves on when the replica reports its new role.
+		if now.Sub(m.failoverStateChange) > m.failoverTimeout {
+			s.abortFailover(m, "-failover-abort-slave-timeout")
+		}
+
+	case failoverStateReconfReplicas:
+		s.reconfigureReplicas(m, now)
+	}
+}
+
+// selectReplica picks the replica to promote: among the healthy ones with a
+// non-zero priority, the lowest priority, then the largest offset.
+func (s *Sentinel) selectReplica(m *master, now time.Time) *instance {
+	infoValidity := 3 * infoPeriod
+	if m.sdown() {
+		infoValidity = 5 * time.Second
+	}
+	var candidates []*instance
+	for _, r := range m.replicas {
+		if r.sdown() || !r.linkUp || r.priority == 0 || r.role != "slave" ||
+			now.Sub(r.lastAvail) > 5*pingPeriod || now.Sub(r.lastInfo) > infoValidity {
+			continue
+		}
+		candidates = append(candidates, r)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	slices.SortFunc(candidates, func(a, b *instance) int {
+		if a.priority != b.priority {
+			return a.priority - b.priority
+		}
+		if a.replOffset != b.replOffset {
+			if a.replOffset > b.replOffset {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.addr, b.addr)
+	})
+	return candidates[0]
+}
+
+// promotionDone is called when the promoted replica reports the master
+// role: its configuration wins from now on, under the failover epoch.
+func (s *Sentinel) promotionDone(m *master, now time.Time) {
+	m.configEpoch = m.failoverEpoch
+	m.failoverState = failoverStateReconfReplicas
+	m.failoverStateChange = now
+	s.event("+promoted-slave", m, m.promoted, "")
+	s.event("+failover-state-reconf-slaves", m, m.instance, "")
+}
+
+// reconfigureReplicas points the other replicas to the promoted one and
+// completes the failover once they follow it, or after the timeout.
+func (s *Sentinel) reconfigureReplicas(m *master, now time.Time) {
+	host, port, _ := net.SplitHostPort(m.promoted.addr)
+	done := true
+	for _, r := range m.replicas {
+		if r == m.promoted {
+			continue
+		}
+		if !r.reconfSent {
+			r.reconfSent = true
+			r.infoRefresh = true
+			s.event("+slave-reconf-sent", m, r, "")
+			go s.call(r, "REPLICAOF", host, port)
+		}
+		if !r.sdown() && (r.masterAddr != m.promoted.addr || !r.masterLinkUp) {
+			done = false
+		}
+	}
+	if !done && now.Sub(m.failoverStateChange) <= m.failoverTimeout {
+		return
+	}
+	if done {
+		s.event("+failover-end", m, m.instance, "")
+	} else {
+		s.event("+failover-end-for-timeout", m, m.instance, "")
+	}
+	s.switchMaster(m, m.promoted.addr)
+}
+
+func (s *Sentinel) abortFailover(m *master, reason string) {
+	s.event(reason, m, m.instance, "")
+	s.event("-failover-abort", m, m.instance, "")
+	s.resetFailover(m)
+}
+
+func (s *Sentinel) resetFailover(m *master) {
+	m.failoverState = failoverStateNone
+	m.failoverStateChange = time.Now()
+	m.forced = false
+	m.promoted = nil
+	for _, r := range m.replicas {
+		r.reconfSent = false
+	}
+}
+
+// switchMaster makes addr the address of m. The old master and the other
+// replicas become its replicas, which are found again from scratch.
+func (s *Sentinel) switchMaster(m *master, addr string) {
+	old := m.addr
+	addrs := []string{}
+	for a, r := range m.replicas {
+		if a != addr {
+			addrs = append(addrs, a)
+		}
+		r.forget()
+	}
+	if old != addr {
+		addrs = append(addrs, old)
+	}
+	m.instance.forget()
+
+	oldHost, oldPort, _ := net.SplitHostPort(old)
+	newHost, newPort, _ := net.SplitHostPort(addr)
+	fmt.Printf("+switch-master %s %s %s %s %s\n", m.name, oldHost, oldPort, newHost, newPort)
+
+	m.instance = newInstance(addr)
+	m.replicas = make(map[string]*instance)
+	m.odownSince = time.Time{}
+	s.resetFailover(m)
+	s.startLinks(m, m.instance, true)
+	for _, a := range addrs {
+		r := newInstance(a)
+		m.replicas[a] = r
+		s.event("+slave", m, r, "")
+		s.startLinks(m, r, true)
+	}
+}
+
+// reset implements SENTINEL RESET for m: it forgets the replicas, the other
+// sentinels and any failover in progress, and starts discovering again.
+func (s *Sentinel) reset(m *master) {
+	for _, r := range m.replicas {
+		r.forget()
+	}
+	for _, p := range m.sentinels {
+		p.forget()
+	}
+	m.instance.forget()
+	m.instance = newInstance(m.addr)
+	m.replicas = make(map[string]*instance)
+	m.sentinels = make(map[string]*peer)
+	m.odownSince = time.Time{}
+	m.leader, m.leaderEpoch = "", 0
+	s.resetFailover(m)
+	s.event("+reset-master", m, m.instance, "")
+	s.startLinks(m, m.instance, true)
+}
@@ -0,0 +1,376 @@
+package sentinel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/resp"
+)
+
+var errLinkDown = errors.New("link down")
+
+// request is a command sent on the command link of an instance.
+type request struct {
+	args  []string
+	reply chan resp.Value
+}
+
+// startLinks starts the links of inst, a master or replica of m when hello
+// is set and another sentinel otherwise. Must be called with s.mu held.
+func (s *Sentinel) startLinks(m *master, inst *instance, hello bool) {
+	go s.commandLink(m, inst, hello)
+	if hello {
+		go s.helloLink(inst)
+	}
+}
+
+// commandLink keeps a connection to inst for PING, INFO and, to masters and
+// replicas, the hello messages, reconnecting until inst is forgotten.
+func (s *Sentinel) commandLink(m *master, inst *instance, hello bool) {
+	for {
+		conn, err := net.DialTimeout("tcp", inst.addr, linkTimeout)
+		if err == nil {
+			s.serveLink(m, inst, hello, conn)
+			conn.Close()
+		}
+		s.mu.Lock()
+		inst.linkUp = false
+		s.mu.Unlock()
+		select {
+		case <-inst.done:
+			return
+		case <-time.After(pingPeriod):
+		}
+	}
+}
+
+// serveLink runs the periodic commands and the requests on conn until it
+// fails.
+func (s *Sentinel) serveLink(m *master, inst *instance, hello bool, conn net.Conn) {
+	reader := resp.NewResp(conn)
+	call := func(args ...string) (resp.Value, error) {
+		conn.SetDeadline(time.Now().Add(linkTimeout))
+		if _, err := conn.Write(resp.Marshal(resp.Command(args...))); err != nil {
+			return resp.Value{}, err
+		}
+		return reader.Read()
+	}
+
+	var lastPing, lastInfo, lastHello time.Time
+	ticker := time.NewTicker(tickPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-inst.done:
+			return
+		case req := <-inst.requests:
+			reply, err := call(req.args...)
+			if err != nil {
+				reply = resp.Value{Type: "error", Str: err.Error()}
+			}
+			req.reply <- reply
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		if now.Sub(lastPing) >= pingPeriod {
+			lastPing = now
+			s.mu.Lock()
+			if inst.pingSent.IsZero() {
+				inst.pingSent = now
+			}
+			s.mu.Unlock()
+			reply, err := call("PING")
+			if err != nil {
+				return
+			}
+			s.pingReply(inst, reply)
+		}
+		if !hello {
+			continue
+		}
+		s.mu.Lock()
+		period := s.infoPeriod(m, inst)
+		if inst.infoRefresh {
+			inst.infoRefresh = false
+			period = 0
+		}
+		s.mu.Unlock()
+		if now.Sub(lastInfo) >= period {
+			lastInfo = now
+			reply, err := call("INFO", "replication")
+			if err != nil {
+				return
+			}
+			if reply.Type == "bulk" {
+				s.refreshInfo(m, inst, reply.Bulk)
+			}
+		}
+		if now.Sub(lastHello) >= helloPeriod {
+			lastHello = now
+			ip, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+			s.mu.Lock()
+			msg := s.hello(m, ip)
+			s.mu.Unlock()
+			if _, err := call("PUBLISH", helloChannel, msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// call sends a command on the command link of inst and waits for the reply.
+func (s *Sentinel) call(inst *instance, args ...string) (resp.Value, error) {
+	req := request{args: args, reply: make(chan resp.Value, 1)}
+	select {
+	case inst.requests <- req:
+	case <-inst.done:
+		return resp.Value{}, errLinkDown
+	case <-time.After(linkTimeout):
+		return resp.Value{}, errLinkDown
+	}
+	reply := <-req.reply
+	if reply.Type == "error" {
+		return reply, errors.New(reply.Str)
+	}
+	return reply, nil
+}
+
+// helloLink subscribes to the hello channel of inst, reconnecting until inst
+// is forgotten.
+func (s *Sentinel) helloLink(inst *instance) {
+	for {
+		conn, err := net.DialTimeout("tcp", inst.addr, linkTimeout)
+		if err == nil {
+			s.readHellos(inst, conn)
+			conn.Close()
+		}
+		select {
+		case <-inst.done:
+			return
+		case <-time.After(pingPeriod):
+		}
+	}
+}
+
+func (s *Sentinel) readHellos(inst *instance, conn net.Conn) {
+	conn.SetWriteDeadline(time.Now().Add(linkTimeout))
+	if _, err := conn.Write(resp.Marshal(resp.Command("SUBSCRIBE", helloChannel))); err != nil {
+		return
+	}
+	reader := resp.NewResp(conn)
+	for {
+		select {
+		case <-inst.done:
+			return
+		default:
+		}
+		// Every sentinel, this one included, says hello every helloPeriod;
+		// a silent link is a broken one.
+		conn.SetReadDeadline(time.Now().Add(3 * helloPeriod))
+		msg, err := reader.Read()
+		if err != nil {
+			return
+		}
+		if msg.Type == "array" && len(msg.Array) == 3 && msg.Array[0].Bulk == "message" {
+			s.processHello(msg.Array[2].Bulk)
+		}
+	}
+}
+
+// pingReply records a reply to PING. Busy instances that are loading or
+// without their master still count as available, as in Redis.
+func (s *Sentinel) pingReply(inst *instance, reply resp.Value) {
+	valid := reply.Type == "string" && reply.Str == "PONG" ||
+		reply.Type == "error" && (strings.HasPrefix(reply.Str, "LOADING") || strings.HasPrefix(reply.Str, "MASTERDOWN"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst.linkUp = true
+	if valid {
+		inst.lastAvail = time.Now()
+		inst.pingSent = time.Time{}
+	}
+}
+
+// infoPeriod is how often INFO is sent to inst: every second when its
+// master is down or failing over, so that changes are seen quickly.
+// Must be called with s.mu held.
+func (s *Sentinel) infoPeriod(m *master, inst *instance) time.Duration {
+	if m.sdown() || m.failoverState != failoverStateNone {
+		return time.Second
+	}
+	return infoPeriod
+}
+
+// refreshInfo records the replication state inst reports in INFO: the
+// replicas of a master, the master of a replica.
+func (s *Sentinel) refreshInfo(m *master, inst *instance, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.instance != inst && m.replicas[inst.addr] != inst {
+		return // forgotten meanwhile
+	}
+	now := time.Now()
+	inst.lastInfo = now
+
+	var role, masterHost, masterPort string
+	inst.masterLinkUp = false
+	for _, line := range strings.Split(text, "\r\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch {
+		case key == "role":
+			role = value
+		case key == "master_host":
+			masterHost = value
+		case key == "master_port":
+			masterPort = value
+		case key == "master_link_status":
+			inst.masterLinkUp = value == "up"
+		case key == "slave_priority":
+			inst.priority, _ = strconv.Atoi(value)
+		case key == "slave_repl_offset":
+			inst.replOffset, _ = strconv.ParseInt(value, 10, 64)
+		case strings.HasPrefix(key, "slave") && inst == m.instance:
+			// slave0:ip=127.0.0.1,port=6380,state=online,offset=42,lag=0
+			var ip, port string
+			for _, field := range strings.Split(value, ",") {
+				k, v, _ := strings.Cut(field, "=")
+				switch k {
+				case "ip":
+					ip = v
+				case "port":
+					port = v
+				}
+			}
+			if ip == "" || port == "" {
+				continue
+			}
+			addr := net.JoinHostPort(ip, port)
+			if m.replicas[addr] == nil && addr != m.addr {
+				r := newInstance(addr)
+				m.replicas[addr] = r
+				s.event("+slave", m, r, "")
+				s.startLinks(m, r, true)
+			}
+		}
+	}
+	if role != inst.role {
+		inst.role = role
+		inst.roleReported = now
+	}
+	inst.masterAddr = ""
+	if masterHost != "" {
+		inst.masterAddr = net.JoinHostPort(masterHost, masterPort)
+	}
+
+	if inst == m.instance {
+		return
+	}
+	if inst == m.promoted && role == "master" && m.failoverState == failoverStateWaitPromotion {
+		s.promotionDone(m, now)
+		return
+	}
+	s.fixReplicaConfig(m, inst, now)
+}
+
+// fixReplicaConfig points a replica that follows another master, or turned
+// into a master itself, back to m. It waits long enough to learn about a
+// failover from the hellos of the other sentinels first.
+func (s *Sentinel) fixReplicaConfig(m *master, inst *instance, now time.Time) {
+	wait := 4 * helloPeriod
+	if m.failoverState != failoverStateNone || !s.masterLooksSane(m, now) || inst.sdown() ||
+		now.Sub(inst.roleReported) < wait || now.Sub(inst.lastReconf) < wait {
+		return
+	}
+	var kind string
+	switch {
+	case inst.role == "master":
+		kind = "+convert-to-slave"
+	case inst.role == "slave" && inst.masterAddr != m.addr:
+		kind = "+fix-slave-config"
+	default:
+		return
+	}
+	inst.lastReconf = now
+	s.event(kind, m, inst, "")
+	host, port, _ := net.SplitHostPort(m.addr)
+	go s.call(inst, "REPLICAOF", host, port)
+}
+
+// masterLooksSane reports whether m is up and reports itself as a master.
+func (s *Sentinel) masterLooksSane(m *master, now time.Time) bool {
+	return !m.sdown() && m.role == "master" && now.Sub(m.lastInfo) < 2*infoPeriod
+}
+
+// hello returns the message announcing this sentinel and its view of m:
+// "ip,port,runid,current_epoch,master_name,master_ip,master_port,master_config_epoch".
+// Must be called with s.mu held.
+func (s *Sentinel) hello(m *master, ip string) string {
+	mhost, mport, _ := net.SplitHostPort(m.currentAddr())
+	return fmt.Sprintf("%s,%d,%s,%d,%s,%s,%s,%d", ip, s.port, s.myid, s.currentEpoch, m.name, mhost, mport, m.configEpoch)
+}
+
+// processHello learns about another sentinel from its hello message, and
+// adopts its configuration of the master when it is newer.
+func (s *Sentinel) processHello(msg string) {
+	fields := strings.Split(msg, ",")
+	if len(fields) != 8 {
+		return
+	}
+	ip, port, runid, name, mhost, mport := fields[0], fields[1], fields[2], fields[4], fields[5], fields[6]
+	epoch, err1 := strconv.ParseInt(fields[3], 10, 64)
+	configEpoch, err2 := strconv.ParseInt(fields[7], 10, 64)
+	if err1 != nil || err2 != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.masters[name]
+	if m == nil || runid == s.myid {
+		return
+	}
+	addr := net.JoinHostPort(ip, port)
+	p := m.sentinels[runid]
+	if p != nil && p.addr != addr {
+		p.forget()
+		delete(m.sentinels, runid)
+		p = nil
+	}
+	if p == nil {
+		// A sentinel that restarted has a new ID: drop the old entry.
+		for id, other := range m.sentinels {
+			if other.addr == addr {
+				other.forget()
+				delete(m.sentinels, id)
+			}
+		}
+		p = &peer{instance: newInstance(addr), runid: runid}
+		m.sentinels[runid] = p
+		s.event("+sentinel", m, p.instance, "")
+		s.startLinks(m, p.instance, false)
+	}
+	p.lastHello = time.Now()
+
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		fmt.Printf("+new-epoch %d\n", epoch)
+	}
+	if configEpoch > m.configEpoch {
+		m.configEpoch = configEpoch
+		if newAddr := net.JoinHostPort(mhost, mport); newAddr != m.addr {
+			s.event("+config-update-from", m, p.instance, "")
+			s.switchMaster(m, newAddr)
+		}
+	}
+}
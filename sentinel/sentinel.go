@@ -0,0 +1,273 @@
+// Package sentinel implements Redis Sentinel: it monitors masters and their
+// replicas, agrees with the other sentinels watching the same master that
+// it is down, and promotes one of its replicas in its place.
+package sentinel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the per-master options, as in sentinel.conf.
+const (
+	DefaultDownAfter       = 30 * time.Second
+	DefaultFailoverTimeout = 3 * time.Minute
+)
+
+const (
+	tickPeriod  = 100 * time.Millisecond
+	pingPeriod  = time.Second
+	infoPeriod  = 10 * time.Second
+	helloPeriod = 2 * time.Second
+	askPeriod   = time.Second
+	linkTimeout = 2 * time.Second
+	// maxDesync spreads the failover attempts of the sentinels, so that
+	// one of them usually gets elected at the first try.
+	maxDesync = time.Second
+
+	helloChannel = "__sentinel__:hello"
+)
+
+// MasterConfig is a master to monitor, as given by "sentinel monitor".
+type MasterConfig struct {
+	Name            string
+	Addr            string
+	Quorum          int
+	DownAfter       time.Duration
+	FailoverTimeout time.Duration
+}
+
+// ParseMonitor parses "<name> <host> <port> <quorum>".
+func ParseMonitor(s string) (MasterConfig, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 4 {
+		return MasterConfig{}, fmt.Errorf("sentinel monitor expects \"<name> <host> <port> <quorum>\", got %q", s)
+	}
+	port, err := strconv.Atoi(fields[2])
+	if err != nil || port <= 0 || port > 65535 {
+		return MasterConfig{}, fmt.Errorf("invalid port in sentinel monitor: %q", fields[2])
+	}
+	quorum, err := strconv.Atoi(fields[3])
+	if err != nil || quorum <= 0 {
+		return MasterConfig{}, fmt.Errorf("invalid quorum in sentinel monitor: %q", fields[3])
+	}
+	return MasterConfig{
+		Name:            fields[0],
+		Addr:            net.JoinHostPort(fields[1], fields[2]),
+		Quorum:          quorum,
+		DownAfter:       DefaultDownAfter,
+		FailoverTimeout: DefaultFailoverTimeout,
+	}, nil
+}
+
+// Sentinel monitors a set of masters. All its state is guarded by mu; the
+// goroutines talking to the instances take it to record what they learn.
+type Sentinel struct {
+	port int
+
+	mu           sync.Mutex
+	myid         string
+	currentEpoch int64
+	masters      map[string]*master
+}
+
+// instance is a monitored server: a master, a replica or another sentinel.
+// Its links run until done is closed, and carry the requests sent to it.
+type instance struct {
+	addr     string
+	done     chan struct{}
+	requests chan request
+
+	created     time.Time
+	lastAvail   time.Time // last valid reply to PING
+	pingSent    time.Time // PING awaiting a valid reply, zero if none
+	linkUp      bool
+	sdownSince  time.Time
+	lastInfo    time.Time
+	lastReconf  time.Time // last REPLICAOF sent to fix its configuration
+	reconfSent  bool      // during a failover
+	askPending  bool
+	infoRefresh bool // INFO is wanted right away
+
+	// As reported by INFO.
+	role         string
+	roleReported time.Time
+	masterAddr   string
+	masterLinkUp bool
+	priority     int
+	replOffset   int64
+}
+
+// master is a monitored master with what is known about it.
+type master struct {
+	*instance
+	name            string
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+
+	replicas  map[string]*instance // by address
+	sentinels map[string]*peer     // by run ID
+
+	odownSince  time.Time
+	configEpoch int64
+	lastAsk     time.Time
+
+	// This sentinel's vote in the leader election of leaderEpoch.
+	leader      string
+	leaderEpoch int64
+
+	failoverState       string
+	failoverEpoch       int64
+	failoverStart       time.Time
+	failoverStateChange time.Time
+	forced              bool
+	promoted            *instance
+}
+
+// peer is another sentinel monitoring the same master.
+type peer struct {
+	*instance
+	runid     string
+	lastHello time.Time
+
+	// From its last reply to SENTINEL IS-MASTER-DOWN-BY-ADDR.
+	masterDown    bool
+	lastDownReply time.Time
+	leader        string
+	leaderEpoch   int64
+}
+
+// New returns a sentinel listening on port and monitoring masters.
+func New(port int, masters []MasterConfig) *Sentinel {
+	s := &Sentinel{
+		port:    port,
+		myid:    newRunID(),
+		masters: make(map[string]*master),
+	}
+	for _, c := range masters {
+		s.masters[c.Name] = &master{
+			instance:        newInstance(c.Addr),
+			name:            c.Name,
+			quorum:          c.Quorum,
+			downAfter:       c.DownAfter,
+			failoverTimeout: c.FailoverTimeout,
+			replicas:        make(map[string]*instance),
+			sentinels:       make(map[string]*peer),
+			failoverState:   failoverStateNone,
+		}
+	}
+	return s
+}
+
+// Start connects to the monitored masters and runs the periodic checks in
+// the background.
+func (s *Sentinel) Start() {
+	s.mu.Lock()
+	fmt.Printf("Sentinel ID is %s\n", s.myid)
+	for _, m := range s.masters {
+		s.event("+monitor", m, m.instance, fmt.Sprintf("quorum %d", m.quorum))
+		s.startLinks(m, m.instance, true)
+	}
+	s.mu.Unlock()
+
+	go func() {
+		for range time.Tick(tickPeriod) {
+			s.tick()
+		}
+	}()
+}
+
+// tick runs the checks of every master, as Redis' sentinelTimer.
+func (s *Sentinel) tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, m := range s.masters {
+		s.checkSubjectivelyDown(m, m.instance, now)
+		for _, r := range m.replicas {
+			s.checkSubjectivelyDown(m, r, now)
+		}
+		for _, p := range m.sentinels {
+			s.checkSubjectivelyDown(m, p.instance, now)
+		}
+		s.checkObjectivelyDown(m, now)
+		if s.startFailoverIfNeeded(m, now) {
+			m.lastAsk = time.Time{}
+		}
+		s.failoverStep(m, now)
+		s.askOtherSentinels(m, now)
+	}
+}
+
+func newInstance(addr string) *instance {
+	now := time.Now()
+	return &instance{
+		addr:      addr,
+		done:      make(chan struct{}),
+		requests:  make(chan request),
+		created:   now,
+		lastAvail: now,
+		priority:  100,
+	}
+}
+
+// forget stops the links of inst.
+func (inst *instance) forget() {
+	close(inst.done)
+}
+
+func (inst *instance) sdown() bool {
+	return !inst.sdownSince.IsZero()
+}
+
+// currentAddr returns the address clients should use for m: the promoted
+// replica once it accepted the role, even before the failover completes.
+func (m *master) currentAddr() string {
+	if m.promoted != nil && m.failoverState == failoverStateReconfReplicas {
+		return m.promoted.addr
+	}
+	return m.addr
+}
+
+// kind names inst in events and flags.
+func (m *master) kind(inst *instance) string {
+	if inst == m.instance {
+		return "master"
+	}
+	for _, p := range m.sentinels {
+		if p.instance == inst {
+			return "sentinel"
+		}
+	}
+	return "slave"
+}
+
+// event logs a Sentinel event in Redis' format, e.g.
+// "+sdown slave 127.0.0.1:6380 127.0.0.1 6380 @ mymaster 127.0.0.1 6379".
+func (s *Sentinel) event(kind string, m *master, inst *instance, extra string) {
+	host, port, _ := net.SplitHostPort(inst.addr)
+	var msg string
+	if inst == m.instance {
+		msg = fmt.Sprintf("%s master %s %s %s", kind, m.name, host, port)
+	} else {
+		mhost, mport, _ := net.SplitHostPort(m.addr)
+		msg = fmt.Sprintf("%s %s %s %s %s @ %s %s %s", kind, m.kind(inst), inst.addr, host, port, m.name, mhost, mport)
+	}
+	if extra != "" {
+		msg += " " + extra
+	}
+	fmt.Println(msg)
+}
+
+func newRunID() string {
+	var b [20]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
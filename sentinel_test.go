@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startReplicationGroup starts a master and n replicas of it.
+func startReplicationGroup(t *testing.T, n int) (*process, []*process) {
+	master := startProcess(t, freePort(t))
+	var replicas []*process
+	for range n {
+		replicas = append(replicas, startProcess(t, freePort(t), "-replicaof", "127.0.0.1 "+master.port))
+	}
+	return master, replicas
+}
+
+// startSentinels starts n sentinels monitoring master as mymaster.
+func startSentinels(t *testing.T, n, quorum int, master *process) []*process {
+	var sentinels []*process
+	for range n {
+		sentinels = append(sentinels, startProcess(t, freePort(t), "-sentinel",
+			"-sentinel-monitor", "mymaster 127.0.0.1 "+master.port+" "+strconv.Itoa(quorum),
+			"-sentinel-down-after-milliseconds", "1000",
+			"-sentinel-failover-timeout", "10000"))
+	}
+	return sentinels
+}
+
+// masterAddr returns the address a sentinel reports for mymaster, or "".
+func masterAddr(s *process) string {
+	reply, err := call(s.addr(), "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster")
+	if err != nil || len(reply.Array) != 2 {
+		return ""
+	}
+	return net.JoinHostPort(reply.Array[0].Bulk, reply.Array[1].Bulk)
+}
+
+// waitDiscovery waits until every sentinel knows the other sentinels and
+// has the INFO of the replicas, which makes them candidates for promotion.
+func waitDiscovery(t *testing.T, sentinels []*process, replicas int) {
+	t.Helper()
+	for _, s := range sentinels {
+		waitFor(t, 30*time.Second, "sentinel "+s.port+" to discover the replicas and sentinels", func() bool {
+			reply, err := call(s.addr(), "SENTINEL", "MASTER", "mymaster")
+			if err != nil || fields(reply)["num-other-sentinels"] != strconv.Itoa(len(sentinels)-1) {
+				return false
+			}
+			reply, err = call(s.addr(), "SENTINEL", "REPLICAS", "mymaster")
+			if err != nil || len(reply.Array) != replicas {
+				return false
+			}
+			for _, r := range reply.Array {
+				if f := fields(r); f["master-link-status"] != "ok" || f["info-refresh"] == "" {
+					return false
+				}
+			}
+			return true
+		})
+	}
+}
+
+// waitFollowing waits until a write to master is read from replica.
+func waitFollowing(t *testing.T, master, replica *process) {
+	t.Helper()
+	key := "following-" + replica.port
+	if reply := mustCall(t, master.addr(), "SET", key, master.port); reply.Str != "OK" {
+		t.Fatalf("SET on the new master %s: %+v", master.port, reply)
+	}
+	waitFor(t, 30*time.Second, "replica "+replica.port+" to follow "+master.port, func() bool {
+		reply, err := call(replica.addr(), "GET", key)
+		return err == nil && reply.Bulk == master.port
+	})
+}
+
+func TestSentinelFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs several processes for a while")
+	}
+	master, replicas := startReplicationGroup(t, 2)
+	sentinels := startSentinels(t, 3, 2, master)
+	waitDiscovery(t, sentinels, len(replicas))
+
+	for _, s := range sentinels {
+		if addr := masterAddr(s); addr != master.addr() {
+			t.Fatalf("sentinel %s reports the master at %q, want %s", s.port, addr, master.addr())
+		}
+	}
+	if reply := mustCall(t, sentinels[0].addr(), "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "unknown"); reply.Type != "nil" {
+		t.Fatalf("GET-MASTER-ADDR-BY-NAME of an unknown master: %+v", reply)
+	}
+	reply := mustCall(t, sentinels[0].addr(), "SENTINEL", "REPLICAS", "mymaster")
+	var ports []string
+	for _, r := range reply.Array {
+		ports = append(ports, fields(r)["port"])
+	}
+	if !slices.Contains(ports, replicas[0].port) || !slices.Contains(ports, replicas[1].port) {
+		t.Fatalf("SENTINEL REPLICAS lists ports %v, want %s and %s", ports, replicas[0].port, replicas[1].port)
+	}
+
+	master.kill()
+
+	var promoted string
+	waitFor(t, 60*time.Second, "the sentinels to agree on a promoted replica", func() bool {
+		promoted = masterAddr(sentinels[0])
+		if promoted == master.addr() || promoted == "" {
+			return false
+		}
+		for _, s := range sentinels[1:] {
+			if masterAddr(s) != promoted {
+				return false
+			}
+		}
+		return true
+	})
+	i := slices.IndexFunc(replicas, func(r *process) bool { return r.addr() == promoted })
+	if i < 0 {
+		t.Fatalf("the sentinels promoted %s, which isn't a replica", promoted)
+	}
+	newMaster, other := replicas[i], replicas[1-i]
+	if reply := mustCall(t, newMaster.addr(), "ROLE"); len(reply.Array) == 0 || reply.Array[0].Bulk != "master" {
+		t.Fatalf("ROLE of the promoted replica: %+v", reply)
+	}
+	waitFollowing(t, newMaster, other)
+	// The leader switches to the new master once the failover ends.
+	for _, s := range sentinels {
+		waitFor(t, 30*time.Second, "sentinel "+s.port+" to end the failover", func() bool {
+			reply, err := call(s.addr(), "SENTINEL", "MASTER", "mymaster")
+			f := fields(reply)
+			return err == nil && f["port"] == newMaster.port && f["failover-state"] == "none"
+		})
+	}
+}
+
+func TestSentinelManualFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs several processes for a while")
+	}
+	master, replicas := startReplicationGroup(t, 1)
+	sentinels := startSentinels(t, 1, 1, master)
+	s := sentinels[0]
+	waitDiscovery(t, sentinels, len(replicas))
+
+	if reply := mustCall(t, s.addr(), "SENTINEL", "FAILOVER", "unknown"); reply.Type != "error" {
+		t.Fatalf("SENTINEL FAILOVER of an unknown master: %+v", reply)
+	}
+	if reply := mustCall(t, s.addr(), "SENTINEL", "FAILOVER", "mymaster"); reply.Str != "OK" {
+		t.Fatalf("SENTINEL FAILOVER: %+v", reply)
+	}
+	if reply := mustCall(t, s.addr(), "SENTINEL", "FAILOVER", "mymaster"); reply.Type != "error" {
+		t.Fatalf("SENTINEL FAILOVER while one is in progress: %+v", reply)
+	}
+	waitFor(t, 30*time.Second, "the replica to be promoted", func() bool {
+		return masterAddr(s) == replicas[0].addr()
+	})
+	// The old master, still running, is turned into a replica.
+	waitFollowing(t, replicas[0], master)
+
+	if reply := mustCall(t, s.addr(), "SENTINEL", "RESET", "my*"); reply.Num != 1 {
+		t.Fatalf("SENTINEL RESET: %+v", reply)
+	}
+	if addr := masterAddr(s); addr != replicas[0].addr() {
+		t.Fatalf("after SENTINEL RESET the master is at %q, want %s", addr, replicas[0].addr())
+	}
+	waitDiscovery(t, sentinels, 1)
+	reply := mustCall(t, s.addr(), "SENTINEL", "REPLICAS", "mymaster")
+	if len(reply.Array) != 1 || fields(reply.Array[0])["port"] != master.port {
+		t.Fatalf("SENTINEL REPLICAS after the failover: %+v", reply)
+	}
+}
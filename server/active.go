@@ -0,0 +1,545 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/resp"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// In active-active mode several masters take writes and exchange them
+// asynchronously, so that each keeps serving during a partition. Every key
+// holds a CRDT (see store/crdt.go) whose states merge to the same value on
+// every master once they all got each other's writes.
+//
+// Every master lists every other one as a peer and streams them its
+// writes, as the new state of the key they changed:
+//
+//	ACTIVE SYNC <replica-id> <peer-id or ?> <offset>
+//	  -> +CONTINUE, then the stream from offset
+//	  -> +FULLSYNC <peer-id> <offset> <count>, then count "STATE <key> <state>",
+//	     then the stream from offset
+//
+// The stream is made of "OP <key> <state>" and PING, and counted in bytes
+// like the replication stream; the last part of it is kept in a backlog of
+// repl-backlog-size bytes, so that a peer can resume it. The receiving side
+// acknowledges every second with "ACTIVE ACK <offset> <own stream offset>".
+//
+// The replica ID is random for every run: a restarted master gets a full
+// synchronization from its peers, and sends them one.
+
+// activeDataAux is the RDB aux field holding the CRDT states of the keys.
+const activeDataAux = "active-crdt"
+
+var errActiveProtocol = errors.New("bad protocol from active peer")
+
+// activeState is the state of a master in active-active mode.
+type activeState struct {
+	id string
+
+	mu      sync.Mutex
+	offset  int64
+	backlog *replBacklog
+	links   []*activeLink // peers our stream goes to
+	peers   []*activePeer // peers whose stream we merge, as configured
+	// tombstones are the keys that lost their value, with the offset of our
+	// stream when that happened.
+	tombstones []activeTombstone
+	lastPing   time.Time
+}
+
+type activeTombstone struct {
+	key    string
+	state  *store.CRDT
+	offset int64
+}
+
+// activeLink is a connection that turned into the stream of our writes to a
+// peer with ACTIVE SYNC. Like for replicas, the stream is queued in pending
+// and sent by its own goroutine.
+type activeLink struct {
+	conn   net.Conn
+	peerID string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	closed  bool
+	// From the last ACTIVE ACK: our offset the peer merged, and the offset
+	// of its own stream at the time.
+	ackOffset int64
+	peerEnd   int64
+	ackTime   time.Time
+}
+
+// activePeer is our connection to a peer, receiving its stream.
+type activePeer struct {
+	addr string
+
+	mu     sync.Mutex
+	id     string // of the stream we follow, "" before the first synchronization
+	offset int64  // of that stream, merged
+	conn   net.Conn
+	lastIO time.Time
+}
+
+// ActiveInit prepares active-active mode; the CRDTs are set up when the
+// dataset is loaded, and StartActivePeers connects to the peers.
+func (info *ServerInfo) ActiveInit() {
+	var b [8]byte
+	rand.Read(b[:])
+	a := &activeState{
+		id:      hex.EncodeToString(b[:]),
+		backlog: newReplBacklog(info.replBacklogSize(), 0),
+	}
+	for _, addr := range info.ActivePeers {
+		a.peers = append(a.peers, &activePeer{addr: masterAddress(addr)})
+	}
+	info.active = a
+	fmt.Printf("Active-active mode, replica ID %s\n", a.id)
+}
+
+// enableActive switches kv to CRDTs, with the states from the aux fields of
+// the RDB file. It does nothing outside active-active mode.
+func (info *ServerInfo) enableActive(kv *store.KeyValueStore, aux map[string]string) error {
+	a := info.active
+	if a == nil {
+		return nil
+	}
+	var states map[string]*store.CRDT
+	if s, ok := aux[activeDataAux]; ok {
+		if err := json.Unmarshal([]byte(s), &states); err != nil {
+			return fmt.Errorf("invalid %s field in the RDB file: %w", activeDataAux, err)
+		}
+	}
+	kv.EnableCRDT(a.id, states, func(key string, c *store.CRDT) {
+		cmd := resp.Command("OP", key, string(c.Marshal()))
+		info.dropActiveLinks(a.feed(resp.Marshal(cmd), key, c))
+	})
+	return nil
+}
+
+// StartActivePeers connects to the configured peers and merges their writes,
+// reconnecting whenever a link drops. Call it once the dataset is loaded.
+func (info *ServerInfo) StartActivePeers(kv *store.KeyValueStore) {
+	for _, p := range info.active.peers {
+		go info.followActivePeer(kv, p)
+	}
+}
+
+// activeRejects returns the error for commands that can't run in
+// active-active mode, or "".
+func (info *ServerInfo) activeRejects(command string) string {
+	if info.active == nil {
+		return ""
+	}
+	switch command {
+	case "MIGRATE", "REPLICAOF", "SLAVEOF", "FAILOVER", "PSYNC", "SYNC":
+		return "ERR " + command + " is not allowed in active-active mode"
+	}
+	return ""
+}
+
+// feed adds data to our stream. The state c of key comes from a write; when
+// it has no value, it is remembered until every peer has it. It returns the
+// links that fell too far behind.
+func (a *activeState) feed(data []byte, key string, c *store.CRDT) []*activeLink {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.backlog.write(data)
+	a.offset += int64(len(data))
+	if c != nil && !c.HasValue() {
+		a.tombstones = append(a.tombstones, activeTombstone{key: key, state: c, offset: a.offset})
+	}
+	var lagging []*activeLink
+	for _, l := range a.links {
+		if !l.queue(data) {
+			lagging = append(lagging, l)
+		}
+	}
+	return lagging
+}
+
+// activeSync serves ACTIVE SYNC on conn and returns the attached link, or
+// nil and the error to reply.
+func (info *ServerInfo) activeSync(kv *store.KeyValueStore, conn net.Conn, args []resp.Value) (*activeLink, resp.Value) {
+	a := info.active
+	if a == nil {
+		return nil, resp.Value{Type: "error", Str: "ERR This instance has active-active support disabled"}
+	}
+	if len(args) != 4 || !strings.EqualFold(args[0].Bulk, "SYNC") {
+		return nil, resp.Value{Type: "error", Str: "ERR syntax error"}
+	}
+	l := &activeLink{conn: conn, peerID: args[1].Bulk, ackTime: time.Now()}
+	l.cond = sync.NewCond(&l.mu)
+
+	// No write may slip between the states and the attachment.
+	info.writeMu.Lock()
+	if offset, err := strconv.ParseInt(args[3].Bulk, 10, 64); err == nil && args[2].Bulk == a.id {
+		a.mu.Lock()
+		data, ok := a.backlog.readFrom(offset)
+		if ok {
+			l.pending = data
+			a.links = append(a.links, l)
+		}
+		a.mu.Unlock()
+		if ok {
+			info.writeMu.Unlock()
+			if _, err := io.WriteString(conn, "+CONTINUE\r\n"); err != nil {
+				info.dropActiveLink(l)
+				return l, resp.Value{}
+			}
+			fmt.Printf("Active peer %s resumes our stream at offset %d\n", l.peerID, offset)
+			go info.writeToActiveLink(l)
+			return l, resp.Value{}
+		}
+	}
+	states := kv.CRDTStates()
+	a.mu.Lock()
+	offset := a.offset
+	a.links = append(a.links, l)
+	a.mu.Unlock()
+	info.writeMu.Unlock()
+
+	fmt.Printf("Active peer %s asks for a full synchronization, sending %d keys\n", l.peerID, len(states))
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "+FULLSYNC %s %d %d\r\n", a.id, offset, len(states))
+	for key, c := range states {
+		w.Write(resp.Marshal(resp.Command("STATE", key, string(c.Marshal()))))
+	}
+	if err := w.Flush(); err != nil {
+		info.dropActiveLink(l)
+		return l, resp.Value{}
+	}
+	go info.writeToActiveLink(l)
+	return l, resp.Value{}
+}
+
+// ack handles ACTIVE ACK <offset> <peer-offset> on a link.
+func (l *activeLink) ack(args []resp.Value) {
+	if len(args) != 3 || !strings.EqualFold(args[0].Bulk, "ACK") {
+		return
+	}
+	offset, err1 := strconv.ParseInt(args[1].Bulk, 10, 64)
+	peerEnd, err2 := strconv.ParseInt(args[2].Bulk, 10, 64)
+	if err1 != nil || err2 != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ackOffset, l.peerEnd, l.ackTime = offset, peerEnd, time.Now()
+}
+
+// writeToActiveLink sends the queued stream to l until it is dropped.
+func (info *ServerInfo) writeToActiveLink(l *activeLink) {
+	l.mu.Lock()
+	for {
+		for len(l.pending) == 0 && !l.closed {
+			l.cond.Wait()
+		}
+		if l.closed {
+			l.mu.Unlock()
+			return
+		}
+		data := l.pending
+		l.pending = nil
+		l.mu.Unlock()
+		if _, err := l.conn.Write(data); err != nil {
+			info.dropActiveLink(l)
+			return
+		}
+		l.mu.Lock()
+	}
+}
+
+// queue adds data to the stream pending for l, unless it fell too far behind.
+func (l *activeLink) queue(data []byte) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return true
+	}
+	if len(l.pending)+len(data) > replicaOutputLimit {
+		return false
+	}
+	l.pending = append(l.pending, data...)
+	l.cond.Signal()
+	return true
+}
+
+func (info *ServerInfo) dropActiveLinks(links []*activeLink) {
+	for _, l := range links {
+		fmt.Printf("Active peer %s exceeded the output buffer limit\n", l.peerID)
+		info.dropActiveLink(l)
+	}
+}
+
+// dropActiveLink detaches l and closes its connection.
+func (info *ServerInfo) dropActiveLink(l *activeLink) {
+	a := info.active
+	a.mu.Lock()
+	for i, other := range a.links {
+		if other == l {
+			a.links = append(a.links[:i], a.links[i+1:]...)
+			break
+		}
+	}
+	a.mu.Unlock()
+
+	l.mu.Lock()
+	wasClosed := l.closed
+	l.closed = true
+	l.cond.Broadcast()
+	l.mu.Unlock()
+	l.conn.Close()
+	if !wasClosed {
+		fmt.Printf("Stream to active peer %s closed\n", l.peerID)
+	}
+}
+
+// followActivePeer merges the stream of p forever, backing off between
+// failed attempts.
+func (info *ServerInfo) followActivePeer(kv *store.KeyValueStore, p *activePeer) {
+	backoff := replMinBackoff
+	for {
+		synced, err := info.syncWithActivePeer(kv, p)
+		p.mu.Lock()
+		p.conn = nil
+		p.mu.Unlock()
+		fmt.Printf("Connection with active peer %s lost: %v\n", p.addr, err)
+		if synced {
+			backoff = replMinBackoff
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, replMaxBackoff)
+	}
+}
+
+// syncWithActivePeer performs one connection to p, until an error occurs.
+// synced reports whether the stream of p was reached.
+func (info *ServerInfo) syncWithActivePeer(kv *store.KeyValueStore, p *activePeer) (synced bool, err error) {
+	conn, err := net.DialTimeout("tcp", p.addr, replTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	reader := resp.NewResp(&deadlineReader{conn: conn, r: conn})
+
+	p.mu.Lock()
+	id, offset := p.id, p.offset
+	p.mu.Unlock()
+	if id == "" {
+		id = "?"
+	}
+	conn.SetWriteDeadline(time.Now().Add(replTimeout))
+	if err := resp.Respond(conn, resp.Command("ACTIVE", "SYNC", info.active.id, id, strconv.FormatInt(offset, 10))); err != nil {
+		return false, err
+	}
+	reply, err := reader.Read()
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(reply.Str)
+	switch {
+	case reply.Type == "error":
+		return false, fmt.Errorf("peer replied to ACTIVE SYNC with error: %s", reply.Str)
+	case reply.Type == "string" && reply.Str == "CONTINUE":
+		fmt.Printf("Resuming the stream of active peer %s at offset %d\n", p.addr, offset)
+	case reply.Type == "string" && len(fields) == 4 && fields[0] == "FULLSYNC":
+		start, err1 := strconv.ParseInt(fields[2], 10, 64)
+		count, err2 := strconv.Atoi(fields[3])
+		if err1 != nil || err2 != nil {
+			return false, errActiveProtocol
+		}
+		fmt.Printf("Full synchronization with active peer %s: merging %d keys\n", p.addr, count)
+		for range count {
+			v, err := reader.Read()
+			if err != nil {
+				return false, err
+			}
+			if err := info.mergeActiveRecord(kv, v, "STATE"); err != nil {
+				return false, err
+			}
+		}
+		// The stream is only resumable once all the states were merged.
+		p.mu.Lock()
+		p.id, p.offset = fields[1], start
+		p.mu.Unlock()
+	default:
+		return false, errActiveProtocol
+	}
+	p.mu.Lock()
+	p.conn = conn
+	p.lastIO = time.Now()
+	p.mu.Unlock()
+
+	for {
+		v, err := reader.Read()
+		if err != nil {
+			return true, err
+		}
+		if err := info.mergeActiveRecord(kv, v, "OP"); err != nil {
+			return true, err
+		}
+		p.mu.Lock()
+		p.offset += int64(len(resp.Marshal(v)))
+		p.lastIO = time.Now()
+		p.mu.Unlock()
+	}
+}
+
+// mergeActiveRecord merges a STATE or OP record received from a peer;
+// PINGs are allowed in the stream.
+func (info *ServerInfo) mergeActiveRecord(kv *store.KeyValueStore, v resp.Value, name string) error {
+	if v.Type != "array" || len(v.Array) == 0 {
+		return errActiveProtocol
+	}
+	if name == "OP" && len(v.Array) == 1 && strings.EqualFold(v.Array[0].Bulk, "PING") {
+		return nil
+	}
+	if len(v.Array) != 3 || !strings.EqualFold(v.Array[0].Bulk, name) {
+		return errActiveProtocol
+	}
+	c, err := store.UnmarshalCRDT([]byte(v.Array[2].Bulk))
+	if err != nil {
+		return err
+	}
+	key := v.Array[1].Bulk
+
+	info.writeMu.Lock()
+	defer info.writeMu.Unlock()
+	merged := kv.MergeCRDT(key, c)
+	if !merged.HasValue() {
+		a := info.active
+		a.mu.Lock()
+		a.tombstones = append(a.tombstones, activeTombstone{key: key, state: merged, offset: a.offset})
+		a.mu.Unlock()
+	}
+	return nil
+}
+
+// activeCron acknowledges the streams of the peers, pings ours and drops
+// the tombstones that every peer has. Called once a second.
+func (info *ServerInfo) activeCron(kv *store.KeyValueStore) {
+	a := info.active
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	end := a.offset
+	ping := time.Since(a.lastPing) >= replPingPeriod
+	if ping {
+		a.lastPing = time.Now()
+	}
+	a.mu.Unlock()
+
+	for _, p := range a.peers {
+		p.mu.Lock()
+		if p.conn != nil {
+			p.conn.SetWriteDeadline(time.Now().Add(replTimeout))
+			resp.Respond(p.conn, resp.Command("ACTIVE", "ACK", strconv.FormatInt(p.offset, 10), strconv.FormatInt(end, 10)))
+		}
+		p.mu.Unlock()
+	}
+	if ping {
+		info.dropActiveLinks(a.feed(resp.Marshal(resp.Command("PING")), "", nil))
+	}
+
+	for _, t := range a.collectTombstones() {
+		kv.DropTombstone(t.key, t.state)
+	}
+}
+
+// collectTombstones removes and returns the tombstones no peer may still
+// send an older state for: every peer merged our stream past the tombstone,
+// and we merged theirs up to where it was when they acknowledged.
+func (a *activeState) collectTombstones() []activeTombstone {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	safe := a.offset
+	for _, p := range a.peers {
+		p.mu.Lock()
+		id, received := p.id, p.offset
+		p.mu.Unlock()
+		acked := int64(-1)
+		for _, l := range a.links {
+			l.mu.Lock()
+			if l.peerID == id && !l.closed && received >= l.peerEnd {
+				acked = max(acked, l.ackOffset)
+			}
+			l.mu.Unlock()
+		}
+		safe = min(safe, acked)
+	}
+	n := 0
+	for n < len(a.tombstones) && a.tombstones[n].offset <= safe {
+		n++
+	}
+	dropped := a.tombstones[:n:n]
+	a.tombstones = a.tombstones[n:]
+	return dropped
+}
+
+// activeStates returns the CRDT states to save with a snapshot, nil outside
+// active-active mode.
+func (info *ServerInfo) activeStates(kv *store.KeyValueStore) map[string]*store.CRDT {
+	if info.active == nil {
+		return nil
+	}
+	return kv.CRDTStates()
+}
+
+// activeAux returns the RDB aux fields holding states.
+func activeAux(states map[string]*store.CRDT) (map[string]string, error) {
+	if states == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(states)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{activeDataAux: string(b)}, nil
+}
+
+func (info *ServerInfo) activeInfo(kv *store.KeyValueStore) []string {
+	a := info.active
+	if a == nil {
+		return []string{"active_enabled:0"}
+	}
+	tombstones := kv.Tombstones()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	lines := []string{
+		"active_enabled:1",
+		"active_replica_id:" + a.id,
+		fmt.Sprintf("active_offset:%d", a.offset),
+		fmt.Sprintf("active_tombstones:%d", tombstones),
+		fmt.Sprintf("active_pending_tombstones:%d", len(a.tombstones)),
+	}
+	for i, p := range a.peers {
+		p.mu.Lock()
+		state, lag := "down", int64(-1)
+		if p.conn != nil {
+			state, lag = "up", int64(time.Since(p.lastIO).Seconds())
+		}
+		lines = append(lines, fmt.Sprintf("active_peer%d:addr=%s,id=%s,link=%s,offset=%d,last_io=%d", i, p.addr, p.id, state, p.offset, lag))
+		p.mu.Unlock()
+	}
+	for i, l := range a.links {
+		l.mu.Lock()
+		lines = append(lines, fmt.Sprintf("active_stream%d:id=%s,ack_offset=%d,lag=%d", i, l.peerID, l.ackOffset, int64(time.Since(l.ackTime).Seconds())))
+		l.mu.Unlock()
+	}
+	return lines
+}
@@ -0,0 +1,603 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/rdb"
+	"github.com/saurabhdhingra/go-redis/resp"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// appendfsync policies
+const (
+	FsyncAlways   = "always"
+	FsyncEverysec = "everysec"
+	FsyncNo       = "no"
+)
+
+// Number of elements written per command when rewriting lists, as in Redis.
+const aofRewriteItemsPerCmd = 64
+
+var (
+	errRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+	errAOFDisabled       = errors.New("ERR Background append only file rewriting requires appendonly yes")
+)
+
+// appendOnlyFile is the open multi-part AOF. Writes are appended to the last
+// incr file listed in the manifest.
+type appendOnlyFile struct {
+	mu             sync.Mutex
+	dir            string
+	name           string
+	fsync          string
+	useRDBPreamble bool
+
+	manifest *aofManifest
+	file     *os.File
+
+	// Unix second of the last timestamp annotation, when they are enabled.
+	timestamps    bool
+	lastTimestamp int64
+
+	rewriting      bool
+	lastRewriteErr error
+	lastErr        error
+}
+
+// aofDir returns the directory holding the AOF files and their manifest.
+func (info *ServerInfo) aofDir() string {
+	dir, name := info.Dir, info.AppendDirName
+	if dir == "" {
+		dir = "."
+	}
+	if name == "" {
+		name = "appendonlydir"
+	}
+	return filepath.Join(dir, name)
+}
+
+// aofName returns appendfilename, the prefix of every file in aofDir.
+func (info *ServerInfo) aofName() string {
+	if info.AppendFilename == "" {
+		return "appendonly.aof"
+	}
+	return info.AppendFilename
+}
+
+func (a *appendOnlyFile) manifestPath() string {
+	return filepath.Join(a.dir, a.name+".manifest")
+}
+
+func (a *appendOnlyFile) path(f *aofFile) string {
+	return filepath.Join(a.dir, f.name)
+}
+
+// LoadDataFromDisk restores the dataset at startup: from the AOF when
+// appendonly is enabled, otherwise from the RDB file.
+func (info *ServerInfo) LoadDataFromDisk(kv *store.KeyValueStore) error {
+	info.SetLoading(true)
+	defer info.SetLoading(false)
+	info.setLastSave(time.Now())
+
+	if !info.AppendOnly {
+		return info.loadRDB(kv)
+	}
+
+	fsync := info.AppendFsync
+	if fsync == "" {
+		fsync = FsyncEverysec
+	}
+	a := &appendOnlyFile{
+		dir:            info.aofDir(),
+		name:           info.aofName(),
+		fsync:          fsync,
+		useRDBPreamble: info.AOFUseRDBPreamble,
+		timestamps:     info.AOFTimestampEnabled,
+	}
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return err
+	}
+
+	m, err := info.loadAOFManifest(a)
+	if errors.Is(err, os.ErrNotExist) {
+		// First start with appendonly enabled: seed the base from the snapshot.
+		if err := info.loadRDB(kv); err != nil {
+			return err
+		}
+		a.manifest = &aofManifest{}
+		base, err := a.writeBase(kv.Snapshot(), 1)
+		if err != nil {
+			return err
+		}
+		a.manifest.base = base
+		a.manifest.currBaseSeq = base.seq
+		fmt.Println("Creating AOF base file", base.name, "on server start")
+	} else if err != nil {
+		return err
+	} else {
+		if m, err = info.recoverAOF(a, m); err != nil {
+			return err
+		}
+		a.manifest = m
+		if err := info.loadAOFFiles(kv, a); err != nil {
+			return err
+		}
+	}
+
+	if n := len(a.manifest.incr); n > 0 {
+		last := a.manifest.incr[n-1]
+		f, err := os.OpenFile(a.path(last), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		a.file = f
+	} else if err := a.openNewIncr(); err != nil {
+		return err
+	}
+
+	info.aof.Store(a)
+	if fsync == FsyncEverysec {
+		go a.fsyncEverySecond()
+	}
+	return nil
+}
+
+// loadAOFManifest reads and validates the manifest, repairing what can be
+// repaired safely: a half-written last line, leftover history files and temp
+// files. A single-file AOF from before the manifest existed becomes the base.
+func (info *ServerInfo) loadAOFManifest(a *appendOnlyFile) (*aofManifest, error) {
+	path := a.manifestPath()
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		legacy := filepath.Join(filepath.Dir(a.dir), a.name)
+		if _, err := os.Stat(legacy); err != nil {
+			return nil, os.ErrNotExist
+		}
+		base := &aofFile{name: fmt.Sprintf("%s.1.base.aof", a.name), seq: 1, typ: aofFileBase}
+		if err := os.Rename(legacy, a.path(base)); err != nil {
+			return nil, err
+		}
+		m := &aofManifest{base: base, currBaseSeq: 1}
+		if err := writeAOFManifest(path, m); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Upgraded %s to a multi-part AOF in %s\n", legacy, a.dir)
+		return m, nil
+	}
+
+	m, truncated, err := parseAOFManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	repaired := truncated
+	if truncated {
+		fmt.Println("!!! Warning: the AOF manifest ends with an incomplete line, dropping it")
+	}
+	if len(m.history) > 0 {
+		for _, f := range m.history {
+			os.Remove(a.path(f))
+		}
+		m.history = nil
+		repaired = true
+	}
+	for _, f := range append([]*aofFile{m.base}, m.incr...) {
+		if f == nil {
+			continue
+		}
+		if _, err := os.Stat(a.path(f)); err != nil {
+			// Not wrapped: a missing file must not pass for a first start.
+			return nil, fmt.Errorf("AOF file %s listed in the manifest is missing: %v", f.name, err)
+		}
+	}
+	if temps, _ := filepath.Glob(filepath.Join(a.dir, "temp-*")); len(temps) > 0 {
+		for _, t := range temps {
+			os.Remove(t)
+		}
+	}
+	if repaired {
+		if err := writeAOFManifest(path, m); err != nil {
+			return nil, err
+		}
+		fmt.Println("AOF manifest repaired")
+	}
+	return m, nil
+}
+
+// loadAOFFiles replays the base file and then every incr file, in order.
+func (info *ServerInfo) loadAOFFiles(kv *store.KeyValueStore, a *appendOnlyFile) error {
+	start := time.Now()
+	files := a.manifest.incr
+	if a.manifest.base != nil {
+		files = append([]*aofFile{a.manifest.base}, files...)
+	}
+	commands := 0
+	for i, f := range files {
+		n, err := info.loadAOFFile(kv, a.path(f), i == len(files)-1)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		commands += n
+	}
+	// The replayed writes are already on disk.
+	kv.ClearDirty(kv.Dirty())
+	fmt.Printf("DB loaded from append only file: %d commands in %.3f seconds\n", commands, time.Since(start).Seconds())
+	return nil
+}
+
+// loadAOFFile replays one AOF file into kv. A file may open with an RDB
+// preamble. A command cut short at the end of the last file is dropped, and
+// the file truncated, when AOFLoadTruncated is set.
+func (info *ServerInfo) loadAOFFile(kv *store.KeyValueStore, path string, last bool) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	counter := &countingReader{r: f}
+	br := bufio.NewReader(counter)
+	offset := func() int64 { return counter.n - int64(br.Buffered()) }
+
+	if magic, _ := br.Peek(5); string(magic) == "REDIS" {
+		data, err := rdb.Load(br)
+		if err != nil {
+			return 0, err
+		}
+		kv.Load(data)
+	}
+
+	reader := resp.NewResp(br)
+	valid := offset() // just past the last complete command outside a transaction
+	var queued [][]resp.Value
+	inTransaction := false
+	commands := 0
+	for {
+		if _, ok, err := readAOFAnnotation(br); err != nil {
+			return 0, err
+		} else if ok {
+			if !inTransaction {
+				valid = offset()
+			}
+			continue
+		}
+		value, err := reader.Read()
+		if err != nil {
+			if valid == stat.Size() {
+				break
+			}
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return 0, fmt.Errorf("bad file format reading the append only file at offset %d: %w", valid, err)
+			}
+			if !last || !info.AOFLoadTruncated {
+				return 0, fmt.Errorf("unexpected end of file reading the append only file at offset %d", valid)
+			}
+			fmt.Printf("!!! Warning: short read while loading the AOF file %s, truncating to %d bytes\n", path, valid)
+			if err := os.Truncate(path, valid); err != nil {
+				return 0, err
+			}
+			break
+		}
+		if value.Type != "array" || len(value.Array) == 0 {
+			return 0, fmt.Errorf("bad file format reading the append only file at offset %d", valid)
+		}
+
+		command := strings.ToUpper(value.Array[0].Bulk)
+		switch {
+		case command == "MULTI":
+			inTransaction = true
+			queued = nil
+		case command == "EXEC":
+			for _, cmd := range queued {
+				executeCommand(kv, info, strings.ToUpper(cmd[0].Bulk), cmd[1:])
+			}
+			inTransaction = false
+			queued = nil
+			valid = offset()
+		case inTransaction:
+			queued = append(queued, value.Array)
+		default:
+			executeCommand(kv, info, command, value.Array[1:])
+			valid = offset()
+		}
+		commands++
+	}
+	return commands, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (a *appendOnlyFile) fsyncEverySecond() {
+	for range time.Tick(time.Second) {
+		a.mu.Lock()
+		if err := a.file.Sync(); err != nil {
+			a.lastErr = err
+			fmt.Println("Error syncing the AOF:", err)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// openNewIncr starts a new incr file, records it in the manifest and switches
+// appends to it. Must be called with a.mu held, or before a is shared.
+func (a *appendOnlyFile) openNewIncr() error {
+	incr := &aofFile{
+		name: fmt.Sprintf("%s.%d.incr.aof", a.name, a.manifest.currIncrSeq+1),
+		seq:  a.manifest.currIncrSeq + 1,
+		typ:  aofFileIncr,
+	}
+	f, err := os.OpenFile(a.path(incr), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	m := a.manifest.clone()
+	m.incr = append(m.incr, incr)
+	m.currIncrSeq = incr.seq
+	if err := writeAOFManifest(a.manifestPath(), m); err != nil {
+		f.Close()
+		os.Remove(a.path(incr))
+		return err
+	}
+	if a.file != nil {
+		a.file.Sync()
+		a.file.Close()
+	}
+	a.file = f
+	a.manifest = m
+	// Every incr file opens with the time it starts at, which tells point-in-time
+	// recovery how recent the matching base is.
+	a.lastTimestamp = 0
+	if a.timestamps {
+		f.Write(a.timestampAnnotation())
+	}
+	return nil
+}
+
+// timestampAnnotation returns a "#TS:" line when the second has changed since
+// the last one written. Must be called with a.mu held.
+func (a *appendOnlyFile) timestampAnnotation() []byte {
+	now := time.Now().Unix()
+	if now <= a.lastTimestamp {
+		return nil
+	}
+	a.lastTimestamp = now
+	return []byte(aofTimestampPrefix + strconv.FormatInt(now, 10) + "\r\n")
+}
+
+// feedAppendOnlyFile appends cmds to the AOF. With appendfsync always the data
+// is on disk before the client gets its reply.
+func (info *ServerInfo) feedAppendOnlyFile(cmds [][]resp.Value) {
+	a := info.aof.Load()
+	if a == nil {
+		return
+	}
+	var buf []byte
+	for _, cmd := range cmds {
+		buf = append(buf, resp.Marshal(resp.Value{Type: "array", Array: cmd})...)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.timestamps {
+		buf = append(a.timestampAnnotation(), buf...)
+	}
+	if _, err := a.file.Write(buf); err != nil {
+		a.lastErr = err
+		fmt.Println("Error writing to the AOF:", err)
+		return
+	}
+	if a.fsync == FsyncAlways {
+		if err := a.file.Sync(); err != nil {
+			a.lastErr = err
+			fmt.Println("Error syncing the AOF:", err)
+		}
+	}
+}
+
+// bgrewriteaof compacts the AOF in the background. Appends switch to a fresh
+// incr file right away, so the new base only has to hold a snapshot of kv
+// taken at the same moment. The caller must hold writeMu for that reason.
+func (info *ServerInfo) bgrewriteaof(kv *store.KeyValueStore) error {
+	a := info.aof.Load()
+	if a == nil {
+		return errAOFDisabled
+	}
+
+	a.mu.Lock()
+	if a.rewriting {
+		a.mu.Unlock()
+		return errRewriteInProgress
+	}
+	if err := a.openNewIncr(); err != nil {
+		a.mu.Unlock()
+		return err
+	}
+	a.rewriting = true
+	baseSeq := a.manifest.currBaseSeq + 1
+	a.mu.Unlock()
+
+	snapshot := kv.Snapshot()
+	go func() {
+		base, err := a.writeBase(snapshot, baseSeq)
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.rewriting = false
+		if err == nil {
+			err = a.installBase(base)
+		}
+		a.lastRewriteErr = err
+		if err != nil {
+			fmt.Println("Background AOF rewrite error:", err)
+			return
+		}
+		fmt.Println("Background AOF rewrite finished successfully")
+	}()
+	return nil
+}
+
+// writeBase writes snapshot as base file number seq, in RDB format when the
+// preamble is enabled and as commands otherwise.
+func (a *appendOnlyFile) writeBase(snapshot map[string]store.Data, seq int64) (*aofFile, error) {
+	ext := "aof"
+	if a.useRDBPreamble {
+		ext = "rdb"
+	}
+	base := &aofFile{name: fmt.Sprintf("%s.%d.base.%s", a.name, seq, ext), seq: seq, typ: aofFileBase}
+
+	tmp := filepath.Join(a.dir, fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*aofFile, error) {
+		f.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	if a.useRDBPreamble {
+		err = rdb.Save(f, snapshot, map[string]string{"aof-base": "1"})
+	} else {
+		w := bufio.NewWriter(f)
+		if err = rewriteCommands(w, snapshot); err == nil {
+			err = w.Flush()
+		}
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, a.path(base)); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return base, nil
+}
+
+// installBase makes base the current base file. The previous base and every
+// incr file but the one being appended to become history in the persisted
+// manifest first, so a crash at any point leaves a loadable AOF; only then
+// are they deleted. Must be called with a.mu held.
+func (a *appendOnlyFile) installBase(base *aofFile) error {
+	m := a.manifest.clone()
+	if m.base != nil {
+		m.history = append(m.history, &aofFile{name: m.base.name, seq: m.base.seq, typ: aofFileHistory})
+	}
+	current := m.incr[len(m.incr)-1]
+	for _, f := range m.incr[:len(m.incr)-1] {
+		m.history = append(m.history, &aofFile{name: f.name, seq: f.seq, typ: aofFileHistory})
+	}
+	m.incr = []*aofFile{current}
+	m.base = base
+	m.currBaseSeq = base.seq
+	if err := writeAOFManifest(a.manifestPath(), m); err != nil {
+		os.Remove(a.path(base))
+		return err
+	}
+	a.manifest = m
+
+	for _, f := range m.history {
+		if err := os.Remove(a.path(f)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Println("Error removing AOF history file:", err)
+		}
+	}
+	m = m.clone()
+	m.history = nil
+	if err := writeAOFManifest(a.manifestPath(), m); err != nil {
+		// The files are gone already; the next start drops the stale entries.
+		fmt.Println("Error updating the AOF manifest:", err)
+		return nil
+	}
+	a.manifest = m
+	return nil
+}
+
+// rewriteCommands writes the shortest command sequence that recreates snapshot.
+func rewriteCommands(w io.Writer, snapshot map[string]store.Data) error {
+	now := time.Now()
+	for key, d := range snapshot {
+		if !d.Expiration.IsZero() && now.After(d.Expiration) {
+			continue
+		}
+		for _, cmd := range commandsForKey(key, d) {
+			if err := resp.Respond(w, resp.Command(cmd...)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// commandsForKey returns the commands that recreate a single key, with its
+// expiration.
+func commandsForKey(key string, d store.Data) [][]string {
+	cmds := valueCommands(key, d)
+	if d.Type != "string" && !d.Expiration.IsZero() {
+		cmds = append(cmds, []string{"PEXPIREAT", key, strconv.FormatInt(d.Expiration.UnixMilli(), 10)})
+	}
+	return cmds
+}
+
+// valueCommands returns the commands that recreate the value of key; only
+// SET carries the expiration.
+func valueCommands(key string, d store.Data) [][]string {
+	switch d.Type {
+	case "list":
+		// LPUSH places its arguments at the head in the order given, so the
+		// chunks are pushed from the tail of the list towards the head.
+		var cmds [][]string
+		for end := len(d.List); end > 0; end -= aofRewriteItemsPerCmd {
+			start := max(0, end-aofRewriteItemsPerCmd)
+			cmds = append(cmds, append([]string{"LPUSH", key}, d.List[start:end]...))
+		}
+		return cmds
+	case "stream":
+		if len(d.Stream) == 0 {
+			// An empty stream is an entry added and trimmed away.
+			return [][]string{{"XADD", key, "0-1", "x", "y"}, {"XTRIM", key, "MAXLEN", "0"}}
+		}
+		cmds := make([][]string, 0, len(d.Stream))
+		for _, entry := range d.Stream {
+			cmd := []string{"XADD", key, entry.ID}
+			for _, field := range slices.Sorted(maps.Keys(entry.Fields)) {
+				cmd = append(cmd, field, entry.Fields[field])
+			}
+			cmds = append(cmds, cmd)
+		}
+		return cmds
+	default:
+		cmd := []string{"SET", key, d.Value}
+		if !d.Expiration.IsZero() {
+			cmd = append(cmd, "PXAT", strconv.FormatInt(d.Expiration.UnixMilli(), 10))
+		}
+		return [][]string{cmd}
+	}
+}
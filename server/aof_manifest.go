@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Types of the files tracked by an AOF manifest.
+const (
+	aofFileBase    = 'b'
+	aofFileIncr    = 'i'
+	aofFileHistory = 'h'
+)
+
+// aofFile is one entry of the manifest.
+type aofFile struct {
+	name string
+	seq  int64
+	typ  byte
+}
+
+// aofManifest describes a multi-part AOF: one base file with the dataset as of
+// the last rewrite, incremental files with the writes since, and history files
+// that a finished rewrite made obsolete and that are about to be deleted.
+type aofManifest struct {
+	base    *aofFile
+	incr    []*aofFile
+	history []*aofFile
+
+	currBaseSeq int64
+	currIncrSeq int64
+}
+
+// String renders the manifest in the format Redis uses:
+// "file <name> seq <seq> type <b|h|i>" per line.
+func (m *aofManifest) String() string {
+	var sb strings.Builder
+	line := func(f *aofFile) {
+		fmt.Fprintf(&sb, "file %s seq %d type %c\n", f.name, f.seq, f.typ)
+	}
+	if m.base != nil {
+		line(m.base)
+	}
+	for _, f := range m.history {
+		line(f)
+	}
+	for _, f := range m.incr {
+		line(f)
+	}
+	return sb.String()
+}
+
+func (m *aofManifest) clone() *aofManifest {
+	c := *m
+	c.incr = append([]*aofFile{}, m.incr...)
+	c.history = append([]*aofFile{}, m.history...)
+	return &c
+}
+
+// parseAOFManifest reads a manifest. A final line without its newline, as
+// left by a crash mid-write, is reported through truncated so the caller
+// can repair the file.
+func parseAOFManifest(path string) (m *aofManifest, truncated bool, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	text := string(content)
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		truncated = true
+		text = text[:strings.LastIndex(text, "\n")+1]
+	}
+
+	m = &aofManifest{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, false, fmt.Errorf("invalid AOF manifest line %d: %q", lineno, line)
+		}
+		f := &aofFile{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				f.name = fields[i+1]
+			case "seq":
+				f.seq, err = strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil || f.seq <= 0 {
+					return nil, false, fmt.Errorf("invalid seq on AOF manifest line %d", lineno)
+				}
+			case "type":
+				if len(fields[i+1]) != 1 {
+					return nil, false, fmt.Errorf("invalid type on AOF manifest line %d", lineno)
+				}
+				f.typ = fields[i+1][0]
+			}
+			// Unknown keys are ignored, as newer versions may add some.
+		}
+		if f.name == "" || f.seq == 0 || f.name != filepath.Base(f.name) {
+			return nil, false, fmt.Errorf("invalid AOF manifest line %d: %q", lineno, line)
+		}
+		if seen[f.name] {
+			return nil, false, fmt.Errorf("file %s appears twice in the AOF manifest", f.name)
+		}
+		seen[f.name] = true
+
+		switch f.typ {
+		case aofFileBase:
+			if m.base != nil {
+				return nil, false, errors.New("found duplicate base file information in the AOF manifest")
+			}
+			m.base = f
+			m.currBaseSeq = f.seq
+		case aofFileIncr:
+			if f.seq <= m.currIncrSeq {
+				return nil, false, errors.New("found a non-monotonic incr sequence number in the AOF manifest")
+			}
+			m.incr = append(m.incr, f)
+			m.currIncrSeq = f.seq
+		case aofFileHistory:
+			m.history = append(m.history, f)
+		default:
+			return nil, false, fmt.Errorf("unknown file type %q on AOF manifest line %d", f.typ, lineno)
+		}
+	}
+	if m.base == nil && len(m.incr) == 0 {
+		return nil, false, errors.New("the AOF manifest lists no base or incr files")
+	}
+	return m, truncated, nil
+}
+
+// writeAOFManifest atomically replaces the manifest at path.
+func writeAOFManifest(path string, m *aofManifest) error {
+	tmp := filepath.Join(filepath.Dir(path), "temp-"+filepath.Base(path))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(m.String()); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes a rename inside dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
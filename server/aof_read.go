@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// ReadAOF replays an AOF into a fresh keyspace without starting a server, for
+// offline inspection. path is either a manifest, in which case the base and
+// incr files it lists are replayed, or a single AOF file. Nothing on disk is
+// modified; an incomplete command at the end of a file is reported as an
+// error rather than truncated.
+func ReadAOF(path string) (map[string]store.Data, error) {
+	info := &ServerInfo{}
+	kv := store.NewKeyValueStore()
+	if !strings.HasSuffix(path, ".manifest") {
+		if _, err := info.loadAOFFile(kv, path, false); err != nil {
+			return nil, err
+		}
+		return kv.Snapshot(), nil
+	}
+
+	// A half-written last manifest line is ignored, as the server would.
+	m, _, err := parseAOFManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	files := m.incr
+	if m.base != nil {
+		files = append([]*aofFile{m.base}, files...)
+	}
+	for _, f := range files {
+		if _, err := info.loadAOFFile(kv, filepath.Join(filepath.Dir(path), f.name), false); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+	return kv.Snapshot(), nil
+}
+
+// WriteAOF writes the commands that recreate data, as BGREWRITEAOF does for a
+// base file without an RDB preamble. Expired keys are skipped.
+func WriteAOF(w io.Writer, data map[string]store.Data) error {
+	return rewriteCommands(w, data)
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/resp"
+)
+
+// Timestamp annotations have the form "#TS:<unix seconds>\r\n" and precede the
+// writes made during that second, as with Redis' aof-timestamp-enabled.
+const aofTimestampPrefix = "#TS:"
+
+// AOFTimestamp is a timestamp annotation found in the incremental AOF files.
+type AOFTimestamp struct {
+	File   string
+	Offset int64 // offset of the annotation across all incr files
+	Time   time.Time
+}
+
+// aofItem is a command, a MULTI/EXEC block or an annotation of an incr file.
+type aofItem struct {
+	file       int   // index of the incr file in the manifest
+	start, end int64 // offsets within the file
+	global     int64 // offset of start across all incr files
+	globalEnd  int64
+	timestamp  int64 // set for annotations only
+}
+
+// AOFTimestamps lists the timestamp annotations of the AOF whose manifest is at
+// manifestPath, so an operator can pick a point to recover to.
+func AOFTimestamps(manifestPath string) ([]AOFTimestamp, error) {
+	dir, m, err := openAOFForRecovery(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	var stamps []AOFTimestamp
+	err = scanAOFIncr(dir, m, func(it aofItem) bool {
+		if it.timestamp != 0 {
+			stamps = append(stamps, AOFTimestamp{File: m.incr[it.file].name, Offset: it.global, Time: time.Unix(it.timestamp, 0)})
+		}
+		return false
+	})
+	return stamps, err
+}
+
+// TruncateAOFToTimestamp cuts the incremental AOF files right before the first
+// annotation later than until, so that loading the AOF restores the dataset as
+// it was at that second. See truncateAOFAt for what happens to the files.
+func TruncateAOFToTimestamp(manifestPath string, until time.Time) error {
+	dir, m, err := openAOFForRecovery(manifestPath)
+	if err != nil {
+		return err
+	}
+	seenEarlier := false
+	var cut *aofItem
+	err = scanAOFIncr(dir, m, func(it aofItem) bool {
+		if it.timestamp == 0 {
+			return false
+		}
+		if it.timestamp > until.Unix() {
+			cut = &it
+			return true
+		}
+		seenEarlier = true
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if cut == nil {
+		return fmt.Errorf("no timestamp annotation later than %d found, nothing to truncate", until.Unix())
+	}
+	if !seenEarlier {
+		return fmt.Errorf("the AOF base file is newer than %d, it cannot be rolled back that far", until.Unix())
+	}
+	return truncateAOFAt(manifestPath, dir, m, cut.file, cut.start)
+}
+
+// TruncateAOFToOffset cuts the incremental AOF files at the last command
+// boundary within offset bytes, counted across the incr files in manifest
+// order. A MULTI/EXEC block is kept or dropped as a whole.
+func TruncateAOFToOffset(manifestPath string, offset int64) error {
+	dir, m, err := openAOFForRecovery(manifestPath)
+	if err != nil {
+		return err
+	}
+	var cut *aofItem
+	err = scanAOFIncr(dir, m, func(it aofItem) bool {
+		if it.globalEnd > offset {
+			cut = &it
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if cut == nil {
+		return fmt.Errorf("the incremental AOF is not longer than %d bytes, nothing to truncate", offset)
+	}
+	return truncateAOFAt(manifestPath, dir, m, cut.file, cut.start)
+}
+
+// recoverAOF applies the point-in-time recovery requested at startup, if any,
+// and returns the manifest to load from.
+func (info *ServerInfo) recoverAOF(a *appendOnlyFile, m *aofManifest) (*aofManifest, error) {
+	var err error
+	switch {
+	case info.AOFTruncateToTimestamp > 0:
+		until := time.Unix(info.AOFTruncateToTimestamp, 0)
+		fmt.Println("Truncating the AOF to timestamp", info.AOFTruncateToTimestamp)
+		err = TruncateAOFToTimestamp(a.manifestPath(), until)
+	case info.AOFTruncateToOffset > 0:
+		fmt.Println("Truncating the AOF to offset", info.AOFTruncateToOffset)
+		err = TruncateAOFToOffset(a.manifestPath(), info.AOFTruncateToOffset)
+	default:
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("point-in-time recovery failed: %w", err)
+	}
+	m, _, err = parseAOFManifest(a.manifestPath())
+	return m, err
+}
+
+func openAOFForRecovery(manifestPath string) (string, *aofManifest, error) {
+	m, truncated, err := parseAOFManifest(manifestPath)
+	if err != nil {
+		return "", nil, err
+	}
+	if truncated {
+		return "", nil, errors.New("the AOF manifest ends with an incomplete line")
+	}
+	return filepath.Dir(manifestPath), m, nil
+}
+
+// truncateAOFAt rolls the AOF back to offset bytes of incr file number file,
+// leaving every AOF file as it is: the part kept of that file is copied to a
+// new incr file, which the manifest lists in place of it and of the incr
+// files after it. The previous manifest is kept as <manifest>.<unix time>.bak,
+// and putting it back undoes the recovery.
+func truncateAOFAt(manifestPath, dir string, m *aofManifest, file int, offset int64) error {
+	src, err := os.Open(filepath.Join(dir, m.incr[file].name))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	m = m.clone()
+	incr := &aofFile{
+		name: fmt.Sprintf("%s.%d.incr.aof", strings.TrimSuffix(filepath.Base(manifestPath), ".manifest"), m.currIncrSeq+1),
+		seq:  m.currIncrSeq + 1,
+		typ:  aofFileIncr,
+	}
+	tmp := filepath.Join(dir, "temp-"+incr.name)
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(dst, src, offset); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, incr.name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	previous, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	backup := fmt.Sprintf("%s.%d.bak", manifestPath, time.Now().Unix())
+	if err := os.WriteFile(backup, previous, 0644); err != nil {
+		return err
+	}
+	m.incr = append(m.incr[:file:file], incr)
+	m.currIncrSeq = incr.seq
+	if err := writeAOFManifest(manifestPath, m); err != nil {
+		return err
+	}
+	fmt.Printf("The AOF manifest before the recovery is saved as %s\n", filepath.Base(backup))
+	return nil
+}
+
+// scanAOFIncr calls fn for every item of the incr files in order until fn
+// returns true.
+func scanAOFIncr(dir string, m *aofManifest, fn func(aofItem) bool) error {
+	var global int64
+	for i, incr := range m.incr {
+		stop, size, err := scanAOFFile(filepath.Join(dir, incr.name), func(it aofItem) bool {
+			it.file = i
+			it.global = global + it.start
+			it.globalEnd = global + it.end
+			return fn(it)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", incr.name, err)
+		}
+		if stop {
+			return nil
+		}
+		global += size
+	}
+	return nil
+}
+
+// scanAOFFile walks the commands and annotations of a single AOF file.
+func scanAOFFile(path string, fn func(aofItem) bool) (stopped bool, size int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, 0, err
+	}
+	defer f.Close()
+	counter := &countingReader{r: f}
+	br := bufio.NewReader(counter)
+	offset := func() int64 { return counter.n - int64(br.Buffered()) }
+	reader := resp.NewResp(br)
+
+	var txnStart int64 = -1
+	for {
+		start := offset()
+		if ts, ok, err := readAOFAnnotation(br); err != nil {
+			return false, 0, err
+		} else if ok {
+			if ts != 0 && fn(aofItem{start: start, end: offset(), timestamp: ts}) {
+				return true, 0, nil
+			}
+			continue
+		}
+		value, err := reader.Read()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// An incomplete tail is left for aof-load-truncated to deal with.
+			return false, offset(), nil
+		}
+		if err != nil {
+			return false, 0, err
+		}
+		if value.Type != "array" || len(value.Array) == 0 {
+			return false, 0, fmt.Errorf("bad file format at offset %d", start)
+		}
+		switch strings.ToUpper(value.Array[0].Bulk) {
+		case "MULTI":
+			txnStart = start
+			continue
+		case "EXEC":
+			start, txnStart = txnStart, -1
+		default:
+			if txnStart >= 0 {
+				continue
+			}
+		}
+		if fn(aofItem{start: start, end: offset()}) {
+			return true, 0, nil
+		}
+	}
+}
+
+// readAOFAnnotation consumes an annotation line if one comes next, returning
+// its timestamp when it is a timestamp annotation.
+func readAOFAnnotation(br *bufio.Reader) (int64, bool, error) {
+	b, err := br.Peek(1)
+	if err != nil || b[0] != '#' {
+		return 0, false, nil
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		// A partially written annotation is treated like a truncated command.
+		return 0, false, nil
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, aofTimestampPrefix) {
+		return 0, true, nil
+	}
+	ts, err := strconv.ParseInt(strings.TrimPrefix(line, aofTimestampPrefix), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid timestamp annotation %q", line)
+	}
+	return ts, true, nil
+}
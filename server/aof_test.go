@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/rdb"
+	"github.com/saurabhdhingra/go-redis/resp"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// newAOFServer returns a server with appendonly enabled in dir, loaded into
+// a new keyspace.
+func newAOFServer(t *testing.T, dir string, preamble bool) (*ServerInfo, *store.KeyValueStore) {
+	t.Helper()
+	info := &ServerInfo{Dir: dir, AppendOnly: true, AppendFsync: FsyncNo, AOFUseRDBPreamble: preamble}
+	kv := store.NewKeyValueStore()
+	if err := info.LoadDataFromDisk(kv); err != nil {
+		t.Fatal(err)
+	}
+	return info, kv
+}
+
+// write applies a write command and logs it to the AOF, as dispatch does.
+func write(info *ServerInfo, kv *store.KeyValueStore, args ...string) {
+	cmd := resp.Command(args...).Array
+	info.writeMu.Lock()
+	defer info.writeMu.Unlock()
+	executeCommand(kv, info, strings.ToUpper(args[0]), cmd[1:])
+	info.feedAppendOnlyFile([][]resp.Value{cmd})
+}
+
+// rewrite runs BGREWRITEAOF and waits for it to finish.
+func rewrite(t *testing.T, info *ServerInfo, kv *store.KeyValueStore) {
+	t.Helper()
+	info.writeMu.Lock()
+	err := info.bgrewriteaof(kv)
+	info.writeMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := info.aof.Load()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		a.mu.Lock()
+		rewriting, err := a.rewriting, a.lastRewriteErr
+		a.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rewriting {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the AOF rewrite")
+		}
+	}
+}
+
+func wantKeys(t *testing.T, kv *store.KeyValueStore, want map[string]string) {
+	t.Helper()
+	snapshot := kv.Snapshot()
+	if len(snapshot) != len(want) {
+		t.Errorf("%d keys loaded, want %d", len(snapshot), len(want))
+	}
+	for key, value := range want {
+		if d := snapshot[key]; d.Value != value {
+			t.Errorf("key %q is %q, want %q", key, d.Value, value)
+		}
+	}
+}
+
+func TestLoadAOFManifest(t *testing.T) {
+	dir := t.TempDir()
+	aofDir := filepath.Join(dir, "appendonlydir")
+	if err := os.Mkdir(aofDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// An RDB base, two incr files, history left behind by an interrupted
+	// rewrite and a manifest whose last line was cut short.
+	var base bytes.Buffer
+	rdb.Save(&base, map[string]store.Data{"a": {Type: "string", Value: "base"}, "b": {Type: "string", Value: "base"}}, nil)
+	files := map[string]string{
+		"appendonly.aof.2.base.rdb":  base.String(),
+		"appendonly.aof.1.base.aof":  string(resp.Marshal(resp.Command("SET", "stale", "1"))),
+		"appendonly.aof.3.incr.aof":  string(resp.Marshal(resp.Command("SET", "b", "incr3"))),
+		"appendonly.aof.4.incr.aof":  "#TS:1700000000\r\n" + string(resp.Marshal(resp.Command("SET", "c", "incr4"))),
+		"appendonly.aof.manifest":    "file appendonly.aof.1.base.aof seq 1 type h\nfile appendonly.aof.2.base.rdb seq 2 type b\nfile appendonly.aof.3.incr.aof seq 3 type i\nfile appendonly.aof.4.incr.aof seq 4 type i\nfile appendonly.aof.5.in",
+		"temp-rewriteaof-bg-123.aof": "partial",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(aofDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, kv := newAOFServer(t, dir, true)
+	wantKeys(t, kv, map[string]string{"a": "base", "b": "incr3", "c": "incr4"})
+	for _, name := range []string{"appendonly.aof.1.base.aof", "temp-rewriteaof-bg-123.aof"} {
+		if _, err := os.Stat(filepath.Join(aofDir, name)); err == nil {
+			t.Errorf("%s wasn't removed", name)
+		}
+	}
+	m, truncated, err := parseAOFManifest(filepath.Join(aofDir, "appendonly.aof.manifest"))
+	if err != nil || truncated {
+		t.Fatalf("repaired manifest: truncated %v, %v", truncated, err)
+	}
+	if m.base.name != "appendonly.aof.2.base.rdb" || len(m.incr) != 2 || len(m.history) != 0 {
+		t.Fatalf("repaired manifest:\n%s", m)
+	}
+
+	// Writes go to the last incr file and survive a restart.
+	write(info, kv, "SET", "d", "new")
+	_, kv = newAOFServer(t, dir, true)
+	wantKeys(t, kv, map[string]string{"a": "base", "b": "incr3", "c": "incr4", "d": "new"})
+}
+
+func TestLoadAOFMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	aofDir := filepath.Join(dir, "appendonlydir")
+	os.Mkdir(aofDir, 0755)
+	manifest := "file appendonly.aof.1.base.rdb seq 1 type b\n"
+	os.WriteFile(filepath.Join(aofDir, "appendonly.aof.manifest"), []byte(manifest), 0644)
+	info := &ServerInfo{Dir: dir, AppendOnly: true, AppendFsync: FsyncNo}
+	if err := info.LoadDataFromDisk(store.NewKeyValueStore()); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("loading with a missing base file: %v", err)
+	}
+}
+
+func TestAOFRewrite(t *testing.T) {
+	for _, preamble := range []bool{true, false} {
+		dir := t.TempDir()
+		info, kv := newAOFServer(t, dir, preamble)
+		write(info, kv, "SET", "a", "1")
+		write(info, kv, "SET", "b", "2")
+		rewrite(t, info, kv)
+		write(info, kv, "SET", "a", "3")
+
+		a := info.aof.Load()
+		a.mu.Lock()
+		base := a.path(a.manifest.base)
+		a.mu.Unlock()
+		content, err := os.ReadFile(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if preamble != strings.HasPrefix(string(content), "REDIS") || preamble != strings.HasSuffix(base, ".rdb") {
+			t.Fatalf("with aof-use-rdb-preamble %v the base is %s:\n%q", preamble, filepath.Base(base), content)
+		}
+		if preamble {
+			data, aux, err := rdb.LoadAux(bytes.NewReader(content))
+			if err != nil || aux["aof-base"] != "1" || data["b"].Value != "2" {
+				t.Fatalf("RDB preamble: %v, %v, %v", data, aux, err)
+			}
+		}
+
+		_, kv = newAOFServer(t, dir, preamble)
+		wantKeys(t, kv, map[string]string{"a": "3", "b": "2"})
+	}
+}
+
+func TestLoadAOFPreambleLegacy(t *testing.T) {
+	// A single-file AOF of an older server: an RDB preamble followed by
+	// commands. It becomes the base of a multi-part AOF.
+	dir := t.TempDir()
+	var legacy bytes.Buffer
+	rdb.Save(&legacy, map[string]store.Data{"a": {Type: "string", Value: "rdb"}}, nil)
+	legacy.Write(resp.Marshal(resp.Command("SET", "b", "command")))
+	if err := os.WriteFile(filepath.Join(dir, "appendonly.aof"), legacy.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, kv := newAOFServer(t, dir, true)
+	wantKeys(t, kv, map[string]string{"a": "rdb", "b": "command"})
+	if _, err := os.Stat(filepath.Join(dir, "appendonlydir", "appendonly.aof.1.base.aof")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTruncateAOFToTimestamp(t *testing.T) {
+	dir := t.TempDir()
+	aofDir := filepath.Join(dir, "appendonlydir")
+	os.Mkdir(aofDir, 0755)
+	set := func(key, value string) string { return string(resp.Marshal(resp.Command("SET", key, value))) }
+	files := map[string]string{
+		"appendonly.aof.1.base.aof": set("a", "base"),
+		"appendonly.aof.1.incr.aof": "#TS:100\r\n" + set("a", "100") + "#TS:200\r\n" + set("a", "200"),
+		"appendonly.aof.2.incr.aof": "#TS:300\r\n" + set("a", "300"),
+		"appendonly.aof.manifest":   "file appendonly.aof.1.base.aof seq 1 type b\nfile appendonly.aof.1.incr.aof seq 1 type i\nfile appendonly.aof.2.incr.aof seq 2 type i\n",
+	}
+	for name, content := range files {
+		os.WriteFile(filepath.Join(aofDir, name), []byte(content), 0644)
+	}
+
+	manifest := filepath.Join(aofDir, "appendonly.aof.manifest")
+	if err := TruncateAOFToTimestamp(manifest, time.Unix(150, 0)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ReadAOF(manifest)
+	if err != nil || data["a"].Value != "100" {
+		t.Fatalf("AOF rolled back to 150: %v, %v", data, err)
+	}
+	for name, content := range files {
+		if name == "appendonly.aof.manifest" {
+			continue
+		}
+		if b, _ := os.ReadFile(filepath.Join(aofDir, name)); string(b) != content {
+			t.Errorf("%s was changed to %q", name, b)
+		}
+	}
+
+	// Putting the previous manifest back undoes the recovery.
+	backups, _ := filepath.Glob(manifest + ".*.bak")
+	if len(backups) != 1 {
+		t.Fatalf("manifest backups: %v", backups)
+	}
+	if err := os.Rename(backups[0], manifest); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadAOF(manifest); err != nil || data["a"].Value != "300" {
+		t.Fatalf("AOF with the previous manifest: %v, %v", data, err)
+	}
+
+	if err := TruncateAOFToTimestamp(manifest, time.Unix(50, 0)); err == nil {
+		t.Fatal("rolled back past the base file")
+	}
+}
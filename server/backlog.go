@@ -0,0 +1,54 @@
+package server
+
+// replBacklog is a circular buffer holding the most recent part of the
+// replication stream, so that replicas can resume after a short disconnection
+// without a full resynchronization.
+type replBacklog struct {
+	buf     []byte
+	idx     int   // where the next byte is written
+	histlen int   // number of valid bytes
+	offset  int64 // replication offset of the first valid byte
+}
+
+func newReplBacklog(size int, offset int64) *replBacklog {
+	return &replBacklog{buf: make([]byte, size), offset: offset}
+}
+
+// write appends p, overwriting the oldest bytes once the buffer is full.
+func (b *replBacklog) write(p []byte) {
+	size := len(b.buf)
+	if len(p) > size {
+		// Only the tail of p fits.
+		b.offset += int64(b.histlen + len(p) - size)
+		copy(b.buf, p[len(p)-size:])
+		b.idx, b.histlen = 0, size
+		return
+	}
+	n := copy(b.buf[b.idx:], p)
+	copy(b.buf, p[n:])
+	b.idx = (b.idx + len(p)) % size
+	b.histlen += len(p)
+	if b.histlen > size {
+		b.offset += int64(b.histlen - size)
+		b.histlen = size
+	}
+}
+
+// end returns the replication offset just past the last byte written.
+func (b *replBacklog) end() int64 {
+	return b.offset + int64(b.histlen)
+}
+
+// readFrom returns a copy of the stream from offset to the end, and false
+// when offset is not in the buffer anymore.
+func (b *replBacklog) readFrom(offset int64) ([]byte, bool) {
+	if offset < b.offset || offset > b.end() {
+		return nil, false
+	}
+	n := int(b.end() - offset)
+	start := (b.idx - n + len(b.buf)) % len(b.buf)
+	out := make([]byte, n)
+	k := copy(out, b.buf[start:min(start+n, len(b.buf))])
+	copy(out[k:], b.buf[:n-k])
+	return out, true
+}
@@ -0,0 +1,849 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/cluster"
+	"github.com/saurabhdhingra/go-redis/resp"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// Errors returned to clients of a cluster node.
+const (
+	errCrossSlot   = "CROSSSLOT Keys in request don't hash to the same slot"
+	errSlotUnbound = "CLUSTERDOWN Hash slot not served"
+	errClusterDown = "CLUSTERDOWN The cluster is down"
+	errTryAgain    = "TRYAGAIN Multiple keys request during rehashing of slot"
+)
+
+// clusterBusPortIncr is added to the client port to get the cluster bus port.
+const clusterBusPortIncr = 10000
+
+// shardPubSubCommands are routed by the slot of their shard channels.
+var shardPubSubCommands = map[string]bool{"SSUBSCRIBE": true, "SUNSUBSCRIBE": true, "SPUBLISH": true}
+
+// clusterState is this node's view of the cluster, saved in the cluster
+// config file whenever it changes. Nodes' Slots are only filled in to
+// describe them; slots is the authority on who serves what.
+type clusterState struct {
+	// reshardMu keeps the keys of a slot in place between the check that a
+	// command runs here and the command: commands with keys hold it shared,
+	// or exclusively in the slots being resharded, where keys move. It comes
+	// first in the lock order.
+	reshardMu sync.RWMutex
+
+	mu            sync.Mutex
+	path          string
+	myself        *clusterNode
+	nodes         map[string]*clusterNode
+	slots         [cluster.Slots]*clusterNode
+	currentEpoch  uint64
+	lastVoteEpoch uint64
+	running       bool // the bus is started; new nodes get a link
+	stateOK       bool // updated by the cron, see updateState
+
+	// Slots being resharded: migrating holds the target of the slots this
+	// node moves away, importing the source of those it receives.
+	migrating [cluster.Slots]*clusterNode
+	importing [cluster.Slots]*clusterNode
+
+	// The election of this replica to replace its failed master.
+	failoverAuthTime  time.Time
+	failoverAuthEpoch uint64
+	failoverAuthSent  bool
+	failoverAuthVotes map[string]bool
+}
+
+// clusterNode is a node of the cluster with what the bus learned about it.
+type clusterNode struct {
+	cluster.Node
+
+	created    time.Time
+	dataRecv   time.Time // last message from it on any link
+	failTime   time.Time
+	votedTime  time.Time // last vote given to a replica of this master
+	replOffset int64
+
+	// failReports holds when each master last reported it failing.
+	failReports map[string]time.Time
+
+	// The outbound link: messages are queued on send, conn is set while
+	// connected, and done stops the link when the node is deleted.
+	send chan []byte
+	conn net.Conn
+	done chan struct{}
+}
+
+func newClusterNode(n cluster.Node) *clusterNode {
+	return &clusterNode{
+		Node:        n,
+		created:     time.Now(),
+		failReports: make(map[string]time.Time),
+		send:        make(chan []byte, 64),
+		done:        make(chan struct{}),
+	}
+}
+
+func (n *clusterNode) isMaster() bool {
+	return n.MasterID == ""
+}
+
+func (n *clusterNode) addr() string {
+	return net.JoinHostPort(n.IP, strconv.Itoa(n.Port))
+}
+
+// ClusterInit loads the cluster config file, or creates it for a new node
+// on the first start. A node configured as a replica starts as one.
+func (info *ServerInfo) ClusterInit() error {
+	c := &clusterState{
+		path:  info.clusterConfigPath(),
+		nodes: make(map[string]*clusterNode),
+	}
+	err := c.load()
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		c.myself = newClusterNode(cluster.Node{ID: newReplID(), Flags: []string{"myself", "master"}})
+		c.nodes[c.myself.ID] = c.myself
+		fmt.Printf("No cluster configuration found, I'm %s\n", c.myself.ID)
+	case err != nil:
+		return fmt.Errorf("loading the cluster config %s: %w", c.path, err)
+	default:
+		fmt.Printf("Node configuration loaded, I'm %s\n", c.myself.ID)
+	}
+	c.myself.Port = info.Port
+	c.myself.BusPort = info.Port + clusterBusPortIncr
+	c.myself.Connected = true
+	if master := c.nodes[c.myself.MasterID]; master != nil {
+		info.Role = "slave"
+		info.MasterAddr = master.addr()
+	}
+	info.cluster = c
+	return c.save()
+}
+
+func (info *ServerInfo) clusterConfigPath() string {
+	dir, name := info.Dir, info.ClusterConfigFile
+	if dir == "" {
+		dir = "."
+	}
+	if name == "" {
+		name = "nodes.conf"
+	}
+	return filepath.Join(dir, name)
+}
+
+// load reads the cluster config: one node per line, as in CLUSTER NODES,
+// and a "vars" line with the epochs.
+func (c *clusterState) load() error {
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				n, err := strconv.ParseUint(fields[i+1], 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid %s in %q", fields[i], line)
+				}
+				switch fields[i] {
+				case "currentEpoch":
+					c.currentEpoch = n
+				case "lastVoteEpoch":
+					c.lastVoteEpoch = n
+				}
+			}
+			continue
+		}
+		parsed, err := cluster.ParseNode(line)
+		if err != nil {
+			return err
+		}
+		n := newClusterNode(*parsed)
+		for _, r := range n.Slots {
+			for slot := r.Start; slot <= r.End; slot++ {
+				c.slots[slot] = n
+			}
+		}
+		n.Slots = nil
+		// Links are up only once they connect again.
+		n.Connected = false
+		n.PingSent, n.PongRecv = 0, 0
+		if n.HasFlag("myself") {
+			c.myself = n
+		}
+		c.nodes[n.ID] = n
+	}
+	if c.myself == nil {
+		return errors.New("no node is flagged myself")
+	}
+	for _, m := range c.myself.Migrations {
+		n := c.nodes[m.NodeID]
+		if n == nil {
+			return fmt.Errorf("slot %d is moved from or to unknown node %s", m.Slot, m.NodeID)
+		}
+		if m.Importing {
+			c.importing[m.Slot] = n
+		} else {
+			c.migrating[m.Slot] = n
+		}
+	}
+	c.myself.Migrations = nil
+	return nil
+}
+
+// save atomically replaces the cluster config file. Must be called with
+// c.mu held once the server runs.
+func (c *clusterState) save() error {
+	var b strings.Builder
+	for _, n := range c.sortedNodes() {
+		if n.HasFlag("handshake") {
+			continue
+		}
+		b.WriteString(c.describe(n).String())
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "vars currentEpoch %d lastVoteEpoch %d\n", c.currentEpoch, c.lastVoteEpoch)
+
+	tmp := filepath.Join(filepath.Dir(c.path), "temp-"+filepath.Base(c.path))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(c.path))
+}
+
+// saveOrDie saves the config; like Redis, a node that can't record its
+// view of the cluster stops rather than risk forgetting it.
+func (c *clusterState) saveOrDie() {
+	if err := c.save(); err != nil {
+		fmt.Println("Fatal: can't update cluster config file:", err)
+		os.Exit(1)
+	}
+}
+
+// describe returns the description of n with its slots filled in, and for
+// this node the slots it is moving.
+func (c *clusterState) describe(n *clusterNode) *cluster.Node {
+	d := n.Node
+	d.Flags = slices.Clone(n.Flags)
+	d.Slots = cluster.Ranges(func(slot int) bool { return c.slots[slot] == n })
+	if n == c.myself {
+		for slot := range cluster.Slots {
+			if to := c.migrating[slot]; to != nil {
+				d.Migrations = append(d.Migrations, cluster.Migration{Slot: slot, NodeID: to.ID})
+			}
+			if from := c.importing[slot]; from != nil {
+				d.Migrations = append(d.Migrations, cluster.Migration{Slot: slot, NodeID: from.ID, Importing: true})
+			}
+		}
+	}
+	return &d
+}
+
+// closeSlots forgets the slots being moved, e.g. when this node turns into
+// a replica.
+func (c *clusterState) closeSlots() {
+	c.migrating = [cluster.Slots]*clusterNode{}
+	c.importing = [cluster.Slots]*clusterNode{}
+}
+
+func (c *clusterState) sortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		nodes = append(nodes, n)
+	}
+	slices.SortFunc(nodes, func(a, b *clusterNode) int { return strings.Compare(a.ID, b.ID) })
+	return nodes
+}
+
+// replicasOf returns the known replicas of master.
+func (c *clusterState) replicasOf(master *clusterNode) []*clusterNode {
+	var replicas []*clusterNode
+	for _, n := range c.sortedNodes() {
+		if n.MasterID == master.ID {
+			replicas = append(replicas, n)
+		}
+	}
+	return replicas
+}
+
+// numSlots returns how many slots n serves.
+func (c *clusterState) numSlots(n *clusterNode) int {
+	count := 0
+	for _, owner := range c.slots {
+		if owner == n {
+			count++
+		}
+	}
+	return count
+}
+
+// size returns the number of masters serving slots, the voters of failure
+// detection and failover elections.
+func (c *clusterState) size() int {
+	return len(c.servingMasters())
+}
+
+func (c *clusterState) servingMasters() map[*clusterNode]bool {
+	masters := make(map[*clusterNode]bool)
+	for _, n := range c.slots {
+		if n != nil {
+			masters[n] = true
+		}
+	}
+	return masters
+}
+
+// updateState records whether the cluster can serve queries: every slot is
+// served by a node that didn't fail, unless requireFullCoverage is off, and
+// this node reaches a majority of the masters.
+func (c *clusterState) updateState(requireFullCoverage bool) {
+	ok := true
+	if requireFullCoverage {
+		for _, n := range c.slots {
+			if n == nil || n.HasFlag("fail") {
+				ok = false
+				break
+			}
+		}
+	}
+	masters := c.servingMasters()
+	reachable := 0
+	for n := range masters {
+		if !n.HasFlag("pfail") && !n.HasFlag("fail") {
+			reachable++
+		}
+	}
+	if reachable < len(masters)/2+1 {
+		ok = false
+	}
+	if ok != c.stateOK {
+		state := "fail"
+		if ok {
+			state = "ok"
+		}
+		fmt.Printf("Cluster state changed: %s\n", state)
+	}
+	c.stateOK = ok
+}
+
+// clusterCall runs a client command, or replies with the redirection to
+// the node that serves its keys.
+func (info *ServerInfo) clusterCall(kv *store.KeyValueStore, cmd []resp.Value, asking bool) resp.Value {
+	c := info.cluster
+	if c == nil || len(commandKeys(cmd)) == 0 {
+		return info.call(kv, cmd)
+	}
+	c.reshardMu.RLock()
+	if c.resharding(cmd) {
+		c.reshardMu.RUnlock()
+		c.reshardMu.Lock()
+		defer c.reshardMu.Unlock()
+	} else {
+		defer c.reshardMu.RUnlock()
+	}
+	if msg := info.clusterRedirect(kv, cmd, nil, asking); msg != "" {
+		return resp.Value{Type: "error", Str: msg}
+	}
+	return info.call(kv, cmd)
+}
+
+// resharding reports whether the slot of cmd's first key is being moved.
+func (c *clusterState) resharding(cmd []resp.Value) bool {
+	slot := cluster.KeySlot(commandKeys(cmd)[0])
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.migrating[slot] != nil || c.importing[slot] != nil
+}
+
+// clusterRedirect returns the error sending cmd to the node that serves its
+// keys, or "" when it runs here. Within a transaction, txSlot holds the slot
+// of the earlier commands, -1 until one had keys. While a slot is resharded,
+// the keys already moved are served by the importing node, to clients that
+// sent ASKING first.
+func (info *ServerInfo) clusterRedirect(kv *store.KeyValueStore, cmd []resp.Value, txSlot *int, asking bool) string {
+	c := info.cluster
+	if c == nil {
+		return ""
+	}
+	keys := commandKeys(cmd)
+	if len(keys) == 0 {
+		return ""
+	}
+	slot := cluster.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.KeySlot(key) != slot {
+			return errCrossSlot
+		}
+	}
+	if txSlot != nil {
+		if *txSlot >= 0 && *txSlot != slot {
+			return errCrossSlot
+		}
+		*txSlot = slot
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.stateOK {
+		return errClusterDown
+	}
+	n := c.slots[slot]
+	if n == nil {
+		return errSlotUnbound
+	}
+	command := strings.ToUpper(cmd[0].Bulk)
+	// Shard channels hold no keys to move: the owner of the slot and its
+	// replicas serve them.
+	if shardPubSubCommands[command] {
+		if n != c.myself && n.ID != c.myself.MasterID {
+			return fmt.Sprintf("MOVED %d %s", slot, n.addr())
+		}
+		return ""
+	}
+	migrating := n == c.myself && c.migrating[slot] != nil
+	importing := c.importing[slot] != nil
+	if !migrating && !importing {
+		if n != c.myself {
+			return fmt.Sprintf("MOVED %d %s", slot, n.addr())
+		}
+		return ""
+	}
+
+	// MIGRATE moves whatever keys are still here.
+	if command == "MIGRATE" {
+		return ""
+	}
+	missing, multipleKeys := 0, false
+	for _, key := range keys {
+		if _, ok := kv.Lookup(key); !ok {
+			missing++
+		}
+		if key != keys[0] {
+			multipleKeys = true
+		}
+	}
+	switch {
+	case migrating && missing > 0 && missing < len(keys):
+		return errTryAgain
+	case migrating && missing > 0:
+		return fmt.Sprintf("ASK %d %s", slot, c.migrating[slot].addr())
+	case importing && (asking || commandFlag(command, flagAsking)):
+		if multipleKeys && missing > 0 {
+			return errTryAgain
+		}
+		return ""
+	case n != c.myself:
+		return fmt.Sprintf("MOVED %d %s", slot, n.addr())
+	}
+	return ""
+}
+
+// spublish delivers a message to the subscribers of a shard channel on this
+// node and, in cluster mode, sends it over the bus to the other nodes of the
+// shard. Like SPUBLISH, it returns the number of local receivers.
+func (info *ServerInfo) spublish(channel, message string) int {
+	if c := info.cluster; c != nil {
+		offset := info.replOffset()
+		c.mu.Lock()
+		master := c.myself
+		if !master.isMaster() {
+			master = c.nodes[c.myself.MasterID]
+		}
+		if master != nil {
+			msg := c.message("PUBLISHSHARD", offset)
+			msg.channel, msg.message = channel, message
+			data := msg.marshal()
+			for _, n := range append([]*clusterNode{master}, c.replicasOf(master)...) {
+				if n != c.myself && !n.HasFlag("handshake") {
+					c.sendTo(n, data)
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+	return info.pubsub.spublish(channel, message)
+}
+
+// pruneShardChannels unsubscribes the clients of the shard channels whose
+// slot is no longer served by this node's shard, after the slots changed.
+func (info *ServerInfo) pruneShardChannels() {
+	c := info.cluster
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info.pubsub.dropShardChannels(func(channel string) bool {
+		n := c.slots[cluster.KeySlot(channel)]
+		return n != nil && (n == c.myself || n.ID == c.myself.MasterID)
+	})
+}
+
+// clusterCommand implements CLUSTER.
+func (info *ServerInfo) clusterCommand(kv *store.KeyValueStore, args []resp.Value) resp.Value {
+	c := info.cluster
+	if c == nil {
+		return resp.Value{Type: "error", Str: "ERR This instance has cluster support disabled"}
+	}
+	if len(args) == 0 {
+		return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'cluster' command"}
+	}
+	sub := strings.ToUpper(args[0].Bulk)
+	args = args[1:]
+	wrongArgs := resp.Value{Type: "error", Str: fmt.Sprintf("ERR wrong number of arguments for 'cluster|%s' command", strings.ToLower(sub))}
+	// Read before taking c.mu, which nests inside the replication locks.
+	offset := info.replOffset()
+
+	switch sub {
+	case "KEYSLOT":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		return resp.Value{Type: "integer", Num: cluster.KeySlot(args[0].Bulk)}
+
+	case "COUNTKEYSINSLOT":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		slot, err := strconv.Atoi(args[0].Bulk)
+		if err != nil || slot < 0 || slot >= cluster.Slots {
+			return resp.Value{Type: "error", Str: "ERR Invalid slot"}
+		}
+		keys := kv.Keys(func(key string) bool { return cluster.KeySlot(key) == slot })
+		return resp.Value{Type: "integer", Num: len(keys)}
+
+	case "GETKEYSINSLOT":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		slot, err1 := strconv.Atoi(args[0].Bulk)
+		count, err2 := strconv.Atoi(args[1].Bulk)
+		if err1 != nil || err2 != nil || slot < 0 || slot >= cluster.Slots || count < 0 {
+			return resp.Value{Type: "error", Str: "ERR Invalid slot or number of keys"}
+		}
+		keys := kv.Keys(func(key string) bool { return cluster.KeySlot(key) == slot })
+		slices.Sort(keys)
+		keys = keys[:min(count, len(keys))]
+		return resp.Command(keys...)
+
+	case "MYID":
+		return resp.Value{Type: "bulk", Bulk: c.myself.ID}
+
+	case "NODES":
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		var b strings.Builder
+		for _, n := range c.sortedNodes() {
+			b.WriteString(c.describe(n).String())
+			b.WriteString("\n")
+		}
+		return resp.Value{Type: "bulk", Bulk: b.String()}
+
+	case "INFO":
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		state := "ok"
+		if !c.stateOK {
+			state = "fail"
+		}
+		var assigned, pfail, fail int
+		for _, n := range c.slots {
+			switch {
+			case n == nil:
+			case n.HasFlag("fail"):
+				fail++
+			case n.HasFlag("pfail"):
+				pfail++
+			}
+			if n != nil {
+				assigned++
+			}
+		}
+		lines := []string{
+			"cluster_enabled:1",
+			"cluster_state:" + state,
+			fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+			fmt.Sprintf("cluster_slots_ok:%d", assigned-pfail-fail),
+			fmt.Sprintf("cluster_slots_pfail:%d", pfail),
+			fmt.Sprintf("cluster_slots_fail:%d", fail),
+			fmt.Sprintf("cluster_known_nodes:%d", len(c.nodes)),
+			fmt.Sprintf("cluster_size:%d", c.size()),
+			fmt.Sprintf("cluster_current_epoch:%d", c.currentEpoch),
+			fmt.Sprintf("cluster_my_epoch:%d", c.myself.ConfigEpoch),
+		}
+		return resp.Value{Type: "bulk", Bulk: strings.Join(lines, "\r\n") + "\r\n"}
+
+	case "SLOTS":
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		var ranges []resp.Value
+		for _, master := range c.sortedNodes() {
+			for _, r := range c.describe(master).Slots {
+				entry := []resp.Value{{Type: "integer", Num: r.Start}, {Type: "integer", Num: r.End}}
+				for _, n := range append([]*clusterNode{master}, c.replicasOf(master)...) {
+					if n.HasFlag("fail") {
+						continue
+					}
+					entry = append(entry, resp.Value{Type: "array", Array: []resp.Value{
+						{Type: "bulk", Bulk: n.IP},
+						{Type: "integer", Num: n.Port},
+						{Type: "bulk", Bulk: n.ID},
+						{Type: "array"},
+					}})
+				}
+				ranges = append(ranges, resp.Value{Type: "array", Array: entry})
+			}
+		}
+		slices.SortFunc(ranges, func(a, b resp.Value) int { return a.Array[0].Num - b.Array[0].Num })
+		return resp.Value{Type: "array", Array: ranges}
+
+	case "SHARDS":
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		var shards []resp.Value
+		for _, master := range c.sortedNodes() {
+			if !master.isMaster() || master.HasFlag("handshake") {
+				continue
+			}
+			var slots []resp.Value
+			for _, r := range c.describe(master).Slots {
+				slots = append(slots, resp.Value{Type: "integer", Num: r.Start}, resp.Value{Type: "integer", Num: r.End})
+			}
+			var nodes []resp.Value
+			for _, n := range append([]*clusterNode{master}, c.replicasOf(master)...) {
+				nodes = append(nodes, c.shardNode(n, offset))
+			}
+			shards = append(shards, resp.Value{Type: "array", Array: []resp.Value{
+				{Type: "bulk", Bulk: "slots"}, {Type: "array", Array: slots},
+				{Type: "bulk", Bulk: "nodes"}, {Type: "array", Array: nodes},
+			}})
+		}
+		return resp.Value{Type: "array", Array: shards}
+
+	case "ADDSLOTS", "DELSLOTS":
+		if len(args) == 0 {
+			return wrongArgs
+		}
+		var slots []int
+		for _, arg := range args {
+			slot, err := strconv.Atoi(arg.Bulk)
+			if err != nil || slot < 0 || slot >= cluster.Slots {
+				return resp.Value{Type: "error", Str: "ERR Invalid or out of range slot"}
+			}
+			if slices.Contains(slots, slot) {
+				return resp.Value{Type: "error", Str: fmt.Sprintf("ERR Slot %d specified multiple times", slot)}
+			}
+			slots = append(slots, slot)
+		}
+		defer info.pruneShardChannels()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if !c.myself.isMaster() {
+			return resp.Value{Type: "error", Str: fmt.Sprintf("ERR Please use %s only with masters.", sub)}
+		}
+		for _, slot := range slots {
+			if sub == "ADDSLOTS" && c.slots[slot] != nil {
+				return resp.Value{Type: "error", Str: fmt.Sprintf("ERR Slot %d is already busy", slot)}
+			}
+			if sub == "DELSLOTS" && c.slots[slot] == nil {
+				return resp.Value{Type: "error", Str: fmt.Sprintf("ERR Slot %d is already unassigned", slot)}
+			}
+		}
+		for _, slot := range slots {
+			if sub == "ADDSLOTS" {
+				c.slots[slot] = c.myself
+			} else {
+				c.slots[slot] = nil
+			}
+		}
+		c.updateState(info.ClusterRequireFullCoverage)
+		c.saveOrDie()
+		return resp.Value{Type: "string", Str: "OK"}
+
+	case "SETSLOT":
+		// CLUSTER SETSLOT <slot> IMPORTING|MIGRATING|NODE <node-id> | STABLE
+		if len(args) < 2 {
+			return wrongArgs
+		}
+		slot, err := strconv.Atoi(args[0].Bulk)
+		if err != nil || slot < 0 || slot >= cluster.Slots {
+			return resp.Value{Type: "error", Str: "ERR Invalid or out of range slot"}
+		}
+		action := strings.ToUpper(args[1].Bulk)
+		if action == "STABLE" && len(args) != 2 || action != "STABLE" && len(args) != 3 {
+			return resp.Value{Type: "error", Str: "ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP"}
+		}
+		// Opening or closing the slot waits for the commands running in it.
+		c.reshardMu.Lock()
+		defer c.reshardMu.Unlock()
+		slotKeys := len(kv.Keys(func(key string) bool { return cluster.KeySlot(key) == slot }))
+		defer info.pruneShardChannels()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if !c.myself.isMaster() {
+			return resp.Value{Type: "error", Str: "ERR Please use SETSLOT only with masters."}
+		}
+		var n *clusterNode
+		if action != "STABLE" {
+			n = c.nodes[args[2].Bulk]
+		}
+		switch action {
+		case "MIGRATING", "IMPORTING":
+			switch {
+			case action == "MIGRATING" && c.slots[slot] != c.myself:
+				return resp.Value{Type: "error", Str: fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot)}
+			case action == "IMPORTING" && c.slots[slot] == c.myself:
+				return resp.Value{Type: "error", Str: fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot)}
+			case n == nil:
+				return resp.Value{Type: "error", Str: "ERR I don't know about node " + args[2].Bulk}
+			case !n.isMaster():
+				return resp.Value{Type: "error", Str: "ERR Target node is not a master"}
+			}
+			if action == "MIGRATING" {
+				c.migrating[slot] = n
+			} else {
+				c.importing[slot] = n
+			}
+		case "STABLE":
+			c.migrating[slot] = nil
+			c.importing[slot] = nil
+		case "NODE":
+			switch {
+			case n == nil:
+				return resp.Value{Type: "error", Str: "ERR Unknown node " + args[2].Bulk}
+			case !n.isMaster():
+				return resp.Value{Type: "error", Str: "ERR Target node is not a master"}
+			case c.slots[slot] == c.myself && n != c.myself && slotKeys > 0:
+				return resp.Value{Type: "error", Str: fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)}
+			}
+			if n != c.myself && slotKeys == 0 {
+				c.migrating[slot] = nil
+			}
+			// The slot is ours now: a new config epoch makes the other nodes
+			// take our word over the previous owner's.
+			if n == c.myself && c.importing[slot] != nil {
+				c.importing[slot] = nil
+				if c.bumpConfigEpoch() {
+					fmt.Printf("configEpoch updated after importing slot %d\n", slot)
+				}
+				defer c.broadcastPong(offset)
+			}
+			c.slots[slot] = n
+		default:
+			return resp.Value{Type: "error", Str: "ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP"}
+		}
+		c.updateState(info.ClusterRequireFullCoverage)
+		c.saveOrDie()
+		return resp.Value{Type: "string", Str: "OK"}
+
+	case "MEET":
+		// CLUSTER MEET <ip> <port> [<cluster-bus-port>]
+		if len(args) != 2 && len(args) != 3 {
+			return wrongArgs
+		}
+		port, err := strconv.Atoi(args[1].Bulk)
+		busPort := port + clusterBusPortIncr
+		if err == nil && len(args) == 3 {
+			busPort, err = strconv.Atoi(args[2].Bulk)
+		}
+		ip := net.ParseIP(args[0].Bulk)
+		if err != nil || ip == nil || port <= 0 || port > 65535 || busPort <= 0 || busPort > 65535 {
+			return resp.Value{Type: "error", Str: fmt.Sprintf("ERR Invalid node address specified: %s:%s", args[0].Bulk, args[1].Bulk)}
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		info.startHandshake(kv, ip.String(), port, busPort, true)
+		return resp.Value{Type: "string", Str: "OK"}
+
+	case "REPLICATE":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		c.mu.Lock()
+		master := c.nodes[args[0].Bulk]
+		var errMsg string
+		switch {
+		case master == nil:
+			errMsg = "ERR Unknown node " + args[0].Bulk
+		case master == c.myself:
+			errMsg = "ERR Can't replicate myself"
+		case !master.isMaster():
+			errMsg = "ERR I can only replicate a master, not a replica."
+		case c.myself.isMaster() && (c.numSlots(c.myself) > 0 || kv.Len() > 0):
+			errMsg = "ERR To set a master the node must be empty and without assigned slots."
+		}
+		if errMsg != "" {
+			c.mu.Unlock()
+			return resp.Value{Type: "error", Str: errMsg}
+		}
+		change := c.setMaster(master)
+		c.mu.Unlock()
+		info.applyClusterRole(kv, change)
+		return resp.Value{Type: "string", Str: "OK"}
+
+	default:
+		return resp.Value{Type: "error", Str: fmt.Sprintf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", strings.ToLower(sub))}
+	}
+}
+
+// shardNode describes n in CLUSTER SHARDS. Must be called with c.mu held.
+func (c *clusterState) shardNode(n *clusterNode, myOffset int64) resp.Value {
+	role := "master"
+	if !n.isMaster() {
+		role = "replica"
+	}
+	health := "online"
+	if n.HasFlag("fail") {
+		health = "failed"
+	}
+	offset := n.replOffset
+	if n == c.myself {
+		offset = myOffset
+	}
+	return resp.Value{Type: "array", Array: []resp.Value{
+		{Type: "bulk", Bulk: "id"}, {Type: "bulk", Bulk: n.ID},
+		{Type: "bulk", Bulk: "port"}, {Type: "integer", Num: n.Port},
+		{Type: "bulk", Bulk: "ip"}, {Type: "bulk", Bulk: n.IP},
+		{Type: "bulk", Bulk: "endpoint"}, {Type: "bulk", Bulk: n.IP},
+		{Type: "bulk", Bulk: "role"}, {Type: "bulk", Bulk: role},
+		{Type: "bulk", Bulk: "replication-offset"}, {Type: "integer", Num: int(offset)},
+		{Type: "bulk", Bulk: "health"}, {Type: "bulk", Bulk: health},
+	}}
+}
+
+func (info *ServerInfo) clusterInfo() []string {
+	return []string{"cluster_enabled:" + boolToInfo(info.cluster != nil)}
+}
@@ -0,0 +1,957 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/cluster"
+	"github.com/saurabhdhingra/go-redis/resp"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+const (
+	clusterCronPeriod = 100 * time.Millisecond
+	// A replica that lost its master for longer than this many node
+	// timeouts has data too old to be promoted.
+	clusterReplicaValidityFactor = 10
+)
+
+// busMessage is a message of the cluster bus, sent as a RESP array of bulk
+// strings: the type, the sender's current epoch and replication offset, the
+// sender's description as in CLUSTER NODES, then what the type carries.
+// Replicas describe themselves with the slots and config epoch of their
+// master, which is what their failover elections are about.
+type busMessage struct {
+	typ          string // PING, PONG, MEET, FAIL, AUTH-REQUEST, AUTH-ACK, UPDATE or PUBLISHSHARD
+	currentEpoch uint64
+	offset       int64
+	sender       *cluster.Node
+	gossip       []*cluster.Node // PING, PONG and MEET: other nodes, without slots
+	node         string          // FAIL: the failing node
+	update       *cluster.Node   // UPDATE: the node whose config is newer
+	channel      string          // PUBLISHSHARD: the shard channel
+	message      string          // PUBLISHSHARD: what was published
+}
+
+func (m *busMessage) marshal() []byte {
+	args := []string{
+		m.typ,
+		strconv.FormatUint(m.currentEpoch, 10),
+		strconv.FormatInt(m.offset, 10),
+		m.sender.String(),
+	}
+	switch m.typ {
+	case "FAIL":
+		args = append(args, m.node)
+	case "UPDATE":
+		args = append(args, m.update.String())
+	case "PUBLISHSHARD":
+		args = append(args, m.channel, m.message)
+	default:
+		for _, g := range m.gossip {
+			args = append(args, g.String())
+		}
+	}
+	return resp.Marshal(resp.Command(args...))
+}
+
+func parseBusMessage(v resp.Value) (*busMessage, error) {
+	if v.Type != "array" || len(v.Array) < 4 {
+		return nil, errors.New("invalid cluster bus message")
+	}
+	m := &busMessage{typ: v.Array[0].Bulk}
+	var err1, err2, err3 error
+	m.currentEpoch, err1 = strconv.ParseUint(v.Array[1].Bulk, 10, 64)
+	m.offset, err2 = strconv.ParseInt(v.Array[2].Bulk, 10, 64)
+	m.sender, err3 = cluster.ParseNode(v.Array[3].Bulk)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return nil, err
+	}
+	rest := v.Array[4:]
+	switch m.typ {
+	case "FAIL":
+		if len(rest) != 1 {
+			return nil, errors.New("invalid FAIL message")
+		}
+		m.node = rest[0].Bulk
+	case "UPDATE":
+		if len(rest) != 1 {
+			return nil, errors.New("invalid UPDATE message")
+		}
+		update, err := cluster.ParseNode(rest[0].Bulk)
+		if err != nil {
+			return nil, err
+		}
+		m.update = update
+	case "PUBLISHSHARD":
+		if len(rest) != 2 {
+			return nil, errors.New("invalid PUBLISHSHARD message")
+		}
+		m.channel, m.message = rest[0].Bulk, rest[1].Bulk
+	default:
+		for _, g := range rest {
+			node, err := cluster.ParseNode(g.Bulk)
+			if err != nil {
+				return nil, err
+			}
+			m.gossip = append(m.gossip, node)
+		}
+	}
+	return m, nil
+}
+
+// clusterRoleChange is what the bus decided about this node, applied once
+// c.mu is released: the replication locks come first in the lock order.
+type clusterRoleChange struct {
+	promote    bool
+	masterAddr string
+	dropSlots  []int // slots lost to another master, whose keys go
+}
+
+func (ch *clusterRoleChange) merge(other clusterRoleChange) {
+	ch.promote = ch.promote || other.promote
+	if other.masterAddr != "" {
+		ch.masterAddr = other.masterAddr
+	}
+	ch.dropSlots = append(ch.dropSlots, other.dropSlots...)
+}
+
+// StartClusterBus listens for the other nodes on the cluster bus port and
+// starts gossiping with the known ones.
+func (info *ServerInfo) StartClusterBus(kv *store.KeyValueStore) error {
+	c := info.cluster
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(info.Port+clusterBusPortIncr))
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.running = true
+	for _, n := range c.nodes {
+		if n != c.myself {
+			go info.clusterLink(kv, n)
+		}
+	}
+	c.updateState(info.ClusterRequireFullCoverage)
+	c.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				fmt.Println("Error accepting cluster bus connection:", err)
+				continue
+			}
+			go info.serveClusterConn(kv, conn)
+		}
+	}()
+	go func() {
+		for range time.Tick(clusterCronPeriod) {
+			info.clusterCron(kv)
+		}
+	}()
+	return nil
+}
+
+// serveClusterConn reads the messages another node sends on its link to
+// this one, answering its pings.
+func (info *ServerInfo) serveClusterConn(kv *store.KeyValueStore, conn net.Conn) {
+	defer conn.Close()
+	reader := resp.NewResp(conn)
+	for {
+		v, err := reader.Read()
+		if err != nil {
+			return
+		}
+		msg, err := parseBusMessage(v)
+		if err != nil {
+			fmt.Println("Error reading cluster bus message:", err)
+			return
+		}
+		if reply := info.processBusMessage(kv, msg, conn, nil); reply != nil {
+			conn.SetWriteDeadline(time.Now().Add(info.ClusterNodeTimeout))
+			if _, err := conn.Write(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// clusterLink keeps the outbound link to n, reconnecting until n is deleted.
+func (info *ServerInfo) clusterLink(kv *store.KeyValueStore, n *clusterNode) {
+	c := info.cluster
+	for {
+		c.mu.Lock()
+		addr := net.JoinHostPort(n.IP, strconv.Itoa(n.BusPort))
+		// Trying to connect counts as a ping, so that a node that can't
+		// be reached gets flagged.
+		if n.PingSent == 0 {
+			n.PingSent = time.Now().UnixMilli()
+		}
+		c.mu.Unlock()
+		if conn, err := net.DialTimeout("tcp", addr, info.ClusterNodeTimeout); err == nil {
+			info.serveClusterLink(kv, n, conn)
+		}
+		select {
+		case <-n.done:
+			return
+		case <-time.After(clusterCronPeriod):
+		}
+	}
+}
+
+func (info *ServerInfo) serveClusterLink(kv *store.KeyValueStore, n *clusterNode, conn net.Conn) {
+	c := info.cluster
+	offset := info.replOffset()
+	c.mu.Lock()
+	typ := "PING"
+	if n.HasFlag("meet") {
+		typ = "MEET"
+		n.SetFlag("meet", false)
+	}
+	hello := c.ping(typ, offset, n).marshal()
+	n.conn = conn
+	n.Connected = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		n.conn = nil
+		n.Connected = false
+		c.mu.Unlock()
+		conn.Close()
+	}()
+
+	conn.SetWriteDeadline(time.Now().Add(info.ClusterNodeTimeout))
+	if _, err := conn.Write(hello); err != nil {
+		return
+	}
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		reader := resp.NewResp(conn)
+		for {
+			v, err := reader.Read()
+			if err != nil {
+				return
+			}
+			msg, err := parseBusMessage(v)
+			if err != nil {
+				fmt.Println("Error reading cluster bus message:", err)
+				return
+			}
+			info.processBusMessage(kv, msg, conn, n)
+		}
+	}()
+	for {
+		select {
+		case data := <-n.send:
+			conn.SetWriteDeadline(time.Now().Add(info.ClusterNodeTimeout))
+			if _, err := conn.Write(data); err != nil {
+				return
+			}
+		case <-readDone:
+			return
+		case <-n.done:
+			return
+		}
+	}
+}
+
+// message returns a message of typ from this node. Must be called with c.mu
+// held, as are the other clusterState methods below.
+func (c *clusterState) message(typ string, offset int64) *busMessage {
+	sender := c.describe(c.myself)
+	sender.SetFlag("myself", false)
+	sender.Migrations = nil
+	if master := c.nodes[c.myself.MasterID]; master != nil {
+		sender.Slots = c.describe(master).Slots
+		sender.ConfigEpoch = master.ConfigEpoch
+	}
+	return &busMessage{typ: typ, currentEpoch: c.currentEpoch, offset: offset, sender: sender}
+}
+
+// ping returns a PING, PONG or MEET for to, with gossip about the other
+// nodes.
+func (c *clusterState) ping(typ string, offset int64, to *clusterNode) *busMessage {
+	msg := c.message(typ, offset)
+	for _, n := range c.sortedNodes() {
+		if n == c.myself || n == to || n.HasFlag("handshake") || n.IP == "" {
+			continue
+		}
+		g := n.Node
+		g.Flags = append([]string(nil), n.Flags...)
+		g.Slots = nil
+		msg.gossip = append(msg.gossip, &g)
+	}
+	return msg
+}
+
+// sendTo queues a message on the link to n, dropping it when the link is
+// backed up: the next ping carries the same information.
+func (c *clusterState) sendTo(n *clusterNode, data []byte) {
+	select {
+	case n.send <- data:
+	default:
+	}
+}
+
+// broadcastPong tells every node about this one right away, after a change
+// of its slots or role.
+func (c *clusterState) broadcastPong(offset int64) {
+	for _, n := range c.nodes {
+		if n != c.myself && !n.HasFlag("handshake") {
+			c.sendTo(n, c.ping("PONG", offset, n).marshal())
+		}
+	}
+}
+
+func (c *clusterState) broadcast(data []byte) {
+	for _, n := range c.nodes {
+		if n != c.myself && !n.HasFlag("handshake") {
+			c.sendTo(n, data)
+		}
+	}
+}
+
+// processBusMessage handles a message received on conn, either on the
+// outbound link to link or on an inbound connection (link nil), and
+// returns the reply to send back, if any.
+func (info *ServerInfo) processBusMessage(kv *store.KeyValueStore, msg *busMessage, conn net.Conn, link *clusterNode) []byte {
+	offset := info.replOffset()
+	c := info.cluster
+	c.mu.Lock()
+	reply, change := info.processBusMessageLocked(kv, msg, conn, link, offset)
+	c.mu.Unlock()
+	info.applyClusterRole(kv, change)
+	return reply
+}
+
+func (info *ServerInfo) processBusMessageLocked(kv *store.KeyValueStore, msg *busMessage, conn net.Conn, link *clusterNode, offset int64) ([]byte, clusterRoleChange) {
+	c := info.cluster
+	now := time.Now()
+	var change clusterRoleChange
+
+	sender := c.nodes[msg.sender.ID]
+	if sender != nil && sender.HasFlag("handshake") {
+		sender = nil
+	}
+	senderIP := msg.sender.IP
+	if senderIP == "" {
+		senderIP, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	}
+	if sender != nil {
+		sender.dataRecv = now
+		sender.replOffset = msg.offset
+		if msg.currentEpoch > c.currentEpoch {
+			c.currentEpoch = msg.currentEpoch
+			c.saveOrDie()
+		}
+		if msg.sender.MasterID == "" && msg.sender.ConfigEpoch > sender.ConfigEpoch {
+			sender.ConfigEpoch = msg.sender.ConfigEpoch
+			c.saveOrDie()
+		}
+	}
+
+	// A node learns its own address from the connections of the others.
+	if link == nil && (msg.typ == "MEET" || c.myself.IP == "") {
+		if ip, _, _ := net.SplitHostPort(conn.LocalAddr().String()); ip != c.myself.IP {
+			c.myself.IP = ip
+			fmt.Printf("IP address for this node updated to %s\n", ip)
+			c.saveOrDie()
+		}
+	}
+	// A node that meets us is added, after a handshake of our own.
+	if sender == nil && msg.typ == "MEET" {
+		info.startHandshake(kv, senderIP, msg.sender.Port, msg.sender.BusPort, false)
+	}
+
+	switch msg.typ {
+	case "PING", "PONG", "MEET":
+		if link != nil && link.HasFlag("handshake") {
+			if sender != nil {
+				// We know the node already under its name.
+				c.deleteNode(link)
+				return nil, change
+			}
+			fmt.Printf("Handshake with node %s completed.\n", msg.sender.ID)
+			delete(c.nodes, link.ID)
+			link.ID = msg.sender.ID
+			c.nodes[link.ID] = link
+			link.SetFlag("handshake", false)
+			link.MasterID = msg.sender.MasterID
+			link.SetFlag("master", link.isMaster())
+			link.SetFlag("slave", !link.isMaster())
+			c.saveOrDie()
+		}
+
+		if sender != nil && msg.typ == "PING" &&
+			(sender.IP != senderIP || sender.Port != msg.sender.Port || sender.BusPort != msg.sender.BusPort) {
+			sender.IP, sender.Port, sender.BusPort = senderIP, msg.sender.Port, msg.sender.BusPort
+			fmt.Printf("Address updated for node %s, now %s\n", sender.ID, sender.addr())
+			if sender.conn != nil {
+				sender.conn.Close()
+			}
+			c.saveOrDie()
+		}
+
+		if link != nil && msg.typ == "PONG" {
+			link.PongRecv = now.UnixMilli()
+			link.PingSent = 0
+			if link.HasFlag("pfail") {
+				link.SetFlag("pfail", false)
+			} else if link.HasFlag("fail") {
+				c.clearNodeFailureIfNeeded(link, info.ClusterNodeTimeout)
+			}
+		}
+
+		if sender == nil {
+			break
+		}
+		change.merge(c.updateRole(sender, msg.sender))
+
+		// Slots: adopt a newer claim of a master, and tell a node with a
+		// stale claim about the newer configuration.
+		senderMaster := sender
+		if !sender.isMaster() {
+			senderMaster = c.nodes[sender.MasterID]
+		}
+		dirty := senderMaster != nil && !slices.Equal(c.describe(senderMaster).Slots, msg.sender.Slots)
+		if dirty && sender.isMaster() {
+			change.merge(c.updateSlotsConfigWith(sender, msg.sender.ConfigEpoch, msg.sender.Slots))
+		}
+		if dirty {
+		stale:
+			for _, r := range msg.sender.Slots {
+				for slot := r.Start; slot <= r.End; slot++ {
+					owner := c.slots[slot]
+					if owner == nil || owner == senderMaster || owner.ConfigEpoch <= msg.sender.ConfigEpoch {
+						continue
+					}
+					update := c.message("UPDATE", offset)
+					update.update = c.describe(owner)
+					c.sendTo(sender, update.marshal())
+					break stale
+				}
+			}
+		}
+
+		if sender.isMaster() && c.myself.isMaster() && sender.ConfigEpoch == c.myself.ConfigEpoch {
+			c.handleConfigEpochCollision(sender)
+		}
+		info.processGossip(kv, sender, msg.gossip)
+
+	case "FAIL":
+		if sender == nil {
+			break
+		}
+		failing := c.nodes[msg.node]
+		if failing != nil && failing != c.myself && !failing.HasFlag("fail") {
+			fmt.Printf("FAIL message received from %s about %s\n", sender.ID, failing.ID)
+			failing.SetFlag("fail", true)
+			failing.SetFlag("pfail", false)
+			failing.failTime = now
+			c.saveOrDie()
+		}
+
+	case "AUTH-REQUEST":
+		if sender != nil {
+			c.voteFor(sender, msg, offset, info.ClusterNodeTimeout)
+		}
+
+	case "AUTH-ACK":
+		if sender != nil && sender.isMaster() && c.numSlots(sender) > 0 && msg.currentEpoch >= c.failoverAuthEpoch && c.failoverAuthVotes != nil {
+			c.failoverAuthVotes[sender.ID] = true
+		}
+
+	case "UPDATE":
+		if sender == nil {
+			break
+		}
+		n := c.nodes[msg.update.ID]
+		if n == nil || n.ConfigEpoch >= msg.update.ConfigEpoch {
+			break
+		}
+		if !n.isMaster() {
+			c.setNodeAsMaster(n)
+		}
+		n.ConfigEpoch = msg.update.ConfigEpoch
+		change.merge(c.updateSlotsConfigWith(n, msg.update.ConfigEpoch, msg.update.Slots))
+
+	case "PUBLISHSHARD":
+		if sender != nil {
+			info.pubsub.spublish(msg.channel, msg.message)
+		}
+	}
+
+	c.updateState(info.ClusterRequireFullCoverage)
+	if msg.typ == "PING" || msg.typ == "MEET" {
+		return c.ping("PONG", offset, sender).marshal(), change
+	}
+	return nil, change
+}
+
+// updateRole records the role sender announces in desc.
+func (c *clusterState) updateRole(sender *clusterNode, desc *cluster.Node) clusterRoleChange {
+	if desc.MasterID == "" {
+		c.setNodeAsMaster(sender)
+		return clusterRoleChange{}
+	}
+	if sender.isMaster() {
+		// A master turned into a replica: its slots are claimed again by
+		// whoever serves them now.
+		for slot, owner := range c.slots {
+			if owner == sender {
+				c.slots[slot] = nil
+			}
+		}
+		sender.SetFlag("master", false)
+		sender.SetFlag("slave", true)
+	}
+	if sender.MasterID != desc.MasterID {
+		sender.MasterID = desc.MasterID
+		c.saveOrDie()
+	}
+	return clusterRoleChange{}
+}
+
+func (c *clusterState) setNodeAsMaster(n *clusterNode) {
+	if n.isMaster() {
+		return
+	}
+	n.MasterID = ""
+	n.SetFlag("slave", false)
+	n.SetFlag("master", true)
+	c.saveOrDie()
+}
+
+// setMaster makes this node a replica of master.
+func (c *clusterState) setMaster(master *clusterNode) clusterRoleChange {
+	if c.myself.isMaster() {
+		for slot, owner := range c.slots {
+			if owner == c.myself {
+				c.slots[slot] = nil
+			}
+		}
+		c.myself.SetFlag("master", false)
+		c.myself.SetFlag("slave", true)
+		c.closeSlots()
+	}
+	c.myself.MasterID = master.ID
+	c.failoverAuthTime = time.Time{}
+	c.saveOrDie()
+	return clusterRoleChange{masterAddr: master.addr()}
+}
+
+// updateSlotsConfigWith gives sender the slots it claims with configEpoch,
+// where that is newer than the configuration of their owner. When this
+// node, or its master, loses its last slot to sender, it follows sender.
+func (c *clusterState) updateSlotsConfigWith(sender *clusterNode, configEpoch uint64, ranges []cluster.SlotRange) clusterRoleChange {
+	var change clusterRoleChange
+	if sender == c.myself {
+		return change
+	}
+	curMaster := c.myself
+	if !c.myself.isMaster() {
+		curMaster = c.nodes[c.myself.MasterID]
+	}
+	newMaster := false
+	var lost []int
+	for _, r := range ranges {
+		for slot := r.Start; slot <= r.End; slot++ {
+			owner := c.slots[slot]
+			// A slot being imported is only assigned with SETSLOT NODE.
+			if owner == sender || c.importing[slot] != nil || owner != nil && owner.ConfigEpoch >= configEpoch {
+				continue
+			}
+			if owner == c.myself {
+				lost = append(lost, slot)
+				c.migrating[slot] = nil
+			}
+			if owner != nil && owner == curMaster {
+				newMaster = true
+			}
+			c.slots[slot] = sender
+		}
+	}
+	if newMaster && c.numSlots(curMaster) == 0 {
+		fmt.Printf("Configuration change detected. Reconfiguring myself as a replica of %s\n", sender.ID)
+		change = c.setMaster(sender)
+	} else if len(lost) > 0 {
+		change.dropSlots = lost
+	}
+	c.saveOrDie()
+	return change
+}
+
+// bumpConfigEpoch gives this node a new config epoch, unless its own is
+// already the greatest, without the agreement of the other masters. It
+// reports whether the epoch changed.
+func (c *clusterState) bumpConfigEpoch() bool {
+	maxEpoch := c.currentEpoch
+	for _, n := range c.nodes {
+		maxEpoch = max(maxEpoch, n.ConfigEpoch)
+	}
+	if c.myself.ConfigEpoch != 0 && c.myself.ConfigEpoch == maxEpoch {
+		return false
+	}
+	c.currentEpoch = maxEpoch + 1
+	c.myself.ConfigEpoch = c.currentEpoch
+	return true
+}
+
+// handleConfigEpochCollision gives this master a new config epoch when it
+// has the same as sender, so that every master ends up with its own; of the
+// two, the node with the smaller ID moves.
+func (c *clusterState) handleConfigEpochCollision(sender *clusterNode) {
+	if sender.ID <= c.myself.ID {
+		return
+	}
+	c.currentEpoch++
+	c.myself.ConfigEpoch = c.currentEpoch
+	c.saveOrDie()
+	fmt.Printf("WARNING: configEpoch collision with node %s. configEpoch set to %d\n", sender.ID, c.myself.ConfigEpoch)
+}
+
+// processGossip records what sender says about the other nodes: failure
+// reports from masters, and nodes we don't know yet.
+func (info *ServerInfo) processGossip(kv *store.KeyValueStore, sender *clusterNode, gossip []*cluster.Node) {
+	c := info.cluster
+	for _, g := range gossip {
+		n := c.nodes[g.ID]
+		if n == nil {
+			if g.ID != c.myself.ID && g.IP != "" {
+				info.startHandshake(kv, g.IP, g.Port, g.BusPort, false)
+			}
+			continue
+		}
+		failing := g.HasFlag("pfail") || g.HasFlag("fail")
+		if sender.isMaster() && n != c.myself {
+			if failing {
+				if _, ok := n.failReports[sender.ID]; !ok {
+					fmt.Printf("Node %s reported node %s as not reachable.\n", sender.ID, n.ID)
+				}
+				n.failReports[sender.ID] = time.Now()
+				c.markNodeAsFailingIfNeeded(n, info.ClusterNodeTimeout)
+			} else {
+				delete(n.failReports, sender.ID)
+			}
+		}
+		// A node we can't reach may have moved; trust a node that can.
+		if (n.HasFlag("pfail") || n.HasFlag("fail")) && !failing && g.IP != "" &&
+			(n.IP != g.IP || n.Port != g.Port || n.BusPort != g.BusPort) {
+			n.IP, n.Port, n.BusPort = g.IP, g.Port, g.BusPort
+			if n.conn != nil {
+				n.conn.Close()
+			}
+			c.saveOrDie()
+		}
+	}
+}
+
+// markNodeAsFailingIfNeeded flags n as failing once it is unreachable from
+// here and a majority of the masters reported it so, and tells everyone.
+func (c *clusterState) markNodeAsFailingIfNeeded(n *clusterNode, nodeTimeout time.Duration) {
+	if !n.HasFlag("pfail") || n.HasFlag("fail") {
+		return
+	}
+	failures := 0
+	for reporter, at := range n.failReports {
+		if time.Since(at) > 2*nodeTimeout {
+			delete(n.failReports, reporter)
+			continue
+		}
+		failures++
+	}
+	if c.myself.isMaster() {
+		failures++
+	}
+	if failures < c.size()/2+1 {
+		return
+	}
+	fmt.Printf("Marking node %s as failing (quorum reached).\n", n.ID)
+	n.SetFlag("pfail", false)
+	n.SetFlag("fail", true)
+	n.failTime = time.Now()
+	msg := c.message("FAIL", 0)
+	msg.node = n.ID
+	c.broadcast(msg.marshal())
+	c.saveOrDie()
+}
+
+// clearNodeFailureIfNeeded clears the FAIL flag of a node that is reachable
+// again, unless it is a master whose slots may still be taken over.
+func (c *clusterState) clearNodeFailureIfNeeded(n *clusterNode, nodeTimeout time.Duration) {
+	switch {
+	case !n.isMaster() || c.numSlots(n) == 0:
+		fmt.Printf("Clear FAIL state for node %s: is reachable again.\n", n.ID)
+	case time.Since(n.failTime) > 2*nodeTimeout:
+		fmt.Printf("Clear FAIL state for node %s: is reachable again and nobody is serving its slots after some time.\n", n.ID)
+	default:
+		return
+	}
+	n.SetFlag("fail", false)
+	c.saveOrDie()
+}
+
+// voteFor answers the failover election of sender, a replica of a failed
+// master: a master votes once per epoch, and once per failed master in
+// twice the node timeout.
+func (c *clusterState) voteFor(sender *clusterNode, msg *busMessage, offset int64, nodeTimeout time.Duration) {
+	if !c.myself.isMaster() || c.numSlots(c.myself) == 0 {
+		return
+	}
+	denied := func(reason string) {
+		fmt.Printf("Failover auth denied to %s: %s\n", sender.ID, reason)
+	}
+	master := c.nodes[msg.sender.MasterID]
+	switch {
+	case msg.currentEpoch < c.currentEpoch:
+		denied(fmt.Sprintf("reqEpoch (%d) < curEpoch(%d)", msg.currentEpoch, c.currentEpoch))
+		return
+	case c.lastVoteEpoch == c.currentEpoch:
+		denied(fmt.Sprintf("already voted for epoch %d", c.currentEpoch))
+		return
+	case msg.sender.MasterID == "":
+		denied("it is a master node")
+		return
+	case master == nil:
+		denied("I don't know its master")
+		return
+	case !master.HasFlag("fail"):
+		denied("its master is up")
+		return
+	case time.Since(master.votedTime) < 2*nodeTimeout:
+		denied(fmt.Sprintf("can't vote about this master before %d milliseconds", (2*nodeTimeout - time.Since(master.votedTime)).Milliseconds()))
+		return
+	}
+	for _, r := range msg.sender.Slots {
+		for slot := r.Start; slot <= r.End; slot++ {
+			if owner := c.slots[slot]; owner != nil && owner.ConfigEpoch > msg.sender.ConfigEpoch {
+				denied(fmt.Sprintf("slot %d epoch (%d) > reqEpoch (%d)", slot, owner.ConfigEpoch, msg.sender.ConfigEpoch))
+				return
+			}
+		}
+	}
+	c.lastVoteEpoch = c.currentEpoch
+	master.votedTime = time.Now()
+	c.saveOrDie()
+	fmt.Printf("Failover auth granted to %s for epoch %d\n", sender.ID, c.currentEpoch)
+	c.sendTo(sender, c.message("AUTH-ACK", offset).marshal())
+}
+
+// startHandshake adds a node known only by its address; its first PONG
+// tells its name. Must be called with c.mu held.
+func (info *ServerInfo) startHandshake(kv *store.KeyValueStore, ip string, port, busPort int, meet bool) {
+	c := info.cluster
+	for _, n := range c.nodes {
+		if n.HasFlag("handshake") && n.IP == ip && n.Port == port && n.BusPort == busPort {
+			return
+		}
+	}
+	flags := []string{"handshake"}
+	if meet {
+		flags = append(flags, "meet")
+	}
+	n := newClusterNode(cluster.Node{ID: newReplID(), IP: ip, Port: port, BusPort: busPort, Flags: flags})
+	c.nodes[n.ID] = n
+	if c.running {
+		go info.clusterLink(kv, n)
+	}
+}
+
+// deleteNode forgets n and stops its link.
+func (c *clusterState) deleteNode(n *clusterNode) {
+	for slot, owner := range c.slots {
+		if owner == n {
+			c.slots[slot] = nil
+		}
+		if c.migrating[slot] == n {
+			c.migrating[slot] = nil
+		}
+		if c.importing[slot] == n {
+			c.importing[slot] = nil
+		}
+	}
+	for _, other := range c.nodes {
+		delete(other.failReports, n.ID)
+	}
+	delete(c.nodes, n.ID)
+	close(n.done)
+	if n.conn != nil {
+		n.conn.Close()
+	}
+	if !n.HasFlag("handshake") {
+		c.saveOrDie()
+	}
+}
+
+// clusterCron pings the other nodes, flags those that don't answer and
+// runs the failover of this replica when its master failed.
+func (info *ServerInfo) clusterCron(kv *store.KeyValueStore) {
+	offset := info.replOffset()
+	dataAge := info.masterLinkDownFor()
+	c := info.cluster
+	timeout := info.ClusterNodeTimeout
+	pingInterval := min(time.Second, timeout/2)
+
+	c.mu.Lock()
+	now := time.Now()
+	for _, n := range c.sortedNodes() {
+		if n == c.myself {
+			continue
+		}
+		if n.HasFlag("handshake") {
+			if now.Sub(n.created) > max(timeout, time.Second) {
+				c.deleteNode(n)
+			}
+			continue
+		}
+		pingDelay := now.Sub(time.UnixMilli(n.PingSent))
+		dataDelay := now.Sub(n.dataRecv)
+		// A link whose ping goes unanswered may be stuck: reconnect.
+		if n.conn != nil && n.PingSent != 0 && pingDelay > timeout/2 && dataDelay > timeout/2 {
+			n.conn.Close()
+		}
+		if n.conn != nil && n.PingSent == 0 && now.Sub(time.UnixMilli(n.PongRecv)) >= pingInterval {
+			c.sendTo(n, c.ping("PING", offset, n).marshal())
+			n.PingSent = now.UnixMilli()
+		}
+		if n.PingSent != 0 && min(pingDelay, dataDelay) > timeout && !n.HasFlag("pfail") && !n.HasFlag("fail") {
+			fmt.Printf("*** NODE %s possibly failing\n", n.ID)
+			n.SetFlag("pfail", true)
+		}
+	}
+	change := c.handleReplicaFailover(offset, dataAge, timeout)
+	c.updateState(info.ClusterRequireFullCoverage)
+	c.mu.Unlock()
+	info.applyClusterRole(kv, change)
+}
+
+// handleReplicaFailover runs the election of this replica to replace its
+// failed master: after a delay that favors the replicas with the most data,
+// it asks the masters for their votes in a new epoch, and takes over the
+// slots of its master once a majority granted them.
+func (c *clusterState) handleReplicaFailover(offset int64, dataAge, nodeTimeout time.Duration) clusterRoleChange {
+	if c.myself.isMaster() {
+		return clusterRoleChange{}
+	}
+	master := c.nodes[c.myself.MasterID]
+	if master == nil || !master.HasFlag("fail") || c.numSlots(master) == 0 {
+		return clusterRoleChange{}
+	}
+	// Too long without the master: our data can't stand for its own.
+	if dataAge > nodeTimeout*clusterReplicaValidityFactor {
+		return clusterRoleChange{}
+	}
+
+	now := time.Now()
+	authTimeout := max(2*nodeTimeout, 2*time.Second)
+	if now.Sub(c.failoverAuthTime) > 2*authTimeout {
+		rank := 0
+		for _, r := range c.replicasOf(master) {
+			if r != c.myself && r.replOffset > offset {
+				rank++
+			}
+		}
+		delay := 500*time.Millisecond + rand.N(500*time.Millisecond) + time.Duration(rank)*time.Second
+		c.failoverAuthTime = now.Add(delay)
+		c.failoverAuthSent = false
+		c.failoverAuthVotes = make(map[string]bool)
+		fmt.Printf("Start of election delayed for %d milliseconds (rank #%d, offset %d).\n", delay.Milliseconds(), rank, offset)
+		return clusterRoleChange{}
+	}
+	if now.Before(c.failoverAuthTime) || now.Sub(c.failoverAuthTime) > authTimeout {
+		return clusterRoleChange{}
+	}
+	if !c.failoverAuthSent {
+		c.currentEpoch++
+		c.failoverAuthEpoch = c.currentEpoch
+		c.failoverAuthSent = true
+		c.saveOrDie()
+		fmt.Printf("Starting a failover election for epoch %d.\n", c.currentEpoch)
+		c.broadcast(c.message("AUTH-REQUEST", offset).marshal())
+		return clusterRoleChange{}
+	}
+	if len(c.failoverAuthVotes) < c.size()/2+1 {
+		return clusterRoleChange{}
+	}
+
+	fmt.Println("Failover election won: I'm the new master.")
+	if c.myself.ConfigEpoch < c.failoverAuthEpoch {
+		c.myself.ConfigEpoch = c.failoverAuthEpoch
+		fmt.Printf("configEpoch set to %d after successful failover\n", c.myself.ConfigEpoch)
+	}
+	for slot, owner := range c.slots {
+		if owner == master {
+			c.slots[slot] = c.myself
+		}
+	}
+	c.setNodeAsMaster(c.myself)
+	c.failoverAuthTime = time.Time{}
+	c.saveOrDie()
+	c.broadcastPong(offset)
+	return clusterRoleChange{promote: true}
+}
+
+// applyClusterRole carries out what the bus decided about this node.
+func (info *ServerInfo) applyClusterRole(kv *store.KeyValueStore, ch clusterRoleChange) {
+	if ch.promote {
+		info.writeMu.Lock()
+		info.mu.Lock()
+		if info.Role != "master" {
+			info.promote()
+			fmt.Println("MASTER MODE enabled (cluster failover)")
+		}
+		info.mu.Unlock()
+		info.writeMu.Unlock()
+	}
+	if ch.masterAddr != "" {
+		info.mu.Lock()
+		if info.Role != "slave" || info.link == nil || info.link.addr != ch.masterAddr {
+			info.demote(kv, newMasterLink(ch.masterAddr))
+			fmt.Printf("Connecting to MASTER %s\n", ch.masterAddr)
+		}
+		info.mu.Unlock()
+	}
+	if len(ch.dropSlots) > 0 {
+		info.dropSlotKeys(kv, ch.dropSlots)
+	}
+	info.pruneShardChannels()
+}
+
+// dropSlotKeys deletes the keys of slots another master took over.
+func (info *ServerInfo) dropSlotKeys(kv *store.KeyValueStore, slots []int) {
+	lost := make(map[int]bool, len(slots))
+	for _, slot := range slots {
+		lost[slot] = true
+	}
+	info.writeMu.Lock()
+	defer info.writeMu.Unlock()
+	keys := kv.Keys(func(key string) bool { return lost[cluster.KeySlot(key)] })
+	if len(keys) == 0 {
+		return
+	}
+	kv.DEL(keys)
+	info.propagate([][]resp.Value{resp.Command(append([]string{"DEL"}, keys...)...).Array})
+}
+
+// masterLinkDownFor returns how long a replica has been without its
+// master, 0 when connected or a master.
+func (info *ServerInfo) masterLinkDownFor() time.Duration {
+	info.mu.Lock()
+	link := info.link
+	info.mu.Unlock()
+	if link == nil {
+		return 0
+	}
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.state == replStateConnected {
+		return 0
+	}
+	return time.Since(link.downSince)
+}
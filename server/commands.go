@@ -0,0 +1,151 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/saurabhdhingra/go-redis/resp"
+)
+
+// Command flags, named after the ones in Redis' command table.
+const (
+	// flagWrite marks commands that may modify the keyspace.
+	flagWrite = 1 << iota
+	// flagStale marks commands a replica runs while its link is down, even
+	// when replica-serve-stale-data is off.
+	flagStale
+	// flagLoading marks commands allowed while the dataset is loading.
+	flagLoading
+	// flagAsking marks commands served in a slot being imported as if the
+	// client had sent ASKING.
+	flagAsking
+	// flagPubSub marks commands a connection with subscriptions may send.
+	flagPubSub
+)
+
+// commandInfo describes a command to the dispatcher.
+type commandInfo struct {
+	flags int
+
+	// The keys are the arguments from firstKey to lastKey every keyStep, as
+	// in Redis; a negative lastKey counts from the end. getKeys replaces
+	// them for commands with keys at variable positions.
+	firstKey, lastKey, keyStep int
+	getKeys                    func(args []resp.Value) []string
+}
+
+// commandTable lists the commands the server knows.
+var commandTable = map[string]commandInfo{
+	"PING":         {flags: flagStale | flagPubSub},
+	"ECHO":         {},
+	"INFO":         {flags: flagStale | flagLoading},
+	"SELECT":       {},
+	"MULTI":        {},
+	"EXEC":         {},
+	"DISCARD":      {},
+	"WAIT":         {flags: flagStale},
+	"SAVE":         {},
+	"BGSAVE":       {},
+	"BGREWRITEAOF": {},
+	"LASTSAVE":     {},
+	"REPLICAOF":    {flags: flagStale},
+	"SLAVEOF":      {flags: flagStale},
+	"ROLE":         {flags: flagStale},
+	"FAILOVER":     {},
+	"REPLCONF":     {flags: flagStale},
+	"PSYNC":        {flags: flagStale},
+	"SYNC":         {flags: flagStale},
+	"CLUSTER":      {flags: flagStale},
+	"ASKING":       {},
+	"RAFT":         {flags: flagStale | flagLoading},
+	"ACTIVE":       {},
+	"SUBSCRIBE":    {flags: flagStale | flagLoading | flagPubSub},
+	"UNSUBSCRIBE":  {flags: flagStale | flagLoading | flagPubSub},
+	"PSUBSCRIBE":   {flags: flagStale | flagLoading | flagPubSub},
+	"PUNSUBSCRIBE": {flags: flagStale | flagLoading | flagPubSub},
+	"PUBLISH":      {flags: flagStale | flagLoading},
+	"PUBSUB":       {flags: flagStale | flagLoading},
+
+	// Shard channels hash to slots like keys.
+	"SSUBSCRIBE":   {flags: flagStale | flagLoading | flagPubSub, firstKey: 1, lastKey: -1, keyStep: 1},
+	"SUNSUBSCRIBE": {flags: flagStale | flagLoading | flagPubSub, firstKey: 1, lastKey: -1, keyStep: 1},
+	"SPUBLISH":     {flags: flagStale | flagLoading, firstKey: 1, lastKey: 1, keyStep: 1},
+
+	"GET":     {firstKey: 1, lastKey: 1, keyStep: 1},
+	"SET":     {flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	"INCR":    {flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	"DECR":    {flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	"DEL":     {flags: flagWrite, firstKey: 1, lastKey: -1, keyStep: 1},
+	"EXISTS":  {firstKey: 1, lastKey: -1, keyStep: 1},
+	"TYPE":    {firstKey: 1, lastKey: 1, keyStep: 1},
+	"DUMP":    {firstKey: 1, lastKey: 1, keyStep: 1},
+	"RESTORE": {flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	"MIGRATE": {flags: flagWrite, getKeys: migrateKeys},
+	"LPUSH":   {flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	"LPOP":    {flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	"BLPOP":   {flags: flagWrite, firstKey: 1, lastKey: -2, keyStep: 1},
+	"LRANGE":  {firstKey: 1, lastKey: 1, keyStep: 1},
+	"LLEN":    {firstKey: 1, lastKey: 1, keyStep: 1},
+	"XADD":    {flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	"XTRIM":   {flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	"XRANGE":  {firstKey: 1, lastKey: 1, keyStep: 1},
+	"XREAD":   {getKeys: xreadKeys},
+	"EXPIRE":  {flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	"TTL":     {firstKey: 1, lastKey: 1, keyStep: 1},
+	"RENAME":  {flags: flagWrite, firstKey: 1, lastKey: 2, keyStep: 1},
+
+	// The form in which EXPIRE is logged.
+	"PEXPIREAT": {flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+
+	// Sent by MIGRATE between cluster nodes.
+	"RESTORE-ASKING": {flags: flagWrite | flagAsking, firstKey: 1, lastKey: 1, keyStep: 1},
+}
+
+// commandFlag reports whether command has flag; unknown commands have none.
+func commandFlag(command string, flag int) bool {
+	return commandTable[command].flags&flag != 0
+}
+
+// commandKeys returns the keys cmd operates on.
+func commandKeys(cmd []resp.Value) []string {
+	info := commandTable[strings.ToUpper(cmd[0].Bulk)]
+	if info.getKeys != nil {
+		return info.getKeys(cmd[1:])
+	}
+	if info.firstKey == 0 {
+		return nil
+	}
+	last := info.lastKey
+	if last < 0 {
+		last += len(cmd)
+	}
+	var keys []string
+	for i := info.firstKey; i <= last && i < len(cmd); i += info.keyStep {
+		keys = append(keys, cmd[i].Bulk)
+	}
+	return keys
+}
+
+// xreadKeys returns the keys of XREAD [COUNT n] [BLOCK ms] STREAMS key ... id ...
+func xreadKeys(args []resp.Value) []string {
+	for i, arg := range args {
+		if strings.EqualFold(arg.Bulk, "STREAMS") {
+			streams := args[i+1:]
+			var keys []string
+			for _, key := range streams[:len(streams)/2] {
+				keys = append(keys, key.Bulk)
+			}
+			return keys
+		}
+	}
+	return nil
+}
+
+// migrateKeys returns the keys of MIGRATE, given either as its key argument
+// or after KEYS.
+func migrateKeys(args []resp.Value) []string {
+	opts, err := parseMigrate(args)
+	if err != nil {
+		return nil
+	}
+	return opts.keys
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// Cron runs the periodic background tasks of the server, such as automatic
+// snapshots and pinging replicas. It never returns.
+func (info *ServerInfo) Cron(kv *store.KeyValueStore) {
+	for range time.Tick(time.Second) {
+		info.saveIfNeeded(kv)
+		info.replicationCron()
+		info.activeCron(kv)
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/rdb"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// repl-diskless-load policies
+const (
+	DisklessLoadDisabled  = "disabled"
+	DisklessLoadOnEmptyDB = "on-empty-db"
+	DisklessLoadSwapDB    = "swapdb"
+)
+
+// eofMarkLen is the length of the marker that ends a diskless transfer.
+const eofMarkLen = 40
+
+var errNoReplicasLeft = errors.New("all the replicas of the transfer disconnected")
+
+// queueDisklessSync attaches r to the next diskless transfer. The transfer
+// starts repl-diskless-sync-delay after the first replica asked for it, so
+// that replicas asking meanwhile share the same snapshot.
+func (info *ServerInfo) queueDisklessSync(kv *store.KeyValueStore, r *replica) {
+	info.repl.mu.Lock()
+	defer info.repl.mu.Unlock()
+	info.repl.replicas = append(info.repl.replicas, r)
+	info.repl.disklessBatch = append(info.repl.disklessBatch, r)
+	if len(info.repl.disklessBatch) == 1 {
+		go info.disklessSync(kv)
+	}
+}
+
+// disklessSync snapshots the dataset and streams it as an RDB file straight
+// to the sockets of the waiting replicas, framed as "$EOF:<mark>\r\n<payload><mark>"
+// since the length isn't known in advance.
+func (info *ServerInfo) disklessSync(kv *store.KeyValueStore) {
+	time.Sleep(info.ReplDisklessSyncDelay)
+
+	// As in syncReplica, no write may slip between the snapshot and the offset.
+	info.writeMu.Lock()
+	snapshot := kv.Snapshot()
+	info.repl.mu.Lock()
+	batch := info.repl.disklessBatch
+	info.repl.disklessBatch = nil
+	replid := info.repl.replID()
+	if info.repl.backlog == nil {
+		info.repl.backlog = newReplBacklog(info.replBacklogSize(), info.repl.offset)
+	}
+	offset := info.repl.offset
+	for _, r := range batch {
+		// What was queued while waiting is part of the snapshot.
+		r.mu.Lock()
+		r.pending = nil
+		r.state = replicaStateSendBulk
+		r.mu.Unlock()
+	}
+	info.repl.mu.Unlock()
+	info.writeMu.Unlock()
+
+	mark := newReplID()
+	w := &fanoutWriter{failed: make(map[*replica]error)}
+	for _, r := range batch {
+		r.conn.SetWriteDeadline(time.Now().Add(replTimeout))
+		_, err := fmt.Fprintf(r.conn, "+FULLRESYNC %s %d\r\n$EOF:%s\r\n", replid, offset, mark)
+		if err != nil {
+			w.failed[r] = err
+		}
+		w.replicas = append(w.replicas, r)
+	}
+	fmt.Printf("Starting diskless transfer to %d replicas\n", len(batch))
+	saveErr := rdb.Save(w, snapshot, map[string]string{"repl-stream-db": "0"})
+	if saveErr == nil {
+		_, saveErr = io.WriteString(w, mark)
+	}
+
+	for _, r := range batch {
+		err := saveErr
+		if err == nil {
+			err = w.failed[r]
+		}
+		if err != nil {
+			fmt.Printf("Diskless transfer to replica %s failed: %v\n", r.addr, err)
+			info.dropReplica(r)
+			continue
+		}
+		// The stream that follows is written without a deadline.
+		r.conn.SetWriteDeadline(time.Time{})
+		fmt.Printf("Streamed RDB transfer with replica %s succeeded\n", r.addr)
+		r.mu.Lock()
+		r.state = replicaStateOnline
+		r.ackTime = time.Now()
+		r.mu.Unlock()
+		go info.writeToReplica(r)
+	}
+}
+
+// fanoutWriter writes the same bytes to several replicas, leaving out the
+// ones whose connection fails or stalls for replTimeout. It only fails when
+// none is left.
+type fanoutWriter struct {
+	replicas []*replica
+	failed   map[*replica]error
+}
+
+func (w *fanoutWriter) Write(p []byte) (int, error) {
+	live := 0
+	for _, r := range w.replicas {
+		if w.failed[r] != nil {
+			continue
+		}
+		r.conn.SetWriteDeadline(time.Now().Add(replTimeout))
+		if _, err := r.conn.Write(p); err != nil {
+			w.failed[r] = err
+			continue
+		}
+		live++
+	}
+	if live == 0 {
+		return 0, errNoReplicasLeft
+	}
+	return len(p), nil
+}
+
+// eofMarkReader reads the payload of a diskless transfer, up to the mark
+// that ends it. The mark is consumed but nothing past it is, since the
+// replication stream follows right away.
+type eofMarkReader struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mark []byte
+	done bool
+}
+
+func (e *eofMarkReader) Read(p []byte) (int, error) {
+	if e.done {
+		return 0, io.EOF
+	}
+	e.conn.SetReadDeadline(time.Now().Add(replTimeout))
+	if _, err := e.r.Peek(len(e.mark)); err != nil {
+		return 0, err
+	}
+	// Return the bytes that can't be the start of the mark.
+	b, _ := e.r.Peek(e.r.Buffered())
+	n := 0
+	for ; n < len(b) && n < len(p); n++ {
+		rest := b[n:]
+		if len(rest) >= len(e.mark) && bytes.Equal(rest[:len(e.mark)], e.mark) ||
+			len(rest) < len(e.mark) && bytes.HasPrefix(e.mark, rest) {
+			break
+		}
+	}
+	if n == 0 {
+		e.r.Discard(len(e.mark))
+		e.done = true
+		return 0, io.EOF
+	}
+	copy(p, b[:n])
+	e.r.Discard(n)
+	return n, nil
+}
+
+// loadPayload replaces the dataset with the RDB file read from payload,
+// following repl-diskless-load, and then calls adopt under writeMu. Unless
+// the file is loaded straight into an empty dataset, the old dataset stays
+// in place until the new one is complete.
+func (info *ServerInfo) loadPayload(kv *store.KeyValueStore, link *masterLink, payload io.Reader, adopt func()) error {
+	switch {
+	case info.ReplDisklessLoad == DisklessLoadSwapDB:
+		data, err := rdb.Load(payload)
+		if err != nil {
+			return fmt.Errorf("failed to load the RDB from master: %w", err)
+		}
+		if _, err := io.Copy(io.Discard, payload); err != nil {
+			return err
+		}
+		info.writeMu.Lock()
+		defer info.writeMu.Unlock()
+		if link.isStopped() {
+			return errReplicationStopped
+		}
+		kv.Load(data)
+		adopt()
+		return nil
+
+	case info.ReplDisklessLoad == DisklessLoadOnEmptyDB && kv.Len() == 0:
+		info.writeMu.Lock()
+		defer info.writeMu.Unlock()
+		if link.isStopped() {
+			return errReplicationStopped
+		}
+		info.SetLoading(true)
+		defer info.SetLoading(false)
+		err := rdb.Parse(payload, func(key string, d store.Data) error {
+			return kv.RESTORE(key, d, true)
+		})
+		if err == nil {
+			_, err = io.Copy(io.Discard, payload)
+		}
+		if err != nil {
+			// A partial dataset is worse than none.
+			kv.Load(make(map[string]store.Data))
+			return fmt.Errorf("failed to load the RDB from master: %w", err)
+		}
+		kv.ClearDirty(kv.Dirty())
+		adopt()
+		return nil
+	}
+
+	// Receive the whole file before touching the dataset, and keep it as
+	// the local snapshot afterwards.
+	tmp := filepath.Join(filepath.Dir(info.rdbPath()), fmt.Sprintf("temp-%d.%d.rdb", time.Now().Unix(), os.Getpid()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	_, err = io.Copy(f, payload)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	data, err := rdb.LoadFile(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to load the RDB from master: %w", err)
+	}
+	info.writeMu.Lock()
+	defer info.writeMu.Unlock()
+	if link.isStopped() {
+		return errReplicationStopped
+	}
+	kv.Load(data)
+	if err := os.Rename(tmp, info.rdbPath()); err != nil {
+		fmt.Println("Failed to keep the RDB received from master:", err)
+	}
+	adopt()
+	return nil
+}
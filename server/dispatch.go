@@ -0,0 +1,200 @@
+package server
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/resp"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// call executes a client command. Writes are serialized so that the order in
+// which they reach the AOF is the order in which they were applied.
+func (info *ServerInfo) call(store *store.KeyValueStore, cmd []resp.Value) resp.Value {
+	command := strings.ToUpper(cmd[0].Bulk)
+	if info.raft != nil && (commandFlag(command, flagWrite) || len(commandKeys(cmd)) > 0) {
+		return info.raftCall(store, command, cmd)
+	}
+	if !commandFlag(command, flagWrite) {
+		if msg := info.rejectCommand(command); msg != "" {
+			return resp.Value{Type: "error", Str: msg}
+		}
+		if command != "BGREWRITEAOF" {
+			return executeCommand(store, info, command, cmd[1:])
+		}
+		// BGREWRITEAOF snapshots the keyspace, which must not interleave with a write.
+		info.writeMu.Lock()
+		defer info.writeMu.Unlock()
+		return executeCommand(store, info, command, cmd[1:])
+	}
+
+	if command == "MIGRATE" {
+		return info.migrate(store, cmd)
+	}
+
+	// Checked once the write may run: a failover that paused it may have
+	// turned this server into a replica meanwhile.
+	info.lockWrites()
+	defer info.writeMu.Unlock()
+	if msg := info.writeError(command); msg != "" {
+		return resp.Value{Type: "error", Str: msg}
+	}
+	reply := executeCommand(store, info, command, cmd[1:])
+	if p := propagatedCommand(store, command, cmd, reply); p != nil {
+		info.propagate([][]resp.Value{p})
+	}
+	return reply
+}
+
+// exec runs a queued transaction without letting other writes interleave and
+// logs its writes wrapped in MULTI/EXEC. In raft mode the transaction is one
+// entry of the log.
+func (info *ServerInfo) exec(store *store.KeyValueStore, queued [][]resp.Value) resp.Value {
+	if info.raft != nil && len(queued) > 0 {
+		results, err := info.raftPropose(queued)
+		if err != nil {
+			return resp.Value{Type: "error", Str: errorString(err)}
+		}
+		return resp.Value{Type: "array", Array: results}
+	}
+
+	info.lockWrites()
+	defer info.writeMu.Unlock()
+
+	results := make([]resp.Value, len(queued))
+	var propagated [][]resp.Value
+	for i, cmd := range queued {
+		command := strings.ToUpper(cmd[0].Bulk)
+		msg := info.rejectCommand(command)
+		if commandFlag(command, flagWrite) {
+			msg = info.writeError(command)
+		}
+		if msg != "" {
+			results[i] = resp.Value{Type: "error", Str: msg}
+			continue
+		}
+		results[i] = executeCommand(store, info, command, cmd[1:])
+		if commandFlag(command, flagWrite) {
+			if p := propagatedCommand(store, command, cmd, results[i]); p != nil {
+				propagated = append(propagated, p)
+			}
+		}
+	}
+	if len(propagated) > 0 {
+		cmds := [][]resp.Value{resp.Command("MULTI").Array}
+		cmds = append(cmds, propagated...)
+		cmds = append(cmds, resp.Command("EXEC").Array)
+		info.propagate(cmds)
+	}
+	return resp.Value{Type: "array", Array: results}
+}
+
+// writeError returns the error a write is refused with, "" when it may run.
+// Must be called with writeMu held.
+func (info *ServerInfo) writeError(command string) string {
+	if msg := info.rejectCommand(command); msg != "" {
+		return msg
+	}
+	if info.writesDisabledByBgsaveError() {
+		return errMisconf.Error()
+	}
+	if !info.enoughGoodReplicas() {
+		return errNoReplicas
+	}
+	return ""
+}
+
+// propagate hands executed writes to the AOF and to the replicas.
+func (info *ServerInfo) propagate(cmds [][]resp.Value) {
+	info.feedAppendOnlyFile(cmds)
+	info.feedReplicas(cmds)
+}
+
+// propagatedCommand returns the form in which an executed write is logged, or
+// nil when it did not change the dataset. Relative expirations and generated
+// stream IDs are made explicit so that replaying the log is deterministic.
+func propagatedCommand(kv *store.KeyValueStore, command string, cmd []resp.Value, reply resp.Value) []resp.Value {
+	if command == "MIGRATE" {
+		return migratePropagated(kv, cmd)
+	}
+	if reply.Type == "error" || reply.Type == "nil" {
+		return nil
+	}
+	switch command {
+	case "SET":
+		out := []resp.Value{cmd[0], cmd[1], cmd[2]}
+		for i := 3; i+1 < len(cmd); i += 2 {
+			option := strings.ToUpper(cmd[i].Bulk)
+			n, _ := strconv.ParseInt(cmd[i+1].Bulk, 10, 64)
+			var at int64
+			switch option {
+			case "EX":
+				at = time.Now().Add(time.Duration(n) * time.Second).UnixMilli()
+			case "PX":
+				at = time.Now().Add(time.Duration(n) * time.Millisecond).UnixMilli()
+			case "EXAT":
+				at = n * 1000
+			default:
+				at = n
+			}
+			out = append(out, resp.Value{Type: "bulk", Bulk: "PXAT"}, resp.Value{Type: "bulk", Bulk: strconv.FormatInt(at, 10)})
+		}
+		return out
+	case "DEL":
+		if reply.Num == 0 {
+			return nil
+		}
+	case "EXPIRE":
+		if reply.Num == 0 {
+			return nil
+		}
+		seconds, _ := strconv.ParseInt(cmd[2].Bulk, 10, 64)
+		at := time.Now().Add(time.Duration(seconds) * time.Second).UnixMilli()
+		return resp.Command("PEXPIREAT", cmd[1].Bulk, strconv.FormatInt(at, 10)).Array
+	case "PEXPIREAT":
+		if reply.Num == 0 {
+			return nil
+		}
+	case "RESTORE", "RESTORE-ASKING":
+		// A relative TTL is made absolute, as with SET.
+		ttl, _ := strconv.ParseInt(cmd[2].Bulk, 10, 64)
+		out := append([]resp.Value{}, cmd...)
+		out[0] = resp.Value{Type: "bulk", Bulk: "RESTORE"}
+		if ttl > 0 && !slices.ContainsFunc(cmd[4:], func(v resp.Value) bool { return strings.EqualFold(v.Bulk, "ABSTTL") }) {
+			out[2] = resp.Value{Type: "bulk", Bulk: strconv.FormatInt(time.Now().Add(time.Duration(ttl)*time.Millisecond).UnixMilli(), 10)}
+			out = append(out, resp.Value{Type: "bulk", Bulk: "ABSTTL"})
+		}
+		return out
+	case "BLPOP":
+		// Only the key that was actually popped matters on replay.
+		return resp.Command("LPOP", reply.Array[0].Bulk).Array
+	case "XADD":
+		out := append([]resp.Value{}, cmd...)
+		out[2] = resp.Value{Type: "bulk", Bulk: reply.Bulk}
+		return out
+	}
+	return cmd
+}
+
+// migratePropagated returns the DEL a MIGRATE of a transaction is logged as:
+// locally it deletes the keys the target accepted, which are gone now even
+// when the target refused others. The caller holds the write lock since
+// MIGRATE ran.
+func migratePropagated(kv *store.KeyValueStore, cmd []resp.Value) []resp.Value {
+	opts, err := parseMigrate(cmd[1:])
+	if err != nil || opts.copy {
+		return nil
+	}
+	var moved []string
+	for _, key := range opts.keys {
+		if _, ok := kv.Lookup(key); !ok {
+			moved = append(moved, key)
+		}
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	return resp.Command(append([]string{"DEL"}, moved...)...).Array
+}
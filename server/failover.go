@@ -0,0 +1,283 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/resp"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// States of a coordinated failover, named as in INFO.
+const (
+	failoverStateNone       = "no-failover"
+	failoverStateWaiting    = "waiting-for-sync"
+	failoverStateInProgress = "failover-in-progress"
+)
+
+var errFailoverAborted = errors.New("FAILOVER ABORT was called")
+
+// failover is a switchover started with FAILOVER. Writes are paused while it
+// runs, so the replica that takes over can catch up with every one of them.
+type failover struct {
+	target  string // the replica to promote, or "" for the first to catch up
+	force   bool
+	timeout time.Duration
+
+	// Guarded by info.mu.
+	state   string
+	abort   chan struct{}
+	aborted bool
+}
+
+// lockWrites acquires writeMu for a write, waiting for a failover to end
+// first if one paused the writes.
+func (info *ServerInfo) lockWrites() {
+	for {
+		info.writeMu.Lock()
+		paused := info.writesPaused
+		if paused == nil {
+			return
+		}
+		info.writeMu.Unlock()
+		<-paused
+	}
+}
+
+// failoverState returns master_failover_state.
+func (info *ServerInfo) failoverState() string {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if info.failover == nil {
+		return failoverStateNone
+	}
+	return info.failover.state
+}
+
+// failoverCommand implements FAILOVER [TO host port [FORCE]] [ABORT] [TIMEOUT ms].
+func (info *ServerInfo) failoverCommand(kv *store.KeyValueStore, args []resp.Value) resp.Value {
+	f := &failover{abort: make(chan struct{})}
+	abort := false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Bulk) {
+		case "TO":
+			if i+2 >= len(args) || f.target != "" {
+				return resp.Value{Type: "error", Str: "ERR syntax error"}
+			}
+			port, err := strconv.Atoi(args[i+2].Bulk)
+			if err != nil || port < 0 || port > 65535 {
+				return resp.Value{Type: "error", Str: "ERR Invalid target port"}
+			}
+			f.target = net.JoinHostPort(args[i+1].Bulk, args[i+2].Bulk)
+			i += 2
+		case "FORCE":
+			f.force = true
+		case "TIMEOUT":
+			if i+1 >= len(args) {
+				return resp.Value{Type: "error", Str: "ERR syntax error"}
+			}
+			ms, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil {
+				return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+			}
+			if ms <= 0 {
+				return resp.Value{Type: "error", Str: "ERR FAILOVER timeout must be greater than 0"}
+			}
+			f.timeout = time.Duration(ms) * time.Millisecond
+			i++
+		case "ABORT":
+			abort = true
+		default:
+			return resp.Value{Type: "error", Str: "ERR syntax error"}
+		}
+	}
+
+	if abort {
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR syntax error"}
+		}
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		if info.failover == nil {
+			return resp.Value{Type: "error", Str: "ERR No failover in progress."}
+		}
+		if !info.failover.aborted {
+			info.failover.aborted = true
+			close(info.failover.abort)
+		}
+		return resp.Value{Type: "string", Str: "OK"}
+	}
+	if f.force && (f.target == "" || f.timeout == 0) {
+		return resp.Value{Type: "error", Str: "ERR FAILOVER with force option requires both a timeout and target HOST and IP."}
+	}
+
+	info.writeMu.Lock()
+	defer info.writeMu.Unlock()
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if info.Role != "master" {
+		return resp.Value{Type: "error", Str: "ERR FAILOVER is not valid when server is a replica."}
+	}
+	if info.failover != nil {
+		return resp.Value{Type: "error", Str: "ERR FAILOVER already in progress."}
+	}
+	info.repl.mu.Lock()
+	online := 0
+	var target *replica
+	for _, r := range info.repl.replicas {
+		r.mu.Lock()
+		if r.state == replicaStateOnline {
+			online++
+		}
+		r.mu.Unlock()
+		if r.addr == f.target {
+			target = r
+		}
+	}
+	info.repl.mu.Unlock()
+	if online == 0 {
+		return resp.Value{Type: "error", Str: "ERR FAILOVER requires connected replicas."}
+	}
+	if f.target != "" {
+		if target == nil {
+			return resp.Value{Type: "error", Str: "ERR FAILOVER target HOST and PORT is not a replica."}
+		}
+		target.mu.Lock()
+		state := target.state
+		target.mu.Unlock()
+		if state != replicaStateOnline {
+			return resp.Value{Type: "error", Str: "ERR FAILOVER target replica is not online."}
+		}
+	}
+
+	f.state = failoverStateWaiting
+	info.failover = f
+	info.writesPaused = make(chan struct{})
+	fmt.Println("FAILOVER requested, writes are paused until it completes")
+	go info.runFailover(kv, f)
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+// runFailover waits for a replica to acknowledge the whole replication
+// stream, then becomes its replica asking it, with PSYNC FAILOVER, to take
+// over as the master.
+func (info *ServerInfo) runFailover(kv *store.KeyValueStore, f *failover) {
+	target, err := info.waitForFailoverTarget(f)
+	if err != nil {
+		info.endFailover(err, false)
+		return
+	}
+
+	done := make(chan error, 1)
+	info.writeMu.Lock()
+	info.mu.Lock()
+	f.state = failoverStateInProgress
+	link := newMasterLink(target)
+	link.failover = done
+	info.demote(kv, link)
+	info.mu.Unlock()
+	info.writeMu.Unlock()
+	fmt.Printf("FAILOVER to %s in progress\n", target)
+
+	select {
+	case err = <-done:
+	case <-f.abort:
+		err = errFailoverAborted
+	}
+	if err != nil {
+		info.endFailover(fmt.Errorf("failover target rejected the takeover: %w", err), true)
+		return
+	}
+	info.endFailover(nil, false)
+	fmt.Printf("FAILOVER to %s completed\n", target)
+}
+
+// waitForFailoverTarget returns the address of the replica to promote once
+// it acknowledged the current offset. With FORCE the target is returned when
+// the timeout expires even if it is behind.
+func (info *ServerInfo) waitForFailoverTarget(f *failover) (string, error) {
+	var deadline <-chan time.Time
+	if f.timeout > 0 {
+		deadline = time.After(f.timeout)
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if addr := info.caughtUpReplica(f.target); addr != "" {
+			return addr, nil
+		}
+		select {
+		case <-f.abort:
+			return "", errFailoverAborted
+		case <-deadline:
+			if f.force {
+				return f.target, nil
+			}
+			return "", errors.New("replica never caught up before timeout")
+		case <-ticker.C:
+		}
+	}
+}
+
+// caughtUpReplica returns the address of an online replica, target if set,
+// that acknowledged master_repl_offset.
+func (info *ServerInfo) caughtUpReplica(target string) string {
+	info.repl.mu.Lock()
+	defer info.repl.mu.Unlock()
+	for _, r := range info.repl.replicas {
+		if target != "" && r.addr != target {
+			continue
+		}
+		r.mu.Lock()
+		ok := r.state == replicaStateOnline && r.ackOffset >= info.repl.offset
+		r.mu.Unlock()
+		if ok {
+			return r.addr
+		}
+	}
+	return ""
+}
+
+// endFailover resumes the writes. When the takeover failed after the demotion,
+// this server is promoted back, as in REPLICAOF NO ONE.
+func (info *ServerInfo) endFailover(err error, promote bool) {
+	info.writeMu.Lock()
+	defer info.writeMu.Unlock()
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if promote {
+		info.promote()
+	}
+	info.failover = nil
+	close(info.writesPaused)
+	info.writesPaused = nil
+	if err != nil {
+		fmt.Println("FAILOVER aborted:", err)
+	}
+}
+
+// takeOver handles PSYNC ... FAILOVER on a replica: the master asks it to be
+// promoted before the master becomes its replica. The history must be ours,
+// so that the old master can continue it.
+func (info *ServerInfo) takeOver(conn net.Conn, replid string) error {
+	info.writeMu.Lock()
+	defer info.writeMu.Unlock()
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.repl.mu.Lock()
+	current := info.repl.replID()
+	info.repl.mu.Unlock()
+	if replid != current {
+		resp.Respond(conn, resp.Value{Type: "error", Str: "ERR PSYNC FAILOVER replid must match my replid."})
+		return errors.New("PSYNC FAILOVER with a foreign replid")
+	}
+	if info.Role == "slave" {
+		info.promote()
+		fmt.Printf("MASTER MODE enabled (failover request from %s)\n", conn.RemoteAddr())
+	}
+	return nil
+}
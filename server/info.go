@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/resp"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// infoSections lists the sections INFO knows, in the order they are printed.
+var infoSections = []string{"persistence", "replication", "cluster", "raft", "active"}
+
+// infoString renders the requested INFO sections; no arguments, "default",
+// "all" or "everything" select every section.
+func (info *ServerInfo) infoString(kv *store.KeyValueStore, args []resp.Value) string {
+	selected := infoSections
+	if len(args) > 0 {
+		selected = nil
+		for _, arg := range args {
+			section := strings.ToLower(arg.Bulk)
+			if section == "default" || section == "all" || section == "everything" {
+				selected = infoSections
+				break
+			}
+			selected = append(selected, section)
+		}
+	}
+
+	var sections []string
+	for _, name := range infoSections {
+		if !slices.Contains(selected, name) {
+			continue
+		}
+		var lines []string
+		switch name {
+		case "persistence":
+			lines = info.persistenceInfo(kv)
+		case "replication":
+			lines = info.replicationInfo()
+		case "cluster":
+			lines = info.clusterInfo()
+		case "raft":
+			lines = info.raftInfo()
+		case "active":
+			lines = info.activeInfo(kv)
+		}
+		title := strings.ToUpper(name[:1]) + name[1:]
+		sections = append(sections, "# "+title+"\r\n"+strings.Join(lines, "\r\n")+"\r\n")
+	}
+	return strings.Join(sections, "\r\n")
+}
+
+func (info *ServerInfo) persistenceInfo(kv *store.KeyValueStore) []string {
+	info.mu.Lock()
+	bgsaveStatus := "ok"
+	if info.lastBgsaveErr != nil {
+		bgsaveStatus = "err"
+	}
+	lastBgsaveSec := int64(-1)
+	if !info.bgsaveStart.IsZero() && !info.bgsaveInProgress {
+		lastBgsaveSec = int64(info.lastBgsaveDuration.Seconds())
+	}
+	currentBgsaveSec := int64(-1)
+	if info.bgsaveInProgress {
+		currentBgsaveSec = int64(time.Since(info.bgsaveStart).Seconds())
+	}
+	lines := []string{
+		"loading:" + boolToInfo(info.loading.Load()),
+		fmt.Sprintf("rdb_changes_since_last_save:%d", kv.Dirty()),
+		"rdb_bgsave_in_progress:" + boolToInfo(info.bgsaveInProgress),
+		fmt.Sprintf("rdb_last_save_time:%d", info.lastSave.Unix()),
+		"rdb_last_bgsave_status:" + bgsaveStatus,
+		fmt.Sprintf("rdb_last_bgsave_time_sec:%d", lastBgsaveSec),
+		fmt.Sprintf("rdb_current_bgsave_time_sec:%d", currentBgsaveSec),
+		fmt.Sprintf("rdb_saves:%d", info.rdbSaves),
+	}
+	info.mu.Unlock()
+
+	a := info.aof.Load()
+	lines = append(lines, "aof_enabled:"+boolToInfo(a != nil))
+	if a != nil {
+		a.mu.Lock()
+		status := "ok"
+		if a.lastErr != nil {
+			status = "err"
+		}
+		rewriteStatus := "ok"
+		if a.lastRewriteErr != nil {
+			rewriteStatus = "err"
+		}
+		lines = append(lines,
+			"aof_rewrite_in_progress:"+boolToInfo(a.rewriting),
+			"aof_last_bgrewrite_status:"+rewriteStatus,
+			"aof_last_write_status:"+status,
+		)
+		a.mu.Unlock()
+	}
+	return lines
+}
+
+func (info *ServerInfo) replicationInfo() []string {
+	info.mu.Lock()
+	role, link := info.Role, info.link
+	info.mu.Unlock()
+	lines := []string{"role:" + role}
+	if role == "master" {
+		lines = append(lines, info.replicaInfo()...)
+		lines = append(lines, "master_failover_state:"+info.failoverState())
+		return append(lines, info.backlogInfo()...)
+	}
+
+	if link == nil {
+		return append(lines, "master_link_status:down")
+	}
+	link.mu.Lock()
+	host, port, _ := net.SplitHostPort(link.addr)
+	status := "down"
+	if link.state == replStateConnected {
+		status = "up"
+	}
+	lastIO := int64(-1)
+	if !link.lastIO.IsZero() {
+		lastIO = int64(time.Since(link.lastIO).Seconds())
+	}
+	lines = append(lines,
+		"master_host:"+host,
+		"master_port:"+port,
+		"master_link_status:"+status,
+		fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+		"master_sync_in_progress:"+boolToInfo(link.state == replStateTransfer),
+	)
+	if status == "down" {
+		lines = append(lines, fmt.Sprintf("master_link_down_since_seconds:%d", int64(time.Since(link.downSince).Seconds())))
+	}
+	link.mu.Unlock()
+
+	info.repl.mu.Lock()
+	lines = append(lines, fmt.Sprintf("slave_repl_offset:%d", info.repl.offset))
+	info.repl.mu.Unlock()
+	lines = append(lines,
+		fmt.Sprintf("slave_priority:%d", info.ReplicaPriority),
+		"slave_read_only:"+boolToInfo(info.ReplicaReadOnly),
+	)
+	lines = append(lines, info.replicaInfo()...)
+	lines = append(lines, "master_failover_state:"+info.failoverState())
+	return append(lines, info.backlogInfo()...)
+}
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/rdb"
+	"github.com/saurabhdhingra/go-redis/resp"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// dumpCommand implements DUMP key.
+func dumpCommand(kv *store.KeyValueStore, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'dump' command"}
+	}
+	data, ok := kv.Lookup(args[0].Bulk)
+	if !ok {
+		return resp.Value{Type: "nil"}
+	}
+	payload, err := rdb.Dump(data)
+	if err != nil {
+		return resp.Value{Type: "error", Str: errorString(err)}
+	}
+	return resp.Value{Type: "bulk", Bulk: string(payload)}
+}
+
+// restoreCommand implements
+// RESTORE key ttl payload [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency].
+// The store keeps no access statistics, so IDLETIME and FREQ are validated
+// and otherwise ignored.
+func restoreCommand(kv *store.KeyValueStore, args []resp.Value) resp.Value {
+	if len(args) < 3 {
+		return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'restore' command"}
+	}
+	replace, absTTL := false, false
+	idle, freq := int64(-1), int64(-1)
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Bulk) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME":
+			if i+1 >= len(args) || freq != -1 {
+				return resp.Value{Type: "error", Str: "ERR syntax error"}
+			}
+			n, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil {
+				return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+			}
+			if n < 0 {
+				return resp.Value{Type: "error", Str: "ERR Invalid IDLETIME value, must be >= 0"}
+			}
+			idle = n
+			i++
+		case "FREQ":
+			if i+1 >= len(args) || idle != -1 {
+				return resp.Value{Type: "error", Str: "ERR syntax error"}
+			}
+			n, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil {
+				return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+			}
+			if n < 0 || n > 255 {
+				return resp.Value{Type: "error", Str: "ERR Invalid FREQ value, must be >= 0 and <= 255"}
+			}
+			freq = n
+			i++
+		default:
+			return resp.Value{Type: "error", Str: "ERR syntax error"}
+		}
+	}
+
+	ttl, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	if ttl < 0 {
+		return resp.Value{Type: "error", Str: "ERR Invalid TTL value, must be >= 0"}
+	}
+	data, err := rdb.Restore([]byte(args[2].Bulk))
+	if err != nil {
+		return resp.Value{Type: "error", Str: errorString(err)}
+	}
+	switch {
+	case ttl > 0 && absTTL:
+		data.Expiration = time.UnixMilli(ttl)
+	case ttl > 0:
+		data.Expiration = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	}
+	if err := kv.RESTORE(args[0].Bulk, data, replace); err != nil {
+		return resp.Value{Type: "error", Str: errorString(err)}
+	}
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+// migrateOptions are the parsed arguments of MIGRATE.
+type migrateOptions struct {
+	addr     string
+	db       int
+	timeout  time.Duration
+	copy     bool
+	replace  bool
+	auth     []string // AUTH arguments, password or username and password
+	keys     []string
+	keysFlag bool
+}
+
+// parseMigrate parses
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE]
+// [AUTH password | AUTH2 username password] [KEYS key ...].
+func parseMigrate(args []resp.Value) (*migrateOptions, error) {
+	if len(args) < 5 {
+		return nil, errors.New("ERR wrong number of arguments for 'migrate' command")
+	}
+	db, err := strconv.Atoi(args[3].Bulk)
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	timeout, err := strconv.ParseInt(args[4].Bulk, 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+	opts := &migrateOptions{
+		addr:    net.JoinHostPort(args[0].Bulk, args[1].Bulk),
+		db:      db,
+		timeout: time.Duration(timeout) * time.Millisecond,
+	}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Bulk) {
+		case "COPY":
+			opts.copy = true
+		case "REPLACE":
+			opts.replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return nil, errors.New("ERR syntax error")
+			}
+			opts.auth = []string{args[i+1].Bulk}
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return nil, errors.New("ERR syntax error")
+			}
+			opts.auth = []string{args[i+1].Bulk, args[i+2].Bulk}
+			i += 2
+		case "KEYS":
+			if args[2].Bulk != "" {
+				return nil, errors.New("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			for _, key := range args[i+1:] {
+				opts.keys = append(opts.keys, key.Bulk)
+			}
+			opts.keysFlag = true
+			i = len(args)
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+	if !opts.keysFlag {
+		opts.keys = []string{args[2].Bulk}
+	}
+	return opts, nil
+}
+
+// migratedKey is a key MIGRATE sends, with the DUMP payload it was sent as.
+type migratedKey struct {
+	key        string
+	payload    string
+	expiration time.Time
+}
+
+// dumpMigratedKeys dumps the keys that exist.
+func dumpMigratedKeys(kv *store.KeyValueStore, keys []string) ([]migratedKey, error) {
+	var dumped []migratedKey
+	for _, key := range keys {
+		data, ok := kv.Lookup(key)
+		if !ok {
+			continue
+		}
+		payload, err := rdb.Dump(data)
+		if err != nil {
+			return nil, err
+		}
+		dumped = append(dumped, migratedKey{key: key, payload: string(payload), expiration: data.Expiration})
+	}
+	return dumped, nil
+}
+
+// restoreCommands returns the RESTORE of every key with its remaining TTL.
+// Between cluster nodes RESTORE-ASKING is sent, which the target serves while
+// it imports the slot.
+func (opts *migrateOptions) restoreCommands(keys []migratedKey, clusterEnabled bool) [][]string {
+	restore := "RESTORE"
+	if clusterEnabled {
+		restore = "RESTORE-ASKING"
+	}
+	restores := make([][]string, len(keys))
+	for i, k := range keys {
+		ttl := int64(0)
+		if !k.expiration.IsZero() {
+			ttl = max(1, time.Until(k.expiration).Milliseconds())
+		}
+		restores[i] = []string{restore, k.key, strconv.FormatInt(ttl, 10), k.payload}
+		if opts.replace {
+			restores[i] = append(restores[i], "REPLACE")
+		}
+	}
+	return restores
+}
+
+// deleteMigrated deletes the keys the target accepted that still hold the
+// value they were sent with, and returns them. Must be called with writeMu
+// held.
+func deleteMigrated(kv *store.KeyValueStore, keys []migratedKey, restored []bool) []string {
+	var moved []string
+	for i, ok := range restored {
+		if !ok {
+			continue
+		}
+		data, exists := kv.Lookup(keys[i].key)
+		if !exists || !data.Expiration.Equal(keys[i].expiration) {
+			continue
+		}
+		if payload, err := rdb.Dump(data); err == nil && string(payload) == keys[i].payload {
+			moved = append(moved, keys[i].key)
+		}
+	}
+	if len(moved) > 0 {
+		kv.DEL(moved)
+	}
+	return moved
+}
+
+// migrateCommand implements MIGRATE within a transaction, whose write lock
+// it keeps for the whole transfer. Every existing key is sent to the target
+// as a RESTORE of its DUMP payload, in one pipeline. Unless COPY is given the
+// keys the target accepted are deleted locally; as in Redis, when it refuses
+// some keys the others are still moved and the error is reported.
+func migrateCommand(kv *store.KeyValueStore, args []resp.Value, clusterEnabled bool) resp.Value {
+	opts, err := parseMigrate(args)
+	if err != nil {
+		return resp.Value{Type: "error", Str: err.Error()}
+	}
+	keys, err := dumpMigratedKeys(kv, opts.keys)
+	if err != nil {
+		return resp.Value{Type: "error", Str: errorString(err)}
+	}
+	if len(keys) == 0 {
+		return resp.Value{Type: "string", Str: "NOKEY"}
+	}
+	restored, err := sendMigration(opts, opts.restoreCommands(keys, clusterEnabled))
+	if !opts.copy {
+		deleteMigrated(kv, keys, restored)
+	}
+	if err != nil {
+		return resp.Value{Type: "error", Str: err.Error()}
+	}
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+// migrate runs MIGRATE outside of a transaction, as migrateCommand does but
+// without holding writeMu while it talks to the target, which would stall
+// every other write. Once the transfer is done only the keys left unchanged
+// meanwhile are deleted, and their deletion propagated.
+func (info *ServerInfo) migrate(kv *store.KeyValueStore, cmd []resp.Value) resp.Value {
+	opts, err := parseMigrate(cmd[1:])
+	if err != nil {
+		return resp.Value{Type: "error", Str: err.Error()}
+	}
+	info.lockWrites()
+	if msg := info.writeError("MIGRATE"); msg != "" {
+		info.writeMu.Unlock()
+		return resp.Value{Type: "error", Str: msg}
+	}
+	keys, err := dumpMigratedKeys(kv, opts.keys)
+	info.writeMu.Unlock()
+	if err != nil {
+		return resp.Value{Type: "error", Str: errorString(err)}
+	}
+	if len(keys) == 0 {
+		return resp.Value{Type: "string", Str: "NOKEY"}
+	}
+
+	restored, err := sendMigration(opts, opts.restoreCommands(keys, info.cluster != nil))
+	if !opts.copy {
+		info.lockWrites()
+		// A server that turned into a replica meanwhile keeps the keys.
+		if msg := info.rejectCommand("MIGRATE"); msg != "" {
+			err = errors.New(msg)
+		} else if moved := deleteMigrated(kv, keys, restored); len(moved) > 0 {
+			info.propagate([][]resp.Value{resp.Command(append([]string{"DEL"}, moved...)...).Array})
+		}
+		info.writeMu.Unlock()
+	}
+	if err != nil {
+		return resp.Value{Type: "error", Str: err.Error()}
+	}
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+// sendMigration pipelines AUTH, SELECT and the RESTORE commands to the target
+// and returns which RESTOREs it accepted, with the first error. None counts
+// as accepted once AUTH or SELECT failed.
+func sendMigration(opts *migrateOptions, restores [][]string) ([]bool, error) {
+	conn, err := net.DialTimeout("tcp", opts.addr, opts.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("IOERR error or timeout connecting to the client")
+	}
+	defer conn.Close()
+
+	var cmds [][]string
+	if opts.auth != nil {
+		cmds = append(cmds, append([]string{"AUTH"}, opts.auth...))
+	}
+	cmds = append(cmds, []string{"SELECT", strconv.Itoa(opts.db)})
+	setup := len(cmds)
+	cmds = append(cmds, restores...)
+
+	w := bufio.NewWriter(conn)
+	for _, cmd := range cmds {
+		resp.Respond(w, resp.Command(cmd...))
+	}
+	conn.SetDeadline(time.Now().Add(opts.timeout))
+	if err := w.Flush(); err != nil {
+		return nil, errors.New("IOERR error or timeout writing to target instance")
+	}
+
+	reader := resp.NewResp(conn)
+	restored := make([]bool, len(restores))
+	setupFailed := false
+	var replyErr error
+	for i := range cmds {
+		conn.SetDeadline(time.Now().Add(opts.timeout))
+		reply, err := reader.Read()
+		if err != nil {
+			return restored, errors.New("IOERR error or timeout reading to target instance")
+		}
+		if reply.Type == "error" {
+			if replyErr == nil {
+				replyErr = fmt.Errorf("ERR Target instance replied with error: %s", reply.Str)
+			}
+			setupFailed = setupFailed || i < setup
+			continue
+		}
+		if i >= setup && !setupFailed {
+			restored[i-setup] = true
+		}
+	}
+	return restored, replyErr
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// Where keyspace events are published, set by K and E in
+// notify-keyspace-events next to the classes of events of the store.
+const (
+	notifyKeyspace = 1 << (iota + 16) // K: event on __keyspace@0__:<key>
+	notifyKeyevent                    // E: key on __keyevent@0__:<event>
+)
+
+// keyspaceEventFlags maps the characters of notify-keyspace-events to flags.
+var keyspaceEventFlags = map[rune]int{
+	'K': notifyKeyspace,
+	'E': notifyKeyevent,
+	'g': store.NotifyGeneric,
+	'$': store.NotifyString,
+	'l': store.NotifyList,
+	'h': store.NotifyHash,
+	'z': store.NotifyZSet,
+	't': store.NotifyStream,
+	'x': store.NotifyExpired,
+	'e': store.NotifyEvicted,
+	'n': store.NotifyNew,
+	'm': store.NotifyKeyMiss,
+	'A': store.NotifyAll,
+}
+
+// ParseKeyspaceEvents parses the value of notify-keyspace-events, e.g. "KEA".
+// An empty string disables the notifications.
+func ParseKeyspaceEvents(s string) (int, error) {
+	flags := 0
+	for _, c := range s {
+		flag, ok := keyspaceEventFlags[c]
+		if !ok {
+			return 0, fmt.Errorf("invalid notify-keyspace-events %q", s)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+// KeyspaceEventsInit has kv report the events of its keys, published as
+// NotifyKeyspaceEvents says. Nothing is published unless it selects K or E
+// and some class of events.
+func (info *ServerInfo) KeyspaceEventsInit(kv *store.KeyValueStore) {
+	flags := info.NotifyKeyspaceEvents
+	where := notifyKeyspace | notifyKeyevent
+	if flags&where == 0 || flags&^where == 0 {
+		return
+	}
+	kv.OnKeyspaceEvent(flags&^where, func(class int, event, key string) {
+		if flags&notifyKeyspace != 0 {
+			info.pubsub.publish("__keyspace@0__:"+key, event)
+		}
+		if flags&notifyKeyevent != 0 {
+			info.pubsub.publish("__keyevent@0__:"+event, key)
+		}
+	})
+}
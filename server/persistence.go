@@ -0,0 +1,200 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/rdb"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+var (
+	errBgsaveInProgress = errors.New("ERR Background save already in progress")
+	errMisconf          = errors.New("MISCONF Redis is configured to save RDB snapshots, but it's currently unable to persist to disk. " +
+		"Commands that may modify the data set are disabled, because this instance is configured to report errors during writes " +
+		"if RDB snapshotting fails (stop-writes-on-bgsave-error option). Please check the Redis logs for details about the RDB error.")
+)
+
+// Seconds to wait before retrying an automatic save after a failed one.
+const bgsaveRetryDelay = 5 * time.Second
+
+// SaveParam is a "save <seconds> <changes>" rule: snapshot once at least
+// Changes writes happened and Seconds elapsed since the last save.
+type SaveParam struct {
+	Seconds int
+	Changes int64
+}
+
+// ParseSaveParams parses the value of the save option, e.g. "3600 1 300 100".
+// An empty string disables automatic saves.
+func ParseSaveParams(s string) ([]SaveParam, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save parameters %q", s)
+	}
+	params := make([]SaveParam, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.Atoi(fields[i])
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, fmt.Errorf("invalid save parameters %q", s)
+		}
+		params = append(params, SaveParam{Seconds: seconds, Changes: changes})
+	}
+	return params, nil
+}
+
+// saveIfNeeded starts a background save when one of the save rules matches.
+// Called once a second from the server cron.
+func (info *ServerInfo) saveIfNeeded(kv *store.KeyValueStore) {
+	if info.loading.Load() {
+		return
+	}
+	info.mu.Lock()
+	inProgress := info.bgsaveInProgress
+	sinceSave := time.Since(info.lastSave)
+	canRetry := info.lastBgsaveErr == nil || time.Since(info.lastBgsaveTry) > bgsaveRetryDelay
+	info.mu.Unlock()
+	if inProgress || !canRetry {
+		return
+	}
+
+	dirty := kv.Dirty()
+	for _, p := range info.SaveParams {
+		if dirty >= p.Changes && sinceSave >= time.Duration(p.Seconds)*time.Second {
+			fmt.Printf("%d changes in %d seconds. Saving...\n", p.Changes, p.Seconds)
+			info.bgsave(kv)
+			return
+		}
+	}
+}
+
+// rdbPath returns the location of the snapshot file, defaulting like Redis to ./dump.rdb.
+func (info *ServerInfo) rdbPath() string {
+	dir, name := info.Dir, info.DBFilename
+	if dir == "" {
+		dir = "."
+	}
+	if name == "" {
+		name = "dump.rdb"
+	}
+	return filepath.Join(dir, name)
+}
+
+// SetLoading marks the dataset as being loaded; clients get LOADING errors meanwhile.
+func (info *ServerInfo) SetLoading(loading bool) {
+	info.loading.Store(loading)
+}
+
+// loadRDB loads the snapshot file into kv, if one exists. In active-active
+// mode it then switches kv to CRDTs, with the states saved in the file.
+func (info *ServerInfo) loadRDB(kv *store.KeyValueStore) error {
+	start := time.Now()
+	f, err := os.Open(info.rdbPath())
+	if errors.Is(err, os.ErrNotExist) {
+		info.setLastSave(time.Now())
+		return info.enableActive(kv, nil)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, aux, err := rdb.LoadAux(f)
+	if err != nil {
+		return err
+	}
+	kv.Load(data)
+	info.setLastSave(time.Now())
+	fmt.Printf("DB loaded from disk: %d keys in %.3f seconds\n", len(data), time.Since(start).Seconds())
+	return info.enableActive(kv, aux)
+}
+
+// save writes a snapshot in the foreground, blocking the calling client.
+func (info *ServerInfo) save(kv *store.KeyValueStore) error {
+	info.mu.Lock()
+	if info.bgsaveInProgress {
+		info.mu.Unlock()
+		return errBgsaveInProgress
+	}
+	info.mu.Unlock()
+
+	dirty := kv.Dirty()
+	snapshot, states := kv.Snapshot(), info.activeStates(kv)
+	aux, err := activeAux(states)
+	if err != nil {
+		return err
+	}
+	if err := rdb.SaveFile(info.rdbPath(), snapshot, aux); err != nil {
+		return err
+	}
+	kv.ClearDirty(dirty)
+	info.mu.Lock()
+	info.lastSave = time.Now()
+	info.lastBgsaveErr = nil
+	info.rdbSaves++
+	info.mu.Unlock()
+	return nil
+}
+
+// bgsave writes a snapshot from a goroutine. The keyspace is copied up front
+// so clients keep running against the live store while the file is written.
+func (info *ServerInfo) bgsave(kv *store.KeyValueStore) error {
+	info.mu.Lock()
+	if info.bgsaveInProgress {
+		info.mu.Unlock()
+		return errBgsaveInProgress
+	}
+	info.bgsaveInProgress = true
+	info.bgsaveStart = time.Now()
+	info.lastBgsaveTry = info.bgsaveStart
+	info.mu.Unlock()
+
+	dirty := kv.Dirty()
+	snapshot, states := kv.Snapshot(), info.activeStates(kv)
+	go func() {
+		aux, err := activeAux(states)
+		if err == nil {
+			err = rdb.SaveFile(info.rdbPath(), snapshot, aux)
+		}
+		if err == nil {
+			kv.ClearDirty(dirty)
+		}
+		info.mu.Lock()
+		info.bgsaveInProgress = false
+		info.lastBgsaveErr = err
+		info.lastBgsaveDuration = time.Since(info.bgsaveStart)
+		if err == nil {
+			info.lastSave = time.Now()
+			info.rdbSaves++
+		}
+		info.mu.Unlock()
+		if err != nil {
+			fmt.Println("Background saving error:", err)
+		} else {
+			fmt.Println("Background saving terminated with success")
+		}
+	}()
+	return nil
+}
+
+// writesDisabledByBgsaveError reports whether writes are refused because the
+// last background save failed and stop-writes-on-bgsave-error is on.
+func (info *ServerInfo) writesDisabledByBgsaveError() bool {
+	if !info.StopWritesOnBgsaveError || len(info.SaveParams) == 0 {
+		return false
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.lastBgsaveErr != nil
+}
+
+func (info *ServerInfo) setLastSave(t time.Time) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.lastSave = t
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/glob"
+	"github.com/saurabhdhingra/go-redis/resp"
+)
+
+// pubsubOutputLimit disconnects subscribers that fall this far behind in
+// reading their messages, like client-output-buffer-limit for pubsub.
+const pubsubOutputLimit = 32 << 20
+
+// clientReplyBuffer is how far the replies to a client may get ahead of
+// its reading before the client stops being read.
+const clientReplyBuffer = 1 << 20
+
+// clientDrainTimeout bounds the writing of the last replies of a client
+// that is going away.
+const clientDrainTimeout = 10 * time.Second
+
+var errOutputLimit = errors.New("output buffer limit reached")
+
+// Kinds of subscriptions: to channels, to patterns of channel names and to
+// shard channels, which in cluster mode live in the slot of their name.
+const (
+	subChannel = iota
+	subPattern
+	subShard
+	numSubKinds
+)
+
+// subKindNames are the names of the replies confirming each kind of
+// subscription and unsubscription.
+var subKindNames = [numSubKinds]struct{ subscribe, unsubscribe string }{
+	subChannel: {"subscribe", "unsubscribe"},
+	subPattern: {"psubscribe", "punsubscribe"},
+	subShard:   {"ssubscribe", "sunsubscribe"},
+}
+
+// pubsub routes published messages to the connections subscribed to their
+// channel, or to a pattern matching it.
+type pubsub struct {
+	mu   sync.Mutex
+	subs [numSubKinds]map[string]map[*subscriber]bool
+}
+
+// subscriber is the Pub/Sub state of a client connection. Messages are
+// queued by the publishing goroutines, so all writes go through out.
+type subscriber struct {
+	out  *clientWriter
+	subs [numSubKinds]map[string]bool
+}
+
+// count returns the number of subscriptions reported in the replies to
+// subscriptions of kind: channels and patterns count together, shard
+// channels apart. Must be called with the pubsub mu held.
+func (s *subscriber) count(kind int) int {
+	if kind == subShard {
+		return len(s.subs[subShard])
+	}
+	return len(s.subs[subChannel]) + len(s.subs[subPattern])
+}
+
+// clientWriter queues the replies and the messages for a client, which its
+// own goroutine writes: a publisher never waits for a slow subscriber.
+type clientWriter struct {
+	conn net.Conn
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	writing bool
+	closed  bool
+}
+
+func newClientWriter(conn net.Conn) *clientWriter {
+	w := &clientWriter{conn: conn}
+	w.cond = sync.NewCond(&w.mu)
+	go w.run()
+	return w
+}
+
+// reply queues v, a reply to a command of the client. It waits while more
+// than clientReplyBuffer bytes are pending, so that a client that doesn't
+// read its replies stops being read instead of filling the memory.
+func (w *clientWriter) reply(v resp.Value) error {
+	data := resp.Marshal(v)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.pending) > 0 && len(w.pending)+len(data) > clientReplyBuffer && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return net.ErrClosed
+	}
+	w.pending = append(w.pending, data...)
+	w.cond.Broadcast()
+	return nil
+}
+
+// push queues a Pub/Sub push, which other connections send too, without
+// waiting: the client is disconnected when too many are pending.
+func (w *clientWriter) push(v resp.Value) error {
+	data := resp.Marshal(v)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return net.ErrClosed
+	}
+	if len(w.pending)+len(data) > pubsubOutputLimit {
+		fmt.Printf("Client %s closed for overcoming the output buffer limit\n", w.conn.RemoteAddr())
+		w.closeLocked()
+		return errOutputLimit
+	}
+	w.pending = append(w.pending, data...)
+	w.cond.Broadcast()
+	return nil
+}
+
+// run writes what is queued until the writer is closed.
+func (w *clientWriter) run() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for {
+		for len(w.pending) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			return
+		}
+		data := w.pending
+		w.pending = nil
+		w.writing = true
+		w.mu.Unlock()
+		_, err := w.conn.Write(data)
+		w.mu.Lock()
+		w.writing = false
+		w.cond.Broadcast()
+		if err != nil {
+			w.closeLocked()
+		}
+	}
+}
+
+// flush waits until everything queued was written, before the connection
+// is written to directly.
+func (w *clientWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for (len(w.pending) > 0 || w.writing) && !w.closed {
+		w.cond.Wait()
+	}
+}
+
+// close stops the writer once what is queued was written: a client that
+// half-closes the connection after a pipeline still gets its replies. It
+// gives up after clientDrainTimeout.
+func (w *clientWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) > 0 || w.writing {
+		w.conn.SetWriteDeadline(time.Now().Add(clientDrainTimeout))
+	}
+	for (len(w.pending) > 0 || w.writing) && !w.closed {
+		w.cond.Wait()
+	}
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+// closeLocked stops the writer and closes the connection, which ends the
+// client. Must be called with w.mu held.
+func (w *clientWriter) closeLocked() {
+	w.closed = true
+	w.pending = nil
+	w.cond.Broadcast()
+	w.conn.Close()
+}
+
+// subscribed reports whether s has subscriptions, which restricts the
+// commands it may send.
+func (ps *pubsub) subscribed(s *subscriber) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, names := range s.subs {
+		if len(names) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribe implements SUBSCRIBE, PSUBSCRIBE and SSUBSCRIBE, confirming each
+// channel or pattern with the count of subscriptions.
+func (ps *pubsub) subscribe(s *subscriber, kind int, names []resp.Value) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.subs[kind] == nil {
+		ps.subs[kind] = make(map[string]map[*subscriber]bool)
+	}
+	if s.subs[kind] == nil {
+		s.subs[kind] = make(map[string]bool)
+	}
+	for _, name := range names {
+		if !s.subs[kind][name.Bulk] {
+			s.subs[kind][name.Bulk] = true
+			if ps.subs[kind][name.Bulk] == nil {
+				ps.subs[kind][name.Bulk] = make(map[*subscriber]bool)
+			}
+			ps.subs[kind][name.Bulk][s] = true
+		}
+		s.out.push(pubsubReply(subKindNames[kind].subscribe, name.Bulk, s.count(kind)))
+	}
+}
+
+// unsubscribe implements UNSUBSCRIBE, PUNSUBSCRIBE and SUNSUBSCRIBE; without
+// names it unsubscribes from all the channels of the kind.
+func (ps *pubsub) unsubscribe(s *subscriber, kind int, names []resp.Value, notify bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var list []string
+	for _, name := range names {
+		list = append(list, name.Bulk)
+	}
+	if len(names) == 0 {
+		for name := range s.subs[kind] {
+			list = append(list, name)
+		}
+		if len(list) == 0 && notify {
+			s.out.push(resp.Value{Type: "array", Array: []resp.Value{
+				{Type: "bulk", Bulk: subKindNames[kind].unsubscribe}, {Type: "nil"}, {Type: "integer", Num: s.count(kind)},
+			}})
+		}
+	}
+	for _, name := range list {
+		ps.remove(s, kind, name)
+		if notify {
+			s.out.push(pubsubReply(subKindNames[kind].unsubscribe, name, s.count(kind)))
+		}
+	}
+}
+
+// remove ends the subscription of s to name. Must be called with ps.mu held.
+func (ps *pubsub) remove(s *subscriber, kind int, name string) {
+	if !s.subs[kind][name] {
+		return
+	}
+	delete(s.subs[kind], name)
+	delete(ps.subs[kind][name], s)
+	if len(ps.subs[kind][name]) == 0 {
+		delete(ps.subs[kind], name)
+	}
+}
+
+// drop ends every subscription of a connection that is closing.
+func (ps *pubsub) drop(s *subscriber) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for kind := range s.subs {
+		for name := range s.subs[kind] {
+			ps.remove(s, kind, name)
+		}
+	}
+}
+
+// publish implements PUBLISH and returns the number of receivers: the
+// subscribers of the channel and of every pattern matching it.
+func (ps *pubsub) publish(channel, message string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	msg := resp.Command("message", channel, message)
+	receivers := 0
+	for s := range ps.subs[subChannel][channel] {
+		s.out.push(msg)
+		receivers++
+	}
+	for pattern, subs := range ps.subs[subPattern] {
+		if !glob.Match(pattern, channel) {
+			continue
+		}
+		pmsg := resp.Command("pmessage", pattern, channel, message)
+		for s := range subs {
+			s.out.push(pmsg)
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// spublish delivers a message to the subscribers of a shard channel on this
+// node and returns their number.
+func (ps *pubsub) spublish(channel, message string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	msg := resp.Command("smessage", channel, message)
+	for s := range ps.subs[subShard][channel] {
+		s.out.push(msg)
+	}
+	return len(ps.subs[subShard][channel])
+}
+
+// dropShardChannels ends the subscriptions to the shard channels for which
+// keep returns false, telling their subscribers with sunsubscribe.
+func (ps *pubsub) dropShardChannels(keep func(channel string) bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for channel, subs := range ps.subs[subShard] {
+		if keep(channel) {
+			continue
+		}
+		for s := range subs {
+			ps.remove(s, subShard, channel)
+			s.out.push(pubsubReply(subKindNames[subShard].unsubscribe, channel, s.count(subShard)))
+		}
+	}
+}
+
+// pubsubCommand implements PUBSUB CHANNELS|SHARDCHANNELS [pattern], PUBSUB
+// NUMSUB|SHARDNUMSUB [channel ...] and PUBSUB NUMPAT.
+func (ps *pubsub) pubsubCommand(args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'pubsub' command"}
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	sub := strings.ToUpper(args[0].Bulk)
+	kind := subChannel
+	if sub == "SHARDCHANNELS" || sub == "SHARDNUMSUB" {
+		kind = subShard
+	}
+	switch {
+	case (sub == "CHANNELS" || sub == "SHARDCHANNELS") && len(args) <= 2:
+		var names []string
+		for name := range ps.subs[kind] {
+			if len(args) == 1 || glob.Match(args[1].Bulk, name) {
+				names = append(names, name)
+			}
+		}
+		slices.Sort(names)
+		return resp.Command(names...)
+	case sub == "NUMSUB" || sub == "SHARDNUMSUB":
+		out := []resp.Value{}
+		for _, ch := range args[1:] {
+			out = append(out, ch, resp.Value{Type: "integer", Num: len(ps.subs[kind][ch.Bulk])})
+		}
+		return resp.Value{Type: "array", Array: out}
+	case sub == "NUMPAT" && len(args) == 1:
+		return resp.Value{Type: "integer", Num: len(ps.subs[subPattern])}
+	case sub == "CHANNELS" || sub == "SHARDCHANNELS" || sub == "NUMPAT":
+		return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'pubsub|" + strings.ToLower(sub) + "' command"}
+	}
+	return resp.Value{Type: "error", Str: "ERR unknown subcommand '" + args[0].Bulk + "'. Try PUBSUB HELP."}
+}
+
+func pubsubReply(kind, channel string, count int) resp.Value {
+	return resp.Value{Type: "array", Array: []resp.Value{
+		{Type: "bulk", Bulk: kind}, {Type: "bulk", Bulk: channel}, {Type: "integer", Num: count},
+	}}
+}
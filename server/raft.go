@@ -0,0 +1,277 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/raft"
+	"github.com/saurabhdhingra/go-redis/rdb"
+	"github.com/saurabhdhingra/go-redis/resp"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// In raft mode the writes are proposed to a Raft log and applied, on every
+// node, once a majority stored them: an acknowledged write survives the loss
+// of a minority of the nodes. Only the leader serves commands with keys;
+// reads wait for its read index, so they see every acknowledged write.
+// Followers reply NOTLEADER with the leader's address.
+//
+// The log and its snapshots, in Dir, hold the dataset: the RDB file and the
+// AOF aren't loaded at startup.
+
+// RaftInit restores the dataset from the raft snapshot and log, and starts
+// the node. A new node waits for RAFT INIT or RAFT JOIN.
+func (info *ServerInfo) RaftInit(kv *store.KeyValueStore) error {
+	n, err := raft.Open(raft.Config{
+		ID:                info.RaftAddr,
+		Dir:               info.Dir,
+		ElectionTimeout:   info.RaftElectionTimeout,
+		HeartbeatInterval: info.RaftHeartbeatInterval,
+		SnapshotEntries:   info.RaftSnapshotEntries,
+	}, &raftStateMachine{info: info, kv: kv})
+	if err != nil {
+		return err
+	}
+	info.raft = n
+	return nil
+}
+
+// raftRejects returns the error for commands that can't run in raft mode,
+// or "": they change the dataset outside of the log.
+func raftRejects(command string) string {
+	switch command {
+	case "MIGRATE", "REPLICAOF", "SLAVEOF", "FAILOVER":
+		return "ERR " + command + " is not allowed in raft mode"
+	}
+	return ""
+}
+
+// raftCall runs a command with keys, or a write, through the log.
+func (info *ServerInfo) raftCall(kv *store.KeyValueStore, command string, cmd []resp.Value) resp.Value {
+	if msg := raftRejects(command); msg != "" {
+		return resp.Value{Type: "error", Str: msg}
+	}
+	if !commandFlag(command, flagWrite) {
+		if err := info.raft.ReadIndex(); err != nil {
+			return resp.Value{Type: "error", Str: errorString(err)}
+		}
+		return executeCommand(kv, info, command, cmd[1:])
+	}
+	results, err := info.raftPropose([][]resp.Value{cmd})
+	if err != nil {
+		return resp.Value{Type: "error", Str: errorString(err)}
+	}
+	return results[0]
+}
+
+// raftPropose appends commands to the log, to be applied together, and
+// returns their replies.
+func (info *ServerInfo) raftPropose(cmds [][]resp.Value) ([]resp.Value, error) {
+	entry := []resp.Value{{Type: "bulk", Bulk: strconv.FormatInt(time.Now().UnixMilli(), 10)}}
+	for _, cmd := range cmds {
+		entry = append(entry, resp.Value{Type: "array", Array: cmd})
+	}
+	result, err := info.raft.Propose(string(resp.Marshal(resp.Value{Type: "array", Array: entry})))
+	if err != nil {
+		return nil, err
+	}
+	return result.([]resp.Value), nil
+}
+
+// raftStateMachine applies the log to the keyspace.
+type raftStateMachine struct {
+	info *ServerInfo
+	kv   *store.KeyValueStore
+}
+
+// Apply runs the commands of an entry: a RESP array of the time the leader
+// proposed it, in milliseconds, then the commands. Relative expirations and
+// generated stream IDs are computed from that time, so that every node gets
+// the same dataset.
+func (sm *raftStateMachine) Apply(data string) any {
+	v, err := resp.NewResp(strings.NewReader(data)).Read()
+	if err != nil || v.Type != "array" || len(v.Array) < 2 {
+		fmt.Println("Raft: skipping an invalid log entry")
+		return []resp.Value{{Type: "error", Str: "ERR Invalid raft log entry"}}
+	}
+	ms, _ := strconv.ParseInt(v.Array[0].Bulk, 10, 64)
+	at := time.UnixMilli(ms)
+
+	sm.info.writeMu.Lock()
+	defer sm.info.writeMu.Unlock()
+	var results []resp.Value
+	var propagated [][]resp.Value
+	for _, c := range v.Array[1:] {
+		cmd := c.Array
+		command := strings.ToUpper(cmd[0].Bulk)
+		if msg := raftRejects(command); msg != "" {
+			results = append(results, resp.Value{Type: "error", Str: msg})
+			continue
+		}
+		cmd = deterministicCommand(sm.kv, command, cmd, at)
+		reply := executeCommand(sm.kv, sm.info, command, cmd[1:])
+		results = append(results, reply)
+		if commandFlag(command, flagWrite) {
+			if p := propagatedCommand(sm.kv, command, cmd, reply); p != nil {
+				propagated = append(propagated, p)
+			}
+		}
+	}
+	switch {
+	case len(propagated) == 1:
+		sm.info.propagate(propagated)
+	case len(propagated) > 1:
+		cmds := [][]resp.Value{resp.Command("MULTI").Array}
+		cmds = append(cmds, propagated...)
+		cmds = append(cmds, resp.Command("EXEC").Array)
+		sm.info.propagate(cmds)
+	}
+	return results
+}
+
+// deterministicCommand rewrites cmd so that running it doesn't depend on the
+// clock of the node, taking at as the current time.
+func deterministicCommand(kv *store.KeyValueStore, command string, cmd []resp.Value, at time.Time) []resp.Value {
+	switch command {
+	case "SET":
+		out := slices.Clone(cmd)
+		for i := 3; i+1 < len(out); i++ {
+			n, err := strconv.ParseInt(out[i+1].Bulk, 10, 64)
+			if err != nil || n <= 0 {
+				continue
+			}
+			switch strings.ToUpper(out[i].Bulk) {
+			case "EX":
+				n *= 1000
+			case "PX":
+			default:
+				continue
+			}
+			out[i] = resp.Value{Type: "bulk", Bulk: "PXAT"}
+			out[i+1] = resp.Value{Type: "bulk", Bulk: strconv.FormatInt(at.UnixMilli()+n, 10)}
+			i++
+		}
+		return out
+	case "RESTORE", "RESTORE-ASKING":
+		if len(cmd) < 4 || slices.ContainsFunc(cmd[4:], func(v resp.Value) bool { return strings.EqualFold(v.Bulk, "ABSTTL") }) {
+			return cmd
+		}
+		ttl, err := strconv.ParseInt(cmd[2].Bulk, 10, 64)
+		if err != nil || ttl <= 0 {
+			return cmd
+		}
+		out := slices.Clone(cmd)
+		out[2] = resp.Value{Type: "bulk", Bulk: strconv.FormatInt(at.UnixMilli()+ttl, 10)}
+		return append(out, resp.Value{Type: "bulk", Bulk: "ABSTTL"})
+	case "EXPIRE":
+		seconds, err := strconv.ParseInt(cmd[min(2, len(cmd)-1)].Bulk, 10, 64)
+		if len(cmd) != 3 || err != nil {
+			return cmd
+		}
+		return resp.Command("PEXPIREAT", cmd[1].Bulk, strconv.FormatInt(at.UnixMilli()+seconds*1000, 10)).Array
+	case "XADD":
+		if len(cmd) < 3 || cmd[2].Bulk != "*" {
+			return cmd
+		}
+		out := slices.Clone(cmd)
+		out[2] = resp.Value{Type: "bulk", Bulk: kv.NextStreamID(cmd[1].Bulk, at)}
+		return out
+	}
+	return cmd
+}
+
+// Snapshot writes the keyspace to an RDB file. It runs between entries, so
+// no write is in progress.
+func (sm *raftStateMachine) Snapshot(path string, aux map[string]string) error {
+	return rdb.SaveFile(path, sm.kv.Snapshot(), aux)
+}
+
+// Restore replaces the keyspace with an RDB file.
+func (sm *raftStateMachine) Restore(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, aux, err := rdb.LoadAux(f)
+	if err != nil {
+		return nil, err
+	}
+	sm.info.writeMu.Lock()
+	sm.kv.Load(data)
+	sm.info.writeMu.Unlock()
+	fmt.Printf("Raft: loaded a snapshot with %d keys\n", len(data))
+	return aux, nil
+}
+
+// raftCommand implements RAFT:
+//
+//	RAFT INIT                 start a cluster with this node alone
+//	RAFT JOIN <addr>          ask the cluster of the node at addr to add this one
+//	RAFT ADDNODE <addr>       add a node, on the leader
+//	RAFT REMOVENODE <addr>    remove a node, on the leader
+//
+// and the RPCs between nodes, see the raft package.
+func (info *ServerInfo) raftCommand(args []resp.Value) resp.Value {
+	if info.raft == nil {
+		return resp.Value{Type: "error", Str: "ERR This instance has raft support disabled"}
+	}
+	if len(args) == 0 {
+		return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'raft' command"}
+	}
+	sub := strings.ToUpper(args[0].Bulk)
+	var err error
+	switch sub {
+	case "INIT":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'raft|init' command"}
+		}
+		err = info.raft.Bootstrap()
+	case "JOIN", "ADDNODE", "REMOVENODE":
+		if len(args) != 2 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'raft|" + strings.ToLower(sub) + "' command"}
+		}
+		switch addr := args[1].Bulk; sub {
+		case "JOIN":
+			err = info.raft.Join(addr)
+		case "ADDNODE":
+			err = info.raft.AddNode(addr)
+		default:
+			err = info.raft.RemoveNode(addr)
+		}
+	default:
+		rpc := make([]string, len(args))
+		for i, arg := range args {
+			rpc[i] = arg.Bulk
+		}
+		rpc[0] = sub
+		return info.raft.HandleRPC(rpc)
+	}
+	if err != nil {
+		return resp.Value{Type: "error", Str: errorString(err)}
+	}
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+func (info *ServerInfo) raftInfo() []string {
+	if info.raft == nil {
+		return []string{"raft_enabled:0"}
+	}
+	st := info.raft.Status()
+	return []string{
+		"raft_enabled:1",
+		"raft_node:" + st.ID,
+		"raft_state:" + st.State,
+		fmt.Sprintf("raft_term:%d", st.Term),
+		"raft_leader:" + st.Leader,
+		"raft_members:" + strings.Join(st.Members, ","),
+		fmt.Sprintf("raft_commit_index:%d", st.CommitIndex),
+		fmt.Sprintf("raft_last_applied:%d", st.LastApplied),
+		fmt.Sprintf("raft_last_index:%d", st.LastIndex),
+		fmt.Sprintf("raft_snapshot_index:%d", st.SnapshotIndex),
+	}
+}
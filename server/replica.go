@@ -0,0 +1,408 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/resp"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+const (
+	// replTimeout is how long the link may stay silent before it is dropped;
+	// masters ping their replicas every few seconds.
+	replTimeout = 60 * time.Second
+	// The delay before reconnecting doubles after each failed attempt.
+	replMinBackoff = time.Second
+	replMaxBackoff = 30 * time.Second
+)
+
+var errReplicationStopped = errors.New("replication with this master was stopped")
+
+// Replication states of the link to the master, as in Redis' repl_state.
+const (
+	replStateConnect    = "connect"
+	replStateConnecting = "connecting"
+	replStateHandshake  = "handshake"
+	replStateTransfer   = "sync"
+	replStateConnected  = "connected"
+)
+
+// masterLink is the replica's connection to its master.
+type masterLink struct {
+	addr string
+
+	mu        sync.Mutex
+	state     string
+	conn      net.Conn
+	lastIO    time.Time
+	downSince time.Time
+	stopped   bool // set by REPLICAOF when the link is replaced
+
+	// failover is set when this link is how a FAILOVER hands the master role
+	// to addr: PSYNC asks addr to take over, and the outcome of that first
+	// attempt is sent on the channel.
+	failover chan error
+}
+
+func newMasterLink(addr string) *masterLink {
+	return &masterLink{
+		addr:      addr,
+		state:     replStateConnect,
+		downSince: time.Now(),
+	}
+}
+
+// StartReplication connects to the master at info.MasterAddr and keeps the
+// dataset in sync with it, reconnecting whenever the link drops. It returns
+// right away; call it once the local dataset is loaded.
+func (info *ServerInfo) StartReplication(kv *store.KeyValueStore) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.startReplication(kv, newMasterLink(masterAddress(info.MasterAddr)))
+}
+
+// startReplication replaces the link to the master, if any, by link.
+// Must be called with info.mu held.
+func (info *ServerInfo) startReplication(kv *store.KeyValueStore, link *masterLink) {
+	if info.link != nil {
+		info.link.stop()
+	}
+	info.link = link
+	go info.replicate(kv, link)
+}
+
+// masterAddress accepts "host port", as in the replicaof directive, as well as "host:port".
+func masterAddress(s string) string {
+	if host, port, ok := strings.Cut(strings.TrimSpace(s), " "); ok {
+		return net.JoinHostPort(host, strings.TrimSpace(port))
+	}
+	return s
+}
+
+// replicate runs the link to the master forever, backing off between
+// failed attempts.
+func (info *ServerInfo) replicate(kv *store.KeyValueStore, link *masterLink) {
+	backoff := replMinBackoff
+	for {
+		synced, err := info.syncWithMaster(kv, link)
+		link.failoverDone(err)
+		link.mu.Lock()
+		if link.state == replStateConnected {
+			link.downSince = time.Now()
+		}
+		link.state = replStateConnect
+		link.conn = nil
+		stopped := link.stopped
+		link.mu.Unlock()
+		if stopped {
+			return
+		}
+		fmt.Printf("Connection with master %s lost: %v\n", link.addr, err)
+
+		if synced {
+			backoff = replMinBackoff
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, replMaxBackoff)
+	}
+}
+
+// syncWithMaster performs one connection: the handshake, the full
+// synchronization and then the command stream, until an error occurs. synced
+// reports whether the dataset was received.
+func (info *ServerInfo) syncWithMaster(kv *store.KeyValueStore, link *masterLink) (synced bool, err error) {
+	if !link.setState(replStateConnecting, nil) {
+		return false, errReplicationStopped
+	}
+	conn, err := net.DialTimeout("tcp", link.addr, replTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if !link.setState(replStateHandshake, conn) {
+		return false, errReplicationStopped
+	}
+
+	counter := &countingReader{r: conn}
+	br := bufio.NewReader(counter)
+	offset := func() int64 { return counter.n - int64(br.Buffered()) }
+	reader := resp.NewResp(br)
+
+	request := func(args ...string) (resp.Value, error) {
+		conn.SetDeadline(time.Now().Add(replTimeout))
+		if err := resp.Respond(conn, resp.Command(args...)); err != nil {
+			return resp.Value{}, err
+		}
+		reply, err := reader.Read()
+		if err != nil {
+			return resp.Value{}, err
+		}
+		if reply.Type == "error" {
+			return reply, fmt.Errorf("master replied to %s with error: %s", args[0], reply.Str)
+		}
+		return reply, nil
+	}
+
+	if _, err := request("PING"); err != nil {
+		return false, err
+	}
+	port := info.Port
+	if info.ReplicaAnnouncePort != 0 {
+		port = info.ReplicaAnnouncePort
+	}
+	if _, err := request("REPLCONF", "listening-port", strconv.Itoa(port)); err != nil {
+		return false, err
+	}
+	if info.ReplicaAnnounceIP != "" {
+		if _, err := request("REPLCONF", "ip-address", info.ReplicaAnnounceIP); err != nil {
+			return false, err
+		}
+	}
+	if _, err := request("REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		return false, err
+	}
+	// Ask to continue from where the stream was left, when there is a history.
+	info.repl.mu.Lock()
+	psyncID, psyncOffset := "?", int64(-1)
+	if info.repl.backlog != nil {
+		psyncID, psyncOffset = info.repl.replID(), info.repl.offset+1
+	}
+	info.repl.mu.Unlock()
+	psync := []string{"PSYNC", psyncID, strconv.FormatInt(psyncOffset, 10)}
+	link.mu.Lock()
+	if link.failover != nil {
+		psync = append(psync, "FAILOVER")
+	}
+	link.mu.Unlock()
+	reply, err := request(psync...)
+	if err != nil {
+		return false, err
+	}
+
+	fields := strings.Fields(reply.Str)
+	switch {
+	case len(fields) >= 1 && fields[0] == "CONTINUE":
+		info.writeMu.Lock()
+		info.repl.mu.Lock()
+		changed := len(fields) == 2 && fields[1] != info.repl.replid
+		if changed {
+			// The master was promoted since; its new history continues ours.
+			info.repl.shiftReplID(fields[1])
+		}
+		info.repl.mu.Unlock()
+		info.writeMu.Unlock()
+		if changed {
+			info.disconnectReplicas()
+		}
+		fmt.Println("MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization")
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		masterOffset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("unexpected reply to PSYNC: %q", reply.Str)
+		}
+		if !link.setState(replStateTransfer, conn) {
+			return false, errReplicationStopped
+		}
+		if err := info.loadMasterRDB(kv, link, conn, br, fields[1], masterOffset); err != nil {
+			return false, err
+		}
+		fmt.Println("MASTER <-> REPLICA sync: Finished with success")
+	default:
+		return false, fmt.Errorf("unexpected reply to PSYNC: %q", reply.Str)
+	}
+	link.failoverDone(nil)
+	link.mu.Lock()
+	link.state = replStateConnected
+	link.lastIO = time.Now()
+	link.mu.Unlock()
+
+	return true, info.streamFromMaster(kv, link, conn, reader, offset)
+}
+
+// loadMasterRDB reads the RDB file that follows FULLRESYNC, framed as
+// "$<length>\r\n" or, from diskless masters, with an EOF mark, and replaces
+// the dataset with it, adopting the master's history from offset on.
+// Masters may send newlines as keepalives while they prepare the file.
+func (info *ServerInfo) loadMasterRDB(kv *store.KeyValueStore, link *masterLink, conn net.Conn, br *bufio.Reader, replid string, offset int64) error {
+	var header string
+	for header == "" {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		header = strings.TrimRight(line, "\r\n")
+	}
+	if header[0] == '-' {
+		return fmt.Errorf("master aborted the transfer: %s", header[1:])
+	}
+	if header[0] != '$' {
+		return fmt.Errorf("bad protocol from master, expected the RDB payload: %q", header)
+	}
+	var payload io.Reader
+	if mark, ok := strings.CutPrefix(header, "$EOF:"); ok {
+		if len(mark) != eofMarkLen {
+			return fmt.Errorf("bad EOF mark from master: %q", header)
+		}
+		fmt.Println("MASTER <-> REPLICA sync: receiving streamed RDB from master")
+		payload = &eofMarkReader{conn: conn, r: br, mark: []byte(mark)}
+	} else {
+		size, err := strconv.ParseInt(header[1:], 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("bad RDB payload length from master: %q", header)
+		}
+		fmt.Printf("MASTER <-> REPLICA sync: receiving %d bytes from master\n", size)
+		// The deadline is pushed back as data arrives, so large files are fine.
+		payload = io.LimitReader(&deadlineReader{conn: conn, r: br}, size)
+	}
+
+	return info.loadPayload(kv, link, payload, func() {
+		info.repl.mu.Lock()
+		info.repl.replid = replid
+		info.repl.offset = offset
+		info.repl.clearReplID2()
+		info.repl.backlog = newReplBacklog(info.replBacklogSize(), offset)
+		info.repl.mu.Unlock()
+		// Our replicas followed the history that was just replaced.
+		info.disconnectReplicas()
+		// The AOF must describe the new dataset, not the one it replaced.
+		if info.aof.Load() != nil {
+			if err := info.bgrewriteaof(kv); err != nil {
+				fmt.Println("Failed to rewrite the AOF after the sync with master:", err)
+			}
+		}
+	})
+}
+
+// streamFromMaster applies the command stream that follows the RDB file.
+// Replies are not sent back. The stream also goes to the backlog, byte for
+// byte, so that this replica's history matches the master's.
+func (info *ServerInfo) streamFromMaster(kv *store.KeyValueStore, link *masterLink, conn net.Conn, reader *resp.Resp, offset func() int64) error {
+	var queued [][]resp.Value
+	inTransaction := false
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		start := offset()
+		value, err := reader.Read()
+		if err != nil {
+			return err
+		}
+		raw := resp.Marshal(value)
+		if value.Type != "array" || len(value.Array) == 0 || int64(len(raw)) != offset()-start {
+			return errors.New("bad protocol from master")
+		}
+		link.mu.Lock()
+		link.lastIO = time.Now()
+		link.mu.Unlock()
+
+		info.writeMu.Lock()
+		if link.isStopped() {
+			info.writeMu.Unlock()
+			return errReplicationStopped
+		}
+		command := strings.ToUpper(value.Array[0].Bulk)
+		switch {
+		case command == "REPLCONF" && len(value.Array) > 1 && strings.EqualFold(value.Array[1].Bulk, "GETACK"):
+			// The acknowledged offset excludes the GETACK itself, as in Redis.
+			info.sendAck(link)
+		case command == "MULTI":
+			inTransaction = true
+			queued = nil
+		case command == "EXEC":
+			info.applyFromMaster(kv, queued, true)
+			inTransaction = false
+			queued = nil
+		case inTransaction:
+			queued = append(queued, value.Array)
+		case command == "PING" || command == "REPLCONF":
+		default:
+			info.applyFromMaster(kv, [][]resp.Value{value.Array}, false)
+		}
+		info.feedReplicationStream(raw)
+		info.writeMu.Unlock()
+	}
+}
+
+// applyFromMaster executes commands received from the master and logs them
+// to the local AOF, wrapped in MULTI/EXEC when they came as a transaction.
+// The caller holds writeMu.
+func (info *ServerInfo) applyFromMaster(kv *store.KeyValueStore, cmds [][]resp.Value, transaction bool) {
+	for _, cmd := range cmds {
+		executeCommand(kv, info, strings.ToUpper(cmd[0].Bulk), cmd[1:])
+	}
+	if transaction {
+		cmds = append([][]resp.Value{resp.Command("MULTI").Array}, cmds...)
+		cmds = append(cmds, resp.Command("EXEC").Array)
+	}
+	info.feedAppendOnlyFile(cmds)
+}
+
+// sendAck reports the processed offset to the master with REPLCONF ACK.
+func (info *ServerInfo) sendAck(link *masterLink) {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.state != replStateConnected || link.conn == nil {
+		return
+	}
+	offset := info.replOffset()
+	link.conn.SetWriteDeadline(time.Now().Add(replTimeout))
+	resp.Respond(link.conn, resp.Command("REPLCONF", "ACK", strconv.FormatInt(offset, 10)))
+}
+
+// failoverDone reports the outcome of the PSYNC FAILOVER attempt, if this
+// link still has one to report.
+func (link *masterLink) failoverDone(err error) {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.failover != nil {
+		link.failover <- err
+		link.failover = nil
+	}
+}
+
+// setState moves the link to state over conn, unless it was stopped.
+func (link *masterLink) setState(state string, conn net.Conn) bool {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.stopped {
+		return false
+	}
+	link.state = state
+	link.conn = conn
+	return true
+}
+
+// stop ends the link for good, closing the connection to the master.
+func (link *masterLink) stop() {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	link.stopped = true
+	if link.conn != nil {
+		link.conn.Close()
+	}
+}
+
+func (link *masterLink) isStopped() bool {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	return link.stopped
+}
+
+// deadlineReader extends the read deadline of conn before every read.
+type deadlineReader struct {
+	conn net.Conn
+	r    io.Reader
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(replTimeout))
+	return d.r.Read(p)
+}
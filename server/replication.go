@@ -0,0 +1,609 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saurabhdhingra/go-redis/rdb"
+	"github.com/saurabhdhingra/go-redis/resp"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+const (
+	defaultReplBacklogSize = 1 << 20
+	// replPingPeriod is how often masters ping their replicas, so that the
+	// replicas can tell a silent master from a dead one.
+	replPingPeriod = 10 * time.Second
+	// replicaOutputLimit disconnects replicas that fall this far behind, like
+	// client-output-buffer-limit for replicas.
+	replicaOutputLimit = 256 << 20
+)
+
+const errNoReplicas = "NOREPLICAS Not enough good replicas to write."
+
+// States of a replica as seen by its master, named as in INFO.
+const (
+	replicaStateWaitBgsave = "wait_bgsave"
+	replicaStateSendBulk   = "send_bulk"
+	replicaStateOnline     = "online"
+)
+
+// replication is the master side of replication: the replication ID and
+// offset, the backlog and the attached replicas.
+type replication struct {
+	mu       sync.Mutex
+	replid   string
+	offset   int64 // master_repl_offset
+	backlog  *replBacklog
+	replicas []*replica
+	lastPing time.Time
+
+	// replid2 is the ID of the history this one continues, valid up to
+	// secondOffset (exclusive, as a PSYNC offset), so that the former
+	// siblings of a promoted replica can still resume their stream.
+	replid2      string
+	secondOffset int64
+
+	noReplicasSince time.Time // for repl-backlog-ttl
+
+	disklessBatch []*replica // waiting for the next diskless transfer
+}
+
+// replica is a connection that turned into a replica with PSYNC. Writes are
+// queued in pending and sent by their own goroutine, so a slow replica never
+// blocks the master.
+type replica struct {
+	conn net.Conn
+	addr string // the address the replica listens on
+	capa []string
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	state     string
+	pending   []byte
+	closed    bool
+	ackOffset int64
+	ackTime   time.Time
+}
+
+// replicaHandshake collects what a connection announced with REPLCONF before PSYNC.
+type replicaHandshake struct {
+	ip   string // replica-announce-ip, if set
+	port int
+	capa []string
+}
+
+// replID returns the replication ID, picking a random one on first use.
+// Must be called with r.mu held.
+func (r *replication) replID() string {
+	if r.replid == "" {
+		r.replid = newReplID()
+	}
+	return r.replid
+}
+
+// shiftReplID starts a new history with ID replid, keeping the current one as
+// the secondary ID. Must be called with r.mu held.
+func (r *replication) shiftReplID(replid string) {
+	r.replid2 = r.replID()
+	r.secondOffset = r.offset + 1
+	r.replid = replid
+}
+
+// clearReplID2 forgets the secondary ID. Must be called with r.mu held.
+func (r *replication) clearReplID2() {
+	r.replid2 = strings.Repeat("0", 40)
+	r.secondOffset = -1
+}
+
+// replBacklogSize returns the configured repl-backlog-size.
+func (info *ServerInfo) replBacklogSize() int {
+	if info.ReplBacklogSize <= 0 {
+		return defaultReplBacklogSize
+	}
+	return info.ReplBacklogSize
+}
+
+// newReplID returns 40 random hex characters, like Redis' run IDs.
+func newReplID() string {
+	var b [20]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// replconf handles REPLCONF on a connection that may become a replica.
+func (info *ServerInfo) replconf(hs *replicaHandshake, r *replica, args []resp.Value) resp.Value {
+	if len(args)%2 != 0 {
+		return resp.Value{Type: "error", Str: "ERR syntax error"}
+	}
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1].Bulk
+		switch strings.ToLower(args[i].Bulk) {
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+			}
+			hs.port = port
+		case "ip-address":
+			hs.ip = value
+		case "capa":
+			hs.capa = append(hs.capa, strings.ToLower(value))
+		case "ack":
+			// Sent by replicas every second; it gets no reply.
+			if r != nil {
+				offset, _ := strconv.ParseInt(value, 10, 64)
+				r.mu.Lock()
+				r.ackOffset = max(r.ackOffset, offset)
+				r.ackTime = time.Now()
+				r.mu.Unlock()
+			}
+			return resp.Value{}
+		default:
+			return resp.Value{Type: "error", Str: "ERR Unrecognized REPLCONF option: " + args[i].Bulk}
+		}
+	}
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+// syncReplica serves PSYNC/SYNC on conn and returns the attached replica.
+// A partial resynchronization is tried first. Otherwise the dataset is
+// snapshotted at the current offset, the replica is attached so it queues
+// the writes that follow, and the snapshot is sent as an RDB file before them.
+func (info *ServerInfo) syncReplica(kv *store.KeyValueStore, conn net.Conn, hs *replicaHandshake, command string, args []resp.Value) (*replica, error) {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if hs.ip != "" {
+		host = hs.ip
+	}
+	r := &replica{
+		conn:  conn,
+		addr:  net.JoinHostPort(host, strconv.Itoa(hs.port)),
+		capa:  hs.capa,
+		state: replicaStateWaitBgsave,
+	}
+	r.cond = sync.NewCond(&r.mu)
+
+	if command == "PSYNC" && len(args) == 3 && strings.EqualFold(args[2].Bulk, "FAILOVER") {
+		if err := info.takeOver(conn, args[0].Bulk); err != nil {
+			return nil, err
+		}
+		args = args[:2]
+	}
+	// A replica serves the history it got from its master, which it must
+	// have received first.
+	info.mu.Lock()
+	role, link := info.Role, info.link
+	info.mu.Unlock()
+	if role == "slave" && (link == nil || !link.connected()) {
+		resp.Respond(conn, resp.Value{Type: "error", Str: "NOMASTERLINK Can't SYNC while not connected with my master"})
+		return nil, errors.New("not connected with the master")
+	}
+	if command == "PSYNC" && len(args) == 2 {
+		if ok, err := info.partialResync(r, args[0].Bulk, args[1].Bulk); ok || err != nil {
+			return r, err
+		}
+	}
+
+	// Replicas that can read a transfer of unknown length get the snapshot
+	// streamed without going through the disk.
+	if info.ReplDisklessSync && command == "PSYNC" && slices.Contains(r.capa, "eof") {
+		fmt.Printf("Replica %s asks for synchronization, starting a diskless transfer in %v\n", r.addr, info.ReplDisklessSyncDelay)
+		info.queueDisklessSync(kv, r)
+		return r, nil
+	}
+
+	// No write may slip between the snapshot and the attachment.
+	info.writeMu.Lock()
+	snapshot := kv.Snapshot()
+	info.repl.mu.Lock()
+	replid := info.repl.replID()
+	if info.repl.backlog == nil {
+		info.repl.backlog = newReplBacklog(info.replBacklogSize(), info.repl.offset)
+	}
+	offset := info.repl.offset
+	info.repl.replicas = append(info.repl.replicas, r)
+	info.repl.mu.Unlock()
+	info.writeMu.Unlock()
+
+	fmt.Printf("Replica %s asks for synchronization\n", r.addr)
+	if command == "PSYNC" {
+		if _, err := fmt.Fprintf(conn, "+FULLRESYNC %s %d\r\n", replid, offset); err != nil {
+			info.dropReplica(r)
+			return nil, err
+		}
+	}
+	go info.sendRDBToReplica(r, snapshot)
+	return r, nil
+}
+
+// partialResync attaches r and sends it the backlog from the requested
+// offset when the requested history is ours, current or secondary, and the
+// offset is still in the backlog. PSYNC offsets count from 1.
+func (info *ServerInfo) partialResync(r *replica, replid, offsetArg string) (bool, error) {
+	psyncOffset, err := strconv.ParseInt(offsetArg, 10, 64)
+	if err != nil {
+		return false, nil
+	}
+
+	info.writeMu.Lock()
+	info.repl.mu.Lock()
+	current := info.repl.replID()
+	if info.repl.backlog == nil ||
+		(replid != current && (replid != info.repl.replid2 || psyncOffset > info.repl.secondOffset)) {
+		info.repl.mu.Unlock()
+		info.writeMu.Unlock()
+		return false, nil
+	}
+	data, ok := info.repl.backlog.readFrom(psyncOffset - 1)
+	if !ok {
+		info.repl.mu.Unlock()
+		info.writeMu.Unlock()
+		return false, nil
+	}
+	r.state = replicaStateOnline
+	r.ackTime = time.Now()
+	r.pending = data
+	info.repl.replicas = append(info.repl.replicas, r)
+	info.repl.mu.Unlock()
+	info.writeMu.Unlock()
+
+	reply := "+CONTINUE\r\n"
+	if slices.Contains(r.capa, "psync2") {
+		reply = "+CONTINUE " + current + "\r\n"
+	}
+	if _, err := io.WriteString(r.conn, reply); err != nil {
+		info.dropReplica(r)
+		return false, err
+	}
+	fmt.Printf("Partial resynchronization request from %s accepted, sending %d bytes of backlog\n", r.addr, len(data))
+	go info.writeToReplica(r)
+	return true, nil
+}
+
+// sendRDBToReplica writes snapshot to a temporary RDB file and transfers it
+// as "$<length>\r\n<payload>", then lets the queued stream flow.
+func (info *ServerInfo) sendRDBToReplica(r *replica, snapshot map[string]store.Data) {
+	path := filepath.Join(info.Dir, fmt.Sprintf("temp-repl-%d-%p.rdb", os.Getpid(), r))
+	err := rdb.SaveFile(path, snapshot, map[string]string{"repl-stream-db": "0"})
+	if err == nil {
+		defer os.Remove(path)
+		r.setState(replicaStateSendBulk)
+		err = sendFile(r.conn, path)
+	}
+	if err != nil {
+		fmt.Printf("Full resynchronization of replica %s failed: %v\n", r.addr, err)
+		info.dropReplica(r)
+		return
+	}
+	fmt.Printf("Synchronization with replica %s succeeded\n", r.addr)
+	r.mu.Lock()
+	r.state = replicaStateOnline
+	r.ackTime = time.Now()
+	r.mu.Unlock()
+	go info.writeToReplica(r)
+}
+
+func sendFile(conn net.Conn, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "$%d\r\n", stat.Size())
+	if _, err := io.Copy(w, f); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// writeToReplica sends the queued stream to r until it is dropped.
+func (info *ServerInfo) writeToReplica(r *replica) {
+	r.mu.Lock()
+	for {
+		for len(r.pending) == 0 && !r.closed {
+			r.cond.Wait()
+		}
+		if r.closed {
+			r.mu.Unlock()
+			return
+		}
+		data := r.pending
+		r.pending = nil
+		r.mu.Unlock()
+		if _, err := r.conn.Write(data); err != nil {
+			info.dropReplica(r)
+			return
+		}
+		r.mu.Lock()
+	}
+}
+
+// queue adds data to the stream pending for r. Replicas that fall too far
+// behind are disconnected; they will resynchronize.
+func (r *replica) queue(data []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return true
+	}
+	if len(r.pending)+len(data) > replicaOutputLimit {
+		return false
+	}
+	r.pending = append(r.pending, data...)
+	r.cond.Signal()
+	return true
+}
+
+func (r *replica) setState(state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state = state
+}
+
+// dropReplica detaches r and closes its connection.
+func (info *ServerInfo) dropReplica(r *replica) {
+	info.repl.mu.Lock()
+	for i, other := range info.repl.replicas {
+		if other == r {
+			info.repl.replicas = append(info.repl.replicas[:i], info.repl.replicas[i+1:]...)
+			break
+		}
+	}
+	info.repl.mu.Unlock()
+
+	r.mu.Lock()
+	wasClosed := r.closed
+	r.closed = true
+	r.cond.Broadcast()
+	r.mu.Unlock()
+	r.conn.Close()
+	if !wasClosed {
+		fmt.Printf("Connection with replica %s lost\n", r.addr)
+	}
+}
+
+// disconnectReplicas drops every replica, so that they reconnect and learn
+// about a change in the history they follow.
+func (info *ServerInfo) disconnectReplicas() {
+	info.repl.mu.Lock()
+	replicas := slices.Clone(info.repl.replicas)
+	info.repl.mu.Unlock()
+	for _, r := range replicas {
+		info.dropReplica(r)
+	}
+}
+
+// feedReplicas adds cmds to the replication stream. The caller holds
+// writeMu, so the stream follows the apply order.
+func (info *ServerInfo) feedReplicas(cmds [][]resp.Value) {
+	var data []byte
+	for _, cmd := range cmds {
+		data = append(data, resp.Marshal(resp.Value{Type: "array", Array: cmd})...)
+	}
+	info.feedReplicationStream(data)
+}
+
+// feedReplicationStream appends data to the backlog and to the stream of
+// every replica. Nothing is recorded while there is no backlog, i.e. before
+// the first replica attached. The caller holds writeMu.
+func (info *ServerInfo) feedReplicationStream(data []byte) {
+	info.repl.mu.Lock()
+	if info.repl.backlog == nil {
+		info.repl.mu.Unlock()
+		return
+	}
+	info.repl.backlog.write(data)
+	info.repl.offset += int64(len(data))
+	var lagging []*replica
+	for _, r := range info.repl.replicas {
+		if !r.queue(data) {
+			lagging = append(lagging, r)
+		}
+	}
+	info.repl.mu.Unlock()
+
+	for _, r := range lagging {
+		fmt.Printf("Replica %s exceeded the output buffer limit\n", r.addr)
+		info.dropReplica(r)
+	}
+}
+
+// waitForReplicas implements WAIT numreplicas timeout: it blocks until
+// numreplicas replicas acknowledged offset, or the timeout in milliseconds
+// (0 for none) expires, and returns how many did.
+func (info *ServerInfo) waitForReplicas(args []resp.Value, offset int64) resp.Value {
+	if len(args) != 2 {
+		return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'wait' command"}
+	}
+	if info.role() != "master" {
+		return resp.Value{Type: "error", Str: "ERR WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated."}
+	}
+	numReplicas, err := strconv.Atoi(args[0].Bulk)
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	timeout, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR timeout is not an integer or out of range"}
+	}
+	if timeout < 0 {
+		return resp.Value{Type: "error", Str: "ERR timeout is negative"}
+	}
+
+	acked := info.replicasAcked(offset)
+	if acked >= numReplicas {
+		return resp.Value{Type: "integer", Num: acked}
+	}
+	// Ask for fresh acknowledgements rather than waiting for the periodic ones.
+	info.writeMu.Lock()
+	info.feedReplicas([][]resp.Value{resp.Command("REPLCONF", "GETACK", "*").Array})
+	info.writeMu.Unlock()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(time.Duration(timeout) * time.Millisecond)
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for acked < numReplicas {
+		select {
+		case <-deadline:
+			return resp.Value{Type: "integer", Num: acked}
+		case <-ticker.C:
+			acked = info.replicasAcked(offset)
+		}
+	}
+	return resp.Value{Type: "integer", Num: acked}
+}
+
+// replicasAcked counts the replicas that acknowledged offset.
+func (info *ServerInfo) replicasAcked(offset int64) int {
+	info.repl.mu.Lock()
+	defer info.repl.mu.Unlock()
+	acked := 0
+	for _, r := range info.repl.replicas {
+		r.mu.Lock()
+		if r.state == replicaStateOnline && r.ackOffset >= offset {
+			acked++
+		}
+		r.mu.Unlock()
+	}
+	return acked
+}
+
+// goodReplicas counts the online replicas that acknowledged within
+// min-replicas-max-lag. Must be called with info.repl.mu held.
+func (info *ServerInfo) goodReplicas() int {
+	good := 0
+	for _, r := range info.repl.replicas {
+		r.mu.Lock()
+		if r.state == replicaStateOnline && time.Since(r.ackTime) <= info.MinReplicasMaxLag {
+			good++
+		}
+		r.mu.Unlock()
+	}
+	return good
+}
+
+// enoughGoodReplicas reports whether a master may accept writes under
+// min-replicas-to-write, which is off when either option is 0.
+func (info *ServerInfo) enoughGoodReplicas() bool {
+	if info.MinReplicasToWrite <= 0 || info.MinReplicasMaxLag <= 0 || info.role() != "master" {
+		return true
+	}
+	info.repl.mu.Lock()
+	defer info.repl.mu.Unlock()
+	return info.goodReplicas() >= info.MinReplicasToWrite
+}
+
+// replOffset returns master_repl_offset.
+func (info *ServerInfo) replOffset() int64 {
+	info.repl.mu.Lock()
+	defer info.repl.mu.Unlock()
+	return info.repl.offset
+}
+
+// replicationCron pings the replicas every replPingPeriod, frees the
+// backlog of a master that had no replicas for repl-backlog-ttl and, on
+// replicas, acknowledges the processed offset to the master. Replicas of a
+// replica get the pings of the master in the forwarded stream instead.
+func (info *ServerInfo) replicationCron() {
+	info.mu.Lock()
+	role, link := info.Role, info.link
+	info.mu.Unlock()
+	if link != nil {
+		info.sendAck(link)
+	}
+
+	info.repl.mu.Lock()
+	due := role == "master" && len(info.repl.replicas) > 0 && time.Since(info.repl.lastPing) >= replPingPeriod
+	if due {
+		info.repl.lastPing = time.Now()
+	}
+	if len(info.repl.replicas) > 0 {
+		info.repl.noReplicasSince = time.Time{}
+	} else if info.repl.noReplicasSince.IsZero() {
+		info.repl.noReplicasSince = time.Now()
+	}
+	if role == "master" && info.repl.backlog != nil && info.ReplBacklogTTL > 0 &&
+		!info.repl.noReplicasSince.IsZero() && time.Since(info.repl.noReplicasSince) >= info.ReplBacklogTTL {
+		// Without the backlog, the history can't be continued: start a new one.
+		info.repl.backlog = nil
+		info.repl.replid = newReplID()
+		info.repl.clearReplID2()
+		fmt.Printf("Replication backlog freed after %d seconds without connected replicas\n", int(info.ReplBacklogTTL.Seconds()))
+	}
+	info.repl.mu.Unlock()
+	if due {
+		info.writeMu.Lock()
+		info.feedReplicas([][]resp.Value{resp.Command("PING").Array})
+		info.writeMu.Unlock()
+	}
+}
+
+// replicaInfo returns the "slave<n>:" lines of INFO replication.
+func (info *ServerInfo) replicaInfo() []string {
+	info.repl.mu.Lock()
+	defer info.repl.mu.Unlock()
+	lines := []string{fmt.Sprintf("connected_slaves:%d", len(info.repl.replicas))}
+	if info.MinReplicasToWrite > 0 && info.MinReplicasMaxLag > 0 {
+		lines = append(lines, fmt.Sprintf("min_slaves_good_slaves:%d", info.goodReplicas()))
+	}
+	for i, r := range info.repl.replicas {
+		host, port, _ := net.SplitHostPort(r.addr)
+		r.mu.Lock()
+		lag := int64(0)
+		if !r.ackTime.IsZero() {
+			lag = int64(time.Since(r.ackTime).Seconds())
+		}
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%s,state=%s,offset=%d,lag=%d", i, host, port, r.state, r.ackOffset, lag))
+		r.mu.Unlock()
+	}
+	return lines
+}
+
+// backlogInfo returns the master_repl_* and repl_backlog_* lines of INFO replication.
+func (info *ServerInfo) backlogInfo() []string {
+	info.repl.mu.Lock()
+	defer info.repl.mu.Unlock()
+	if info.repl.replid2 == "" {
+		info.repl.clearReplID2()
+	}
+	lines := []string{
+		"master_replid:" + info.repl.replID(),
+		"master_replid2:" + info.repl.replid2,
+		fmt.Sprintf("master_repl_offset:%d", info.repl.offset),
+		fmt.Sprintf("second_repl_offset:%d", info.repl.secondOffset),
+	}
+	if b := info.repl.backlog; b != nil {
+		return append(lines,
+			"repl_backlog_active:1",
+			fmt.Sprintf("repl_backlog_size:%d", len(b.buf)),
+			fmt.Sprintf("repl_backlog_first_byte_offset:%d", b.offset+1),
+			fmt.Sprintf("repl_backlog_histlen:%d", b.histlen),
+		)
+	}
+	return append(lines,
+		"repl_backlog_active:0",
+		fmt.Sprintf("repl_backlog_size:%d", info.replBacklogSize()),
+		"repl_backlog_first_byte_offset:0",
+		"repl_backlog_histlen:0",
+	)
+}
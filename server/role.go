@@ -0,0 +1,160 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/saurabhdhingra/go-redis/resp"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+// Errors returned to clients of a replica.
+const (
+	errReadOnly   = "READONLY You can't write against a read only replica."
+	errMasterDown = "MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'."
+)
+
+// role returns "master" or "slave". REPLICAOF changes it at runtime, so it is
+// read under mu.
+func (info *ServerInfo) role() string {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.Role
+}
+
+// rejectCommand returns the error a replica answers instead of running
+// command, if any.
+func (info *ServerInfo) rejectCommand(command string) string {
+	if msg := info.activeRejects(command); msg != "" {
+		return msg
+	}
+	info.mu.Lock()
+	role, link := info.Role, info.link
+	info.mu.Unlock()
+	if role != "slave" {
+		return ""
+	}
+	if commandFlag(command, flagWrite) && info.ReplicaReadOnly {
+		return errReadOnly
+	}
+	if !info.ReplicaServeStaleData && !commandFlag(command, flagStale) && (link == nil || !link.connected()) {
+		return errMasterDown
+	}
+	return ""
+}
+
+// replicaofCommand implements REPLICAOF host port and REPLICAOF NO ONE.
+func (info *ServerInfo) replicaofCommand(kv *store.KeyValueStore, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'replicaof' command"}
+	}
+	if info.cluster != nil {
+		return resp.Value{Type: "error", Str: "ERR REPLICAOF not allowed in cluster mode."}
+	}
+	if strings.EqualFold(args[0].Bulk, "no") && strings.EqualFold(args[1].Bulk, "one") {
+		info.writeMu.Lock()
+		defer info.writeMu.Unlock()
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		if info.Role == "master" {
+			return resp.Value{Type: "string", Str: "OK"}
+		}
+		info.promote()
+		fmt.Println("MASTER MODE enabled (user request)")
+		return resp.Value{Type: "string", Str: "OK"}
+	}
+
+	port, err := strconv.Atoi(args[1].Bulk)
+	if err != nil || port < 0 || port > 65535 {
+		return resp.Value{Type: "error", Str: "ERR Invalid master port"}
+	}
+	addr := net.JoinHostPort(args[0].Bulk, args[1].Bulk)
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if info.Role == "slave" && info.link != nil && info.link.addr == addr {
+		return resp.Value{Type: "string", Str: "OK Already connected to specified master"}
+	}
+	info.demote(kv, newMasterLink(addr))
+	fmt.Printf("REPLICAOF %s enabled (user request)\n", addr)
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+// promote turns a replica into a master. The history received so far is kept
+// as the secondary replication ID, so the other replicas of the old master
+// can continue from it. Must be called with writeMu and mu held.
+func (info *ServerInfo) promote() {
+	if info.link != nil {
+		info.link.stop()
+		info.link = nil
+	}
+	info.Role = "master"
+	info.MasterAddr = ""
+	info.repl.mu.Lock()
+	info.repl.shiftReplID(newReplID())
+	info.repl.mu.Unlock()
+	// Let the replicas reconnect to learn about the new ID.
+	info.disconnectReplicas()
+}
+
+// demote makes this server a replica of the master link connects to. The
+// current history is kept, so the new master can continue it when it shares
+// it. Must be called with mu held.
+func (info *ServerInfo) demote(kv *store.KeyValueStore, link *masterLink) {
+	info.Role = "slave"
+	info.MasterAddr = link.addr
+	info.repl.mu.Lock()
+	if info.repl.backlog == nil {
+		info.repl.backlog = newReplBacklog(info.replBacklogSize(), info.repl.offset)
+	}
+	info.repl.mu.Unlock()
+	// Our replicas resynchronize with the history we get from the new master.
+	info.disconnectReplicas()
+	info.startReplication(kv, link)
+}
+
+// roleCommand implements ROLE.
+func (info *ServerInfo) roleCommand() resp.Value {
+	info.mu.Lock()
+	role, link := info.Role, info.link
+	info.mu.Unlock()
+	offset := info.replOffset()
+
+	if role == "slave" && link != nil {
+		link.mu.Lock()
+		host, port, _ := net.SplitHostPort(link.addr)
+		state := link.state
+		link.mu.Unlock()
+		portNum, _ := strconv.Atoi(port)
+		return resp.Value{Type: "array", Array: []resp.Value{
+			{Type: "bulk", Bulk: "slave"},
+			{Type: "bulk", Bulk: host},
+			{Type: "integer", Num: portNum},
+			{Type: "bulk", Bulk: state},
+			{Type: "integer", Num: int(offset)},
+		}}
+	}
+
+	info.repl.mu.Lock()
+	replicas := []resp.Value{}
+	for _, r := range info.repl.replicas {
+		host, port, _ := net.SplitHostPort(r.addr)
+		r.mu.Lock()
+		ack := r.ackOffset
+		r.mu.Unlock()
+		replicas = append(replicas, resp.Command(host, port, strconv.FormatInt(ack, 10)))
+	}
+	info.repl.mu.Unlock()
+	return resp.Value{Type: "array", Array: []resp.Value{
+		{Type: "bulk", Bulk: "master"},
+		{Type: "integer", Num: int(offset)},
+		{Type: "array", Array: replicas},
+	}}
+}
+
+func (link *masterLink) connected() bool {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	return link.state == replStateConnected
+}
@@ -6,16 +6,126 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/saurabhdhingra/go-redis/raft"
 	"github.com/saurabhdhingra/go-redis/resp"
 	"github.com/saurabhdhingra/go-redis/store"
 )
 
-// Add a wrapper to pass role and masterAddr to each connection
+// Add a wrapper to pass role and masterAddr to each connection. Role and
+// MasterAddr are the startup configuration; REPLICAOF changes them under mu.
 type ServerInfo struct {
 	Role       string
 	MasterAddr string
+	Port       int
+
+	// ReplBacklogSize is the size of the replication backlog in bytes; a
+	// master frees it after ReplBacklogTTL without replicas (0 never does).
+	ReplBacklogSize int
+	ReplBacklogTTL  time.Duration
+
+	// ReplDisklessSync streams full synchronizations to the replicas without
+	// an RDB file, waiting ReplDisklessSyncDelay for more replicas to share
+	// it. ReplDisklessLoad is how replicas load what they receive.
+	ReplDisklessSync      bool
+	ReplDisklessSyncDelay time.Duration
+	ReplDisklessLoad      string
+
+	// ReplicaPriority ranks replicas for promotion, lower first; 0 never
+	// promotes. The announce options replace the address a replica's master
+	// reports for it, e.g. behind NAT.
+	ReplicaPriority     int
+	ReplicaAnnounceIP   string
+	ReplicaAnnouncePort int
+
+	// A master refuses writes unless MinReplicasToWrite replicas acknowledged
+	// within MinReplicasMaxLag; either set to 0 disables the check.
+	MinReplicasToWrite int
+	MinReplicasMaxLag  time.Duration
+
+	// ReplicaReadOnly rejects client writes on replicas; without
+	// ReplicaServeStaleData a replica whose link is down refuses most commands.
+	ReplicaReadOnly       bool
+	ReplicaServeStaleData bool
+	Dir                   string
+	DBFilename            string
+
+	// SaveParams trigger automatic background saves; a failed one blocks
+	// writes when StopWritesOnBgsaveError is set.
+	SaveParams              []SaveParam
+	StopWritesOnBgsaveError bool
+
+	AppendOnly        bool
+	AppendDirName     string
+	AppendFilename    string
+	AppendFsync       string
+	AOFLoadTruncated  bool
+	AOFUseRDBPreamble bool
+
+	// AOFTimestampEnabled annotates the AOF with the time of the writes; the
+	// truncate options roll the AOF back at startup (0 disables them).
+	AOFTimestampEnabled    bool
+	AOFTruncateToTimestamp int64
+	AOFTruncateToOffset    int64
+
+	// ClusterEnabled runs the server as a Redis Cluster node, whose view of
+	// the cluster is kept in ClusterConfigFile inside Dir. Nodes that don't
+	// answer for ClusterNodeTimeout are failing; without
+	// ClusterRequireFullCoverage the slots still served are available.
+	ClusterEnabled             bool
+	ClusterConfigFile          string
+	ClusterNodeTimeout         time.Duration
+	ClusterRequireFullCoverage bool
+
+	// RaftEnabled replicates the writes through a Raft log kept in Dir; the
+	// other nodes reach this one at RaftAddr. A follower that doesn't hear
+	// from the leader for RaftElectionTimeout starts an election, leaders
+	// send heartbeats every RaftHeartbeatInterval, and the log is compacted
+	// every RaftSnapshotEntries entries.
+	RaftEnabled           bool
+	RaftAddr              string
+	RaftElectionTimeout   time.Duration
+	RaftHeartbeatInterval time.Duration
+	RaftSnapshotEntries   int
+
+	// ActiveActive takes writes on this master and on ActivePeers alike,
+	// merging them as CRDTs.
+	ActiveActive bool
+	ActivePeers  []string
+
+	// NotifyKeyspaceEvents selects the keyspace events published, see
+	// ParseKeyspaceEvents.
+	NotifyKeyspaceEvents int
+
+	loading atomic.Bool
+
+	// writeMu serializes writes so they are logged in the order they were
+	// applied. writesPaused, guarded by it, is closed when a failover that
+	// paused the writes ends.
+	writeMu      sync.Mutex
+	writesPaused chan struct{}
+	// aof is set once the dataset is loaded, while clients are served.
+	aof atomic.Pointer[appendOnlyFile]
+
+	mu                 sync.Mutex
+	bgsaveInProgress   bool
+	bgsaveStart        time.Time
+	lastBgsaveTry      time.Time
+	lastBgsaveDuration time.Duration
+	lastBgsaveErr      error
+	lastSave           time.Time
+	rdbSaves           int64
+
+	link     *masterLink // set on replicas
+	repl     replication
+	failover *failover
+	pubsub   pubsub
+	cluster  *clusterState // set in cluster mode
+	raft     *raft.Node    // set in raft mode
+	active   *activeState  // set in active-active mode
 }
 
 func HandleConnectionWithRole(conn net.Conn, store *store.KeyValueStore, role, masterAddr string) {
@@ -27,10 +137,31 @@ func HandleConnectionWithInfo(conn net.Conn, store *store.KeyValueStore, info *S
 	defer conn.Close()
 
 	respReader := resp.NewResp(conn)
+	out := newClientWriter(conn)
+	defer out.close()
+
+	// Pub/Sub messages are queued by the publishers
+	sub := &subscriber{out: out}
+	defer info.pubsub.drop(sub)
 
 	// Transaction state per connection
 	inTransaction := false
 	var queuedCommands [][]resp.Value
+	// In cluster mode, the slot of the transaction's keys; a redirection
+	// while queuing aborts EXEC.
+	txSlot := -1
+	txAborted := false
+	// Set by ASKING for the next command only
+	asking := false
+
+	// Set once the connection turned into a replica with PSYNC
+	var handshake replicaHandshake
+	var asReplica *replica
+	// Set once the connection turned into the stream of an active-active peer
+	var asActive *activeLink
+
+	// Replication offset after this connection's last write, for WAIT
+	var lastWriteOffset int64
 
 	for {
 		value, err := respReader.Read()
@@ -46,396 +177,613 @@ func HandleConnectionWithInfo(conn net.Conn, store *store.KeyValueStore, info *S
 
 		if value.Type == "array" && len(value.Array) > 0 {
 			command := strings.ToUpper(value.Array[0].Bulk)
-			args := value.Array[1:]
 
-			// Transaction handling
-			if inTransaction && command != "EXEC" && command != "DISCARD" && command != "MULTI" {
-				// Queue the command
-				queuedCommands = append(queuedCommands, value.Array)
-				resp.Respond(conn, resp.Value{Type: "string", Str: "QUEUED"})
+			// Replicas only send acknowledgements; nothing is replied to them.
+			if asReplica != nil {
+				if command == "REPLCONF" {
+					info.replconf(&handshake, asReplica, value.Array[1:])
+				}
 				continue
 			}
-
-			switch command {
-			case "INFO":
-				// Compose info string
-				infoLines := []string{
-					"role:" + info.Role,
-				}
-				if info.Role == "master" {
-					infoLines = append(infoLines, "connected_slaves:0")
-					infoLines = append(infoLines, "master_replid:0000000000000000000000000000000000000000")
-					infoLines = append(infoLines, "master_repl_offset:0")
-				} else {
-					infoLines = append(infoLines, "master_host:"+info.MasterAddr)
-					infoLines = append(infoLines, "master_link_status:up")
+			if asActive != nil {
+				if command == "ACTIVE" {
+					asActive.ack(value.Array[1:])
 				}
-				resp.Respond(conn, resp.Value{Type: "bulk", Bulk: strings.Join(infoLines, "\r\n")})
 				continue
-			case "PING":
-				resp.Respond(conn, resp.Value{Type: "string", Str: "PONG"})
-			case "ECHO":
-				if len(args) > 0 {
-					resp.Respond(conn, resp.Value{Type: "bulk", Bulk: args[0].Bulk})
-				} else {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR wrong number of arguements for 'echo' command"})
-				}
-			case "SET":
-				if len(args) < 2 {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR wrong number of arguements for 'set' command"})
-					continue
-				}
-				key := args[0].Bulk
-				val := args[1].Bulk
-				expiration := time.Time{}
-
-				for i := 2; i < len(args); i++ {
-					option := strings.ToUpper(args[i].Bulk)
-					switch option {
-					case "EX":
-						if i+1 >= len(args) {
-							resp.Respond(conn, resp.Value{Type: "error", Str: "ERR syntax error"})
-							goto nextCommand
-						}
-						seconds, err := strconv.Atoi(args[i+1].Bulk)
-						if err != nil || seconds <= 0 {
-							resp.Respond(conn, resp.Value{Type: "error", Str: "ERR invalid expire time in 'set' command"})
-							goto nextCommand
-						}
-						expiration = time.Now().Add(time.Duration(seconds) * time.Second)
-						i++
-					case "PX":
-						if i+1 >= len(args) {
-							resp.Respond(conn, resp.Value{Type: "error", Str: "ERR syntax error"})
-						}
-						milliseconds, err := strconv.Atoi(args[i+1].Bulk)
-						if err != nil || milliseconds <= 0 {
-							resp.Respond(conn, resp.Value{Type: "error", Str: "ERR invalid expire time in 'set' command"})
-							goto nextCommand
-						}
-						expiration = time.Now().Add(time.Duration(milliseconds) * time.Millisecond)
-						i++
-					default:
-						resp.Respond(conn, resp.Value{Type: "error", Str: "ERR syntax error"})
-						goto nextCommand
-					}
-				}
-				store.SET(key, val, expiration)
-				resp.Respond(conn, resp.Value{Type: "string", Str: "OK"})
-			nextCommand:
+			}
+
+			// A subscribed connection only manages its subscriptions.
+			if !commandFlag(command, flagPubSub) && info.pubsub.subscribed(sub) {
+				out.reply(resp.Value{Type: "error", Str: "ERR Can't execute '" + strings.ToLower(command) +
+					"': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context"})
 				continue
+			}
 
-			case "GET":
-				if len(args) < 1 {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'get' command"})
-					continue
-				}
-				key := args[0].Bulk
-				val, found := store.GET(key)
-				if found {
-					resp.Respond(conn, resp.Value{Type: "bulk", Bulk: val})
-				} else {
-					resp.Respond(conn, resp.Value{Type: "nil"})
-				}
-			case "LPUSH":
-				if len(args) < 2 {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'lpush' command"})
+			if command == "ASKING" {
+				if info.cluster == nil {
+					out.reply(resp.Value{Type: "error", Str: "ERR This instance has cluster support disabled"})
 					continue
 				}
-				key := args[0].Bulk
-				elements := make([]string, len(args)-1)
-				for i := 1; i < len(args); i++ {
-					elements[i-1] = args[i].Bulk
-				}
-				newLen, err := store.LPUSH(key, elements)
-				if err != nil {
-					resp.Respond(conn, resp.Value{Type: "error", Str: err.Error()})
-				} else {
-					resp.Respond(conn, resp.Value{Type: "integer", Num: newLen})
-				}
-			case "LRANGE":
-				if len(args) != 3 {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'lrange' command"})
-					continue
-				}
-				key := args[0].Bulk
-				start, err := strconv.Atoi(args[1].Bulk)
-				if err != nil {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"})
-					continue
-				}
-				end, err := strconv.Atoi(args[2].Bulk)
-				if err != nil {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"})
-					continue
-				}
-				list, err := store.LRANGE(key, start, end)
-				if err != nil {
-					resp.Respond(conn, resp.Value{Type: "error", Str: err.Error()})
-					continue
-				}
-				respValues := make([]resp.Value, len(list))
-				for i, item := range list {
-					respValues[i] = resp.Value{Type: "bulk", Bulk: item}
-				}
-				resp.Respond(conn, resp.Value{Type: "array", Array: respValues})
-			case "LLEN":
-				if len(args) != 1 {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'llen' command"})
-					continue
-				}
-				key := args[0].Bulk
-				length, err := store.LLEN(key)
-				if err != nil {
-					resp.Respond(conn, resp.Value{Type: "error", Str: err.Error()})
-					continue
-				}
-				resp.Respond(conn, resp.Value{Type: "integer", Num: length})
-			case "LPOP":
-				if len(args) != 1 {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'lpop' command"})
-					continue
-				}
-				key := args[0].Bulk
-				element, found, err := store.LPOP(key)
-				if err != nil {
-					resp.Respond(conn, resp.Value{Type: "error", Str: err.Error()})
-					continue
-				}
-				if found {
-					resp.Respond(conn, resp.Value{Type: "bulk", Bulk: element})
-				} else {
-					resp.Respond(conn, resp.Value{Type: "nil"})
-				}
-			case "BLPOP":
-				if len(args) < 2 {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'blpop' command"})
+				asking = true
+				out.reply(resp.Value{Type: "string", Str: "OK"})
+				continue
+			}
+			wasAsking := asking
+			asking = false
+			// Other commands are checked as they run, see clusterCall.
+			if inTransaction {
+				if msg := info.clusterRedirect(store, value.Array, &txSlot, wasAsking); msg != "" {
+					txAborted = true
+					out.reply(resp.Value{Type: "error", Str: msg})
 					continue
 				}
-				keys := make([]string, len(args)-1)
-				for i := 0; i < len(args)-1; i++ {
-					keys[i] = args[i].Bulk
-				}
-				timeoutStr := args[len(args)-1].Bulk
-				timeoutSeconds, err := strconv.Atoi(timeoutStr)
-				if err != nil || timeoutSeconds < 0 {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR timeout must be a non-negative integer"})
+			}
+
+			// Transaction handling
+			if inTransaction && command != "EXEC" && command != "DISCARD" && command != "MULTI" {
+				// Queue the command
+				queuedCommands = append(queuedCommands, value.Array)
+				out.reply(resp.Value{Type: "string", Str: "QUEUED"})
+				continue
+			}
+
+			if info.loading.Load() && !commandFlag(command, flagLoading) {
+				out.reply(resp.Value{Type: "error", Str: "LOADING Redis is loading the dataset in memory"})
+				continue
+			}
+
+			switch command {
+			case "MULTI":
+				if inTransaction {
+					out.reply(resp.Value{Type: "error", Str: "ERR MULTI calls can not be nested"})
 					continue
 				}
-				timeout := time.Duration(timeoutSeconds) * time.Second
-				result, poppedKey, err := store.BLPOP(keys, timeout)
-				if err != nil {
-					resp.Respond(conn, resp.Value{Type: "error", Str: err.Error()})
+				inTransaction = true
+				queuedCommands = nil
+				txSlot, txAborted = -1, false
+				out.reply(resp.Value{Type: "string", Str: "OK"})
+
+			case "EXEC":
+				if !inTransaction {
+					out.reply(resp.Value{Type: "error", Str: "ERR EXEC without MULTI"})
 					continue
 				}
-				if result != nil {
-					resp.Respond(conn, resp.Value{Type: "array", Array: []resp.Value{{Type: "bulk", Bulk: poppedKey}, {Type: "bulk", Bulk: result[1]}}})
-				} else {
-					resp.Respond(conn, resp.Value{Type: "nil"})
-				}
-			case "TYPE":
-				if len(args) != 1 {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'type' command"})
+				if txAborted {
+					inTransaction = false
+					queuedCommands = nil
+					out.reply(resp.Value{Type: "error", Str: "EXECABORT Transaction discarded because of previous errors."})
 					continue
 				}
-				key := args[0].Bulk
-				typeStr := store.TYPE(key)
-				resp.Respond(conn, resp.Value{Type: "string", Str: typeStr})
+				reply := info.exec(store, queuedCommands)
+				lastWriteOffset = info.replOffset()
+				inTransaction = false
+				queuedCommands = nil
+				out.reply(reply)
 
-			case "XADD":
-				if len(args) < 3 || (len(args)-2)%2 != 0 {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'xadd' command"})
+			case "DISCARD":
+				if !inTransaction {
+					out.reply(resp.Value{Type: "error", Str: "ERR DISCARD without MULTI"})
 					continue
 				}
-				key := args[0].Bulk
-				id := args[1].Bulk
-				fields := make(map[string]string)
-				for i := 2; i < len(args); i += 2 {
-					fields[args[i].Bulk] = args[i+1].Bulk
-				}
-				newID, err := store.XADD(key, id, fields)
-				if err != nil {
-					resp.Respond(conn, resp.Value{Type: "error", Str: err.Error()})
-				} else {
-					resp.Respond(conn, resp.Value{Type: "bulk", Bulk: newID})
+				inTransaction = false
+				queuedCommands = nil
+				out.reply(resp.Value{Type: "string", Str: "OK"})
+			case "REPLCONF":
+				if reply := info.replconf(&handshake, nil, value.Array[1:]); reply.Type != "" {
+					out.reply(reply)
 				}
 
-			case "XRANGE":
-				if len(args) < 3 || len(args) > 5 {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'xrange' command"})
+			case "PSYNC", "SYNC":
+				if msg := info.activeRejects(command); msg != "" {
+					out.reply(resp.Value{Type: "error", Str: msg})
 					continue
 				}
-				key := args[0].Bulk
-				start := args[1].Bulk
-				end := args[2].Bulk
-				count := 0
-				if len(args) == 5 && strings.ToUpper(args[3].Bulk) == "COUNT" {
-					count, _ = strconv.Atoi(args[4].Bulk)
-				}
-				entries, err := store.XRANGE(key, start, end, count)
+				// The replication stream is written to conn directly.
+				out.flush()
+				r, err := info.syncReplica(store, conn, &handshake, command, value.Array[1:])
 				if err != nil {
-					resp.Respond(conn, resp.Value{Type: "error", Str: err.Error()})
+					return
+				}
+				asReplica = r
+				defer info.dropReplica(r)
+			case "ACTIVE":
+				out.flush()
+				l, reply := info.activeSync(store, conn, value.Array[1:])
+				if l == nil {
+					out.reply(reply)
 					continue
 				}
-				respEntries := make([]resp.Value, len(entries))
-				for i, entry := range entries {
-					fields := []resp.Value{{Type: "bulk", Bulk: entry.ID}}
-					for k, v := range entry.Fields {
-						fields = append(fields, resp.Value{Type: "bulk", Bulk: k})
-						fields = append(fields, resp.Value{Type: "bulk", Bulk: v})
-					}
-					respEntries[i] = resp.Value{Type: "array", Array: fields}
-				}
-				resp.Respond(conn, resp.Value{Type: "array", Array: respEntries})
-
-			case "XREAD":
-				// Example: XREAD COUNT 2 STREAMS mystream 0-0
-				count := 0
-				block := time.Duration(0)
-				var streamsIdx int
-				for i := 0; i < len(args); i++ {
-					if strings.ToUpper(args[i].Bulk) == "COUNT" && i+1 < len(args) {
-						count, _ = strconv.Atoi(args[i+1].Bulk)
-						i++
-					} else if strings.ToUpper(args[i].Bulk) == "BLOCK" && i+1 < len(args) {
-						ms, _ := strconv.Atoi(args[i+1].Bulk)
-						block = time.Duration(ms) * time.Millisecond
-						i++
-					} else if strings.ToUpper(args[i].Bulk) == "STREAMS" {
-						streamsIdx = i
-						break
-					}
-				}
-				if streamsIdx == 0 || streamsIdx+1 >= len(args) {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR syntax error in 'xread' command"})
+				asActive = l
+				defer info.dropActiveLink(l)
+			case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE":
+				if len(value.Array) < 2 {
+					out.reply(resp.Value{Type: "error", Str: "ERR wrong number of arguments for '" + strings.ToLower(command) + "' command"})
 					continue
 				}
-				streamNames := []string{}
-				ids := []string{}
-				for i := streamsIdx + 1; i < len(args); i++ {
-					if i < streamsIdx+1+(len(args)-streamsIdx-1)/2 {
-						streamNames = append(streamNames, args[i].Bulk)
-					} else {
-						ids = append(ids, args[i].Bulk)
+				kind := subChannel
+				switch command {
+				case "PSUBSCRIBE":
+					kind = subPattern
+				case "SSUBSCRIBE":
+					kind = subShard
+					if msg := info.clusterRedirect(store, value.Array, nil, wasAsking); msg != "" {
+						out.reply(resp.Value{Type: "error", Str: msg})
+						continue
 					}
 				}
-				if len(streamNames) != len(ids) {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR number of streams and ids do not match in 'xread' command"})
-					continue
-				}
-				streamsMap := make(map[string]string)
-				for i := 0; i < len(streamNames); i++ {
-					streamsMap[streamNames[i]] = ids[i]
-				}
-				entriesMap, err := store.XREAD(streamsMap, count, block)
-				if err != nil {
-					resp.Respond(conn, resp.Value{Type: "error", Str: err.Error()})
+				info.pubsub.subscribe(sub, kind, value.Array[1:])
+			case "UNSUBSCRIBE":
+				info.pubsub.unsubscribe(sub, subChannel, value.Array[1:], true)
+			case "PUNSUBSCRIBE":
+				info.pubsub.unsubscribe(sub, subPattern, value.Array[1:], true)
+			case "SUNSUBSCRIBE":
+				if msg := info.clusterRedirect(store, value.Array, nil, wasAsking); msg != "" {
+					out.reply(resp.Value{Type: "error", Str: msg})
 					continue
 				}
-				respStreams := []resp.Value{}
-				for stream, entries := range entriesMap {
-					respEntries := make([]resp.Value, len(entries))
-					for i, entry := range entries {
-						fields := []resp.Value{{Type: "bulk", Bulk: entry.ID}}
-						for k, v := range entry.Fields {
-							fields = append(fields, resp.Value{Type: "bulk", Bulk: k})
-							fields = append(fields, resp.Value{Type: "bulk", Bulk: v})
-						}
-						respEntries[i] = resp.Value{Type: "array", Array: fields}
-					}
-					respStreams = append(respStreams, resp.Value{Type: "array", Array: []resp.Value{
-						{Type: "bulk", Bulk: stream},
-						{Type: "array", Array: respEntries},
-					}})
-				}
-				resp.Respond(conn, resp.Value{Type: "array", Array: respStreams})
-			case "INCR":
-				if len(args) != 1 {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'incr' command"})
+				info.pubsub.unsubscribe(sub, subShard, value.Array[1:], true)
+			case "PING":
+				if !info.pubsub.subscribed(sub) {
+					out.reply(info.clusterCall(store, value.Array, wasAsking))
 					continue
 				}
-				key := args[0].Bulk
-				val, found := store.GET(key)
-				if !found {
-					store.SET(key, "1", time.Time{})
-					resp.Respond(conn, resp.Value{Type: "integer", Num: 1})
+				// Subscribed connections get a message-like reply.
+				if len(value.Array) > 2 {
+					out.reply(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'ping' command"})
 					continue
 				}
-				intVal, err := strconv.Atoi(val)
-				if err != nil {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"})
-					continue
+				msg := ""
+				if len(value.Array) == 2 {
+					msg = value.Array[1].Bulk
 				}
-				intVal++
-				store.SET(key, strconv.Itoa(intVal), time.Time{})
-				resp.Respond(conn, resp.Value{Type: "integer", Num: intVal})
-
-			case "MULTI":
-				if inTransaction {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR MULTI calls can not be nested"})
-					continue
+				out.reply(resp.Command("pong", msg))
+			case "WAIT":
+				out.reply(info.waitForReplicas(value.Array[1:], lastWriteOffset))
+			default:
+				out.reply(info.clusterCall(store, value.Array, wasAsking))
+				if commandFlag(command, flagWrite) {
+					lastWriteOffset = info.replOffset()
 				}
-				inTransaction = true
-				queuedCommands = nil
-				resp.Respond(conn, resp.Value{Type: "string", Str: "OK"})
+			}
+		} else {
+			out.reply(resp.Value{Type: "error", Str: "ERR invalid command format"})
+		}
+	}
+}
 
-			case "EXEC":
-				if !inTransaction {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR EXEC without MULTI"})
-					continue
-				}
-				results := make([]resp.Value, len(queuedCommands))
-				for i, cmdArr := range queuedCommands {
-					if len(cmdArr) == 0 {
-						results[i] = resp.Value{Type: "error", Str: "ERR empty command in transaction"}
-						continue
-					}
-					cmd := strings.ToUpper(cmdArr[0].Bulk)
-					cmdArgs := cmdArr[1:]
-					// Simulate command execution (only for supported commands)
-					switch cmd {
-					case "INCR":
-						if len(cmdArgs) != 1 {
-							results[i] = resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'incr' command"}
-							continue
-						}
-						key := cmdArgs[0].Bulk
-						val, found := store.GET(key)
-						if !found {
-							store.SET(key, "1", time.Time{})
-							results[i] = resp.Value{Type: "integer", Num: 1}
-							continue
-						}
-						intVal, err := strconv.Atoi(val)
-						if err != nil {
-							results[i] = resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
-							continue
-						}
-						intVal++
-						store.SET(key, strconv.Itoa(intVal), time.Time{})
-						results[i] = resp.Value{Type: "integer", Num: intVal}
-					// Add more supported commands here as needed
-					default:
-						results[i] = resp.Value{Type: "error", Str: "ERR command not supported in transaction"}
-					}
-				}
-				inTransaction = false
-				queuedCommands = nil
-				resp.Respond(conn, resp.Value{Type: "array", Array: results})
+// executeCommand runs a single command against the store and returns its reply.
+func executeCommand(store *store.KeyValueStore, info *ServerInfo, command string, args []resp.Value) resp.Value {
+	switch command {
+	case "INFO":
+		return resp.Value{Type: "bulk", Bulk: info.infoString(store, args)}
+	case "SAVE":
+		if err := info.save(store); err != nil {
+			return resp.Value{Type: "error", Str: errorString(err)}
+		}
+		return resp.Value{Type: "string", Str: "OK"}
+	case "BGSAVE":
+		if err := info.bgsave(store); err != nil {
+			return resp.Value{Type: "error", Str: errorString(err)}
+		}
+		return resp.Value{Type: "string", Str: "Background saving started"}
+	case "BGREWRITEAOF":
+		if err := info.bgrewriteaof(store); err != nil {
+			return resp.Value{Type: "error", Str: errorString(err)}
+		}
+		return resp.Value{Type: "string", Str: "Background append only file rewriting started"}
+	case "LASTSAVE":
+		info.mu.Lock()
+		lastSave := info.lastSave.Unix()
+		info.mu.Unlock()
+		return resp.Value{Type: "integer", Num: int(lastSave)}
+	case "DUMP":
+		return dumpCommand(store, args)
+	case "RESTORE", "RESTORE-ASKING":
+		return restoreCommand(store, args)
+	case "MIGRATE":
+		return migrateCommand(store, args, info.cluster != nil)
+	case "SELECT":
+		// Only database 0 exists; accepting it keeps MIGRATE clients working.
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'select' command"}
+		}
+		if n, err := strconv.Atoi(args[0].Bulk); err != nil {
+			return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+		} else if n != 0 {
+			return resp.Value{Type: "error", Str: "ERR DB index is out of range"}
+		}
+		return resp.Value{Type: "string", Str: "OK"}
+	case "REPLICAOF", "SLAVEOF":
+		return info.replicaofCommand(store, args)
+	case "ROLE":
+		return info.roleCommand()
+	case "FAILOVER":
+		return info.failoverCommand(store, args)
+	case "CLUSTER":
+		return info.clusterCommand(store, args)
+	case "RAFT":
+		return info.raftCommand(args)
+	case "PUBLISH":
+		if len(args) != 2 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'publish' command"}
+		}
+		return resp.Value{Type: "integer", Num: info.pubsub.publish(args[0].Bulk, args[1].Bulk)}
+	case "SPUBLISH":
+		if len(args) != 2 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'spublish' command"}
+		}
+		return resp.Value{Type: "integer", Num: info.spublish(args[0].Bulk, args[1].Bulk)}
+	case "PUBSUB":
+		return info.pubsub.pubsubCommand(args)
+	case "PING":
+		return resp.Value{Type: "string", Str: "PONG"}
+	case "ECHO":
+		if len(args) > 0 {
+			return resp.Value{Type: "bulk", Bulk: args[0].Bulk}
+		} else {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguements for 'echo' command"}
+		}
+	case "SET":
+		if len(args) < 2 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguements for 'set' command"}
+		}
+		key := args[0].Bulk
+		val := args[1].Bulk
+		expiration := time.Time{}
 
-			case "DISCARD":
-				if !inTransaction {
-					resp.Respond(conn, resp.Value{Type: "error", Str: "ERR DISCARD without MULTI"})
-					continue
+		for i := 2; i < len(args); i++ {
+			option := strings.ToUpper(args[i].Bulk)
+			switch option {
+			case "EX":
+				if i+1 >= len(args) {
+					return resp.Value{Type: "error", Str: "ERR syntax error"}
+				}
+				seconds, err := strconv.Atoi(args[i+1].Bulk)
+				if err != nil || seconds <= 0 {
+					return resp.Value{Type: "error", Str: "ERR invalid expire time in 'set' command"}
+				}
+				expiration = time.Now().Add(time.Duration(seconds) * time.Second)
+				i++
+			case "PX":
+				if i+1 >= len(args) {
+					return resp.Value{Type: "error", Str: "ERR syntax error"}
+				}
+				milliseconds, err := strconv.Atoi(args[i+1].Bulk)
+				if err != nil || milliseconds <= 0 {
+					return resp.Value{Type: "error", Str: "ERR invalid expire time in 'set' command"}
+				}
+				expiration = time.Now().Add(time.Duration(milliseconds) * time.Millisecond)
+				i++
+			case "EXAT", "PXAT":
+				// Absolute expirations, used when writes are logged to the AOF
+				if i+1 >= len(args) {
+					return resp.Value{Type: "error", Str: "ERR syntax error"}
+				}
+				at, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+				if err != nil || at <= 0 {
+					return resp.Value{Type: "error", Str: "ERR invalid expire time in 'set' command"}
+				}
+				if option == "EXAT" {
+					expiration = time.Unix(at, 0)
+				} else {
+					expiration = time.UnixMilli(at)
 				}
-				inTransaction = false
-				queuedCommands = nil
-				resp.Respond(conn, resp.Value{Type: "string", Str: "OK"})
+				i++
 			default:
-				resp.Respond(conn, resp.Value{Type: "error", Str: "ERR unknown command '" + command + "'"})
+				return resp.Value{Type: "error", Str: "ERR syntax error"}
 			}
+		}
+		store.SET(key, val, expiration)
+		return resp.Value{Type: "string", Str: "OK"}
+
+	case "GET":
+		if len(args) < 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'get' command"}
+		}
+		key := args[0].Bulk
+		val, found := store.GET(key)
+		if found {
+			return resp.Value{Type: "bulk", Bulk: val}
+		} else {
+			return resp.Value{Type: "nil"}
+		}
+	case "LPUSH":
+		if len(args) < 2 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'lpush' command"}
+		}
+		key := args[0].Bulk
+		elements := make([]string, len(args)-1)
+		for i := 1; i < len(args); i++ {
+			elements[i-1] = args[i].Bulk
+		}
+		newLen, err := store.LPUSH(key, elements)
+		if err != nil {
+			return resp.Value{Type: "error", Str: err.Error()}
 		} else {
-			resp.Respond(conn, resp.Value{Type: "error", Str: "ERR invalid command format"})
+			return resp.Value{Type: "integer", Num: newLen}
+		}
+	case "LRANGE":
+		if len(args) != 3 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'lrange' command"}
+		}
+		key := args[0].Bulk
+		start, err := strconv.Atoi(args[1].Bulk)
+		if err != nil {
+			return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+		}
+		end, err := strconv.Atoi(args[2].Bulk)
+		if err != nil {
+			return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+		}
+		list, err := store.LRANGE(key, start, end)
+		if err != nil {
+			return resp.Value{Type: "error", Str: err.Error()}
+		}
+		respValues := make([]resp.Value, len(list))
+		for i, item := range list {
+			respValues[i] = resp.Value{Type: "bulk", Bulk: item}
+		}
+		return resp.Value{Type: "array", Array: respValues}
+	case "LLEN":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'llen' command"}
+		}
+		key := args[0].Bulk
+		length, err := store.LLEN(key)
+		if err != nil {
+			return resp.Value{Type: "error", Str: err.Error()}
+		}
+		return resp.Value{Type: "integer", Num: length}
+	case "LPOP":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'lpop' command"}
+		}
+		key := args[0].Bulk
+		element, found, err := store.LPOP(key)
+		if err != nil {
+			return resp.Value{Type: "error", Str: err.Error()}
+		}
+		if found {
+			return resp.Value{Type: "bulk", Bulk: element}
+		} else {
+			return resp.Value{Type: "nil"}
+		}
+	case "BLPOP":
+		if len(args) < 2 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'blpop' command"}
+		}
+		keys := make([]string, len(args)-1)
+		for i := 0; i < len(args)-1; i++ {
+			keys[i] = args[i].Bulk
+		}
+		timeoutStr := args[len(args)-1].Bulk
+		timeoutSeconds, err := strconv.Atoi(timeoutStr)
+		if err != nil || timeoutSeconds < 0 {
+			return resp.Value{Type: "error", Str: "ERR timeout must be a non-negative integer"}
 		}
+		timeout := time.Duration(timeoutSeconds) * time.Second
+		result, poppedKey, err := store.BLPOP(keys, timeout)
+		if err != nil {
+			return resp.Value{Type: "error", Str: err.Error()}
+		}
+		if result != nil {
+			return resp.Value{Type: "array", Array: []resp.Value{{Type: "bulk", Bulk: poppedKey}, {Type: "bulk", Bulk: result[0]}}}
+		} else {
+			return resp.Value{Type: "nil"}
+		}
+	case "DEL":
+		if len(args) < 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'del' command"}
+		}
+		keys := make([]string, len(args))
+		for i, arg := range args {
+			keys[i] = arg.Bulk
+		}
+		return resp.Value{Type: "integer", Num: store.DEL(keys)}
+	case "EXISTS":
+		if len(args) < 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'exists' command"}
+		}
+		keys := make([]string, len(args))
+		for i, arg := range args {
+			keys[i] = arg.Bulk
+		}
+		return resp.Value{Type: "integer", Num: store.EXISTS(keys)}
+	case "TYPE":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'type' command"}
+		}
+		key := args[0].Bulk
+		typeStr := store.TYPE(key)
+		return resp.Value{Type: "string", Str: typeStr}
+
+	case "XADD":
+		if len(args) < 3 || (len(args)-2)%2 != 0 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'xadd' command"}
+		}
+		key := args[0].Bulk
+		id := args[1].Bulk
+		fields := make(map[string]string)
+		for i := 2; i < len(args); i += 2 {
+			fields[args[i].Bulk] = args[i+1].Bulk
+		}
+		newID, err := store.XADD(key, id, fields)
+		if err != nil {
+			return resp.Value{Type: "error", Str: err.Error()}
+		} else {
+			return resp.Value{Type: "bulk", Bulk: newID}
+		}
+
+	case "XTRIM":
+		// XTRIM key MAXLEN [=|~] count; an approximate trim is done exactly.
+		if len(args) < 3 || len(args) > 4 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'xtrim' command"}
+		}
+		if !strings.EqualFold(args[1].Bulk, "MAXLEN") || (len(args) == 4 && args[2].Bulk != "=" && args[2].Bulk != "~") {
+			return resp.Value{Type: "error", Str: "ERR syntax error"}
+		}
+		maxLen, err := strconv.Atoi(args[len(args)-1].Bulk)
+		if err != nil || maxLen < 0 {
+			return resp.Value{Type: "error", Str: "ERR The MAXLEN argument must be >= 0."}
+		}
+		removed, err := store.XTRIM(args[0].Bulk, maxLen)
+		if err != nil {
+			return resp.Value{Type: "error", Str: err.Error()}
+		}
+		return resp.Value{Type: "integer", Num: removed}
+
+	case "XRANGE":
+		if len(args) < 3 || len(args) > 5 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'xrange' command"}
+		}
+		key := args[0].Bulk
+		start := args[1].Bulk
+		end := args[2].Bulk
+		count := 0
+		if len(args) == 5 && strings.ToUpper(args[3].Bulk) == "COUNT" {
+			count, _ = strconv.Atoi(args[4].Bulk)
+		}
+		entries, err := store.XRANGE(key, start, end, count)
+		if err != nil {
+			return resp.Value{Type: "error", Str: err.Error()}
+		}
+		respEntries := make([]resp.Value, len(entries))
+		for i, entry := range entries {
+			fields := []resp.Value{{Type: "bulk", Bulk: entry.ID}}
+			for k, v := range entry.Fields {
+				fields = append(fields, resp.Value{Type: "bulk", Bulk: k})
+				fields = append(fields, resp.Value{Type: "bulk", Bulk: v})
+			}
+			respEntries[i] = resp.Value{Type: "array", Array: fields}
+		}
+		return resp.Value{Type: "array", Array: respEntries}
+
+	case "XREAD":
+		// Example: XREAD COUNT 2 STREAMS mystream 0-0
+		count := 0
+		block := time.Duration(0)
+		var streamsIdx int
+		for i := 0; i < len(args); i++ {
+			if strings.ToUpper(args[i].Bulk) == "COUNT" && i+1 < len(args) {
+				count, _ = strconv.Atoi(args[i+1].Bulk)
+				i++
+			} else if strings.ToUpper(args[i].Bulk) == "BLOCK" && i+1 < len(args) {
+				ms, _ := strconv.Atoi(args[i+1].Bulk)
+				block = time.Duration(ms) * time.Millisecond
+				i++
+			} else if strings.ToUpper(args[i].Bulk) == "STREAMS" {
+				streamsIdx = i
+				break
+			}
+		}
+		if streamsIdx == 0 || streamsIdx+1 >= len(args) {
+			return resp.Value{Type: "error", Str: "ERR syntax error in 'xread' command"}
+		}
+		streamNames := []string{}
+		ids := []string{}
+		for i := streamsIdx + 1; i < len(args); i++ {
+			if i < streamsIdx+1+(len(args)-streamsIdx-1)/2 {
+				streamNames = append(streamNames, args[i].Bulk)
+			} else {
+				ids = append(ids, args[i].Bulk)
+			}
+		}
+		if len(streamNames) != len(ids) {
+			return resp.Value{Type: "error", Str: "ERR number of streams and ids do not match in 'xread' command"}
+		}
+		streamsMap := make(map[string]string)
+		for i := 0; i < len(streamNames); i++ {
+			streamsMap[streamNames[i]] = ids[i]
+		}
+		entriesMap, err := store.XREAD(streamsMap, count, block)
+		if err != nil {
+			return resp.Value{Type: "error", Str: err.Error()}
+		}
+		respStreams := []resp.Value{}
+		for stream, entries := range entriesMap {
+			respEntries := make([]resp.Value, len(entries))
+			for i, entry := range entries {
+				fields := []resp.Value{{Type: "bulk", Bulk: entry.ID}}
+				for k, v := range entry.Fields {
+					fields = append(fields, resp.Value{Type: "bulk", Bulk: k})
+					fields = append(fields, resp.Value{Type: "bulk", Bulk: v})
+				}
+				respEntries[i] = resp.Value{Type: "array", Array: fields}
+			}
+			respStreams = append(respStreams, resp.Value{Type: "array", Array: []resp.Value{
+				{Type: "bulk", Bulk: stream},
+				{Type: "array", Array: respEntries},
+			}})
+		}
+		return resp.Value{Type: "array", Array: respStreams}
+	case "INCR", "DECR":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for '" + strings.ToLower(command) + "' command"}
+		}
+		delta := int64(1)
+		if command == "DECR" {
+			delta = -1
+		}
+		n, err := store.INCRBY(args[0].Bulk, delta)
+		if err != nil {
+			return resp.Value{Type: "error", Str: err.Error()}
+		}
+		return resp.Value{Type: "integer", Num: int(n)}
+	case "EXPIRE", "PEXPIREAT":
+		if len(args) != 2 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for '" + strings.ToLower(command) + "' command"}
+		}
+		n, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+		if err != nil {
+			return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+		}
+		at := time.UnixMilli(n)
+		if command == "EXPIRE" {
+			at = time.Now().Add(time.Duration(n) * time.Second)
+		}
+		if !store.EXPIRE(args[0].Bulk, at) {
+			return resp.Value{Type: "integer", Num: 0}
+		}
+		return resp.Value{Type: "integer", Num: 1}
+	case "TTL":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'ttl' command"}
+		}
+		data, ok := store.Lookup(args[0].Bulk)
+		switch {
+		case !ok:
+			return resp.Value{Type: "integer", Num: -2}
+		case data.Expiration.IsZero():
+			return resp.Value{Type: "integer", Num: -1}
+		}
+		return resp.Value{Type: "integer", Num: int((time.Until(data.Expiration) + time.Second/2) / time.Second)}
+	case "RENAME":
+		if len(args) != 2 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'rename' command"}
+		}
+		if err := store.RENAME(args[0].Bulk, args[1].Bulk); err != nil {
+			return resp.Value{Type: "error", Str: err.Error()}
+		}
+		return resp.Value{Type: "string", Str: "OK"}
+
+	default:
+		return resp.Value{Type: "error", Str: "ERR unknown command '" + command + "'"}
+	}
+}
+
+// errorString formats err as a RESP error, adding the generic ERR prefix to
+// errors that do not already carry a Redis error code.
+func errorString(err error) string {
+	msg := err.Error()
+	if code, _, _ := strings.Cut(msg, " "); code != "" && code == strings.ToUpper(code) {
+		return msg
+	}
+	return "ERR " + msg
+}
+
+func boolToInfo(b bool) string {
+	if b {
+		return "1"
 	}
+	return "0"
 }
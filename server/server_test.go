@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/saurabhdhingra/go-redis/resp"
+	"github.com/saurabhdhingra/go-redis/store"
+)
+
+func TestPipelineHalfClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	kv := store.NewKeyValueStore()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go HandleConnectionWithInfo(conn, kv, &ServerInfo{Role: "master"})
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// More replies than the server buffers, sent before any is read, then
+	// the end of the input.
+	const n = 20000
+	var pipeline bytes.Buffer
+	for i := range n {
+		pipeline.Write(resp.Marshal(resp.Command("SET", "k", strconv.Itoa(i))))
+		pipeline.Write(resp.Marshal(resp.Command("GET", "k")))
+	}
+	go func() {
+		conn.Write(pipeline.Bytes())
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	r := resp.NewResp(conn)
+	for i := range n {
+		if reply, err := r.Read(); err != nil || reply.Str != "OK" {
+			t.Fatalf("reply %d to SET: %+v, %v", i, reply, err)
+		}
+		if reply, err := r.Read(); err != nil || reply.Bulk != strconv.Itoa(i) {
+			t.Fatalf("reply %d to GET: %+v, %v", i, reply, err)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Fatalf("after the last reply: %v", err)
+	}
+}
@@ -0,0 +1,577 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// In active-active mode several masters take writes for the same keys and
+// exchange them asynchronously. Every key then carries a CRDT: a state that
+// merges with the state of the same key on another master, in any order and
+// any number of times, to the same result.
+//
+//   - strings are last-writer-wins registers, with a PN-counter for INCR
+//     and DECR: increments the last SET didn't see add to it;
+//   - list elements and stream entries are observed-remove sets: a removal
+//     only removes what its writer had seen, so concurrent additions survive;
+//   - DEL, and writes that replace a value, remove what their writer had
+//     seen in the same way;
+//   - the vector clock of a key tells which writes its state reflects.
+//
+// Each write is identified by a dot: the replica ID of its writer, random
+// for every run of a master, and the sequence number of the write there.
+
+// VectorClock holds, for each replica, the last of its writes to a key that
+// the state of the key reflects, along with every earlier one.
+type VectorClock map[string]uint64
+
+// Covers reports whether the write d is reflected.
+func (vc VectorClock) Covers(d Dot) bool {
+	return vc[d.Replica] >= d.Seq
+}
+
+func (vc VectorClock) merge(other VectorClock) VectorClock {
+	out := make(VectorClock, max(len(vc), len(other)))
+	maps.Copy(out, vc)
+	for replica, seq := range other {
+		out[replica] = max(out[replica], seq)
+	}
+	return out
+}
+
+func (vc VectorClock) String() string {
+	var parts []string
+	for _, replica := range slices.Sorted(maps.Keys(vc)) {
+		parts = append(parts, fmt.Sprintf("%s:%d", replica, vc[replica]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Dot identifies a write.
+type Dot struct {
+	Replica string
+	Seq     uint64
+}
+
+// Stamp is a write with the time it was made at. Of two concurrent writes,
+// the one with the later time wins, then the one of the greater replica.
+type Stamp struct {
+	Dot
+	Time int64 // unix milliseconds
+}
+
+func (s Stamp) after(o Stamp) bool {
+	if s.Time != o.Time {
+		return s.Time > o.Time
+	}
+	if s.Replica != o.Replica {
+		return s.Replica > o.Replica
+	}
+	return s.Seq > o.Seq
+}
+
+// Register is the string value of a key, or its deletion.
+type Register struct {
+	Stamp
+	Value   string
+	Deleted bool
+	// Offset is the counter total the writer saw: the value of the key is
+	// Value plus the increments made since.
+	Offset int64
+}
+
+// Expiry is the expiration of a key, 0 for none.
+type Expiry struct {
+	Stamp
+	At int64 // unix milliseconds
+}
+
+// ListElement is an element of a list. The head has the highest Order.
+type ListElement struct {
+	Stamp
+	Order uint64
+	Value string
+}
+
+// StreamElement is an entry of a stream.
+type StreamElement struct {
+	Stamp
+	Entry StreamEntry
+}
+
+// CRDT is the state of a key in active-active mode. It is never modified
+// once built, as Data values.
+type CRDT struct {
+	Clock    VectorClock
+	Register *Register        `json:",omitempty"`
+	P        map[string]int64 `json:",omitempty"` // increments by replica
+	N        map[string]int64 `json:",omitempty"` // decrements by replica
+	List     []ListElement    `json:",omitempty"`
+	Stream   []StreamElement  `json:",omitempty"`
+	Expiry   *Expiry          `json:",omitempty"`
+}
+
+// Marshal encodes c, to be sent to another master or saved.
+func (c *CRDT) Marshal() []byte {
+	b, _ := json.Marshal(c)
+	return b
+}
+
+// UnmarshalCRDT decodes a state encoded by Marshal.
+func UnmarshalCRDT(b []byte) (*CRDT, error) {
+	c := &CRDT{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	if c.Clock == nil {
+		c.Clock = VectorClock{}
+	}
+	return c, nil
+}
+
+// MergeCRDT returns the state reflecting the writes of both a and b.
+func MergeCRDT(a, b *CRDT) *CRDT {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	m := &CRDT{
+		Clock: a.Clock.merge(b.Clock),
+		P:     mergeCounts(a.P, b.P),
+		N:     mergeCounts(a.N, b.N),
+	}
+
+	m.Register = a.Register
+	if b.Register != nil && (a.Register == nil || supersedes(b.Register.Stamp, b.Clock, a.Register.Stamp, a.Clock)) {
+		m.Register = b.Register
+	}
+	m.Expiry = a.Expiry
+	if b.Expiry != nil && (a.Expiry == nil || supersedes(b.Expiry.Stamp, b.Clock, a.Expiry.Stamp, a.Clock)) {
+		m.Expiry = b.Expiry
+	}
+
+	m.List = mergeElements(a.List, b.List, a.Clock, b.Clock, func(e ListElement) Dot { return e.Dot })
+	slices.SortFunc(m.List, compareListElements)
+
+	m.Stream = mergeElements(a.Stream, b.Stream, a.Clock, b.Clock, func(e StreamElement) Dot { return e.Dot })
+	slices.SortFunc(m.Stream, func(x, y StreamElement) int {
+		if c := compareStreamIDs(x.Entry.ID, y.Entry.ID); c != 0 {
+			return c
+		}
+		if x.after(y.Stamp) {
+			return -1
+		}
+		return 1
+	})
+	// Entries added concurrently with the same ID: the last one wins.
+	m.Stream = slices.CompactFunc(m.Stream, func(x, y StreamElement) bool { return x.Entry.ID == y.Entry.ID })
+	return m
+}
+
+// supersedes reports whether the write a, from a state with clock ca,
+// replaces the write b, from a state with clock cb: a was made after seeing
+// b, or concurrently but later.
+func supersedes(a Stamp, ca VectorClock, b Stamp, cb VectorClock) bool {
+	aSawB, bSawA := ca.Covers(b.Dot), cb.Covers(a.Dot)
+	switch {
+	case a.Dot == b.Dot:
+		return false
+	case aSawB && !bSawA:
+		return true
+	case bSawA && !aSawB:
+		return false
+	}
+	return a.after(b)
+}
+
+func mergeCounts(a, b map[string]int64) map[string]int64 {
+	if len(b) == 0 {
+		return a
+	}
+	if len(a) == 0 {
+		return b
+	}
+	out := maps.Clone(a)
+	for replica, n := range b {
+		out[replica] = max(out[replica], n)
+	}
+	return out
+}
+
+// mergeElements merges two observed-remove sets: an element only one side
+// has was either added without the other side seeing it, and is kept, or
+// removed by the other side, which saw it.
+func mergeElements[T any](a, b []T, ca, cb VectorClock, dot func(T) Dot) []T {
+	inA := make(map[Dot]bool, len(a))
+	for _, e := range a {
+		inA[dot(e)] = true
+	}
+	inB := make(map[Dot]bool, len(b))
+	for _, e := range b {
+		inB[dot(e)] = true
+	}
+	var out []T
+	for _, e := range a {
+		if inB[dot(e)] || !cb.Covers(dot(e)) {
+			out = append(out, e)
+		}
+	}
+	for _, e := range b {
+		if !inA[dot(e)] && !ca.Covers(dot(e)) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func compareListElements(x, y ListElement) int {
+	switch {
+	case x.Order != y.Order:
+		if x.Order > y.Order {
+			return -1
+		}
+		return 1
+	case x.after(y.Stamp):
+		return -1
+	case y.after(x.Stamp):
+		return 1
+	}
+	return 0
+}
+
+// total returns the sum of the increments and decrements.
+func (c *CRDT) total() int64 {
+	var total int64
+	for _, n := range c.P {
+		total += n
+	}
+	for _, n := range c.N {
+		total -= n
+	}
+	return total
+}
+
+// materialize returns the value c holds, or false when it holds none. When
+// concurrent writes left values of different types, the last one is shown.
+func (c *CRDT) materialize() (Data, bool) {
+	total := c.total()
+	var typ string
+	var last Stamp
+	consider := func(t string, s Stamp) {
+		if typ == "" || s.after(last) {
+			typ, last = t, s
+		}
+	}
+	if r := c.Register; r != nil && (!r.Deleted || total != r.Offset) {
+		consider("string", r.Stamp)
+	}
+	for _, e := range c.List {
+		consider("list", e.Stamp)
+	}
+	for _, e := range c.Stream {
+		consider("stream", e.Stamp)
+	}
+	if typ == "" {
+		return Data{}, false
+	}
+
+	d := Data{Type: typ, CRDT: c}
+	switch typ {
+	case "string":
+		d.Value = c.stringValue(total)
+	case "list":
+		d.List = make([]string, len(c.List))
+		for i, e := range c.List {
+			d.List[i] = e.Value
+		}
+	case "stream":
+		d.Stream = make([]StreamEntry, len(c.Stream))
+		for i, e := range c.Stream {
+			d.Stream[i] = e.Entry
+		}
+	}
+	if c.Expiry != nil && c.Expiry.At > 0 {
+		d.Expiration = time.UnixMilli(c.Expiry.At)
+	}
+	return d, true
+}
+
+func (c *CRDT) stringValue(total int64) string {
+	r := c.Register
+	if r.Deleted {
+		return strconv.FormatInt(total-r.Offset, 10)
+	}
+	if total == r.Offset {
+		return r.Value
+	}
+	n, err := strconv.ParseInt(r.Value, 10, 64)
+	if err != nil {
+		// Not a counter anymore: increments to it were concurrent.
+		return r.Value
+	}
+	return strconv.FormatInt(n+total-r.Offset, 10)
+}
+
+// HasValue reports whether c holds a value, possibly an expired one. A state
+// without one is a tombstone.
+func (c *CRDT) HasValue() bool {
+	_, ok := c.materialize()
+	return ok
+}
+
+// live returns the value of c unless it has none or it expired.
+func (c *CRDT) live(now time.Time) (Data, bool) {
+	if c == nil {
+		return Data{}, false
+	}
+	d, ok := c.materialize()
+	if !ok || (!d.Expiration.IsZero() && !now.Before(d.Expiration)) {
+		return Data{}, false
+	}
+	return d, true
+}
+
+// next returns a copy of c to which the write s is added.
+func (c *CRDT) next(s Stamp) *CRDT {
+	n := &CRDT{Clock: VectorClock{}}
+	if c != nil {
+		*n = *c
+		n.Clock = maps.Clone(c.Clock)
+	}
+	n.Clock[s.Replica] = max(n.Clock[s.Replica], s.Seq)
+	return n
+}
+
+// The writes below take the stamps of the writes they make from stamp.
+
+// cleared removes every value of c its writer sees.
+func (c *CRDT) cleared(s Stamp) *CRDT {
+	n := c.next(s)
+	n.Register = &Register{Stamp: s, Deleted: true, Offset: n.total()}
+	n.List, n.Stream = nil, nil
+	n.Expiry = &Expiry{Stamp: s}
+	return n
+}
+
+func (c *CRDT) setString(stamp func() Stamp, value string, expiration time.Time) *CRDT {
+	s := stamp()
+	n := c.cleared(s)
+	n.Register = &Register{Stamp: s, Value: value, Offset: n.total()}
+	n.Expiry = &Expiry{Stamp: s, At: unixMilli(expiration)}
+	return n
+}
+
+// incrBy adds delta to the counter, starting from 0 unless the key holds a
+// string, which the caller checked is an integer.
+func (c *CRDT) incrBy(stamp func() Stamp, delta int64) *CRDT {
+	s := stamp()
+	var n *CRDT
+	if d, ok := c.live(time.Now()); ok && d.Type == "string" {
+		n = c.next(s)
+	} else {
+		n = c.cleared(s)
+		n.Register = &Register{Stamp: s, Value: "0", Offset: n.total()}
+	}
+	if delta >= 0 {
+		n.P = maps.Clone(n.P)
+		if n.P == nil {
+			n.P = map[string]int64{}
+		}
+		n.P[s.Replica] += delta
+	} else {
+		n.N = maps.Clone(n.N)
+		if n.N == nil {
+			n.N = map[string]int64{}
+		}
+		n.N[s.Replica] -= delta
+	}
+	return n
+}
+
+// push adds elements at the head of the list, replacing what isn't a list.
+func (c *CRDT) push(stamp func() Stamp, elements []string) *CRDT {
+	n := c
+	if d, ok := c.live(time.Now()); !ok || d.Type != "list" {
+		n = c.cleared(stamp())
+	}
+	var order uint64
+	if len(n.List) > 0 {
+		order = n.List[0].Order
+	}
+	added := make([]ListElement, len(elements))
+	for i, value := range elements {
+		s := stamp()
+		n = n.next(s)
+		order++
+		added[len(elements)-1-i] = ListElement{Stamp: s, Order: order, Value: value}
+	}
+	n.List = append(added, n.List...)
+	return n
+}
+
+// pop removes the head of the list.
+func (c *CRDT) pop(stamp func() Stamp) *CRDT {
+	n := c.next(stamp())
+	n.List = slices.Clone(n.List[1:])
+	return n
+}
+
+// addEntry adds an entry to the stream, replacing what isn't a stream.
+func (c *CRDT) addEntry(stamp func() Stamp, entry StreamEntry) *CRDT {
+	n := c
+	if d, ok := c.live(time.Now()); !ok || d.Type != "stream" {
+		n = c.cleared(stamp())
+	}
+	s := stamp()
+	n = n.next(s)
+	n.Stream = append(slices.Clone(n.Stream), StreamElement{Stamp: s, Entry: entry})
+	return n
+}
+
+// trim removes the n oldest entries of the stream.
+func (c *CRDT) trim(stamp func() Stamp, n int) *CRDT {
+	t := c.next(stamp())
+	t.Stream = slices.Clone(t.Stream[n:])
+	return t
+}
+
+func (c *CRDT) expire(stamp func() Stamp, at time.Time) *CRDT {
+	s := stamp()
+	n := c.next(s)
+	n.Expiry = &Expiry{Stamp: s, At: unixMilli(at)}
+	return n
+}
+
+// replaced holds d instead of what its writer sees, as RESTORE and RENAME do.
+func (c *CRDT) replaced(stamp func() Stamp, d Data) *CRDT {
+	var n *CRDT
+	switch d.Type {
+	case "string":
+		return c.setString(stamp, d.Value, d.Expiration)
+	case "list":
+		elements := slices.Clone(d.List)
+		slices.Reverse(elements)
+		n = c.cleared(stamp()).push(stamp, elements)
+	case "stream":
+		n = c.cleared(stamp())
+		for _, entry := range d.Stream {
+			n = n.addEntry(stamp, entry)
+		}
+	default:
+		return c.cleared(stamp())
+	}
+	return n.expire(stamp, d.Expiration)
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// EnableCRDT switches the store to active-active mode, as replica, with the
+// states saved by an earlier run. Keys loaded without a state get one. Every
+// local write then calls onWrite, with the store locked, with the new state
+// of the key it changed.
+func (kv *KeyValueStore) EnableCRDT(replica string, states map[string]*CRDT, onWrite func(key string, c *CRDT)) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.crdt = &crdtMode{replica: replica, tombstones: make(map[string]*CRDT), onWrite: onWrite}
+	for key, c := range states {
+		kv.putCRDT(key, c)
+	}
+	for key, data := range kv.data {
+		if data.CRDT == nil {
+			kv.putCRDT(key, (*CRDT)(nil).replaced(kv.stamp, data))
+		}
+	}
+}
+
+// stamp returns the stamp of a new local write. Must be called with kv.mu
+// held.
+func (kv *KeyValueStore) stamp() Stamp {
+	kv.crdt.seq++
+	return Stamp{Dot: Dot{Replica: kv.crdt.replica, Seq: kv.crdt.seq}, Time: time.Now().UnixMilli()}
+}
+
+// crdtOf returns the state of key, nil when it never had one. Must be called
+// with kv.mu held.
+func (kv *KeyValueStore) crdtOf(key string) *CRDT {
+	if data, ok := kv.data[key]; ok && data.CRDT != nil {
+		return data.CRDT
+	}
+	return kv.crdt.tombstones[key]
+}
+
+// putCRDT makes c the state of key. Must be called with kv.mu held.
+func (kv *KeyValueStore) putCRDT(key string, c *CRDT) {
+	if data, ok := c.materialize(); ok {
+		kv.data[key] = data
+		delete(kv.crdt.tombstones, key)
+	} else {
+		delete(kv.data, key)
+		kv.crdt.tombstones[key] = c
+	}
+}
+
+// crdtWrite makes a local write to key. Must be called with kv.mu held.
+func (kv *KeyValueStore) crdtWrite(key string, write func(c *CRDT, stamp func() Stamp) *CRDT) {
+	c := write(kv.crdtOf(key), kv.stamp)
+	kv.putCRDT(key, c)
+	kv.crdt.onWrite(key, c)
+}
+
+// MergeCRDT merges a state of key from another replica and returns the new
+// state. Unlike local writes, it isn't reported to onWrite.
+func (kv *KeyValueStore) MergeCRDT(key string, c *CRDT) *CRDT {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	merged := MergeCRDT(kv.crdtOf(key), c)
+	kv.putCRDT(key, merged)
+	kv.dirty++
+	return merged
+}
+
+// CRDTStates returns the state of every key, including those without a value.
+func (kv *KeyValueStore) CRDTStates() map[string]*CRDT {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	states := maps.Clone(kv.crdt.tombstones)
+	for key, data := range kv.data {
+		if data.CRDT != nil {
+			states[key] = data.CRDT
+		}
+	}
+	return states
+}
+
+// CRDT returns the state of key, or nil.
+func (kv *KeyValueStore) CRDT(key string) *CRDT {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return kv.crdtOf(key)
+}
+
+// Tombstones returns the number of keys without a value that keep a state.
+func (kv *KeyValueStore) Tombstones() int {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return len(kv.crdt.tombstones)
+}
+
+// DropTombstone forgets the state of a key without a value, if it is still c.
+func (kv *KeyValueStore) DropTombstone(key string, c *CRDT) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.crdt.tombstones[key] == c {
+		delete(kv.crdt.tombstones, key)
+	}
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newReplica returns a store in active-active mode as replica.
+func newReplica(replica string) *KeyValueStore {
+	kv := NewKeyValueStore()
+	kv.EnableCRDT(replica, nil, func(string, *CRDT) {})
+	return kv
+}
+
+// syncFrom merges every state of src into dst, as the stream between two
+// masters does.
+func syncFrom(dst, src *KeyValueStore) {
+	for key, c := range src.CRDTStates() {
+		dst.MergeCRDT(key, c)
+	}
+}
+
+// values returns the values of kv without their states.
+func values(kv *KeyValueStore) map[string]Data {
+	out := make(map[string]Data)
+	for key, d := range kv.Snapshot() {
+		d.CRDT = nil
+		out[key] = d
+	}
+	return out
+}
+
+// permutations returns every order of the indexes 0 to n-1.
+func permutations(n int) [][]int {
+	if n == 1 {
+		return [][]int{{0}}
+	}
+	var out [][]int
+	for _, p := range permutations(n - 1) {
+		for i := 0; i <= len(p); i++ {
+			q := append(append(append([]int{}, p[:i]...), n-1), p[i:]...)
+			out = append(out, q)
+		}
+	}
+	return out
+}
+
+func TestCRDTConvergence(t *testing.T) {
+	a, b, c := newReplica("a"), newReplica("b"), newReplica("c")
+	// A common starting point, then concurrent writes of every kind.
+	a.SET("s", "base", time.Time{})
+	a.LPUSH("l", []string{"x", "y"})
+	a.XADD("x", "1-1", map[string]string{"f": "1"})
+	a.INCRBY("n", 10)
+	syncFrom(b, a)
+	syncFrom(c, a)
+
+	a.SET("s", "from-a", time.Time{})
+	b.SET("s", "from-b", time.Time{})
+	a.LPUSH("l", []string{"a1"})
+	b.LPOP("l")
+	c.LPUSH("l", []string{"c1", "c2"})
+	b.XADD("x", "2-1", map[string]string{"f": "b"})
+	c.XADD("x", "3-1", map[string]string{"f": "c"})
+	a.INCRBY("n", 1)
+	b.INCRBY("n", -3)
+	c.INCRBY("n", 5)
+	c.DEL([]string{"s"})
+	a.SET("t", "a", time.Time{})
+	b.SET("t", "b", time.Time{})
+	c.EXPIRE("l", time.Now().Add(time.Hour))
+
+	replicas := []*KeyValueStore{a, b, c}
+	var states []map[string]*CRDT
+	for _, r := range replicas {
+		states = append(states, r.CRDTStates())
+	}
+	var want map[string]Data
+	for _, order := range permutations(len(states)) {
+		kv := newReplica("observer")
+		for _, i := range order {
+			for key, c := range states[i] {
+				kv.MergeCRDT(key, c)
+			}
+		}
+		// Merging a state again changes nothing.
+		for key, c := range states[order[0]] {
+			kv.MergeCRDT(key, c)
+		}
+		got := values(kv)
+		if want == nil {
+			want = got
+		} else if !reflect.DeepEqual(got, want) {
+			t.Fatalf("merging in the order %v gives\n%+v\nnot\n%+v", order, got, want)
+		}
+	}
+
+	// The masters converge to the same values by exchanging their states.
+	for _, dst := range replicas {
+		for _, src := range replicas {
+			if dst != src {
+				syncFrom(dst, src)
+			}
+		}
+	}
+	for i, r := range replicas {
+		if got := values(r); !reflect.DeepEqual(got, want) {
+			t.Fatalf("replica %d has\n%+v\nnot\n%+v", i, got, want)
+		}
+	}
+	if want["n"].Value != "13" {
+		t.Errorf("counter n is %q, want 13", want["n"].Value)
+	}
+	if _, ok := want["s"]; ok {
+		// The DEL of c didn't see the concurrent SETs, which survive it.
+		if v := want["s"].Value; v != "from-a" && v != "from-b" {
+			t.Errorf("s is %q", v)
+		}
+	}
+}
+
+func TestCRDTCounter(t *testing.T) {
+	a, b := newReplica("a"), newReplica("b")
+	a.SET("n", "10", time.Time{})
+	syncFrom(b, a)
+	a.INCRBY("n", 3)
+	b.INCRBY("n", 4)
+	b.INCRBY("n", -2)
+	syncFrom(a, b)
+	syncFrom(b, a)
+	for _, r := range []*KeyValueStore{a, b} {
+		if v, _ := r.GET("n"); v != "15" {
+			t.Fatalf("concurrent increments: n is %q, want 15", v)
+		}
+	}
+
+	// Increments the SET didn't see add to it; those it saw don't.
+	a.SET("n", "100", time.Time{})
+	b.INCRBY("n", 5)
+	syncFrom(a, b)
+	syncFrom(b, a)
+	for _, r := range []*KeyValueStore{a, b} {
+		if v, _ := r.GET("n"); v != "105" {
+			t.Fatalf("SET concurrent with INCRBY: n is %q, want 105", v)
+		}
+	}
+
+	// A counter deleted concurrently with an increment restarts from it.
+	a.DEL([]string{"n"})
+	b.INCRBY("n", 7)
+	syncFrom(a, b)
+	syncFrom(b, a)
+	for _, r := range []*KeyValueStore{a, b} {
+		if v, _ := r.GET("n"); v != "7" {
+			t.Fatalf("DEL concurrent with INCRBY: n is %q, want 7", v)
+		}
+	}
+}
+
+func TestCRDTObservedRemove(t *testing.T) {
+	a, b := newReplica("a"), newReplica("b")
+	a.LPUSH("l", []string{"old"})
+	a.XADD("x", "1-1", map[string]string{"f": "old"})
+	syncFrom(b, a)
+
+	// A removal only removes what its writer saw: the concurrent additions
+	// stay.
+	b.LPOP("l")
+	a.LPUSH("l", []string{"new"})
+	b.DEL([]string{"x"})
+	a.XADD("x", "2-1", map[string]string{"f": "new"})
+	syncFrom(a, b)
+	syncFrom(b, a)
+	for _, r := range []*KeyValueStore{a, b} {
+		if list, _ := r.LRANGE("l", 0, -1); !reflect.DeepEqual(list, []string{"new"}) {
+			t.Fatalf("list after a concurrent LPOP and LPUSH: %v", list)
+		}
+		entries, _ := r.XRANGE("x", "-", "+", 0)
+		if len(entries) != 1 || entries[0].ID != "2-1" {
+			t.Fatalf("stream after a concurrent DEL and XADD: %v", entries)
+		}
+	}
+
+	// What both saw is removed for good, and the key left without a value
+	// keeps a state that removes it from older states merged later.
+	stale := a.CRDTStates()["l"]
+	b.DEL([]string{"l"})
+	syncFrom(a, b)
+	a.MergeCRDT("l", stale)
+	for _, r := range []*KeyValueStore{a, b} {
+		if _, ok := r.Lookup("l"); ok {
+			t.Fatal("a deleted list came back")
+		}
+		if r.Tombstones() != 1 {
+			t.Fatalf("%d tombstones, want 1", r.Tombstones())
+		}
+	}
+}
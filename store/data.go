@@ -13,4 +13,6 @@ type Data struct {
 	Stream     []StreamEntry
 	Type       string // "string", "list", "stream"
 	Expiration time.Time
+	// CRDT is the state the value is made of in active-active mode.
+	CRDT *CRDT
 }
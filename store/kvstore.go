@@ -1,16 +1,47 @@
 package store
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// ErrBusyKey is returned by RESTORE when the target key already exists.
+var ErrBusyKey = errors.New("BUSYKEY Target key name already exists.")
+
+var (
+	ErrWrongType  = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	ErrNotInteger = errors.New("ERR value is not an integer or out of range")
+	ErrNoSuchKey  = errors.New("ERR no such key")
+)
+
 type KeyValueStore struct {
 	mu   sync.RWMutex
 	data map[string]Data
+
+	// dirty counts the changes made since the last successful save.
+	dirty int64
+
+	crdt *crdtMode // set in active-active mode
+
+	notify        func(class int, event, key string) // see OnKeyspaceEvent
+	notifyClasses int                                // of the events given to notify
+	events        []keyEvent                         // reported by unlock
+}
+
+// crdtMode is the state of the store in active-active mode, where writes
+// change the CRDT of the keys and values are made from it, see crdt.go.
+type crdtMode struct {
+	replica string
+	seq     uint64
+	// tombstones hold the state of the keys that have no value, to remove
+	// what they had from the states merged later.
+	tombstones map[string]*CRDT
+	onWrite    func(key string, c *CRDT)
 }
 
 func NewKeyValueStore() *KeyValueStore {
@@ -21,31 +52,123 @@ func NewKeyValueStore() *KeyValueStore {
 
 func (kv *KeyValueStore) SET(key, value string, expiration time.Time) {
 	kv.mu.Lock()
-	defer kv.mu.Unlock()
-	kv.data[key] = Data{Value: value, Expiration: expiration}
+	defer kv.unlock()
+	kv.deleteIfExpired(key)
+	isNew := !kv.exists(key)
+	if kv.crdt != nil {
+		kv.crdtWrite(key, func(c *CRDT, stamp func() Stamp) *CRDT { return c.setString(stamp, value, expiration) })
+	} else {
+		kv.data[key] = Data{Value: value, Type: "string", Expiration: expiration}
+		kv.dirty++
+	}
+	kv.written(NotifyString, "set", key, isNew)
+	if !expiration.IsZero() {
+		kv.event(NotifyGeneric, "expire", key)
+	}
 }
 
 func (kv *KeyValueStore) GET(key string) (string, bool) {
-	kv.mu.RLock()
-	defer kv.mu.RUnlock()
-
-	data, ok := kv.data[key]
+	data, ok := kv.read(key)
 	if !ok {
 		return "", false
 	}
+	return data.Value, true
+}
 
-	if !data.Expiration.IsZero() && time.Now().After(data.Expiration) {
-		delete(kv.data, key)
-		return "", false
+// expired reports whether the expiration of data passed.
+func expired(data Data) bool {
+	return !data.Expiration.IsZero() && !time.Now().Before(data.Expiration)
+}
+
+// deleteIfExpired removes key if its expiration passed and reports whether
+// it did. Every command looks at its keys through it, or through
+// expireKey, so that a key is reported expired once it is accessed again.
+// In active-active mode the state of the key stays, for the writes of the
+// other masters to merge with. Must be called with the store locked.
+func (kv *KeyValueStore) deleteIfExpired(key string) bool {
+	data, ok := kv.data[key]
+	if !ok || !expired(data) || kv.crdt != nil {
+		return false
 	}
+	delete(kv.data, key)
+	kv.event(NotifyExpired, "expired", key)
+	return true
+}
 
-	return data.Value, true
+// expireKey is deleteIfExpired for a key found expired under the read lock.
+func (kv *KeyValueStore) expireKey(key string) {
+	kv.mu.Lock()
+	defer kv.unlock()
+	kv.deleteIfExpired(key)
+}
+
+// Snapshot returns a point-in-time copy of the keyspace. Values are never
+// mutated in place, so copying the map is enough to decouple it from later writes.
+func (kv *KeyValueStore) Snapshot() map[string]Data {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	snapshot := make(map[string]Data, len(kv.data))
+	for key, data := range kv.data {
+		snapshot[key] = data
+	}
+	return snapshot
+}
+
+// Len returns the number of keys, including expired keys not yet removed.
+func (kv *KeyValueStore) Len() int {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return len(kv.data)
+}
+
+// Keys returns the keys for which match returns true, skipping expired keys.
+func (kv *KeyValueStore) Keys(match func(key string) bool) []string {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	now := time.Now()
+	var keys []string
+	for key, data := range kv.data {
+		if (data.Expiration.IsZero() || now.Before(data.Expiration)) && match(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Load replaces the whole keyspace with data, e.g. after reading an RDB file.
+func (kv *KeyValueStore) Load(data map[string]Data) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.data = data
+	kv.dirty = 0
+}
+
+// Dirty returns the number of changes made since the last successful save.
+func (kv *KeyValueStore) Dirty() int64 {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return kv.dirty
+}
+
+// ClearDirty discounts the n changes that a completed save has persisted;
+// changes made while the snapshot was being written still count.
+func (kv *KeyValueStore) ClearDirty(n int64) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.dirty = max(0, kv.dirty-n)
 }
 
 // LPUSH inserts all the specified values at the head of the list stored at key.
 func (kv *KeyValueStore) LPUSH(key string, elements []string) (int, error) {
 	kv.mu.Lock()
-	defer kv.mu.Unlock()
+	defer kv.unlock()
+	kv.deleteIfExpired(key)
+	defer kv.written(NotifyList, "lpush", key, !kv.exists(key))
+	if kv.crdt != nil {
+		kv.crdtWrite(key, func(c *CRDT, stamp func() Stamp) *CRDT { return c.push(stamp, elements) })
+		kv.dirty += int64(len(elements))
+		return len(kv.data[key].List), nil
+	}
 	data, ok := kv.data[key]
 	if !ok || data.Type != "list" {
 		data = Data{Type: "list", List: []string{}}
@@ -55,14 +178,13 @@ func (kv *KeyValueStore) LPUSH(key string, elements []string) (int, error) {
 		data.List = append([]string{elements[i]}, data.List...)
 	}
 	kv.data[key] = data
+	kv.dirty += int64(len(elements))
 	return len(data.List), nil
 }
 
 // LRANGE returns the specified elements of the list stored at key.
 func (kv *KeyValueStore) LRANGE(key string, start, end int) ([]string, error) {
-	kv.mu.RLock()
-	defer kv.mu.RUnlock()
-	data, ok := kv.data[key]
+	data, ok := kv.read(key)
 	if !ok || data.Type != "list" {
 		return []string{}, nil
 	}
@@ -87,9 +209,7 @@ func (kv *KeyValueStore) LRANGE(key string, start, end int) ([]string, error) {
 
 // LLEN returns the length of the list stored at key.
 func (kv *KeyValueStore) LLEN(key string) (int, error) {
-	kv.mu.RLock()
-	defer kv.mu.RUnlock()
-	data, ok := kv.data[key]
+	data, ok := kv.read(key)
 	if !ok || data.Type != "list" {
 		return 0, nil
 	}
@@ -99,27 +219,39 @@ func (kv *KeyValueStore) LLEN(key string) (int, error) {
 // LPOP removes and returns the first element of the list stored at key.
 func (kv *KeyValueStore) LPOP(key string) (string, bool, error) {
 	kv.mu.Lock()
-	defer kv.mu.Unlock()
+	defer kv.unlock()
+	kv.deleteIfExpired(key)
 	data, ok := kv.data[key]
 	if !ok || data.Type != "list" || len(data.List) == 0 {
 		return "", false, nil
 	}
 	val := data.List[0]
+	kv.popHead(key, data)
+	return val, true, nil
+}
+
+// popHead removes the first element of the list data stored at key.
+func (kv *KeyValueStore) popHead(key string, data Data) {
+	kv.dirty++
+	defer kv.event(NotifyList, "lpop", key)
+	if kv.crdt != nil {
+		kv.crdtWrite(key, func(c *CRDT, stamp func() Stamp) *CRDT { return c.pop(stamp) })
+		return
+	}
 	data.List = data.List[1:]
 	kv.data[key] = data
-	return val, true, nil
 }
 
 // BLPOP is a blocking LPOP. For simplicity, this implementation is non-blocking and just calls LPOP on the first key with a non-empty list.
 func (kv *KeyValueStore) BLPOP(keys []string, timeout time.Duration) ([]string, string, error) {
 	kv.mu.Lock()
-	defer kv.mu.Unlock()
+	defer kv.unlock()
 	for _, key := range keys {
+		kv.deleteIfExpired(key)
 		data, ok := kv.data[key]
 		if ok && data.Type == "list" && len(data.List) > 0 {
 			val := data.List[0]
-			data.List = data.List[1:]
-			kv.data[key] = data
+			kv.popHead(key, data)
 			return []string{val}, key, nil
 		}
 	}
@@ -128,26 +260,211 @@ func (kv *KeyValueStore) BLPOP(keys []string, timeout time.Duration) ([]string,
 
 // TYPE returns the type of the value stored at key.
 func (kv *KeyValueStore) TYPE(key string) string {
-	kv.mu.RLock()
-	defer kv.mu.RUnlock()
-	data, ok := kv.data[key]
+	data, ok := kv.read(key)
 	if !ok {
 		return "none"
 	}
 	return data.Type
 }
 
+// Lookup returns the value stored at key, unless it is missing or expired.
+// An expired key is removed; a missing one isn't reported as a key miss.
+func (kv *KeyValueStore) Lookup(key string) (Data, bool) {
+	kv.mu.RLock()
+	data, ok := kv.data[key]
+	kv.mu.RUnlock()
+	if ok && expired(data) {
+		kv.expireKey(key)
+		return Data{}, false
+	}
+	return data, ok
+}
+
+// EXISTS counts how many of keys exist; a key given twice is counted twice.
+func (kv *KeyValueStore) EXISTS(keys []string) int {
+	count := 0
+	for _, key := range keys {
+		if _, ok := kv.Lookup(key); ok {
+			count++
+		}
+	}
+	return count
+}
+
+// DEL removes keys and returns how many of them existed.
+func (kv *KeyValueStore) DEL(keys []string) int {
+	kv.mu.Lock()
+	defer kv.unlock()
+	removed := 0
+	for _, key := range keys {
+		kv.deleteIfExpired(key)
+		data, ok := kv.data[key]
+		if !ok {
+			continue
+		}
+		live := data.Expiration.IsZero() || time.Now().Before(data.Expiration)
+		if live {
+			removed++
+		}
+		if kv.crdt != nil {
+			if live {
+				kv.crdtWrite(key, func(c *CRDT, stamp func() Stamp) *CRDT { return c.cleared(stamp()) })
+				kv.event(NotifyGeneric, "del", key)
+			}
+			continue
+		}
+		delete(kv.data, key)
+		if live {
+			kv.event(NotifyGeneric, "del", key)
+		}
+	}
+	kv.dirty += int64(removed)
+	return removed
+}
+
+// RESTORE stores data at key, failing with ErrBusyKey when the key exists
+// and replace is false. A value whose expiration already passed only
+// removes the existing key.
+func (kv *KeyValueStore) RESTORE(key string, data Data, replace bool) error {
+	kv.mu.Lock()
+	defer kv.unlock()
+	kv.deleteIfExpired(key)
+	existed := kv.exists(key)
+	if existed && !replace {
+		return ErrBusyKey
+	}
+	kv.dirty++
+	if !data.Expiration.IsZero() && !time.Now().Before(data.Expiration) {
+		if existed {
+			defer kv.event(NotifyGeneric, "del", key)
+		}
+	} else {
+		defer kv.written(NotifyGeneric, "restore", key, !existed)
+	}
+	if kv.crdt != nil {
+		kv.crdtWrite(key, func(c *CRDT, stamp func() Stamp) *CRDT { return c.replaced(stamp, data) })
+		return nil
+	}
+	if !data.Expiration.IsZero() && !time.Now().Before(data.Expiration) {
+		delete(kv.data, key)
+	} else {
+		kv.data[key] = data
+	}
+	return nil
+}
+
+// INCRBY adds delta to the integer stored at key, 0 when the key is missing,
+// and returns the result. The expiration is kept.
+func (kv *KeyValueStore) INCRBY(key string, delta int64) (int64, error) {
+	kv.mu.Lock()
+	defer kv.unlock()
+	kv.deleteIfExpired(key)
+	data, ok := kv.data[key]
+	if ok && !data.Expiration.IsZero() && !time.Now().Before(data.Expiration) {
+		data, ok = Data{}, false
+	}
+	if ok && data.Type != "string" {
+		return 0, ErrWrongType
+	}
+	var n int64
+	if ok {
+		var err error
+		if n, err = strconv.ParseInt(data.Value, 10, 64); err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, errors.New("ERR increment or decrement would overflow")
+	}
+	n += delta
+	kv.dirty++
+	defer kv.written(NotifyString, "incrby", key, !ok)
+	if kv.crdt != nil {
+		kv.crdtWrite(key, func(c *CRDT, stamp func() Stamp) *CRDT { return c.incrBy(stamp, delta) })
+		return n, nil
+	}
+	kv.data[key] = Data{Type: "string", Value: strconv.FormatInt(n, 10), Expiration: data.Expiration}
+	return n, nil
+}
+
+// EXPIRE sets the expiration of key, which is removed at once when at has
+// passed, and reports whether the key exists.
+func (kv *KeyValueStore) EXPIRE(key string, at time.Time) bool {
+	kv.mu.Lock()
+	defer kv.unlock()
+	kv.deleteIfExpired(key)
+	data, ok := kv.data[key]
+	if !ok || (!data.Expiration.IsZero() && !time.Now().Before(data.Expiration)) {
+		return false
+	}
+	kv.dirty++
+	if time.Now().Before(at) {
+		defer kv.event(NotifyGeneric, "expire", key)
+	} else {
+		defer kv.event(NotifyGeneric, "del", key)
+	}
+	if kv.crdt != nil {
+		kv.crdtWrite(key, func(c *CRDT, stamp func() Stamp) *CRDT {
+			if !time.Now().Before(at) {
+				return c.cleared(stamp())
+			}
+			return c.expire(stamp, at)
+		})
+		return true
+	}
+	if !time.Now().Before(at) {
+		delete(kv.data, key)
+	} else {
+		data.Expiration = at
+		kv.data[key] = data
+	}
+	return true
+}
+
+// RENAME moves the value of src, with its expiration, to dst.
+func (kv *KeyValueStore) RENAME(src, dst string) error {
+	kv.mu.Lock()
+	defer kv.unlock()
+	kv.deleteIfExpired(src)
+	kv.deleteIfExpired(dst)
+	data, ok := kv.data[src]
+	if !ok || (!data.Expiration.IsZero() && !time.Now().Before(data.Expiration)) {
+		return ErrNoSuchKey
+	}
+	if src == dst {
+		return nil
+	}
+	kv.dirty++
+	isNew := !kv.exists(dst)
+	defer func() {
+		if isNew {
+			kv.event(NotifyNew, "new", dst)
+		}
+		kv.event(NotifyGeneric, "rename_from", src)
+		kv.event(NotifyGeneric, "rename_to", dst)
+	}()
+	if kv.crdt != nil {
+		kv.crdtWrite(dst, func(c *CRDT, stamp func() Stamp) *CRDT { return c.replaced(stamp, data) })
+		kv.crdtWrite(src, func(c *CRDT, stamp func() Stamp) *CRDT { return c.cleared(stamp()) })
+		return nil
+	}
+	delete(kv.data, src)
+	kv.data[dst] = data
+	return nil
+}
+
 // XADD adds an entry to a stream, creating the stream if it doesn't exist.
 func (kv *KeyValueStore) XADD(key, id string, fields map[string]string) (string, error) {
 	kv.mu.Lock()
-	defer kv.mu.Unlock()
+	defer kv.unlock()
+	kv.deleteIfExpired(key)
 	data, ok := kv.data[key]
 	if !ok || data.Type != "stream" {
 		data = Data{Type: "stream", Stream: []StreamEntry{}}
 	}
 	// Generate ID if needed
 	if id == "*" {
-		id = generateStreamID(data.Stream)
+		id = generateStreamID(data.Stream, time.Now())
 	} else {
 		if !validateStreamID(id) {
 			return "", fmt.Errorf("ERR Invalid stream ID specified as stream command argument")
@@ -157,16 +474,49 @@ func (kv *KeyValueStore) XADD(key, id string, fields map[string]string) (string,
 		}
 	}
 	entry := StreamEntry{ID: id, Fields: fields}
+	kv.dirty++
+	defer kv.written(NotifyStream, "xadd", key, !ok)
+	if kv.crdt != nil {
+		kv.crdtWrite(key, func(c *CRDT, stamp func() Stamp) *CRDT { return c.addEntry(stamp, entry) })
+		return id, nil
+	}
 	data.Stream = append(data.Stream, entry)
 	kv.data[key] = data
 	return id, nil
 }
 
+// XTRIM removes the oldest entries of the stream stored at key until at most
+// maxLen are left, and returns how many it removed. A stream trimmed to no
+// entries stays, empty.
+func (kv *KeyValueStore) XTRIM(key string, maxLen int) (int, error) {
+	kv.mu.Lock()
+	defer kv.unlock()
+	kv.deleteIfExpired(key)
+	data, ok := kv.data[key]
+	if !ok || !kv.exists(key) {
+		return 0, nil
+	}
+	if data.Type != "stream" {
+		return 0, ErrWrongType
+	}
+	removed := len(data.Stream) - maxLen
+	if removed <= 0 {
+		return 0, nil
+	}
+	kv.dirty++
+	defer kv.event(NotifyStream, "xtrim", key)
+	if kv.crdt != nil {
+		kv.crdtWrite(key, func(c *CRDT, stamp func() Stamp) *CRDT { return c.trim(stamp, removed) })
+		return removed, nil
+	}
+	data.Stream = data.Stream[removed:]
+	kv.data[key] = data
+	return removed, nil
+}
+
 // XRANGE returns entries in a stream between start and end IDs (inclusive), with optional count.
 func (kv *KeyValueStore) XRANGE(key, start, end string, count int) ([]StreamEntry, error) {
-	kv.mu.RLock()
-	defer kv.mu.RUnlock()
-	data, ok := kv.data[key]
+	data, ok := kv.read(key)
 	if !ok || data.Type != "stream" {
 		return nil, nil
 	}
@@ -185,10 +535,20 @@ func (kv *KeyValueStore) XRANGE(key, start, end string, count int) ([]StreamEntr
 // XREAD reads entries from multiple streams, starting from given IDs. Blocking not implemented yet.
 func (kv *KeyValueStore) XREAD(streams map[string]string, count int, block time.Duration) (map[string][]StreamEntry, error) {
 	kv.mu.RLock()
-	defer kv.mu.RUnlock()
+	var expiredKeys []string
+	defer func() {
+		kv.mu.RUnlock()
+		for _, key := range expiredKeys {
+			kv.expireKey(key)
+		}
+	}()
 	result := make(map[string][]StreamEntry)
 	for key, startID := range streams {
 		data, ok := kv.data[key]
+		if ok && expired(data) {
+			expiredKeys = append(expiredKeys, key)
+			continue
+		}
 		if !ok || data.Type != "stream" {
 			continue
 		}
@@ -208,19 +568,31 @@ func (kv *KeyValueStore) XREAD(streams map[string]string, count int, block time.
 	return result, nil
 }
 
+// NextStreamID returns the ID that XADD with "*" gives an entry added to
+// the stream at key at time now.
+func (kv *KeyValueStore) NextStreamID(key string, now time.Time) string {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	var stream []StreamEntry
+	if data, ok := kv.data[key]; ok && data.Type == "stream" {
+		stream = data.Stream
+	}
+	return generateStreamID(stream, now)
+}
+
 // Helper: generate a new stream ID (simple implementation: increment last ID or use timestamp)
-func generateStreamID(stream []StreamEntry) string {
+func generateStreamID(stream []StreamEntry, now time.Time) string {
 	if len(stream) == 0 {
-		return fmt.Sprintf("%d-0", time.Now().UnixMilli())
+		return fmt.Sprintf("%d-0", now.UnixMilli())
 	}
 	last := stream[len(stream)-1].ID
 	parts := strings.Split(last, "-")
 	ms, _ := strconv.ParseInt(parts[0], 10, 64)
 	seq, _ := strconv.Atoi(parts[1])
-	if ms == time.Now().UnixMilli() {
+	if ms >= now.UnixMilli() {
 		seq++
 	} else {
-		ms = time.Now().UnixMilli()
+		ms = now.UnixMilli()
 		seq = 0
 	}
 	return fmt.Sprintf("%d-%d", ms, seq)
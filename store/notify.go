@@ -0,0 +1,93 @@
+package store
+
+// Classes of keyspace events, the flags of notify-keyspace-events in Redis.
+// There are no hashes or sorted sets yet, but their classes can be
+// configured as in Redis. Likewise keys are never evicted yet, so nothing
+// reports the class e.
+const (
+	NotifyGeneric = 1 << iota // g: DEL, EXPIRE, RENAME, RESTORE
+	NotifyString              // $
+	NotifyList                // l
+	NotifyHash                // h
+	NotifyZSet                // z
+	NotifyStream              // t
+	NotifyExpired             // x: keys removed once their expiration passed
+	NotifyEvicted             // e: keys removed to free memory
+	NotifyNew                 // n: keys added to the keyspace
+	NotifyKeyMiss             // m: reads of missing keys
+
+	// NotifyAll is the alias A, every class but new keys and key misses.
+	NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifyHash | NotifyZSet | NotifyStream | NotifyExpired | NotifyEvicted
+)
+
+// OnKeyspaceEvent sets the function told about the events of the keys in
+// classes, e.g. "set" or "expired", with their class. It is called after the
+// change, once the store is unlocked, in the order of the events.
+func (kv *KeyValueStore) OnKeyspaceEvent(classes int, notify func(class int, event, key string)) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.notify, kv.notifyClasses = notify, classes
+}
+
+// keyEvent is an event waiting for the store to be unlocked.
+type keyEvent struct {
+	class      int
+	event, key string
+}
+
+// event records an event of key for the OnKeyspaceEvent function, if its
+// class is reported. Must be called with the store locked for writing, and
+// unlocked with unlock.
+func (kv *KeyValueStore) event(class int, event, key string) {
+	if kv.notifyClasses&class != 0 {
+		kv.events = append(kv.events, keyEvent{class, event, key})
+	}
+}
+
+// unlock releases the write lock of the store, then reports the events
+// recorded under it.
+func (kv *KeyValueStore) unlock() {
+	events, notify := kv.events, kv.notify
+	kv.events = nil
+	kv.mu.Unlock()
+	for _, e := range events {
+		notify(e.class, e.event, e.key)
+	}
+}
+
+// read returns the value stored at key under the read lock, unless it is
+// missing or expired, and reports a key miss once it is released. Only an
+// expired key takes the write lock, to be removed. Values are never mutated
+// in place, so the caller may use the value unlocked.
+func (kv *KeyValueStore) read(key string) (Data, bool) {
+	kv.mu.RLock()
+	data, ok := kv.data[key]
+	notify, misses := kv.notify, kv.notifyClasses&NotifyKeyMiss != 0
+	kv.mu.RUnlock()
+	if ok && !expired(data) {
+		return data, true
+	}
+	if ok {
+		kv.expireKey(key)
+	}
+	if misses {
+		notify(NotifyKeyMiss, "keymiss", key)
+	}
+	return Data{}, false
+}
+
+// written reports event of key after a write, preceded by "new" when the
+// write added the key.
+func (kv *KeyValueStore) written(class int, event, key string, isNew bool) {
+	if isNew {
+		kv.event(NotifyNew, "new", key)
+	}
+	kv.event(class, event, key)
+}
+
+// exists reports whether key holds a value that hasn't expired. Must be
+// called with the store locked.
+func (kv *KeyValueStore) exists(key string) bool {
+	data, ok := kv.data[key]
+	return ok && !expired(data)
+}
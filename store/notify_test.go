@@ -0,0 +1,59 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordEvents has kv record its events of classes in the returned slice.
+func recordEvents(kv *KeyValueStore, classes int) *[]string {
+	var events []string
+	kv.OnKeyspaceEvent(classes, func(class int, event, key string) {
+		events = append(events, event+" "+key)
+	})
+	return &events
+}
+
+func TestExpiredOnAccess(t *testing.T) {
+	accesses := map[string]func(kv *KeyValueStore){
+		"GET":    func(kv *KeyValueStore) { kv.GET("k") },
+		"TYPE":   func(kv *KeyValueStore) { kv.TYPE("k") },
+		"EXISTS": func(kv *KeyValueStore) { kv.EXISTS([]string{"k"}) },
+		"Lookup": func(kv *KeyValueStore) { kv.Lookup("k") },
+		"LRANGE": func(kv *KeyValueStore) { kv.LRANGE("k", 0, -1) },
+		"XREAD":  func(kv *KeyValueStore) { kv.XREAD(map[string]string{"k": "0-0"}, 0, 0) },
+		"SET":    func(kv *KeyValueStore) { kv.SET("k", "new", time.Time{}) },
+		"DEL":    func(kv *KeyValueStore) { kv.DEL([]string{"k"}) },
+		"LPUSH":  func(kv *KeyValueStore) { kv.LPUSH("k", []string{"new"}) },
+	}
+	for name, access := range accesses {
+		kv := NewKeyValueStore()
+		kv.SET("k", "v", time.Now().Add(time.Millisecond))
+		time.Sleep(2 * time.Millisecond)
+		events := recordEvents(kv, NotifyExpired)
+		access(kv)
+		access(kv)
+		if want := []string{"expired k"}; !reflect.DeepEqual(*events, want) {
+			t.Errorf("events of %s on an expired key: %v, want %v", name, *events, want)
+		}
+	}
+}
+
+func TestKeyMissClass(t *testing.T) {
+	kv := NewKeyValueStore()
+	events := recordEvents(kv, NotifyAll)
+	kv.GET("missing")
+	kv.SET("k", "v", time.Time{})
+	if want := []string{"set k"}; !reflect.DeepEqual(*events, want) {
+		t.Fatalf("events without the class m: %v, want %v", *events, want)
+	}
+
+	events = recordEvents(kv, NotifyKeyMiss)
+	kv.GET("missing")
+	kv.LRANGE("missing", 0, -1)
+	kv.GET("k")
+	if want := []string{"keymiss missing", "keymiss missing"}; !reflect.DeepEqual(*events, want) {
+		t.Fatalf("events with the class m: %v, want %v", *events, want)
+	}
+}